@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"sort"
 	"time"
+
+	"github.com/verifiable-state-chains/lms/metrics"
 )
 
 // VerusClient provides an interface to interact with Verus/CHIPS blockchain via RPC
@@ -65,8 +67,24 @@ type RPCError struct {
 	Message string `json:"message"`
 }
 
-// callRPC makes a JSON-RPC call to the Verus node
+var (
+	rpcDuration = metrics.NewHistogramVec("lms_blockchain_rpc_duration_seconds", "Verus RPC call latency, by method", nil, "method")
+	rpcFailures = metrics.NewCounterVec("lms_blockchain_rpc_failures_total", "Failed Verus RPC calls (transport, HTTP or RPC error), by method", "method")
+)
+
+// callRPC makes a JSON-RPC call to the Verus node, recording its latency and failures
 func (v *VerusClient) callRPC(method string, params []interface{}) (json.RawMessage, error) {
+	start := time.Now()
+	result, err := v.doRPC(method, params)
+	rpcDuration.ObserveSince(start, method)
+	if err != nil {
+		rpcFailures.Inc(method)
+	}
+	return result, err
+}
+
+// doRPC sends one JSON-RPC request to the Verus node
+func (v *VerusClient) doRPC(method string, params []interface{}) (json.RawMessage, error) {
 	req := RPCRequest{
 		JSONRPC: "2.0",
 		ID:      1,
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/verifiable-state-chains/lms/explorer"
+	"github.com/verifiable-state-chains/lms/tlsutil"
 )
 
 func main() {
@@ -14,6 +15,9 @@ func main() {
 	raftEndpointsStr := flag.String("raft-endpoints", "http://159.69.23.29:8080,http://159.69.23.30:8080,http://159.69.23.31:8080", "Comma-separated list of Raft cluster endpoints")
 	hsmEndpoint := flag.String("hsm-endpoint", "http://159.69.23.31:9090", "HSM server endpoint")
 	logFile := flag.String("log-file", "", "Optional: Write logs to file (default: stdout/stderr)")
+	tlsCA := flag.String("tls-ca", "", "CA certificate PEM file trusted for https Raft and HSM endpoints")
+	tlsCert := flag.String("tls-cert", "", "Client certificate PEM file presented to the Raft and HSM APIs")
+	tlsKey := flag.String("tls-key", "", "Client private key PEM file for -tls-cert")
 	flag.Parse()
 
 	// Set up logging
@@ -38,6 +42,15 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create explorer server: %v", err)
 	}
+
+	if *tlsCA != "" || *tlsCert != "" || *tlsKey != "" {
+		tlsConfig, err := tlsutil.ClientConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Failed to load TLS configuration: %v", err)
+		}
+		server.SetClientTLS(tlsConfig)
+		log.Printf("Client TLS: ENABLED (client certificate: %v)", *tlsCert != "")
+	}
 	
 	log.Printf("Starting LMS Hash Chain Explorer on port %d", *port)
 	log.Printf("HSM endpoint: %s", *hsmEndpoint)
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/verifiable-state-chains/lms/hsm_server"
+	"github.com/verifiable-state-chains/lms/tlsutil"
 )
 
 func main() {
@@ -19,6 +25,28 @@ func main() {
 	blockchainRPCPassword := flag.String("blockchain-rpc-password", "pass03465d081d1dfd2b74a2b5de27063f44f6843c64bcd63a6797915eb0ffa25707da", "RPC password")
 	blockchainIdentity := flag.String("blockchain-identity", "sg777z.chips.vrsc@", "Verus identity name")
 	
+	instanceID := flag.String("instance-id", "", "HSM instance name recorded on index leases (default: hostname)")
+	leaseSize := flag.Uint64("lease-size", 0, "Indices leased per reserve_range for H20+ keys (0 = one Raft commit per signature)")
+	workingKeyCache := flag.Int("working-key-cache", 16, "Loaded working keys kept between signatures (0 = load the key for every signature)")
+
+	// Envelope encryption of keys.db: master key from a key file or a passphrase (Argon2id)
+	masterKeyFile := flag.String("master-key-file", "", "Master key file (32 raw bytes or 64 hex digits) encrypting the stored LMS keys")
+	masterPassphraseFile := flag.String("master-passphrase-file", "", "File holding a passphrase the master key is derived from (instead of -master-key-file)")
+	masterSaltFile := flag.String("master-salt-file", "hsm-data/master.salt", "Salt for -master-passphrase-file (created on first use)")
+	previousMasterKeyFile := flag.String("previous-master-key-file", "", "Master key being rotated out: its data keys are re-wrapped under the new one")
+	previousMasterPassphraseFile := flag.String("previous-master-passphrase-file", "", "Passphrase file of the master key being rotated out")
+
+	// PKCS#11 token for the attestation key (and LMS keys if the token supports HSS)
+	pkcs11Module := flag.String("pkcs11-module", "", "PKCS#11 library holding the keys (e.g. /usr/lib/softhsm/libsofthsm2.so); empty: software keys")
+	pkcs11Token := flag.String("pkcs11-token", "", "Label of the PKCS#11 token")
+	pkcs11PINFile := flag.String("pkcs11-pin-file", "", "File holding the PKCS#11 user PIN")
+	pkcs11AttestationLabel := flag.String("pkcs11-attestation-label", "attestation", "Label of the ECDSA P-256 attestation key pair on the token")
+
+	// TLS towards https Raft endpoints
+	tlsCA := flag.String("tls-ca", "", "CA certificate PEM file trusted for https Raft endpoints")
+	tlsCert := flag.String("tls-cert", "", "Client certificate PEM file presented to the Raft API")
+	tlsKey := flag.String("tls-key", "", "Client private key PEM file for -tls-cert")
+
 	flag.Parse()
 
 	raftEndpoints := strings.Split(*raftEndpointsStr, ",")
@@ -41,11 +69,91 @@ func main() {
 		log.Printf("Blockchain commits: DISABLED (use -blockchain-enabled=true to enable)")
 	}
 
-	server, err := hsm_server.NewHSMServer(*port, raftEndpoints, blockchainConfig)
+	var server *hsm_server.HSMServer
+	var err error
+	if *pkcs11Module != "" {
+		pin, err := os.ReadFile(*pkcs11PINFile)
+		if err != nil {
+			log.Fatalf("Failed to read PKCS#11 PIN file: %v", err)
+		}
+		token, err := hsm_server.OpenPKCS11Token(&hsm_server.PKCS11Config{
+			ModulePath: *pkcs11Module,
+			TokenLabel: *pkcs11Token,
+			PIN:        strings.TrimRight(string(pin), "\r\n"),
+		})
+		if err != nil {
+			log.Fatalf("Failed to open PKCS#11 token: %v", err)
+		}
+		server, err = hsm_server.NewPKCS11HSMServer(*port, raftEndpoints, blockchainConfig, token, *pkcs11AttestationLabel)
+		if err != nil {
+			token.Close()
+			log.Fatalf("Failed to create HSM server: %v", err)
+		}
+		log.Printf("PKCS#11 token: %s (HSS/LMS keys on token: %v)", *pkcs11Token, token.SupportsHSS())
+	} else {
+		server, err = hsm_server.NewHSMServer(*port, raftEndpoints, blockchainConfig)
+		if err != nil {
+			log.Fatalf("Failed to create HSM server: %v", err)
+		}
+	}
+
+	master, err := loadMasterKey(*masterKeyFile, *masterPassphraseFile, *masterSaltFile)
 	if err != nil {
-		log.Fatalf("Failed to create HSM server: %v", err)
+		log.Fatalf("Failed to load master key: %v", err)
+	}
+	previousMaster, err := loadMasterKey(*previousMasterKeyFile, *previousMasterPassphraseFile, *masterSaltFile)
+	if err != nil {
+		log.Fatalf("Failed to load previous master key: %v", err)
+	}
+	if master != nil {
+		var previous []hsm_server.MasterKey
+		if previousMaster != nil {
+			previous = append(previous, previousMaster)
+		}
+		if err := server.SetKeyEncryption(master, previous...); err != nil {
+			log.Fatalf("Failed to enable key encryption: %v", err)
+		}
+	} else if previousMaster != nil {
+		log.Fatalf("A previous master key needs a new master key to rotate to")
+	}
+
+	if *tlsCA != "" || *tlsCert != "" || *tlsKey != "" {
+		tlsConfig, err := tlsutil.ClientConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Failed to load TLS configuration: %v", err)
+		}
+		server.SetRaftClientTLS(tlsConfig)
+		log.Printf("Raft client TLS: ENABLED (client certificate: %v)", *tlsCert != "")
+	}
+
+	if *leaseSize > 0 {
+		if *instanceID == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				log.Fatalf("Failed to determine instance ID: %v (use -instance-id)", err)
+			}
+			*instanceID = fmt.Sprintf("%s:%d", hostname, *port)
+		}
+		server.SetIndexLeasing(*instanceID, *leaseSize)
+		log.Printf("Index leasing: ENABLED (instance=%s, lease size=%d)", *instanceID, *leaseSize)
+		if err := server.ReclaimLeases(); err != nil {
+			log.Printf("[WARNING] Failed to reclaim index leases: %v", err)
+		}
 	}
 
+	server.SetWorkingKeyCacheSize(*workingKeyCache)
+
+	// Close the key database on shutdown (outstanding leases are resumed at the next start)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		if err := server.Close(); err != nil {
+			log.Printf("Error during shutdown: %v", err)
+		}
+		os.Exit(0)
+	}()
+
 	log.Printf("Starting HSM server on port %d", *port)
 	log.Printf("Every index commit will go to BOTH Raft and Verus blockchain (if enabled)")
 	
@@ -53,3 +161,20 @@ func main() {
 		log.Fatalf("HSM server error: %v", err)
 	}
 }
+
+// loadMasterKey loads the master key from a key file or a passphrase file (nil if neither is set)
+func loadMasterKey(keyFile, passphraseFile, saltFile string) (hsm_server.MasterKey, error) {
+	switch {
+	case keyFile != "" && passphraseFile != "":
+		return nil, fmt.Errorf("set a master key file or a passphrase file, not both")
+	case keyFile != "":
+		return hsm_server.LoadMasterKeyFile(keyFile)
+	case passphraseFile != "":
+		passphrase, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase file: %v", err)
+		}
+		return hsm_server.LoadPassphraseMasterKey(bytes.TrimRight(passphrase, "\r\n"), saltFile)
+	}
+	return nil, nil
+}
@@ -175,7 +175,7 @@ func (s *ExplorerServer) lookupKeyIDLabelFromRaft(normalizedKeyID string) string
 	for _, endpoint := range s.raftEndpoints {
 		// Try querying by normalized ID as if it were a pubkey_hash
 		url := fmt.Sprintf("%s/pubkey_hash/%s/chain", endpoint, normalizedKeyID)
-		resp, err := http.Get(url)
+		resp, err := s.client.Get(url)
 		if err == nil {
 			defer resp.Body.Close()
 			if resp.StatusCode == http.StatusOK {
@@ -213,7 +213,7 @@ func (s *ExplorerServer) lookupKeyIDLabelFromRaft(normalizedKeyID string) string
 		for _, endpoint := range s.raftEndpoints {
 			// Try querying chain by key_id to get public_key
 			url := fmt.Sprintf("%s/key/%s/chain", endpoint, keyID)
-			resp, err := http.Get(url)
+			resp, err := s.client.Get(url)
 			if err != nil {
 				continue
 			}
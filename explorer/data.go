@@ -8,8 +8,17 @@ import (
 	"time"
 )
 
-// getRecentCommits fetches recent commits from Raft cluster using /all_entries endpoint
+// getRecentCommits returns recent commits, newest first
+// Served from the watch cache while its /watch stream is connected, otherwise fetched from /all_entries.
 func (s *ExplorerServer) getRecentCommits(limit int) ([]CommitInfo, error) {
+	if commits, ok := s.cachedRecentCommits(limit); ok {
+		return commits, nil
+	}
+	return s.fetchRecentCommits(limit)
+}
+
+// fetchRecentCommits fetches recent commits from Raft cluster using /all_entries endpoint
+func (s *ExplorerServer) fetchRecentCommits(limit int) ([]CommitInfo, error) {
 	// Fetch from Raft cluster using /all_entries endpoint
 	allCommits := make([]CommitInfo, 0)
 
@@ -55,23 +64,7 @@ func (s *ExplorerServer) getRecentCommits(limit int) ([]CommitInfo, error) {
 				continue
 			}
 
-			commit := CommitInfo{
-				KeyID:        getString(entryMap, "key_id"),
-				PubkeyHash:   getString(entryMap, "pubkey_hash"),
-				PreviousHash: getString(entryMap, "previous_hash"),
-				Hash:         getString(entryMap, "hash"),
-				Timestamp:    time.Now(), // Raft doesn't provide timestamp
-			}
-
-			if idx, ok := entryMap["index"].(float64); ok {
-				commit.Index = uint64(idx)
-			}
-
-			if raftIdx, ok := entryMap["raft_index"].(float64); ok {
-				commit.RaftIndex = uint64(raftIdx)
-			}
-
-			allCommits = append(allCommits, commit)
+			allCommits = append(allCommits, commitFromEntry(entryMap))
 		}
 
 		// Success - break out of loop
@@ -91,6 +84,27 @@ func (s *ExplorerServer) getRecentCommits(limit int) ([]CommitInfo, error) {
 	return allCommits, nil
 }
 
+// commitFromEntry converts an entry of /all_entries or /watch to a CommitInfo
+func commitFromEntry(entryMap map[string]interface{}) CommitInfo {
+	commit := CommitInfo{
+		KeyID:        getString(entryMap, "key_id"),
+		PubkeyHash:   getString(entryMap, "pubkey_hash"),
+		PreviousHash: getString(entryMap, "previous_hash"),
+		Hash:         getString(entryMap, "hash"),
+		Timestamp:    time.Now(), // Raft doesn't provide timestamp
+	}
+
+	if idx, ok := entryMap["index"].(float64); ok {
+		commit.Index = uint64(idx)
+	}
+
+	if raftIdx, ok := entryMap["raft_index"].(float64); ok {
+		commit.RaftIndex = uint64(raftIdx)
+	}
+
+	return commit
+}
+
 // getAllKeys gets all key IDs from the cluster
 func (s *ExplorerServer) getAllKeys() ([]string, error) {
 	var lastErr error
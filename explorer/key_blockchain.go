@@ -347,7 +347,7 @@ func (s *ExplorerServer) getLatestIndexFromRaft(keyID string) (uint64, string, b
 	// Query Raft for the key's chain
 	for _, endpoint := range s.raftEndpoints {
 		url := fmt.Sprintf("%s/key/%s/chain", endpoint, keyID)
-		resp, err := http.Get(url)
+		resp, err := s.client.Get(url)
 		if err != nil {
 			lastErr = fmt.Errorf("failed to connect to %s: %v", endpoint, err)
 			continue
@@ -1,6 +1,7 @@
 package explorer
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -8,6 +9,9 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/verifiable-state-chains/lms/metrics"
+	"github.com/verifiable-state-chains/lms/tlsutil"
 )
 
 // ExplorerServer provides web interface for exploring hash chains
@@ -20,11 +24,13 @@ type ExplorerServer struct {
 	walletDB        *WalletDB        // Wallet database
 	keyBlockchainDB *KeyBlockchainDB // Key blockchain settings database
 
-	// Cache for recent commits
+	// Cache for recent commits, kept current by the /watch stream (see watch.go)
 	cacheMu          sync.RWMutex
-	recentCommits    []CommitInfo
+	recentCommits    []CommitInfo // Newest first
 	cacheLastUpdated time.Time
-	cacheTTL         time.Duration
+	watchSeeded      bool   // recentCommits was loaded and watchCursor is valid
+	watchConnected   bool   // A /watch stream is open, so recentCommits is current
+	watchCursor      uint64 // Raft index of the last complete Raft log entry received
 }
 
 // CommitInfo represents a single commit entry for display
@@ -107,10 +113,14 @@ func NewExplorerServer(port int, raftEndpoints []string, hsmEndpoint string) (*E
 		authServer:      authServer,
 		walletDB:        walletDB,
 		keyBlockchainDB: keyBlockchainDB,
-		cacheTTL:        5 * time.Second, // Cache for 5 seconds
 	}, nil
 }
 
+// SetClientTLS makes requests to the Raft and HSM endpoints over TLS with the given configuration
+func (s *ExplorerServer) SetClientTLS(config *tls.Config) {
+	s.client = tlsutil.NewHTTPClient(config, s.client.Timeout)
+}
+
 // loggingMiddleware logs all incoming requests and recovers from panics
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -136,6 +146,9 @@ func (s *ExplorerServer) Start() error {
 	// This allows explorer to start for browsing/login even if HSM server is down
 	// HSM operations (generate key, sign, etc.) will fail gracefully with error messages
 
+	// Follow commits from the Raft cluster instead of polling /all_entries
+	go s.watchCommits()
+
 	mux := http.NewServeMux()
 
 	// API endpoints
@@ -193,6 +206,9 @@ func (s *ExplorerServer) Start() error {
 	mux.HandleFunc("/api/my/key/blockchain/toggle", s.handleKeyBlockchainToggle)
 	mux.HandleFunc("/api/my/key/blockchain/status", s.handleKeyBlockchainStatus)
 
+	// Prometheus metrics (blockchain RPC and the /watch stream)
+	mux.Handle("/metrics", metrics.Handler(s.newMetricsRegistry()))
+
 	// Static files
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./explorer/static"))))
 
@@ -0,0 +1,221 @@
+package explorer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/verifiable-state-chains/lms/metrics"
+)
+
+const (
+	// watchCacheCapacity bounds the recent commits kept in memory
+	watchCacheCapacity = 10000
+	// watchSeedLimit is how many commits are loaded from /all_entries before streaming (the server maximum)
+	watchSeedLimit = 1000
+	// watchIdleTimeout drops a stream that sent nothing, not even a keepalive, for this long
+	watchIdleTimeout = 45 * time.Second
+	// watchMaxBackoff caps the delay between reconnect rounds
+	watchMaxBackoff = 30 * time.Second
+)
+
+// watchCommits keeps the recent commits cache current from the /watch stream of the Raft cluster
+// The cache is seeded once from /all_entries; after that every reconnect resumes from the last
+// Raft index received, trying each endpoint in turn, so no commit is missed or repeated.
+func (s *ExplorerServer) watchCommits() {
+	backoff := time.Second
+	for {
+		if err := s.seedCommitCache(); err != nil {
+			log.Printf("[WATCH] Failed to load recent commits: %v", err)
+		} else {
+			for _, endpoint := range s.raftEndpoints {
+				received, err := s.streamCommits(endpoint)
+				if received {
+					backoff = time.Second
+				}
+				log.Printf("[WATCH] Stream from %s ended: %v", endpoint, err)
+			}
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > watchMaxBackoff {
+			backoff = watchMaxBackoff
+		}
+	}
+}
+
+// seedCommitCache loads the newest commits from /all_entries the first time the watcher runs
+func (s *ExplorerServer) seedCommitCache() error {
+	s.cacheMu.RLock()
+	seeded := s.watchSeeded
+	s.cacheMu.RUnlock()
+	if seeded {
+		return nil
+	}
+
+	commits, err := s.fetchRecentCommits(watchSeedLimit)
+	if err != nil {
+		return err
+	}
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	s.recentCommits = commits
+	s.watchCursor = 0
+	for _, commit := range commits {
+		if commit.RaftIndex > s.watchCursor {
+			s.watchCursor = commit.RaftIndex
+		}
+	}
+	s.cacheLastUpdated = time.Now()
+	s.watchSeeded = true
+	return nil
+}
+
+// streamCommits follows /watch on one endpoint until the stream fails
+// It reports whether the stream was opened, so the caller can reset its backoff.
+func (s *ExplorerServer) streamCommits(endpoint string) (bool, error) {
+	s.cacheMu.RLock()
+	cursor := s.watchCursor
+	s.cacheMu.RUnlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idle := time.AfterFunc(watchIdleTimeout, cancel)
+	defer idle.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/watch?from=%d", endpoint, cursor), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// Same transport (and TLS settings) as every other request, without the overall timeout
+	client := &http.Client{Transport: s.client.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+
+	s.setWatchConnected(true)
+	defer s.setWatchConnected(false)
+	log.Printf("[WATCH] Following commits from %s after Raft index %d", endpoint, cursor)
+
+	// Entries of one Raft log entry are cached together once its id arrives, so a stream cut
+	// inside a batch is replayed whole on resume instead of caching part of it twice
+	var pending []CommitInfo
+	var event, data, id string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		idle.Reset(watchIdleTimeout)
+
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "entry" && data != "" {
+				var entryMap map[string]interface{}
+				if err := json.Unmarshal([]byte(data), &entryMap); err != nil {
+					return true, fmt.Errorf("invalid entry event: %v", err)
+				}
+				pending = append(pending, commitFromEntry(entryMap))
+				if id != "" {
+					raftIndex, err := strconv.ParseUint(id, 10, 64)
+					if err != nil {
+						return true, fmt.Errorf("invalid event id %q: %v", id, err)
+					}
+					s.addWatchedCommits(pending, raftIndex)
+					pending = nil
+				}
+			}
+			event, data, id = "", "", ""
+		case strings.HasPrefix(line, ":"):
+			// Comment (keepalive)
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		case strings.HasPrefix(line, "id:"):
+			id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, io.EOF
+}
+
+// addWatchedCommits prepends the entries of one Raft log entry to the cache and advances the cursor past it
+func (s *ExplorerServer) addWatchedCommits(commits []CommitInfo, raftIndex uint64) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	updated := make([]CommitInfo, 0, len(commits)+len(s.recentCommits))
+	for i := len(commits) - 1; i >= 0; i-- {
+		updated = append(updated, commits[i])
+	}
+	updated = append(updated, s.recentCommits...)
+	if len(updated) > watchCacheCapacity {
+		updated = updated[:watchCacheCapacity]
+	}
+	s.recentCommits = updated
+	s.watchCursor = raftIndex
+	s.cacheLastUpdated = time.Now()
+}
+
+func (s *ExplorerServer) setWatchConnected(connected bool) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	s.watchConnected = connected
+}
+
+// cachedRecentCommits returns up to limit cached commits, newest first, while the cache is current
+func (s *ExplorerServer) cachedRecentCommits(limit int) ([]CommitInfo, bool) {
+	s.cacheMu.RLock()
+	defer s.cacheMu.RUnlock()
+
+	if !s.watchConnected {
+		return nil, false
+	}
+	n := len(s.recentCommits)
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	commits := make([]CommitInfo, n)
+	copy(commits, s.recentCommits[:n])
+	return commits, true
+}
+
+// newMetricsRegistry exposes the state of the /watch stream, read on every scrape
+func (s *ExplorerServer) newMetricsRegistry() *metrics.Registry {
+	registry := metrics.NewRegistry()
+	registry.NewGaugeFunc("lms_explorer_watch_connected", "1 while a /watch stream keeps the recent commits cache current", nil,
+		func(set func(float64, ...string)) {
+			s.cacheMu.RLock()
+			defer s.cacheMu.RUnlock()
+			if s.watchConnected {
+				set(1)
+			} else {
+				set(0)
+			}
+		})
+	registry.NewGaugeFunc("lms_explorer_watch_raft_index", "Raft index of the last commit received from /watch", nil,
+		func(set func(float64, ...string)) {
+			s.cacheMu.RLock()
+			defer s.cacheMu.RUnlock()
+			set(float64(s.watchCursor))
+		})
+	return registry
+}
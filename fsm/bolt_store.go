@@ -0,0 +1,462 @@
+package fsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Buckets of a BoltStore
+var (
+	boltEntriesBucket       = []byte("entries")        // position -> RaftEntry JSON
+	boltRaftPositionsBucket = []byte("raft_positions") // Raft index -> position of its first entry
+	boltEntryHashesBucket   = []byte("entry_hashes")   // entry hash -> position of the first entry with it
+	boltStateBucket         = []byte("state")          // One nested bucket per StateChanges bucket
+	boltMetaBucket          = []byte("meta")           // applied_index
+
+	boltAppliedIndexKey = []byte("applied_index")
+)
+
+// boltIndexBucket returns the bucket of a secondary index: key = uvarint length + value + position
+func boltIndexBucket(index EntryIndex) []byte {
+	return []byte("index_" + string(index))
+}
+
+// boltBuckets lists every bucket, in the order they are created
+func boltBuckets() [][]byte {
+	buckets := [][]byte{boltEntriesBucket, boltRaftPositionsBucket, boltEntryHashesBucket, boltStateBucket, boltMetaBucket}
+	for _, index := range secondaryIndexes {
+		buckets = append(buckets, boltIndexBucket(index))
+	}
+	return buckets
+}
+
+// boltInitialMmapSize is reserved address space, not memory: a snapshot holds a read transaction open
+// while it streams, and bbolt cannot grow its mapping under an open transaction, so commits would wait.
+const boltInitialMmapSize = 1 << 30
+
+// BoltStore keeps entries, indexes and state records in a bbolt file
+// Each Commit is one transaction that also records the applied Raft index, so after a restart the FSM
+// loads its state from the file and only applies the log entries after that index.
+type BoltStore struct {
+	db      *bbolt.DB
+	count   int         // Committed entries
+	applied uint64      // Raft index of the last commit
+	pending []RaftEntry // Appended since the last commit (readable before it)
+	reset   bool        // Reset since the last commit: the next commit replaces the file contents
+}
+
+// OpenBoltStore opens or creates a store file
+func OpenBoltStore(path string) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create FSM store directory: %v", err)
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second, InitialMmapSize: boltInitialMmapSize})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open FSM store %s: %v", path, err)
+	}
+
+	s := &BoltStore{db: db}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range boltBuckets() {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if value := tx.Bucket(boltMetaBucket).Get(boltAppliedIndexKey); value != nil {
+			s.applied = binary.BigEndian.Uint64(value)
+		}
+		if last, _ := tx.Bucket(boltEntriesBucket).Cursor().Last(); last != nil {
+			s.count = boltKeyPos(last) + 1
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize FSM store %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// committed returns the number of committed entries still visible (none after a Reset)
+func (s *BoltStore) committed() int {
+	if s.reset {
+		return 0
+	}
+	return s.count
+}
+
+func (s *BoltStore) Len() int {
+	return s.committed() + len(s.pending)
+}
+
+func (s *BoltStore) At(pos int) RaftEntry {
+	if committed := s.committed(); pos >= committed {
+		return s.pending[pos-committed]
+	}
+	var item RaftEntry
+	s.view(func(tx *bbolt.Tx) {
+		item = decodeBoltEntry(tx.Bucket(boltEntriesBucket).Get(boltPosKey(pos)))
+	})
+	return item
+}
+
+func (s *BoltStore) FirstPosition(raftIndex uint64) int {
+	committed := s.committed()
+	if committed > 0 {
+		pos := -1
+		s.view(func(tx *bbolt.Tx) {
+			if _, value := tx.Bucket(boltRaftPositionsBucket).Cursor().Seek(boltUint64Key(raftIndex)); value != nil {
+				pos = boltKeyPos(value)
+			}
+		})
+		if pos >= 0 {
+			return pos
+		}
+	}
+	for i, item := range s.pending {
+		if item.RaftIndex >= raftIndex {
+			return committed + i
+		}
+	}
+	return s.Len()
+}
+
+func (s *BoltStore) PositionOf(entryHash string) (int, bool) {
+	committed := s.committed()
+	if committed > 0 {
+		pos := -1
+		s.view(func(tx *bbolt.Tx) {
+			if value := tx.Bucket(boltEntryHashesBucket).Get([]byte(entryHash)); value != nil {
+				pos = boltKeyPos(value)
+			}
+		})
+		if pos >= 0 {
+			return pos, true
+		}
+	}
+	for i, item := range s.pending {
+		if item.Entry.Hash == entryHash {
+			return committed + i, true
+		}
+	}
+	return 0, false
+}
+
+func (s *BoltStore) Scan(index EntryIndex, value string, from, to int, descending bool, fn func(pos int, item RaftEntry) bool) {
+	from, to = max(from, 0), min(to, s.Len())
+	if from >= to {
+		return
+	}
+	committed := s.committed()
+
+	scanCommitted := func() bool {
+		if from >= committed {
+			return true
+		}
+		more := true
+		s.view(func(tx *bbolt.Tx) {
+			more = boltScan(tx, index, value, from, min(to, committed), descending, fn)
+		})
+		return more
+	}
+	scanPending := func() bool {
+		for i := range s.pending {
+			if descending {
+				i = len(s.pending) - 1 - i
+			}
+			pos := committed + i
+			if pos < from || pos >= to {
+				continue
+			}
+			item := s.pending[i]
+			if index != IndexAll && indexValue(index, item.Entry) != value {
+				continue
+			}
+			if !fn(pos, item) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if descending {
+		if scanPending() {
+			scanCommitted()
+		}
+		return
+	}
+	if scanCommitted() {
+		scanPending()
+	}
+}
+
+func (s *BoltStore) Append(raftIndex uint64, entry *KeyIndexEntry) {
+	s.pending = append(s.pending, RaftEntry{RaftIndex: raftIndex, Entry: entry})
+}
+
+func (s *BoltStore) Reset() {
+	s.pending = nil
+	s.reset = true
+}
+
+func (s *BoltStore) Commit(raftIndex uint64, changes StateChanges) error {
+	committed := s.committed()
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		if s.reset {
+			for _, name := range boltBuckets() {
+				if err := tx.DeleteBucket(name); err != nil && err != bbolt.ErrBucketNotFound {
+					return err
+				}
+				if _, err := tx.CreateBucket(name); err != nil {
+					return err
+				}
+			}
+		}
+
+		entries := tx.Bucket(boltEntriesBucket)
+		positions := tx.Bucket(boltRaftPositionsBucket)
+		hashes := tx.Bucket(boltEntryHashesBucket)
+		for i, item := range s.pending {
+			pos := boltPosKey(committed + i)
+			data, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if err := entries.Put(pos, data); err != nil {
+				return err
+			}
+			if raftKey := boltUint64Key(item.RaftIndex); positions.Get(raftKey) == nil {
+				if err := positions.Put(raftKey, pos); err != nil {
+					return err
+				}
+			}
+			if hashes.Get([]byte(item.Entry.Hash)) == nil {
+				if err := hashes.Put([]byte(item.Entry.Hash), pos); err != nil {
+					return err
+				}
+			}
+			for _, index := range secondaryIndexes {
+				key := append(boltIndexPrefix(indexValue(index, item.Entry)), pos...)
+				if err := tx.Bucket(boltIndexBucket(index)).Put(key, []byte{}); err != nil {
+					return err
+				}
+			}
+		}
+
+		state := tx.Bucket(boltStateBucket)
+		for name, records := range changes {
+			bucket, err := state.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			for key, value := range records {
+				if value == nil {
+					err = bucket.Delete([]byte(key))
+				} else {
+					err = bucket.Put([]byte(key), value)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return tx.Bucket(boltMetaBucket).Put(boltAppliedIndexKey, boltUint64Key(raftIndex))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to commit Raft index %d to the FSM store: %v", raftIndex, err)
+	}
+
+	s.count = committed + len(s.pending)
+	s.pending = nil
+	s.reset = false
+	s.applied = raftIndex
+	return nil
+}
+
+func (s *BoltStore) AppliedIndex() uint64 {
+	return s.applied
+}
+
+func (s *BoltStore) StateRecord(bucket, key string) []byte {
+	if s.reset {
+		return nil
+	}
+	var value []byte
+	s.view(func(tx *bbolt.Tx) {
+		value = boltStateRecord(tx, bucket, key)
+	})
+	return value
+}
+
+func (s *BoltStore) LoadState(buckets ...string) (StateChanges, error) {
+	changes := make(StateChanges)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		for _, name := range buckets {
+			bucket := tx.Bucket(boltStateBucket).Bucket([]byte(name))
+			if bucket == nil {
+				continue
+			}
+			err := bucket.ForEach(func(key, value []byte) error {
+				// bbolt memory is only valid during the transaction
+				changes.set(name, string(key), append([]byte(nil), value...))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load FSM store state: %v", err)
+	}
+	return changes, nil
+}
+
+// View opens a read transaction; it sees the committed entries until released
+func (s *BoltStore) View() (StoreView, error) {
+	tx, err := s.db.Begin(false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open FSM store view: %v", err)
+	}
+	return &boltView{tx: tx, count: s.committed()}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// view runs fn in a read transaction; a store that cannot be read is as fatal as a corrupt one
+func (s *BoltStore) view(fn func(tx *bbolt.Tx)) {
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		fn(tx)
+		return nil
+	})
+	if err != nil {
+		panic(fmt.Sprintf("fsm: failed to read FSM store: %v", err))
+	}
+}
+
+type boltView struct {
+	tx    *bbolt.Tx
+	count int
+}
+
+func (v *boltView) Len() int {
+	return v.count
+}
+
+func (v *boltView) Scan(index EntryIndex, value string, from, to int, descending bool, fn func(pos int, item RaftEntry) bool) {
+	from, to = max(from, 0), min(to, v.count)
+	if from < to {
+		boltScan(v.tx, index, value, from, to, descending, fn)
+	}
+}
+
+func (v *boltView) StateRecord(bucket, key string) []byte {
+	return boltStateRecord(v.tx, bucket, key)
+}
+
+func (v *boltView) Release() {
+	v.tx.Rollback()
+}
+
+// boltScan implements Scan over committed entries (0 <= from < to <= committed); false if fn stopped it
+func boltScan(tx *bbolt.Tx, index EntryIndex, value string, from, to int, descending bool, fn func(pos int, item RaftEntry) bool) bool {
+	entries := tx.Bucket(boltEntriesBucket)
+	bucket, prefix := entries, []byte(nil)
+	if index != IndexAll {
+		bucket, prefix = tx.Bucket(boltIndexBucket(index)), boltIndexPrefix(value)
+	}
+
+	visit := func(key, data []byte) (bool, bool) {
+		pos := boltKeyPos(key[len(prefix):])
+		if pos < from || pos >= to {
+			return false, true
+		}
+		if index != IndexAll {
+			data = entries.Get(boltPosKey(pos))
+		}
+		return true, fn(pos, decodeBoltEntry(data))
+	}
+
+	c := bucket.Cursor()
+	if !descending {
+		for key, data := c.Seek(append(prefix, boltPosKey(from)...)); key != nil && bytes.HasPrefix(key, prefix); key, data = c.Next() {
+			inRange, more := visit(key, data)
+			if !inRange {
+				break
+			}
+			if !more {
+				return false
+			}
+		}
+		return true
+	}
+
+	key, data := c.Seek(append(prefix, boltPosKey(to)...))
+	if key == nil {
+		key, data = c.Last()
+	} else {
+		key, data = c.Prev()
+	}
+	for ; key != nil && bytes.HasPrefix(key, prefix); key, data = c.Prev() {
+		inRange, more := visit(key, data)
+		if !inRange {
+			break
+		}
+		if !more {
+			return false
+		}
+	}
+	return true
+}
+
+// boltStateRecord returns a copy of a state record (nil if there is none)
+func boltStateRecord(tx *bbolt.Tx, bucket, key string) []byte {
+	records := tx.Bucket(boltStateBucket).Bucket([]byte(bucket))
+	if records == nil {
+		return nil
+	}
+	if value := records.Get([]byte(key)); value != nil {
+		// bbolt memory is only valid during the transaction; an empty record is not a missing one
+		return append([]byte{}, value...)
+	}
+	return nil
+}
+
+// decodeBoltEntry decodes a stored entry; the store is written only by Commit, so bad data is corruption
+func decodeBoltEntry(data []byte) RaftEntry {
+	var item RaftEntry
+	if err := json.Unmarshal(data, &item); err != nil || item.Entry == nil {
+		panic(fmt.Sprintf("fsm: corrupt entry in FSM store: %v", err))
+	}
+	return item
+}
+
+// boltIndexPrefix returns the key prefix of an index value (length-prefixed, so no value prefixes another)
+func boltIndexPrefix(value string) []byte {
+	prefix := binary.AppendUvarint(nil, uint64(len(value)))
+	return append(prefix, value...)
+}
+
+func boltUint64Key(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+func boltPosKey(pos int) []byte {
+	return boltUint64Key(uint64(pos))
+}
+
+func boltKeyPos(key []byte) int {
+	return int(binary.BigEndian.Uint64(key))
+}
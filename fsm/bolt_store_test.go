@@ -0,0 +1,377 @@
+package fsm
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/verifiable-state-chains/lms/models"
+)
+
+// openBoltTestFSM opens a combined FSM over a bolt store file, closed at the end of the test
+// It pins the attestation key signing the test's entries (nil: none).
+func openBoltTestFSM(t *testing.T, path string, privKey *ecdsa.PrivateKey) *CombinedFSM {
+	t.Helper()
+
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("OpenBoltStore failed: %v", err)
+	}
+	f, err := NewCombinedFSMWithStore("genesis_hash_123", "", store)
+	if err != nil {
+		store.Close()
+		t.Fatalf("NewCombinedFSMWithStore failed: %v", err)
+	}
+	if privKey != nil {
+		f.PinAttestationKey(&privKey.PublicKey)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// queryAll returns every page of a query, flattened
+func queryAll(t *testing.T, f *CombinedFSM, q EntryQuery) []string {
+	t.Helper()
+
+	var ids []string
+	for {
+		page, err := f.QueryEntries(q)
+		if err != nil {
+			t.Fatalf("Query %+v failed: %v", q, err)
+		}
+		ids = append(ids, pageIndices(page)...)
+		if page.NextCursor == "" {
+			return ids
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+func TestBoltStore_ResumesAfterReopen(t *testing.T) {
+	privKey := generateTestKey(t)
+	path := filepath.Join(t.TempDir(), "fsm.db")
+
+	f := openBoltTestFSM(t, path, privKey)
+	raftIndex := uint64(0)
+	lastA := buildTestChain(t, f, privKey, "key_a", 3, &raftIndex)
+	buildTestChain(t, f, privKey, "key_b", 1, &raftIndex)
+	raftIndex++
+	lease := reserveTestRange(t, f, privKey, raftIndex, lastA.PubkeyHash, "hsm-1", 4)
+
+	head := f.GetTreeHead()
+	indices := f.GetAllKeyIndices()
+	lifecycle, _ := f.GetKeyLifecycle(lastA.PubkeyHash)
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reopened := openBoltTestFSM(t, path, privKey)
+	if reopened.AppliedIndex() != raftIndex {
+		t.Fatalf("Expected applied index %d, got %d", raftIndex, reopened.AppliedIndex())
+	}
+	if got := reopened.GetTreeHead(); got != head {
+		t.Errorf("Tree head changed across reopen: %+v -> %+v", head, got)
+	}
+	if got := reopened.GetAllKeyIndices(); fmt.Sprint(got) != fmt.Sprint(indices) {
+		t.Errorf("Heads changed across reopen: %v -> %v", indices, got)
+	}
+	if got, _ := reopened.GetKeyLifecycle(lastA.PubkeyHash); !reflect.DeepEqual(got, lifecycle) {
+		t.Errorf("Lifecycle changed across reopen: %+v -> %+v", lifecycle, got)
+	}
+	if leases := reopened.GetLeases(lastA.PubkeyHash, true); len(leases) != 1 || leases[0].LeaseID != lease.LeaseID {
+		t.Errorf("Expected the active lease to survive reopen, got %+v", leases)
+	}
+	if reopened.EntryCount() != 7 {
+		t.Errorf("Expected 7 entries, got %d", reopened.EntryCount())
+	}
+
+	// The chain continues from the stored head
+	next := newTestEntry(t, privKey, "key_b", ComputePubkeyHash([]byte("lms-pubkey-key_b")), 2, "", "sign")
+	chain, _ := reopened.GetChainByPubkeyHash(next.PubkeyHash)
+	next = newTestEntry(t, privKey, "key_b", next.PubkeyHash, 2, chain[len(chain)-1].Hash, "sign")
+	raftIndex++
+	applyTestEntry(t, reopened, raftIndex, next)
+	if proof, err := reopened.GetInclusionProof(next.Hash, 0); err != nil || proof.LeafIndex != 7 {
+		t.Errorf("Expected the new entry at leaf 7, got %+v (%v)", proof, err)
+	}
+}
+
+func TestBoltStore_SkipsAppliedEntries(t *testing.T) {
+	privKey := generateTestKey(t)
+	path := filepath.Join(t.TempDir(), "fsm.db")
+
+	f := openBoltTestFSM(t, path, privKey)
+	raftIndex := uint64(0)
+	last := buildTestChain(t, f, privKey, "key_a", 2, &raftIndex)
+	f.Close()
+
+	// Raft replays the log after the last snapshot: entries the store holds are not applied again
+	reopened := openBoltTestFSM(t, path, privKey)
+	data, _ := EncodeCommand(CommandCommitIndex, last)
+	if result := reopened.Apply(&raft.Log{Type: raft.LogCommand, Index: raftIndex, Term: 1, Data: data}); result != nil {
+		t.Errorf("Expected a replayed entry to be skipped, got %v", result)
+	}
+	if reopened.EntryCount() != 3 {
+		t.Errorf("Expected 3 entries after replay, got %d", reopened.EntryCount())
+	}
+}
+
+// recordingFSM records the logs it applies, to replay them on another FSM
+type recordingFSM struct {
+	*CombinedFSM
+	logs []*raft.Log
+}
+
+func (f *recordingFSM) Apply(l *raft.Log) interface{} {
+	f.logs = append(f.logs, l)
+	return f.CombinedFSM.Apply(l)
+}
+
+func TestBoltStore_MatchesMemoryStore(t *testing.T) {
+	privKey := generateTestKey(t)
+	memory, _ := NewCombinedFSM("genesis_hash_123", "")
+	memory.PinAttestationKey(&privKey.PublicKey)
+	recorder := &recordingFSM{CombinedFSM: memory}
+
+	raftIndex := uint64(0)
+	buildTestChain(t, recorder, privKey, "key_a", 3, &raftIndex)
+	buildTestChain(t, recorder, privKey, "key_b", 2, &raftIndex)
+	batch := []*KeyIndexEntry{
+		newTestEntry(t, privKey, "key_c", ComputePubkeyHash([]byte("pk_c")), 0, GenesisHash, "create"),
+		newTestEntry(t, privKey, "key_a", ComputePubkeyHash([]byte("pk_d")), 0, GenesisHash, "create"),
+	}
+	data, _ := EncodeCommand(CommandCommitBatch, CommitBatchCommand{Entries: []KeyIndexEntry{*batch[0], *batch[1]}})
+	recorder.Apply(&raft.Log{Type: raft.LogCommand, Index: raftIndex + 1, Term: 1, Data: data})
+
+	// Signatures are randomized: replay the same logs
+	bolt := openBoltTestFSM(t, filepath.Join(t.TempDir(), "fsm.db"), privKey)
+	for _, l := range recorder.logs {
+		bolt.Apply(l)
+	}
+	if bolt.EntryCount() != 9 || memory.EntryCount() != 9 {
+		t.Fatalf("Expected 9 entries, got memory %d, bolt %d", memory.EntryCount(), bolt.EntryCount())
+	}
+
+	for _, q := range []EntryQuery{
+		{Limit: 2},
+		{Limit: 2, Descending: true},
+		{KeyID: "key_a", Limit: 3},
+		{KeyID: "key_a", RecordType: "create", Descending: true},
+		{RecordType: "sign", FromRaftIndex: 3, ToRaftIndex: 7},
+	} {
+		if want, got := queryAll(t, memory, q), queryAll(t, bolt, q); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Query %+v: memory %v, bolt %v", q, want, got)
+		}
+	}
+
+	// Both stores stream the same snapshot
+	snapshot := persistSnapshot(t, memory)
+	if !bytes.Equal(persistSnapshot(t, bolt), snapshot) {
+		t.Fatal("Bolt store snapshot differs from the memory store snapshot")
+	}
+
+	// A snapshot restored into a bolt store is durable
+	path := filepath.Join(t.TempDir(), "restored.db")
+	restored := openBoltTestFSM(t, path, privKey)
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(snapshot))); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	restored.Close()
+	reopened := openBoltTestFSM(t, path, privKey)
+	if reopened.GetTreeHead() != memory.GetTreeHead() {
+		t.Errorf("Restored store tree head %+v, expected %+v", reopened.GetTreeHead(), memory.GetTreeHead())
+	}
+	if reopened.AppliedIndex() != 0 {
+		t.Errorf("Expected a restored store to require the snapshot again (applied index 0), got %d", reopened.AppliedIndex())
+	}
+}
+
+func TestBoltStore_SnapshotIsPointInTime(t *testing.T) {
+	privKey := generateTestKey(t)
+	f := openBoltTestFSM(t, filepath.Join(t.TempDir(), "fsm.db"), privKey)
+
+	raftIndex := uint64(0)
+	buildTestChain(t, f, privKey, "key_a", 1, &raftIndex)
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	defer snap.Release()
+
+	// Entries applied while the snapshot persists are not part of it
+	buildTestChain(t, f, privKey, "key_b", 1, &raftIndex)
+	sink := &testSnapshotSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	restored, _ := NewCombinedFSM("genesis_hash_123", "")
+	restored.PinAttestationKey(&privKey.PublicKey)
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(sink.Bytes()))); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if restored.EntryCount() != 2 {
+		t.Errorf("Expected the 2 entries present at snapshot time, got %d", restored.EntryCount())
+	}
+}
+
+func TestBoltStore_LoadsStoredTrees(t *testing.T) {
+	privKey := generateTestKey(t)
+	path := filepath.Join(t.TempDir(), "fsm.db")
+
+	f := openBoltTestFSM(t, path, privKey)
+	raftIndex := uint64(0)
+	lastA := buildTestChain(t, f, privKey, "key_a", 3, &raftIndex)
+	lastB := buildTestChain(t, f, privKey, "key_b", 2, &raftIndex)
+	buildTestChain(t, f, privKey, "key_c", 1, &raftIndex)
+
+	head := f.GetTreeHead()
+	proofs := func(f *CombinedFSM) string {
+		stateA, _ := f.GetStateProof(lastA.PubkeyHash)
+		stateB, _ := f.GetStateProof(lastB.PubkeyHash)
+		missing, _ := f.GetStateProof("unknown")
+		inclusion, _ := f.GetInclusionProof(lastA.Hash, 0)
+		consistency, _ := f.GetConsistencyProof(3, 0)
+		return fmt.Sprintf("%+v %+v %+v %+v %+v", stateA, stateB, missing, inclusion, consistency)
+	}
+	want := proofs(f)
+	f.Close()
+
+	// The trees are loaded from the nodes committed with the entries, not rebuilt
+	reopened := openBoltTestFSM(t, path, privKey)
+	if len(reopened.keyIndexFSM.state.updated) != 0 || len(reopened.keyIndexFSM.tlog.tree.added) != 0 {
+		t.Error("Expected the trees loaded from their stored nodes, not rebuilt")
+	}
+	if got := reopened.GetTreeHead(); got != head {
+		t.Errorf("Tree head changed across reopen: %+v -> %+v", head, got)
+	}
+	if got := proofs(reopened); got != want {
+		t.Errorf("Proofs changed across reopen:\n%s\n%s", want, got)
+	}
+	reopened.Close()
+
+	// A store without the tree nodes rebuilds the trees, and the next commit stores them
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("OpenBoltStore failed: %v", err)
+	}
+	state, _ := store.LoadState(stateLogNodes, stateTreeNodes)
+	changes := make(StateChanges)
+	for _, bucket := range []string{stateLogNodes, stateTreeNodes} {
+		for key := range state[bucket] {
+			changes.set(bucket, key, nil)
+		}
+	}
+	if err := store.Commit(store.AppliedIndex(), changes); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	store.Close()
+
+	rebuilt := openBoltTestFSM(t, path, privKey)
+	if got := rebuilt.GetTreeHead(); got != head {
+		t.Errorf("Rebuilt tree head %+v, expected %+v", got, head)
+	}
+	buildTestChain(t, rebuilt, privKey, "key_d", 1, &raftIndex)
+	head = rebuilt.GetTreeHead()
+	rebuilt.Close()
+
+	reopened = openBoltTestFSM(t, path, privKey)
+	if len(reopened.keyIndexFSM.state.updated) != 0 || len(reopened.keyIndexFSM.tlog.tree.added) != 0 {
+		t.Error("Expected the tree nodes stored by the commit after a rebuild")
+	}
+	if got := reopened.GetTreeHead(); got != head {
+		t.Errorf("Tree head changed across reopen: %+v -> %+v", head, got)
+	}
+}
+
+// commitRecordingStore records the state changes of every commit
+type commitRecordingStore struct {
+	Store
+	commits []StateChanges
+}
+
+func (s *commitRecordingStore) Commit(raftIndex uint64, changes StateChanges) error {
+	s.commits = append(s.commits, changes)
+	return s.Store.Commit(raftIndex, changes)
+}
+
+// applyTestAttestation applies an attestation chained to the latest one (the genesis hash for the first)
+func applyTestAttestation(t *testing.T, f *CombinedFSM, raftIndex uint64) {
+	t.Helper()
+
+	payload := models.CreateGenesisPayload("genesis_hash_123", 0, "message_hash")
+	if latest, err := f.GetLatestAttestation(); err == nil {
+		previous, _ := latest.GetChainedPayload()
+		payload.PreviousHash, _ = latest.ComputeHash()
+		payload.LMSIndex = previous.LMSIndex + 1
+		payload.SequenceNumber = previous.SequenceNumber + 1
+	}
+	attestation := &models.AttestationResponse{}
+	attestation.AttestationResponse.Policy.Value = "LMS_ATTEST_POLICY"
+	attestation.SetChainedPayload(payload)
+	data, _ := attestation.ToJSON()
+
+	result := f.Apply(&raft.Log{Type: raft.LogCommand, Index: raftIndex, Term: 1, Data: testLogData(f, CommandAttestation, json.RawMessage(data))})
+	if resultStr, _ := result.(string); strings.HasPrefix(resultStr, "Error") {
+		t.Fatalf("Apply of attestation %d failed: %s", raftIndex, resultStr)
+	}
+}
+
+func TestBoltStore_StoresHashChainDelta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fsm.db")
+	bolt, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("OpenBoltStore failed: %v", err)
+	}
+	store := &commitRecordingStore{Store: bolt}
+	f, err := NewCombinedFSMWithStore("genesis_hash_123", "", store)
+	if err != nil {
+		t.Fatalf("NewCombinedFSMWithStore failed: %v", err)
+	}
+
+	for raftIndex := uint64(1); raftIndex <= 3; raftIndex++ {
+		applyTestAttestation(t, f, raftIndex)
+
+		// Each commit stores only the attestation's log entry
+		records := store.commits[len(store.commits)-1][stateHashChain]
+		key := hashChainRecordKey(hashChainLogPrefix, int(raftIndex-1))
+		if _, exists := records[key]; len(records) != 1 || !exists {
+			t.Fatalf("Expected commit %d to store log entry %d only, got %d records", raftIndex, raftIndex-1, len(records))
+		}
+	}
+	latest, _ := f.GetLatestAttestation()
+
+	// Stored log entries are released from memory and read back from the store
+	if len(f.hashChainFSM.logEntries) != 0 {
+		t.Errorf("Expected the stored log entries released from memory, %d held", len(f.hashChainFSM.logEntries))
+	}
+	if entry, err := f.GetLogEntry(1); err != nil || entry.Index != 1 || entry.Attestation == nil {
+		t.Errorf("Expected log entry 1 read back from the store, got %+v (%v)", entry, err)
+	}
+	f.Close()
+
+	reopened := openBoltTestFSM(t, path, nil)
+	if reopened.GetLogCount() != 3 {
+		t.Fatalf("Expected 3 log entries after reopen, got %d", reopened.GetLogCount())
+	}
+	if got, err := reopened.GetLatestAttestation(); err != nil || fmt.Sprint(got) != fmt.Sprint(latest) {
+		t.Fatalf("Latest attestation changed across reopen: %v (%v)", got, err)
+	}
+
+	if err := reopened.hashChainFSM.VerifyChainIntegrity(); err != nil {
+		t.Errorf("Stored chain does not verify: %v", err)
+	}
+
+	// The chain continues from the stored attestations
+	applyTestAttestation(t, reopened, 4)
+	if reopened.GetLogCount() != 4 {
+		t.Errorf("Expected 4 log entries, got %d", reopened.GetLogCount())
+	}
+}
@@ -1,9 +1,14 @@
 package fsm
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/hashicorp/raft"
@@ -15,38 +20,172 @@ type CombinedFSM struct {
 	mu          sync.RWMutex
 	hashChainFSM *HashChainFSM
 	keyIndexFSM  *KeyIndexFSM
+	commands     commandRegistry
+
+	// legacyCommandCutover is the last Raft log index at which un-enveloped commands are accepted
+	// 0 accepts none. Must be identical on every node so all replicas apply the same log the same way.
+	legacyCommandCutover uint64
 }
 
+// Hash chain state records: the genesis hash, and the log entries and simple messages by position
+const (
+	hashChainGenesisKey    = "genesis_hash"
+	hashChainLogPrefix     = "log/"     // Big-endian position -> models.LogEntry
+	hashChainMessagePrefix = "message/" // Big-endian position -> simple message
+	hashChainSnapshotKey   = "snapshot" // Whole hash chain FSM snapshot, as stored by earlier versions
+)
+
 // NewCombinedFSM creates a new combined FSM
 func NewCombinedFSM(genesisHash string, attestationPubKeyPath string) (*CombinedFSM, error) {
+	return NewCombinedFSMWithStore(genesisHash, attestationPubKeyPath, NewMemoryStore())
+}
+
+// NewCombinedFSMWithStore creates a combined FSM whose key index state lives in a store
+// A persistent store (BoltStore) resumes from the state it holds; the FSM closes it on Close.
+func NewCombinedFSMWithStore(genesisHash string, attestationPubKeyPath string, store Store) (*CombinedFSM, error) {
 	hashChainFSM := NewHashChainFSM(genesisHash)
 	
 	keyIndexFSM, err := NewKeyIndexFSM(attestationPubKeyPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create key index FSM: %v", err)
 	}
+
+	if err := keyIndexFSM.loadState(store); err != nil {
+		return nil, err
+	}
+
+	// Hash chain records are read through the key index FSM, whose lock serializes the store
+	hashChainFSM.stored = func(key string) []byte {
+		return keyIndexFSM.storedRecord(stateHashChain, key)
+	}
+	legacy, err := loadHashChain(hashChainFSM, hashChainFSM.stored)
+	if err != nil {
+		return nil, err
+	}
 	
-	return &CombinedFSM{
+	f := &CombinedFSM{
 		hashChainFSM: hashChainFSM,
 		keyIndexFSM:  keyIndexFSM,
-	}, nil
+	}
+	f.registerCommands()
+
+	// Rewrite a whole-state snapshot record as per-entry records, at the index the store already holds
+	if legacy {
+		f.commit(store.AppliedIndex(), true)
+	}
+	return f, nil
+}
+
+// loadHashChain resumes the hash chain FSM from its state records
+// Only the counts of stored log entries and messages and the chain head are read; the head is the attestation
+// of the last log entry that has one. It reports whether the records were a whole-state snapshot, as stored
+// by earlier versions, which is loaded into memory to be rewritten.
+func loadHashChain(hashChainFSM *HashChainFSM, stored func(key string) []byte) (bool, error) {
+	if raw := stored(hashChainSnapshotKey); raw != nil {
+		return true, hashChainFSM.restoreFromBytes(raw)
+	}
+
+	logCount := storedCount(func(pos int) bool {
+		return stored(hashChainRecordKey(hashChainLogPrefix, pos)) != nil
+	})
+	messageCount := storedCount(func(pos int) bool {
+		return stored(hashChainRecordKey(hashChainMessagePrefix, pos)) != nil
+	})
+	var latest *models.AttestationResponse
+	for pos := logCount - 1; pos >= 0 && latest == nil; pos-- {
+		var entry models.LogEntry
+		if err := json.Unmarshal(stored(hashChainRecordKey(hashChainLogPrefix, pos)), &entry); err != nil {
+			return false, fmt.Errorf("failed to load hash chain log entry %d: %v", pos, err)
+		}
+		latest = entry.Attestation
+	}
+	hashChainFSM.resume(string(stored(hashChainGenesisKey)), logCount, messageCount, latest)
+	return false, nil
+}
+
+// storedCount returns the number of positions stored from 0 on (positions are stored without gaps)
+func storedCount(exists func(pos int) bool) int {
+	hi := 1
+	for exists(hi - 1) {
+		hi *= 2
+	}
+	lo := hi / 2
+	return lo + sort.Search(hi-lo, func(i int) bool {
+		return !exists(lo + i)
+	})
+}
+
+// hashChainRecordKey returns the state record key of a log entry or message position
+func hashChainRecordKey(prefix string, pos int) string {
+	return string(binary.BigEndian.AppendUint64([]byte(prefix), uint64(pos)))
 }
 
 // Apply applies a Raft log entry
+// Entries are command envelopes dispatched by type through the command registry.
+// The state each entry changed is committed to the store with its Raft index.
 func (f *CombinedFSM) Apply(l *raft.Log) interface{} {
 	if l.Type != raft.LogCommand {
 		return nil
 	}
 
-	// Try to parse as KeyIndexEntry first
-	var keyIndexEntry KeyIndexEntry
-	if err := json.Unmarshal(l.Data, &keyIndexEntry); err == nil && keyIndexEntry.KeyID != "" {
-		// It's a key index entry
-		return f.keyIndexFSM.Apply(l)
+	// Entries already in a persistent store were applied before the restart
+	if f.keyIndexFSM.applied(l.Index) {
+		return nil
+	}
+
+	f.mu.RLock()
+	legacyCutover := f.legacyCommandCutover
+	f.mu.RUnlock()
+
+	result := f.commands.dispatch(l, legacyCutover)
+	f.commit(l.Index, false)
+	return result
+}
+
+// commit commits the state a Raft log entry changed with the hash chain records appended since the last commit,
+// which the hash chain FSM then releases from memory
+// With all set (after a restore replaced the state) it also stores the genesis hash; a restore holds every
+// log entry and message as unsaved, so the whole hash chain state is stored.
+func (f *CombinedFSM) commit(raftIndex uint64, all bool) {
+	changes := make(StateChanges)
+	for key, data := range f.hashChainFSM.unsavedRecords() {
+		changes.set(stateHashChain, key, data)
+	}
+	if all {
+		changes.set(stateHashChain, hashChainGenesisKey, []byte(f.hashChainFSM.GetGenesisHash()))
+		changes.set(stateHashChain, hashChainSnapshotKey, nil)
 	}
+	f.keyIndexFSM.commit(raftIndex, changes)
+	f.hashChainFSM.markSaved()
+}
+
+// AppliedIndex returns the last Raft index the store made durable (0 for an in-memory store)
+func (f *CombinedFSM) AppliedIndex() uint64 {
+	return f.keyIndexFSM.AppliedIndex()
+}
 
-	// Otherwise, treat as hash-chain attestation
-	return f.hashChainFSM.Apply(l)
+// Close closes the store
+func (f *CombinedFSM) Close() error {
+	return f.keyIndexFSM.Close()
+}
+
+// registerCommands registers the handler of every command type
+func (f *CombinedFSM) registerCommands() {
+	keyIndex := f.keyIndexFSM
+	f.commands = make(commandRegistry)
+	f.commands.registerIdempotent(CommandCommitIndex, 1, keyIndex.applyCommitIndex)
+	f.commands.register(CommandCommitBatch, 1, keyIndex.locked(keyIndex.applyCommitBatch))
+	f.commands.register(CommandReserveIndex, 1, keyIndex.locked(keyIndex.applyReserveIndex))
+	f.commands.register(CommandReserveRange, 1, keyIndex.locked(keyIndex.applyReserveRange))
+	f.commands.register(CommandReturnRange, 1, keyIndex.locked(keyIndex.applyReturnRange))
+	f.commands.register(CommandRegistry, 1, keyIndex.locked(keyIndex.applyRegistryCommand))
+	f.commands.register(CommandAttestation, 1, func(l *raft.Log, cmd *Command) interface{} {
+		// A legacy entry is replayed as before: data that is not an attestation is a simple message
+		if cmd.legacy {
+			return f.hashChainFSM.Apply(l)
+		}
+		return f.hashChainFSM.applyAttestation(l)
+	})
 }
 
 // Snapshot creates a snapshot
@@ -54,25 +193,79 @@ func (f *CombinedFSM) Snapshot() (raft.FSMSnapshot, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 	
-	hashChainSnapshot, err := f.hashChainFSM.Snapshot()
+	hashChainSnap, err := f.hashChainFSM.Snapshot()
 	if err != nil {
 		return nil, err
 	}
 	
-	keyIndexSnapshot, err := f.keyIndexFSM.Snapshot()
+	keyIndexSnap, err := f.keyIndexFSM.Snapshot()
 	if err != nil {
 		return nil, err
 	}
 	
-	return &combinedSnapshot{
-		hashChainSnapshot: hashChainSnapshot,
-		keyIndexSnapshot:   keyIndexSnapshot,
-	}, nil
+	// The stored hash chain records are read from the same point-in-time view as the entries
+	snap := &combinedSnapshot{
+		hashChainSnapshot: hashChainSnap.(*hashChainSnapshot),
+		keyIndexSnapshot:  keyIndexSnap.(*keyIndexSnapshot),
+	}
+	view := snap.keyIndexSnapshot.entries
+	snap.hashChainSnapshot.stored = func(key string) []byte {
+		return view.StateRecord(stateHashChain, key)
+	}
+	return snap, nil
 }
 
 // Restore restores from snapshot
+// Both sub-FSMs are replaced entirely by the snapshot contents, each decoded from the stream as it is read
 func (f *CombinedFSM) Restore(r io.ReadCloser) error {
-	// For now, restore is a no-op
+	defer r.Close()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Version 0 combined snapshots only persisted the hash chain FSM, as the top-level object
+	// The key index state cannot be recovered from them, so it starts empty
+	dec := json.NewDecoder(r)
+	var version int
+	var legacy hashChainSnapshotData
+	hashChainRestored, keyIndexRestored := false, false
+	err := decodeObject(dec, func(name string) error {
+		switch name {
+		case "version":
+			if err := dec.Decode(&version); err != nil {
+				return err
+			}
+			if version > combinedSnapshotVersion {
+				return fmt.Errorf("unsupported combined snapshot version %d (max supported: %d)",
+					version, combinedSnapshotVersion)
+			}
+			return nil
+		case "hash_chain":
+			hashChainRestored = true
+			return f.hashChainFSM.restoreFrom(dec)
+		case "key_index":
+			// The key index restore resets the store the saved hash chain records are read from
+			if !hashChainRestored {
+				f.hashChainFSM.restoreData(&hashChainSnapshotData{})
+			}
+			keyIndexRestored = true
+			return f.keyIndexFSM.restoreFrom(dec)
+		}
+		return legacy.decodeMember(name, dec)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to decode combined snapshot: %v", err)
+	}
+
+	if version == 0 {
+		f.hashChainFSM.restoreData(&legacy)
+	}
+	if !keyIndexRestored {
+		if err := f.keyIndexFSM.restoreFrom(json.NewDecoder(strings.NewReader("{}"))); err != nil {
+			return err
+		}
+	}
+	f.commit(0, true)
 	return nil
 }
 
@@ -101,7 +294,64 @@ func (f *CombinedFSM) GetGenesisHash() string {
 	return f.hashChainFSM.GetGenesisHash()
 }
 
+// SetLegacyCommandCutover sets the last Raft log index at which commands without a command envelope
+// are accepted and classified by shape. The default 0 rejects every un-enveloped command; clusters
+// whose log was written before envelopes set the Raft index of the last such entry.
+func (f *CombinedFSM) SetLegacyCommandCutover(raftIndex uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.legacyCommandCutover = raftIndex
+}
+
 // KeyIndexFSM methods
+func (f *CombinedFSM) SetV1SignatureCutover(raftIndex uint64) {
+	f.keyIndexFSM.SetV1SignatureCutover(raftIndex)
+}
+
+func (f *CombinedFSM) SetLMSParamsCutover(raftIndex uint64) {
+	f.keyIndexFSM.SetLMSParamsCutover(raftIndex)
+}
+
+func (f *CombinedFSM) PinAttestationKey(pubKey *ecdsa.PublicKey) {
+	f.keyIndexFSM.PinAttestationKey(pubKey)
+}
+
+func (f *CombinedFSM) SetRegistryBootstrapQuorum(adminKeys []*ecdsa.PublicKey, threshold int) error {
+	return f.keyIndexFSM.SetRegistryBootstrapQuorum(adminKeys, threshold)
+}
+
+func (f *CombinedFSM) VerifyEntryAuthorization(entry *KeyIndexEntry) error {
+	return f.keyIndexFSM.VerifyEntryAuthorization(entry)
+}
+
+func (f *CombinedFSM) GetAttestationKeys() ([]AttestationKeyRecord, uint64) {
+	return f.keyIndexFSM.GetAttestationKeys()
+}
+
+func (f *CombinedFSM) GetLeases(pubkeyHash string, activeOnly bool) []*IndexLease {
+	return f.keyIndexFSM.GetLeases(pubkeyHash, activeOnly)
+}
+
+func (f *CombinedFSM) GetKeyLifecycle(pubkeyHash string) (*KeyLifecycle, bool) {
+	return f.keyIndexFSM.GetKeyLifecycle(pubkeyHash)
+}
+
+func (f *CombinedFSM) GetTreeHead() TreeHead {
+	return f.keyIndexFSM.GetTreeHead()
+}
+
+func (f *CombinedFSM) GetInclusionProof(entryHash string, treeSize uint64) (*InclusionProof, error) {
+	return f.keyIndexFSM.GetInclusionProof(entryHash, treeSize)
+}
+
+func (f *CombinedFSM) GetConsistencyProof(fromSize, toSize uint64) (*ConsistencyProof, error) {
+	return f.keyIndexFSM.GetConsistencyProof(fromSize, toSize)
+}
+
+func (f *CombinedFSM) GetStateProof(pubkeyHash string) (*StateProof, error) {
+	return f.keyIndexFSM.GetStateProof(pubkeyHash)
+}
+
 func (f *CombinedFSM) GetKeyIndex(keyID string) (uint64, bool) {
 	return f.keyIndexFSM.GetKeyIndex(keyID)
 }
@@ -141,18 +391,69 @@ func (f *CombinedFSM) GetAllPubkeyHashesByKeyID(keyID string) []string {
 	return f.keyIndexFSM.GetAllPubkeyHashesByKeyID(keyID)
 }
 
+func (f *CombinedFSM) EntriesAfter(raftIndex uint64, limit int) []RaftEntry {
+	return f.keyIndexFSM.EntriesAfter(raftIndex, limit)
+}
+
+func (f *CombinedFSM) LastEntryRaftIndex() uint64 {
+	return f.keyIndexFSM.LastEntryRaftIndex()
+}
+
+func (f *CombinedFSM) QueryEntries(q EntryQuery) (*EntryPage, error) {
+	return f.keyIndexFSM.QueryEntries(q)
+}
+
+func (f *CombinedFSM) EntryCount() int {
+	return f.keyIndexFSM.EntryCount()
+}
+
+func (f *CombinedFSM) KeyStateCounts() map[string]int {
+	return f.keyIndexFSM.KeyStateCounts()
+}
+
+func (f *CombinedFSM) EntriesChanged() <-chan struct{} {
+	return f.keyIndexFSM.EntriesChanged()
+}
+
+// combinedSnapshotVersion is the current on-disk format of CombinedFSM snapshots
+// Version 0 (no "version" field) was a bare hash chain snapshot
+const combinedSnapshotVersion = 1
+
+// A combined snapshot is {"version":1,"hash_chain":<hash chain snapshot>,"key_index":<key index snapshot>}
+
 type combinedSnapshot struct {
-	hashChainSnapshot raft.FSMSnapshot
-	keyIndexSnapshot  raft.FSMSnapshot
+	hashChainSnapshot *hashChainSnapshot
+	keyIndexSnapshot  *keyIndexSnapshot
 }
 
+// Persist streams the combined snapshot layout; log entries and key index entries are written one at a time
 func (s *combinedSnapshot) Persist(sink raft.SnapshotSink) error {
-	// For now, just persist hash chain
-	return s.hashChainSnapshot.Persist(sink)
+	w := bufio.NewWriter(sink)
+	_, err := fmt.Fprintf(w, `{"version":%d,"hash_chain":`, combinedSnapshotVersion)
+	if err == nil {
+		err = s.hashChainSnapshot.writeTo(w)
+	}
+	if err == nil {
+		_, err = w.WriteString(`,"key_index":`)
+	}
+	if err == nil {
+		err = s.keyIndexSnapshot.writeTo(w)
+	}
+	if err == nil {
+		_, err = w.WriteString("}")
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		sink.Cancel()
+		return fmt.Errorf("failed to write combined snapshot: %v", err)
+	}
+
+	return sink.Close()
 }
 
 func (s *combinedSnapshot) Release() {
 	s.hashChainSnapshot.Release()
 	s.keyIndexSnapshot.Release()
 }
-
@@ -0,0 +1,152 @@
+package fsm
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/raft"
+)
+
+// CommandType identifies the payload of a Raft log command
+type CommandType string
+
+// Raft log command types
+const (
+	CommandCommitIndex  CommandType = "commit_index"  // KeyIndexEntry
+	CommandCommitBatch  CommandType = "commit_batch"  // CommitBatchCommand
+	CommandReserveIndex CommandType = "reserve_index" // ReserveIndexCommand
+	CommandReserveRange CommandType = "reserve_range" // ReserveRangeCommand
+	CommandReturnRange  CommandType = "return_range"  // ReturnRangeCommand
+	CommandRegistry     CommandType = "registry"      // RegistryCommand
+	CommandAttestation  CommandType = "attestation"   // models.AttestationResponse (hash chain FSM)
+)
+
+// CommandVersion is the payload schema version written by EncodeCommand
+const CommandVersion = 1
+
+// Command is the envelope of every Raft log entry written by the service
+// Payload is the JSON of the command type's payload at the given schema version.
+type Command struct {
+	Type      CommandType     `json:"command"`
+	Version   int             `json:"version"`
+	RequestID string          `json:"request_id,omitempty"` // Client request ID (idempotent command types only)
+	Payload   json.RawMessage `json:"payload"`
+
+	legacy bool // Decoded from an un-enveloped entry: applied as it was before envelopes
+}
+
+// EncodeCommand wraps a payload in a command envelope for raft.Apply
+func EncodeCommand(cmdType CommandType, payload interface{}) ([]byte, error) {
+	return EncodeCommandWithRequestID(cmdType, "", payload)
+}
+
+// EncodeCommandWithRequestID wraps a payload in a command envelope carrying a client request ID
+// Applying the same request ID and payload again returns the original result (see RequestDedupCapacity)
+func EncodeCommandWithRequestID(cmdType CommandType, requestID string, payload interface{}) ([]byte, error) {
+	payloadData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize %s payload: %v", cmdType, err)
+	}
+	return json.Marshal(Command{Type: cmdType, Version: CommandVersion, RequestID: requestID, Payload: payloadData})
+}
+
+// decodeCommand parses the command envelope of raw log data
+// Entries written before the envelope existed carry no "command" field, and may not be JSON at all.
+// When allowLegacy is set they are mapped to their command type by shape so existing Raft logs still
+// replay (version 1, payload = data); otherwise they are rejected.
+func decodeCommand(data []byte, allowLegacy bool) (*Command, error) {
+	var cmd Command
+	err := json.Unmarshal(data, &cmd)
+	if err == nil && cmd.Type != "" {
+		return &cmd, nil
+	}
+	if allowLegacy {
+		return &Command{Type: legacyCommandType(data), Version: 1, Payload: data, legacy: true}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("log entry is not a JSON command: %v", err)
+	}
+	return nil, fmt.Errorf("log entry has no command envelope")
+}
+
+// legacyCommandType classifies an un-enveloped log entry the way Apply did before envelopes
+// Whatever the key index FSM did not take went to the hash chain FSM, which stored data that is not an
+// attestation (including raw bytes) as a simple message.
+func legacyCommandType(data []byte) CommandType {
+	switch {
+	case isRegistryCommand(data):
+		return CommandRegistry
+	case isReserveCommand(data):
+		return CommandReserveIndex
+	case isReserveRangeCommand(data):
+		return CommandReserveRange
+	case isReturnRangeCommand(data):
+		return CommandReturnRange
+	}
+
+	var entry KeyIndexEntry
+	if err := json.Unmarshal(data, &entry); err == nil && entry.KeyID != "" {
+		return CommandCommitIndex
+	}
+	return CommandAttestation
+}
+
+// commandFunc applies a command; the log passed to it carries the payload as Data
+type commandFunc func(l *raft.Log, cmd *Command) interface{}
+
+// commandHandler applies one command type
+type commandHandler struct {
+	maxVersion int
+	idempotent bool // Accepts client request IDs
+	apply      commandFunc
+}
+
+// commandRegistry maps command types to their handlers
+// Must be identical on every node: dispatch only depends on the log entry and the registry.
+type commandRegistry map[CommandType]commandHandler
+
+// register adds the handler of a command type accepting schema versions 1..maxVersion
+func (r commandRegistry) register(cmdType CommandType, maxVersion int, apply commandFunc) {
+	r.add(cmdType, commandHandler{maxVersion: maxVersion, apply: apply})
+}
+
+// registerIdempotent adds the handler of a command type that deduplicates client request IDs
+func (r commandRegistry) registerIdempotent(cmdType CommandType, maxVersion int, apply commandFunc) {
+	r.add(cmdType, commandHandler{maxVersion: maxVersion, idempotent: true, apply: apply})
+}
+
+func (r commandRegistry) add(cmdType CommandType, handler commandHandler) {
+	if _, exists := r[cmdType]; exists {
+		panic(fmt.Sprintf("command type %s registered twice", cmdType))
+	}
+	r[cmdType] = handler
+}
+
+// dispatch decodes the command envelope of a log entry and applies it with its handler
+// Un-enveloped entries are only classified by shape up to Raft index legacyCutover (0: none).
+// Unknown command types and unsupported versions are rejected with an "Error:" result
+func (r commandRegistry) dispatch(l *raft.Log, legacyCutover uint64) interface{} {
+	cmd, err := decodeCommand(l.Data, l.Index <= legacyCutover)
+	if err != nil {
+		return fmt.Sprintf("Error: Invalid command: %v", err)
+	}
+
+	handler, ok := r[cmd.Type]
+	if !ok {
+		return fmt.Sprintf("Error: Unknown command type %q", cmd.Type)
+	}
+	if cmd.Version < 1 || cmd.Version > handler.maxVersion {
+		return fmt.Sprintf("Error: Unsupported %s command version %d (max supported: %d)",
+			cmd.Type, cmd.Version, handler.maxVersion)
+	}
+	if len(cmd.Payload) == 0 {
+		return fmt.Sprintf("Error: %s command has no payload", cmd.Type)
+	}
+	if cmd.RequestID != "" && !handler.idempotent {
+		return fmt.Sprintf("Error: %s commands do not accept a request_id", cmd.Type)
+	}
+
+	payloadLog := *l
+	payloadLog.Data = cmd.Payload
+	return handler.apply(&payloadLog, cmd)
+}
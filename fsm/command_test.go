@@ -0,0 +1,132 @@
+package fsm
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func applyCommandData(f raft.FSM, raftIndex uint64, data []byte) interface{} {
+	return f.Apply(&raft.Log{Type: raft.LogCommand, Index: raftIndex, Term: 1, Data: data})
+}
+
+func TestCombinedFSM_DispatchesCommandEnvelope(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+
+	data, err := EncodeCommand(CommandCommitIndex, newTestEntry(t, privKey, "key_a", pubkeyHash, 0, GenesisHash, "create"))
+	if err != nil {
+		t.Fatalf("EncodeCommand failed: %v", err)
+	}
+	if result, ok := applyCommandData(f, 1, data).(string); ok && strings.HasPrefix(result, "Error:") {
+		t.Fatalf("Enveloped commit_index rejected: %s", result)
+	}
+	index, head, exists := f.GetIndexAndHashByPubkeyHash(pubkeyHash)
+	if !exists || index != 0 {
+		t.Fatalf("Expected index 0 for pubkey_hash, got %d (exists=%v)", index, exists)
+	}
+
+	data, _ = EncodeCommand(CommandReserveIndex, newTestReservation(t, privKey, "key_a", pubkeyHash, head, "sign"))
+	if _, ok := applyCommandData(f, 2, data).(*IndexReservation); !ok {
+		t.Fatal("Expected a reservation from an enveloped reserve_index")
+	}
+}
+
+func TestCombinedFSM_RejectsUnknownCommands(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"unknown type", `{"command":"drop_table","version":1,"payload":{}}`, `Unknown command type "drop_table"`},
+		{"future version", `{"command":"commit_index","version":2,"payload":{}}`, "Unsupported commit_index command version 2"},
+		{"missing version", `{"command":"commit_index","payload":{}}`, "Unsupported commit_index command version 0"},
+		{"missing payload", `{"command":"commit_index","version":1}`, "has no payload"},
+		{"raw bytes", `hello raft`, "not a JSON command"},
+		{"json array", `[1,2,3]`, "not a JSON command"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every node reaches the same result, with no state change
+			for node := 0; node < 3; node++ {
+				f, _ := NewCombinedFSM("genesis_hash_123", "")
+				result, _ := applyCommandData(f, 1, []byte(tt.data)).(string)
+				if !strings.HasPrefix(result, "Error:") || !strings.Contains(result, tt.want) {
+					t.Fatalf("Expected error containing %q, got %q", tt.want, result)
+				}
+				if f.GetLogCount() != 0 {
+					t.Fatal("Rejected command reached the hash chain FSM")
+				}
+			}
+		})
+	}
+}
+
+func TestCombinedFSM_ReplaysLegacyEntries(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+	f.SetLegacyCommandCutover(3)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+
+	// Entries written before the envelope existed are classified by shape up to the cutover
+	legacyEntry, _ := json.Marshal(newTestEntry(t, privKey, "key_a", pubkeyHash, 0, GenesisHash, "create"))
+	if result, ok := applyCommandData(f, 1, legacyEntry).(string); ok && strings.HasPrefix(result, "Error:") {
+		t.Fatalf("Legacy commit_index rejected: %s", result)
+	}
+	_, head, _ := f.GetIndexAndHashByPubkeyHash(pubkeyHash)
+	legacyReservation, _ := json.Marshal(newTestReservation(t, privKey, "key_a", pubkeyHash, head, "sign"))
+	if _, ok := applyCommandData(f, 2, legacyReservation).(*IndexReservation); !ok {
+		t.Fatal("Expected a reservation from a legacy reserve_index")
+	}
+	if index, _, _ := f.GetIndexAndHashByPubkeyHash(pubkeyHash); index != 1 {
+		t.Fatalf("Expected index 1 after legacy replay, got %d", index)
+	}
+
+	// Raw bytes were stored by the hash chain FSM as a simple message
+	if result, _ := applyCommandData(f, 3, []byte("hello raft")).(string); strings.HasPrefix(result, "Error:") {
+		t.Fatalf("Legacy raw bytes rejected: %s", result)
+	}
+	if messages := f.GetSimpleMessages(); f.GetLogCount() != 1 || len(messages) != 1 || messages[0] != "hello raft" {
+		t.Fatalf("Expected the raw bytes replayed as a simple message, got %d log entries, messages %v", f.GetLogCount(), messages)
+	}
+
+	// After the cutover un-enveloped commands are rejected, whatever their shape
+	_, head, _ = f.GetIndexAndHashByPubkeyHash(pubkeyHash)
+	legacyEntry, _ = json.Marshal(newTestEntry(t, privKey, "key_a", pubkeyHash, 2, head, "sign"))
+	for i, data := range [][]byte{legacyEntry, []byte(`{"unknown": true}`), []byte("hello raft")} {
+		if result, _ := applyCommandData(f, uint64(4+i), data).(string); !strings.HasPrefix(result, "Error: Invalid command") {
+			t.Fatalf("Expected un-enveloped command %d after the cutover to be rejected, got: %s", i, result)
+		}
+	}
+	if f.GetLogCount() != 1 {
+		t.Fatal("Un-enveloped command reached the hash chain FSM")
+	}
+	if index, _, _ := f.GetIndexAndHashByPubkeyHash(pubkeyHash); index != 1 {
+		t.Fatalf("Expected index 1 after rejected legacy commands, got %d", index)
+	}
+}
+
+func TestDecodeCommand_Envelope(t *testing.T) {
+	data, err := EncodeCommand(CommandReturnRange, ReturnRangeCommand{Request: RangeReturnRequest{LeaseID: "lease_1"}})
+	if err != nil {
+		t.Fatalf("EncodeCommand failed: %v", err)
+	}
+
+	cmd, err := decodeCommand(data, false)
+	if err != nil {
+		t.Fatalf("decodeCommand failed: %v", err)
+	}
+	if cmd.Type != CommandReturnRange || cmd.Version != CommandVersion {
+		t.Fatalf("Unexpected envelope: %+v", cmd)
+	}
+	var payload ReturnRangeCommand
+	if err := json.Unmarshal(cmd.Payload, &payload); err != nil || payload.Request.LeaseID != "lease_1" {
+		t.Fatalf("Payload did not round trip: %s (%v)", cmd.Payload, err)
+	}
+}
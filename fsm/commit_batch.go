@@ -0,0 +1,137 @@
+package fsm
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/raft"
+)
+
+// MaxBatchEntries bounds the number of entries in one commit_batch command
+const MaxBatchEntries = 1000
+
+// CommitBatchCommand commits several signed KeyIndexEntries as one Raft log entry
+// Entries are applied in order, so one pubkey_hash may appear several times as consecutive chain entries.
+type CommitBatchCommand struct {
+	Entries []KeyIndexEntry `json:"entries"`
+}
+
+// Batch entry statuses
+const (
+	BatchEntryCommitted = "committed" // Entry was committed with the batch
+	BatchEntryRejected  = "rejected"  // Entry failed validation; see Error
+	BatchEntryAborted   = "aborted"   // Entry was valid but another entry of the batch was rejected
+)
+
+// BatchEntryResult is the outcome of one entry of a batch
+type BatchEntryResult struct {
+	Position   int    `json:"position"` // Position of the entry in the batch
+	KeyID      string `json:"key_id"`
+	PubkeyHash string `json:"pubkey_hash"`
+	Index      uint64 `json:"index"`
+	Hash       string `json:"hash,omitempty"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+// CommitBatchResult is the Apply result of a CommitBatchCommand
+// Committed is true only if every entry was committed; otherwise nothing was.
+type CommitBatchResult struct {
+	Committed bool               `json:"committed"`
+	RaftIndex uint64             `json:"raft_index"`
+	Results   []BatchEntryResult `json:"results"`
+}
+
+// batchUndo holds the chain head of a pubkey_hash before a batch touched it
+type batchUndo struct {
+	index       uint64
+	indexExists bool
+	hash        string
+	hashExists  bool
+	state       *KeyLifecycle
+	stateExists bool
+}
+
+// applyCommitBatch validates every entry of a batch, then commits all of them or none (caller must hold the lock)
+// Each entry is validated against the chain heads left by the entries before it. Heads are advanced
+// tentatively during validation and restored afterwards, so a rejected batch leaves no trace.
+func (f *KeyIndexFSM) applyCommitBatch(l *raft.Log) interface{} {
+	var cmd CommitBatchCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return fmt.Sprintf("Error: Failed to parse commit_batch command: %v", err)
+	}
+	if len(cmd.Entries) == 0 {
+		return "Error: commit_batch has no entries"
+	}
+	if len(cmd.Entries) > MaxBatchEntries {
+		return fmt.Sprintf("Error: commit_batch has %d entries (max %d)", len(cmd.Entries), MaxBatchEntries)
+	}
+
+	result := &CommitBatchResult{RaftIndex: l.Index, Results: make([]BatchEntryResult, len(cmd.Entries))}
+	states := make([]string, len(cmd.Entries))
+	undo := make(map[string]*batchUndo)
+	rejected := false
+
+	for i := range cmd.Entries {
+		entry := &cmd.Entries[i]
+		state, err := f.checkEntry(entry, l.Index)
+		result.Results[i] = BatchEntryResult{
+			Position:   i,
+			KeyID:      entry.KeyID,
+			PubkeyHash: entry.PubkeyHash,
+			Index:      entry.Index,
+			Hash:       entry.Hash,
+		}
+		if err != nil {
+			result.Results[i].Status = BatchEntryRejected
+			result.Results[i].Error = err.Error()
+			rejected = true
+			continue
+		}
+		states[i] = state
+
+		// Advance the head so the next entry of the same chain validates against this one
+		if _, saved := undo[entry.PubkeyHash]; !saved {
+			u := &batchUndo{}
+			u.index, u.indexExists = f.pubkeyHashIndices[entry.PubkeyHash]
+			u.hash, u.hashExists = f.pubkeyHashHashes[entry.PubkeyHash]
+			u.state, u.stateExists = f.keyStates[entry.PubkeyHash]
+			undo[entry.PubkeyHash] = u
+		}
+		f.pubkeyHashIndices[entry.PubkeyHash] = entry.Index
+		f.pubkeyHashHashes[entry.PubkeyHash] = entry.Hash
+		f.setKeyState(entry, state, l.Index)
+	}
+
+	for pubkeyHash, u := range undo {
+		restoreHead(f.pubkeyHashIndices, pubkeyHash, u.index, u.indexExists)
+		restoreHead(f.pubkeyHashHashes, pubkeyHash, u.hash, u.hashExists)
+		restoreHead(f.keyStates, pubkeyHash, u.state, u.stateExists)
+	}
+
+	if rejected {
+		for i := range result.Results {
+			if result.Results[i].Status == "" {
+				result.Results[i].Status = BatchEntryAborted
+			}
+		}
+		return result
+	}
+
+	// Store in submission order
+	for i := range cmd.Entries {
+		f.storeEntry(&cmd.Entries[i], l.Index, states[i])
+		result.Results[i].Status = BatchEntryCommitted
+	}
+	result.Committed = true
+	return result
+}
+
+// restoreHead puts back a map value saved before a batch, deleting keys the batch created
+func restoreHead[V any](m map[string]V, key string, value V, exists bool) {
+	if exists {
+		m[key] = value
+	} else {
+		delete(m, key)
+	}
+}
@@ -0,0 +1,125 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+)
+
+func applyBatch(t *testing.T, f *CombinedFSM, raftIndex uint64, entries []*KeyIndexEntry) *CommitBatchResult {
+	t.Helper()
+
+	cmd := CommitBatchCommand{}
+	for _, entry := range entries {
+		cmd.Entries = append(cmd.Entries, *entry)
+	}
+	data, err := EncodeCommand(CommandCommitBatch, cmd)
+	if err != nil {
+		t.Fatalf("EncodeCommand failed: %v", err)
+	}
+	raw := applyCommandData(f, raftIndex, data)
+	result, ok := raw.(*CommitBatchResult)
+	if !ok {
+		t.Fatalf("Expected a batch result, got: %v", raw)
+	}
+	return result
+}
+
+func TestCommitBatch_CommitsAcrossChains(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+	hashA := ComputePubkeyHash([]byte("pk_a"))
+	hashB := ComputePubkeyHash([]byte("pk_b"))
+
+	createA := newTestEntry(t, privKey, "key_a", hashA, 0, GenesisHash, "create")
+	createB := newTestEntry(t, privKey, "key_b", hashB, 0, GenesisHash, "create")
+	signA := newTestEntry(t, privKey, "key_a", hashA, 1, createA.Hash, "sign")
+
+	result := applyBatch(t, f, 7, []*KeyIndexEntry{createA, createB, signA})
+	if !result.Committed || result.RaftIndex != 7 {
+		t.Fatalf("Expected the batch to commit at Raft index 7, got %+v", result)
+	}
+	for i, entry := range result.Results {
+		if entry.Status != BatchEntryCommitted || entry.Position != i {
+			t.Errorf("Entry %d: unexpected result %+v", i, entry)
+		}
+	}
+
+	if index, hash, _ := f.GetIndexAndHashByPubkeyHash(hashA); index != 1 || hash != signA.Hash {
+		t.Errorf("Expected key_a head at index 1, got %d", index)
+	}
+	if index, _, exists := f.GetIndexAndHashByPubkeyHash(hashB); !exists || index != 0 {
+		t.Errorf("Expected key_b head at index 0, got %d (exists=%v)", index, exists)
+	}
+	if size := f.GetTreeHead().TreeSize; size != 3 {
+		t.Errorf("Expected 3 transparency log leaves, got %d", size)
+	}
+
+	// Entries are stored in submission order
+	stored := f.EntriesAfter(0, 0)
+	for i, entry := range []*KeyIndexEntry{createA, createB, signA} {
+		if i >= len(stored) || stored[i].Entry.Hash != entry.Hash {
+			t.Fatalf("Expected entry %d to be %s in submission order", i, entry.Hash)
+		}
+	}
+}
+
+func TestCommitBatch_AllOrNothing(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+	hashB := ComputePubkeyHash([]byte("pk_b"))
+
+	raftIndex := uint64(0)
+	headA := buildTestChain(t, f, privKey, "key_a", 1, &raftIndex)
+	hashA := headA.PubkeyHash
+	treeSize := f.GetTreeHead().TreeSize
+
+	nextA := newTestEntry(t, privKey, "key_a", hashA, headA.Index+1, headA.Hash, "sign")
+	createB := newTestEntry(t, privKey, "key_b", hashB, 0, GenesisHash, "create")
+	stale := newTestEntry(t, privKey, "key_a", hashA, headA.Index, headA.PreviousHash, "sign") // Conflicts with the head
+
+	result := applyBatch(t, f, raftIndex+1, []*KeyIndexEntry{nextA, createB, stale})
+	if result.Committed {
+		t.Fatal("Batch with a rejected entry must not commit")
+	}
+	if result.Results[0].Status != BatchEntryAborted || result.Results[1].Status != BatchEntryAborted {
+		t.Errorf("Valid entries should be aborted, got %+v", result.Results[:2])
+	}
+	if result.Results[2].Status != BatchEntryRejected || !strings.Contains(result.Results[2].Error, "Hash chain validation failed") {
+		t.Errorf("Expected the stale entry to be rejected, got %+v", result.Results[2])
+	}
+
+	// Nothing of the batch is visible
+	if index, hash, _ := f.GetIndexAndHashByPubkeyHash(hashA); index != headA.Index || hash != headA.Hash {
+		t.Errorf("key_a head moved to %d", index)
+	}
+	if _, _, exists := f.GetIndexAndHashByPubkeyHash(hashB); exists {
+		t.Error("key_b must not exist after a rejected batch")
+	}
+	if _, exists := f.GetKeyLifecycle(hashB); exists {
+		t.Error("key_b lifecycle must not exist after a rejected batch")
+	}
+	if size := f.GetTreeHead().TreeSize; size != treeSize {
+		t.Errorf("Transparency log grew from %d to %d", treeSize, size)
+	}
+
+	// The same entries without the stale one commit
+	if result := applyBatch(t, f, raftIndex+2, []*KeyIndexEntry{nextA, createB}); !result.Committed {
+		t.Fatalf("Expected the corrected batch to commit, got %+v", result)
+	}
+}
+
+func TestCommitBatch_Limits(t *testing.T) {
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+
+	data, _ := EncodeCommand(CommandCommitBatch, CommitBatchCommand{})
+	if result, _ := applyCommandData(f, 1, data).(string); !strings.Contains(result, "no entries") {
+		t.Errorf("Expected an empty batch to be rejected, got %q", result)
+	}
+
+	data, _ = EncodeCommand(CommandCommitBatch, CommitBatchCommand{Entries: make([]KeyIndexEntry, MaxBatchEntries+1)})
+	if result, _ := applyCommandData(f, 2, data).(string); !strings.Contains(result, "max") {
+		t.Errorf("Expected an oversized batch to be rejected, got %q", result)
+	}
+}
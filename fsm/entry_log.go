@@ -0,0 +1,89 @@
+package fsm
+
+import (
+	"sort"
+)
+
+// RaftEntry is a committed entry with the Raft log index that committed it
+type RaftEntry struct {
+	RaftIndex uint64         `json:"raft_index"`
+	Entry     *KeyIndexEntry `json:"entry"`
+}
+
+// appendEntryLog records a stored entry in apply order and wakes entry watchers (caller must hold the lock)
+func (f *KeyIndexFSM) appendEntryLog(entry *KeyIndexEntry, raftIndex uint64) {
+	f.store.Append(raftIndex, entry)
+	f.notifyEntriesChanged()
+}
+
+// notifyEntriesChanged wakes every watcher waiting on EntriesChanged (caller must hold the lock)
+func (f *KeyIndexFSM) notifyEntriesChanged() {
+	close(f.entriesChanged)
+	f.entriesChanged = make(chan struct{})
+}
+
+// entriesInApplyOrder orders the per-chain entries of a version 1-5 snapshot by Raft index
+// Entries committed by one batch share a Raft index; a batch stores them ordered by pubkey_hash
+// and index, so the same tie-break reproduces the apply order on every node.
+func entriesInApplyOrder(chains map[string][]*KeyIndexEntry, raftIndices map[string]uint64) []RaftEntry {
+	entries := make([]RaftEntry, 0)
+	for _, chain := range chains {
+		for _, entry := range chain {
+			entries = append(entries, RaftEntry{RaftIndex: raftIndices[entry.Hash], Entry: entry})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.RaftIndex != b.RaftIndex {
+			return a.RaftIndex < b.RaftIndex
+		}
+		if a.Entry.PubkeyHash != b.Entry.PubkeyHash {
+			return a.Entry.PubkeyHash < b.Entry.PubkeyHash
+		}
+		return a.Entry.Index < b.Entry.Index
+	})
+	return entries
+}
+
+// EntriesAfter returns up to limit entries committed after a Raft index, oldest first
+// Entries sharing a Raft index (one batch) are never split, so limit may be exceeded to finish the last batch.
+func (f *KeyIndexFSM) EntriesAfter(raftIndex uint64, limit int) []RaftEntry {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	entries := make([]RaftEntry, 0)
+	f.store.Scan(IndexAll, "", f.store.FirstPosition(raftIndex+1), f.store.Len(), false, func(_ int, item RaftEntry) bool {
+		if limit > 0 && len(entries) >= limit && item.RaftIndex != entries[len(entries)-1].RaftIndex {
+			return false
+		}
+		entries = append(entries, RaftEntry{RaftIndex: item.RaftIndex, Entry: item.Entry.clone()})
+		return true
+	})
+	return entries
+}
+
+// LastEntryRaftIndex returns the Raft index of the most recently stored entry (0 if none)
+func (f *KeyIndexFSM) LastEntryRaftIndex() uint64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.store.Len() == 0 {
+		return 0
+	}
+	return f.store.At(f.store.Len() - 1).RaftIndex
+}
+
+// EntryCount returns the number of stored entries across all pubkey_hashes
+func (f *KeyIndexFSM) EntryCount() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.store.Len()
+}
+
+// EntriesChanged returns a channel that is closed the next time entries are stored or restored
+// Take the channel before calling EntriesAfter so no commit between the two calls is missed.
+func (f *KeyIndexFSM) EntriesChanged() <-chan struct{} {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.entriesChanged
+}
@@ -0,0 +1,104 @@
+package fsm
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestEntriesAfter_OrderAndCursor(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+
+	raftIndex := uint64(0)
+	buildTestChain(t, f, privKey, "key_a", 3, &raftIndex) // create + 3 signs
+	if last := f.LastEntryRaftIndex(); last != raftIndex {
+		t.Fatalf("Expected last entry at Raft index %d, got %d", raftIndex, last)
+	}
+
+	all := f.EntriesAfter(0, 0)
+	if len(all) != 4 {
+		t.Fatalf("Expected 4 entries, got %d", len(all))
+	}
+	for i, item := range all {
+		if item.Entry.Index != uint64(i) || (i > 0 && item.RaftIndex <= all[i-1].RaftIndex) {
+			t.Errorf("Entry %d out of order: index %d at Raft index %d", i, item.Entry.Index, item.RaftIndex)
+		}
+	}
+
+	after := f.EntriesAfter(all[0].RaftIndex, 1)
+	if len(after) != 1 || after[0].Entry.Index != 1 {
+		t.Errorf("Expected only index 1 after the first entry, got %d entries", len(after))
+	}
+	if entries := f.EntriesAfter(raftIndex, 0); len(entries) != 0 {
+		t.Errorf("Expected nothing after the last entry, got %d", len(entries))
+	}
+}
+
+func TestEntriesAfter_KeepsBatchesWhole(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+	hashA := ComputePubkeyHash([]byte("pk_a"))
+	hashB := ComputePubkeyHash([]byte("pk_b"))
+
+	createB := newTestEntry(t, privKey, "key_b", hashB, 0, GenesisHash, "create")
+	createA := newTestEntry(t, privKey, "key_a", hashA, 0, GenesisHash, "create")
+	signB := newTestEntry(t, privKey, "key_b", hashB, 1, createB.Hash, "sign")
+	if result := applyBatch(t, f, 5, []*KeyIndexEntry{createB, createA, signB}); !result.Committed {
+		t.Fatalf("Batch failed: %+v", result)
+	}
+
+	// A limit inside a batch is extended to the end of the batch
+	if entries := f.EntriesAfter(0, 1); len(entries) != 3 {
+		t.Errorf("Expected the whole batch of 3, got %d", len(entries))
+	}
+
+	// The batch is stored in canonical order, so a restored node rebuilds the same entry and transparency logs
+	before := f.EntriesAfter(0, 0)
+	treeHead := f.GetTreeHead()
+
+	restored, _ := NewCombinedFSM("genesis_hash_123", "")
+	restored.PinAttestationKey(&privKey.PublicKey)
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(persistSnapshot(t, f)))); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	after := restored.EntriesAfter(0, 0)
+	if len(after) != len(before) {
+		t.Fatalf("Expected %d entries after restore, got %d", len(before), len(after))
+	}
+	for i := range before {
+		if before[i].Entry.Hash != after[i].Entry.Hash || before[i].RaftIndex != after[i].RaftIndex {
+			t.Errorf("Entry %d differs after restore", i)
+		}
+	}
+	if restored.GetTreeHead().RootHash != treeHead.RootHash {
+		t.Error("Transparency log root differs after restore")
+	}
+}
+
+func TestEntriesChanged(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+
+	changed := f.EntriesChanged()
+	select {
+	case <-changed:
+		t.Fatal("Channel closed before any entry was stored")
+	default:
+	}
+
+	raftIndex := uint64(0)
+	buildTestChain(t, f, privKey, "key_a", 1, &raftIndex)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("Channel not closed after an entry was stored")
+	}
+	if next := f.EntriesChanged(); next == changed {
+		t.Error("Expected a fresh channel after a change")
+	}
+}
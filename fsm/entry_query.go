@@ -0,0 +1,160 @@
+package fsm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxQueryLimit bounds the entries returned by one QueryEntries page
+const MaxQueryLimit = 1000
+
+// EntryQuery selects stored entries, one page at a time
+// Empty filters match everything; FromRaftIndex and ToRaftIndex are inclusive (0: unbounded).
+type EntryQuery struct {
+	KeyID         string
+	PubkeyHash    string
+	RecordType    string // Entries without record_type match their effective type (create or sign)
+	FromRaftIndex uint64
+	ToRaftIndex   uint64
+
+	Cursor     string // NextCursor of the previous page ("" for the first page)
+	Limit      int    // Page size (0 or above MaxQueryLimit: MaxQueryLimit)
+	Descending bool   // Newest first
+}
+
+// EntryPage is one page of a query
+type EntryPage struct {
+	Entries    []RaftEntry `json:"entries"`
+	NextCursor string      `json:"next_cursor,omitempty"` // Empty on the last page
+	Previous   *RaftEntry  `json:"previous,omitempty"`    // Matching entry just before the page in query order (links pages of a chain)
+}
+
+// entryCursor is a position in the entry log: the Raft index and the position among the entries it committed
+// Entries of one Raft log entry (a batch) are in a deterministic order, so a cursor means the same on every node.
+type entryCursor struct {
+	raftIndex uint64
+	seq       int
+}
+
+func (c entryCursor) String() string {
+	return fmt.Sprintf("%d.%d", c.raftIndex, c.seq)
+}
+
+func parseEntryCursor(s string) (entryCursor, error) {
+	raftPart, seqPart, found := strings.Cut(s, ".")
+	if !found {
+		return entryCursor{}, fmt.Errorf("invalid cursor %q: expected <raft_index>.<seq>", s)
+	}
+	raftIndex, err := strconv.ParseUint(raftPart, 10, 64)
+	if err != nil {
+		return entryCursor{}, fmt.Errorf("invalid cursor %q: %v", s, err)
+	}
+	seq, err := strconv.Atoi(seqPart)
+	if err != nil || seq < 0 {
+		return entryCursor{}, fmt.Errorf("invalid cursor %q: bad sequence", s)
+	}
+	return entryCursor{raftIndex: raftIndex, seq: seq}, nil
+}
+
+// cursorAt returns the cursor of a store position (caller must hold the lock)
+func (f *KeyIndexFSM) cursorAt(pos int) entryCursor {
+	raftIndex := f.store.At(pos).RaftIndex
+	return entryCursor{raftIndex: raftIndex, seq: pos - f.store.FirstPosition(raftIndex)}
+}
+
+// QueryEntries returns a page of entries matching a query, in Raft order
+// The most selective secondary index (pubkey_hash, then key_id, then record_type) bounds the scan,
+// and the Raft index range and cursor are found by position, so no query walks the whole log.
+func (f *KeyIndexFSM) QueryEntries(q EntryQuery) (*EntryPage, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	limit := q.Limit
+	if limit <= 0 || limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+
+	// The index to scan: candidates still have to match the other filters
+	index, value := IndexAll, ""
+	switch {
+	case q.PubkeyHash != "":
+		index, value = IndexPubkeyHash, q.PubkeyHash
+	case q.KeyID != "":
+		index, value = IndexKeyID, q.KeyID
+	case q.RecordType != "":
+		index, value = IndexRecordType, q.RecordType
+	}
+
+	// Positions [startPos, endPos) of the store are in range
+	count := f.store.Len()
+	startPos, endPos := 0, count
+	if q.FromRaftIndex > 0 {
+		startPos = f.store.FirstPosition(q.FromRaftIndex)
+	}
+	if q.ToRaftIndex > 0 && q.ToRaftIndex < ^uint64(0) {
+		endPos = f.store.FirstPosition(q.ToRaftIndex + 1)
+	}
+	if q.Cursor != "" {
+		cursor, err := parseEntryCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		cursorPos := f.store.FirstPosition(cursor.raftIndex) + cursor.seq
+		if cursorPos >= count || f.store.At(cursorPos).RaftIndex != cursor.raftIndex {
+			return nil, fmt.Errorf("invalid cursor %q: no such entry", q.Cursor)
+		}
+		if q.Descending {
+			endPos = min(endPos, cursorPos)
+		} else {
+			startPos = max(startPos, cursorPos+1)
+		}
+	}
+
+	matches := func(entry *KeyIndexEntry) bool {
+		return (q.KeyID == "" || entry.KeyID == q.KeyID) &&
+			(q.PubkeyHash == "" || entry.PubkeyHash == q.PubkeyHash) &&
+			(q.RecordType == "" || entry.effectiveRecordType() == q.RecordType)
+	}
+
+	page := &EntryPage{Entries: make([]RaftEntry, 0)}
+	firstPos, lastPos, more := -1, -1, false
+	f.store.Scan(index, value, startPos, endPos, q.Descending, func(pos int, item RaftEntry) bool {
+		if !matches(item.Entry) {
+			return true
+		}
+		if len(page.Entries) == limit {
+			more = true
+			return false
+		}
+		page.Entries = append(page.Entries, RaftEntry{RaftIndex: item.RaftIndex, Entry: item.Entry.clone()})
+		if firstPos < 0 {
+			firstPos = pos
+		}
+		lastPos = pos
+		return true
+	})
+	if len(page.Entries) == 0 {
+		return page, nil
+	}
+
+	// Another match exists: the next page starts after the last returned entry
+	if more {
+		page.NextCursor = f.cursorAt(lastPos).String()
+	}
+
+	// The matching entry just before the page, ignoring the Raft index range
+	before, after := 0, firstPos
+	if q.Descending {
+		before, after = firstPos+1, count
+	}
+	f.store.Scan(index, value, before, after, !q.Descending, func(_ int, item RaftEntry) bool {
+		if !matches(item.Entry) {
+			return true
+		}
+		page.Previous = &RaftEntry{RaftIndex: item.RaftIndex, Entry: item.Entry.clone()}
+		return false
+	})
+
+	return page, nil
+}
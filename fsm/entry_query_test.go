@@ -0,0 +1,180 @@
+package fsm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// pageIndices returns the key_id:index of each entry on a page
+func pageIndices(page *EntryPage) []string {
+	ids := make([]string, len(page.Entries))
+	for i, item := range page.Entries {
+		ids[i] = fmt.Sprintf("%s:%d", item.Entry.KeyID, item.Entry.Index)
+	}
+	return ids
+}
+
+func assertPage(t *testing.T, what string, page *EntryPage, want ...string) {
+	t.Helper()
+
+	got := pageIndices(page)
+	if len(got) != len(want) {
+		t.Fatalf("%s: expected %v, got %v", what, want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("%s: expected %v, got %v", what, want, got)
+		}
+	}
+}
+
+func TestQueryEntries_Filters(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+
+	raftIndex := uint64(0)
+	buildTestChain(t, f, privKey, "key_a", 2, &raftIndex)
+	firstB := raftIndex + 1
+	buildTestChain(t, f, privKey, "key_b", 2, &raftIndex)
+
+	tests := []struct {
+		name  string
+		query EntryQuery
+		want  []string
+	}{
+		{"all", EntryQuery{}, []string{"key_a:0", "key_a:1", "key_a:2", "key_b:0", "key_b:1", "key_b:2"}},
+		{"key_id", EntryQuery{KeyID: "key_b"}, []string{"key_b:0", "key_b:1", "key_b:2"}},
+		{"pubkey_hash", EntryQuery{PubkeyHash: ComputePubkeyHash([]byte("lms-pubkey-key_a"))}, []string{"key_a:0", "key_a:1", "key_a:2"}},
+		{"record_type", EntryQuery{RecordType: "create"}, []string{"key_a:0", "key_b:0"}},
+		{"record_type and key_id", EntryQuery{KeyID: "key_a", RecordType: "sign"}, []string{"key_a:1", "key_a:2"}},
+		{"raft range", EntryQuery{FromRaftIndex: firstB - 1, ToRaftIndex: firstB}, []string{"key_a:2", "key_b:0"}},
+		{"descending", EntryQuery{KeyID: "key_a", Descending: true}, []string{"key_a:2", "key_a:1", "key_a:0"}},
+		{"no match", EntryQuery{KeyID: "key_c"}, nil},
+	}
+	for _, tt := range tests {
+		page, err := f.QueryEntries(tt.query)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		assertPage(t, tt.name, page, tt.want...)
+		if page.NextCursor != "" {
+			t.Errorf("%s: expected no next cursor on the only page, got %q", tt.name, page.NextCursor)
+		}
+	}
+}
+
+func TestQueryEntries_CursorPages(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+
+	raftIndex := uint64(0)
+	buildTestChain(t, f, privKey, "key_a", 4, &raftIndex) // 5 entries
+
+	for _, descending := range []bool{false, true} {
+		var got []string
+		var previous *RaftEntry
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatal("Pagination does not terminate")
+			}
+			page, err := f.QueryEntries(EntryQuery{KeyID: "key_a", Cursor: cursor, Limit: 2, Descending: descending})
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+
+			// Previous is the last entry of the page before
+			if (previous == nil) != (page.Previous == nil) || (previous != nil && previous.Entry.Hash != page.Previous.Entry.Hash) {
+				t.Errorf("Page %d: previous entry does not match the end of the previous page", pages)
+			}
+			if len(page.Entries) > 0 {
+				previous = &page.Entries[len(page.Entries)-1]
+			}
+
+			got = append(got, pageIndices(page)...)
+			if page.NextCursor == "" {
+				break
+			}
+			cursor = page.NextCursor
+		}
+
+		want := []string{"key_a:0", "key_a:1", "key_a:2", "key_a:3", "key_a:4"}
+		if descending {
+			want = []string{"key_a:4", "key_a:3", "key_a:2", "key_a:1", "key_a:0"}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Descending %v: expected %v across pages, got %v", descending, want, got)
+		}
+	}
+}
+
+func TestQueryEntries_CursorInsideBatch(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+	hashA := ComputePubkeyHash([]byte("pk_a"))
+	hashB := ComputePubkeyHash([]byte("pk_b"))
+
+	createA := newTestEntry(t, privKey, "key_a", hashA, 0, GenesisHash, "create")
+	createB := newTestEntry(t, privKey, "key_b", hashB, 0, GenesisHash, "create")
+	if result := applyBatch(t, f, 5, []*KeyIndexEntry{createA, createB}); !result.Committed {
+		t.Fatalf("Batch failed: %+v", result)
+	}
+
+	// A page may end inside a batch: the cursor records the position within it
+	first, err := f.QueryEntries(EntryQuery{Limit: 1})
+	if err != nil || len(first.Entries) != 1 || first.NextCursor != "5.0" {
+		t.Fatalf("Expected one entry and cursor 5.0, got %+v (%v)", first, err)
+	}
+	second, err := f.QueryEntries(EntryQuery{Limit: 1, Cursor: first.NextCursor})
+	if err != nil || len(second.Entries) != 1 || second.NextCursor != "" {
+		t.Fatalf("Expected the last entry, got %+v (%v)", second, err)
+	}
+	if second.Entries[0].Entry.Hash == first.Entries[0].Entry.Hash {
+		t.Error("Second page repeats the first entry")
+	}
+}
+
+func TestQueryEntries_InvalidCursor(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+
+	raftIndex := uint64(0)
+	buildTestChain(t, f, privKey, "key_a", 1, &raftIndex)
+
+	for _, cursor := range []string{"abc", "1", "1.x", "1.-1", "999.0", "1.5"} {
+		if _, err := f.QueryEntries(EntryQuery{Cursor: cursor}); err == nil {
+			t.Errorf("Expected cursor %q to be rejected", cursor)
+		}
+	}
+}
+
+func TestQueryEntries_IndexesRebuiltOnRestore(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+
+	raftIndex := uint64(0)
+	buildTestChain(t, f, privKey, "key_a", 2, &raftIndex)
+	buildTestChain(t, f, privKey, "key_b", 1, &raftIndex)
+
+	restored, _ := NewCombinedFSM("genesis_hash_123", "")
+	restored.PinAttestationKey(&privKey.PublicKey)
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(persistSnapshot(t, f)))); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	for _, query := range []EntryQuery{{KeyID: "key_a"}, {RecordType: "sign"}, {PubkeyHash: ComputePubkeyHash([]byte("lms-pubkey-key_b"))}} {
+		before, _ := f.QueryEntries(query)
+		after, err := restored.QueryEntries(query)
+		if err != nil {
+			t.Fatalf("Query failed after restore: %v", err)
+		}
+		assertPage(t, "after restore", after, pageIndices(before)...)
+	}
+}
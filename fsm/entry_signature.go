@@ -0,0 +1,223 @@
+package fsm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// Attestation signature formats for KeyIndexEntry
+const (
+	// SignatureVersionV1 signs only "key_id:index" (legacy, does not bind pubkey_hash or chain position)
+	SignatureVersionV1 = 1
+	// SignatureVersionV2 signs every entry field except hash and signature, with domain separation
+	SignatureVersionV2 = 2
+	// SignatureVersionReserve signs a reservation request for the head previous_hash; the FSM assigns index
+	SignatureVersionReserve = 3
+	// SignatureVersionLease signs a range lease request (key_id, pubkey_hash, previous_hash, hsm_instance, count, public_key)
+	SignatureVersionLease = 4
+
+	// CurrentSignatureVersion is the format used for new entries
+	CurrentSignatureVersion = SignatureVersionV2
+)
+
+// signatureDomainV2 separates v2 entry signatures from any other use of the attestation key
+const signatureDomainV2 = "verifiable-state-chains/lms/key-index-entry/v2"
+
+// signatureDomainReserve separates reservation signatures from full entry signatures
+const signatureDomainReserve = "verifiable-state-chains/lms/key-index-reserve/v1"
+
+// signatureDomainLease separates range lease signatures from entry and reservation signatures
+const signatureDomainLease = "verifiable-state-chains/lms/key-index-lease/v1"
+
+// EffectiveSignatureVersion returns the signature format of the entry
+// Entries without signature_version were produced before versioning and use v1
+func (e *KeyIndexEntry) EffectiveSignatureVersion() int {
+	if e.SignatureVersion == 0 {
+		return SignatureVersionV1
+	}
+	return e.SignatureVersion
+}
+
+// SigningPayload returns the exact bytes covered by the attestation signature
+//
+// v2 layout: domain, then each field as a 4-byte big-endian length followed by its bytes,
+// in the order key_id, pubkey_hash, index (8-byte big-endian), previous_hash, record_type, public_key.
+// Length prefixes make the encoding unambiguous, so no field can be shifted into another.
+// Create records that carry lms_params append it as a final field, so the parameter set is attested too.
+func (e *KeyIndexEntry) SigningPayload() ([]byte, error) {
+	switch e.EffectiveSignatureVersion() {
+	case SignatureVersionV1:
+		return []byte(fmt.Sprintf("%s:%d", e.KeyID, e.Index)), nil
+	case SignatureVersionV2:
+		indexBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(indexBytes, e.Index)
+
+		return e.appendParamsField(appendLengthPrefixed(make([]byte, 0, 256),
+			[]byte(signatureDomainV2),
+			[]byte(e.KeyID),
+			[]byte(e.PubkeyHash),
+			indexBytes,
+			[]byte(e.PreviousHash),
+			[]byte(e.RecordType),
+			[]byte(e.PublicKey),
+		)), nil
+	case SignatureVersionReserve:
+		// index is assigned by the FSM in Apply; previous_hash is the head the reservation extends,
+		// so a replayed reservation no longer matches once the head has moved
+		return e.appendParamsField(appendLengthPrefixed(make([]byte, 0, 256),
+			[]byte(signatureDomainReserve),
+			[]byte(e.KeyID),
+			[]byte(e.PubkeyHash),
+			[]byte(e.PreviousHash),
+			[]byte(e.RecordType),
+			[]byte(e.PublicKey),
+		)), nil
+	case SignatureVersionLease:
+		// A lease entry covers [lease_start, index]; the signed count is recovered from the range
+		if e.Index < e.LeaseStart {
+			return nil, fmt.Errorf("lease entry index %d is below lease_start %d", e.Index, e.LeaseStart)
+		}
+		return rangeLeasePayload(e.KeyID, e.PubkeyHash, e.PreviousHash, e.HSMInstance, e.Index-e.LeaseStart+1, e.PublicKey), nil
+	default:
+		return nil, fmt.Errorf("unsupported signature version %d", e.SignatureVersion)
+	}
+}
+
+// appendParamsField appends lms_params as a length-prefixed field when the entry carries it
+// Entries without lms_params keep their original payload
+func (e *KeyIndexEntry) appendParamsField(payload []byte) []byte {
+	if e.LMSParams == nil {
+		return payload
+	}
+	return appendLengthPrefixed(payload, e.LMSParams.signingBytes())
+}
+
+// rangeLeasePayload returns the signed bytes of a range lease request
+// previousHash is the head the lease extends, so a replayed request no longer matches once the head has moved
+func rangeLeasePayload(keyID, pubkeyHash, previousHash, hsmInstance string, count uint64, publicKey string) []byte {
+	countBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(countBytes, count)
+
+	return appendLengthPrefixed(make([]byte, 0, 256),
+		[]byte(signatureDomainLease),
+		[]byte(keyID),
+		[]byte(pubkeyHash),
+		[]byte(previousHash),
+		[]byte(hsmInstance),
+		countBytes,
+		[]byte(publicKey),
+	)
+}
+
+// appendLengthPrefixed appends each field as a 4-byte big-endian length followed by its bytes
+func appendLengthPrefixed(payload []byte, fields ...[]byte) []byte {
+	for _, field := range fields {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(field)))
+		payload = append(payload, field...)
+	}
+	return payload
+}
+
+// SigningDigest returns the SHA-256 digest of the signing payload
+func (e *KeyIndexEntry) SigningDigest() ([32]byte, error) {
+	payload, err := e.SigningPayload()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(payload), nil
+}
+
+// SignEntry signs the entry with the attestation private key using the current signature format
+// It sets public_key, signature_version and signature; the caller computes hash afterwards
+// The key is an *ecdsa.PrivateKey or any ECDSA crypto.Signer (a PKCS#11 token key).
+func SignEntry(entry *KeyIndexEntry, privKey crypto.Signer) error {
+	return signEntryVersion(entry, privKey, CurrentSignatureVersion)
+}
+
+// SignReservation signs a reservation request (key_id, pubkey_hash, previous_hash, record_type, public_key)
+// previous_hash is the expected chain head (GenesisHash for a new key); the FSM allocates the index after it
+func SignReservation(entry *KeyIndexEntry, privKey crypto.Signer) error {
+	return signEntryVersion(entry, privKey, SignatureVersionReserve)
+}
+
+func signEntryVersion(entry *KeyIndexEntry, privKey crypto.Signer, version int) error {
+	pubKey, err := attestationPublicKey(privKey)
+	if err != nil {
+		return err
+	}
+	pubKeyBytes, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return fmt.Errorf("failed to marshal public key: %v", err)
+	}
+
+	entry.PublicKey = base64.StdEncoding.EncodeToString(pubKeyBytes)
+	entry.SignatureVersion = version
+
+	digest, err := entry.SigningDigest()
+	if err != nil {
+		return err
+	}
+
+	signature, err := privKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("failed to sign: %v", err)
+	}
+	entry.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	return nil
+}
+
+// attestationPublicKey returns the ECDSA public key of an attestation signer
+func attestationPublicKey(privKey crypto.Signer) (*ecdsa.PublicKey, error) {
+	pubKey, ok := privKey.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("attestation key is not an ECDSA key")
+	}
+	return pubKey, nil
+}
+
+// verifyEntrySignature verifies the entry signature against the given public key
+func verifyEntrySignature(entry *KeyIndexEntry, pubKey *ecdsa.PublicKey) error {
+	digest, err := entry.SigningDigest()
+	if err != nil {
+		return err
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(entry.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %v", err)
+	}
+
+	if !ecdsa.VerifyASN1(pubKey, digest[:], sigBytes) {
+		return fmt.Errorf("signature verification failed: ECDSA verify returned false (signature_version=%d)",
+			entry.EffectiveSignatureVersion())
+	}
+
+	return nil
+}
+
+// parseEntryPublicKey decodes the base64 PKIX EC public key embedded in an entry
+func parseEntryPublicKey(encoded string) (*ecdsa.PublicKey, error) {
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %v", err)
+	}
+
+	pubKeyInterface, err := x509.ParsePKIXPublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+
+	pubKey, ok := pubKeyInterface.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ECDSA public key")
+	}
+
+	return pubKey, nil
+}
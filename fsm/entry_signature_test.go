@@ -0,0 +1,184 @@
+package fsm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// newV1TestEntry builds a legacy entry signed over "key_id:index" only
+func newV1TestEntry(t *testing.T, privKey *ecdsa.PrivateKey, keyID, pubkeyHash string, index uint64, previousHash string) *KeyIndexEntry {
+	t.Helper()
+
+	dataHash := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", keyID, index)))
+	signature, err := ecdsa.SignASN1(rand.Reader, privKey, dataHash[:])
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	pubKeyBytes, _ := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+
+	entry := &KeyIndexEntry{
+		KeyID:        keyID,
+		PubkeyHash:   pubkeyHash,
+		Index:        index,
+		PreviousHash: previousHash,
+		Signature:    base64.StdEncoding.EncodeToString(signature),
+		PublicKey:    base64.StdEncoding.EncodeToString(pubKeyBytes),
+		RecordType:   "create",
+	}
+	entry.Hash, _ = entry.ComputeHash()
+	return entry
+}
+
+func applyEntryResult(f *KeyIndexFSM, raftIndex uint64, entry *KeyIndexEntry) string {
+	data := testLogData(f, CommandCommitIndex, entry)
+	result, _ := f.Apply(&raft.Log{Type: raft.LogCommand, Index: raftIndex, Term: 1, Data: data}).(string)
+	return result
+}
+
+func TestSignEntry_CoversAllFields(t *testing.T) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+
+	entry := newTestEntry(t, privKey, "key_a", ComputePubkeyHash([]byte("pk_a")), 3, "prev_hash", "sign")
+	if err := f.VerifySignature(entry); err != nil {
+		t.Fatalf("Valid v2 signature rejected: %v", err)
+	}
+
+	// Grafting the signature onto any other field value must fail
+	tampered := []func(e *KeyIndexEntry){
+		func(e *KeyIndexEntry) { e.KeyID = "key_b" },
+		func(e *KeyIndexEntry) { e.PubkeyHash = ComputePubkeyHash([]byte("pk_b")) },
+		func(e *KeyIndexEntry) { e.Index = 4 },
+		func(e *KeyIndexEntry) { e.PreviousHash = "other_prev_hash" },
+		func(e *KeyIndexEntry) { e.RecordType = "delete" },
+		func(e *KeyIndexEntry) { e.SignatureVersion = SignatureVersionV1 },
+	}
+	for i, tamper := range tampered {
+		e := entry.clone()
+		tamper(e)
+		if err := f.VerifySignature(e); err == nil {
+			t.Errorf("Tampered entry %d was accepted", i)
+		}
+	}
+}
+
+func TestSigningPayload_UnambiguousEncoding(t *testing.T) {
+	// Moving bytes between adjacent fields must change the payload
+	a := &KeyIndexEntry{KeyID: "ab", PubkeyHash: "c", SignatureVersion: SignatureVersionV2}
+	b := &KeyIndexEntry{KeyID: "a", PubkeyHash: "bc", SignatureVersion: SignatureVersionV2}
+
+	pa, _ := a.SigningPayload()
+	pb, _ := b.SigningPayload()
+	if string(pa) == string(pb) {
+		t.Fatal("Signing payloads collide for different field boundaries")
+	}
+
+	if _, err := (&KeyIndexEntry{SignatureVersion: 99}).SigningPayload(); err == nil {
+		t.Fatal("Expected error for unknown signature version")
+	}
+}
+
+func TestComputeHash_LegacyEntriesUnchanged(t *testing.T) {
+	// v1 entries must hash exactly as before signature_version existed
+	entry := &KeyIndexEntry{KeyID: "k", PubkeyHash: "p", Index: 1, PreviousHash: "h", Signature: "s", PublicKey: "pk", RecordType: "sign"}
+	hash, _ := entry.ComputeHash()
+
+	legacy, _ := json.Marshal(struct {
+		KeyID        string `json:"key_id"`
+		PubkeyHash   string `json:"pubkey_hash"`
+		Index        uint64 `json:"index"`
+		PreviousHash string `json:"previous_hash"`
+		Signature    string `json:"signature"`
+		PublicKey    string `json:"public_key"`
+		RecordType   string `json:"record_type"`
+	}{"k", "p", 1, "h", "s", "pk", "sign"})
+	legacyHash := sha256.Sum256(legacy)
+
+	if hash != base64.StdEncoding.EncodeToString(legacyHash[:]) {
+		t.Fatal("Hash of v1 entry changed")
+	}
+
+	entry.SignatureVersion = SignatureVersionV2
+	if v2Hash, _ := entry.ComputeHash(); v2Hash == hash {
+		t.Fatal("signature_version must be covered by the entry hash")
+	}
+}
+
+func TestKeyIndexFSM_V1SignatureCutover(t *testing.T) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	f.SetV1SignatureCutover(5)
+	f.SetLMSParamsCutover(5) // v1 creates carry no lms_params
+
+	// v1 entries up to and including the cutover are still accepted (log replay)
+	before := newV1TestEntry(t, privKey, "key_a", ComputePubkeyHash([]byte("pk_a")), 0, GenesisHash)
+	if result := applyEntryResult(f, 5, before); strings.HasPrefix(result, "Error") {
+		t.Fatalf("v1 entry at cutover rejected: %s", result)
+	}
+
+	// v1 entries after the cutover are rejected
+	after := newV1TestEntry(t, privKey, "key_b", ComputePubkeyHash([]byte("pk_b")), 0, GenesisHash)
+	result := applyEntryResult(f, 6, after)
+	if !strings.HasPrefix(result, "Error") {
+		t.Fatalf("Expected v1 entry after cutover to be rejected, got: %s", result)
+	}
+	if _, exists := f.GetIndexByPubkeyHash(after.PubkeyHash); exists {
+		t.Fatal("Rejected v1 entry must not be stored")
+	}
+
+	// v2 entries are accepted after the cutover
+	v2 := newTestEntry(t, privKey, "key_b", after.PubkeyHash, 0, GenesisHash, "create")
+	if result := applyEntryResult(f, 7, v2); strings.HasPrefix(result, "Error") {
+		t.Fatalf("v2 entry rejected: %s", result)
+	}
+}
+
+func TestKeyIndexFSM_V1RejectedByDefault(t *testing.T) {
+	privKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+
+	entry := newV1TestEntry(t, privKey, "key_a", ComputePubkeyHash([]byte("pk_a")), 0, GenesisHash)
+	if result := applyEntryResult(f, 1, entry); !strings.HasPrefix(result, "Error") {
+		t.Fatalf("Expected v1 entry to be rejected without a cutover, got: %s", result)
+	}
+}
+
+func TestKeyIndexFSM_RejectsUnsignedLeaseFields(t *testing.T) {
+	privKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+
+	// lease_start and hsm_instance are hashed but not covered by a v2 signature
+	tampered := []func(e *KeyIndexEntry){
+		func(e *KeyIndexEntry) { e.LeaseStart = 7 },
+		func(e *KeyIndexEntry) { e.HSMInstance = "hsm-other" },
+	}
+	for i, tamper := range tampered {
+		entry := newTestEntry(t, privKey, "key_a", ComputePubkeyHash([]byte("pk_a")), 0, GenesisHash, "create")
+		tamper(entry)
+		entry.Hash, _ = entry.ComputeHash()
+		if result := applyEntryResult(f, uint64(i+1), entry); !strings.Contains(result, "lease_start") {
+			t.Errorf("Expected entry %d with lease fields to be rejected, got: %s", i, result)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package fsm
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -15,16 +17,20 @@ import (
 // must match the hash of the previous entry
 type HashChainFSM struct {
 	mu             sync.RWMutex
-	attestations   []*models.AttestationResponse
-	logEntries     []*models.LogEntry
-	simpleMessages []string // Store simple string messages separately
-	genesisHash    string   // Hash of the genesis block (LMS public key + system bundle)
+	latest         *models.AttestationResponse // Chain head: the last attestation (nil before the first)
+	logEntries     []*models.LogEntry          // Log entries from position savedLog on
+	simpleMessages []string                    // Store simple string messages separately (from position savedMessages on)
+	genesisHash    string                      // Hash of the genesis block (LMS public key + system bundle)
+
+	// With stored set (CombinedFSM), the log entries and messages before these positions are in the store
+	// and read back one at a time; without it they all stay in memory and both positions stay 0
+	savedLog, savedMessages int
+	stored                  func(key string) []byte
 }
 
 // NewHashChainFSM creates a new hash-chain FSM
 func NewHashChainFSM(genesisHash string) *HashChainFSM {
 	return &HashChainFSM{
-		attestations:   make([]*models.AttestationResponse, 0),
 		logEntries:    make([]*models.LogEntry, 0),
 		simpleMessages: make([]string, 0),
 		genesisHash:   genesisHash,
@@ -43,30 +49,7 @@ func (f *HashChainFSM) Apply(l *raft.Log) interface{} {
 	// Try to parse as attestation first
 	var attestation models.AttestationResponse
 	if err := json.Unmarshal(l.Data, &attestation); err == nil {
-		// It's an attestation - validate hash chain
-		payload, err := attestation.GetChainedPayload()
-		if err != nil {
-			return fmt.Sprintf("Error: Failed to get chained payload: %v", err)
-		}
-
-		// Validate hash chain integrity
-		if err := f.validateHashChain(&attestation, payload); err != nil {
-			return fmt.Sprintf("Error: Hash chain validation failed: %v", err)
-		}
-
-		// Create log entry
-		entry := &models.LogEntry{
-			Index:       uint64(l.Index),
-			Term:        uint64(l.Term),
-			Attestation:  &attestation,
-		}
-
-		// Store the attestation and log entry
-		f.attestations = append(f.attestations, &attestation)
-		f.logEntries = append(f.logEntries, entry)
-
-		return fmt.Sprintf("Applied attestation: index=%d, lms_index=%d, sequence=%d",
-			l.Index, payload.LMSIndex, payload.SequenceNumber)
+		return f.appendAttestation(l, &attestation)
 	}
 
 	// If not an attestation, treat as simple string message (for testing)
@@ -87,11 +70,50 @@ func (f *HashChainFSM) Apply(l *raft.Log) interface{} {
 	return fmt.Sprintf("Stored log: %s", message)
 }
 
+// applyAttestation applies an attestation command; unlike Apply, data that is not an attestation is rejected
+func (f *HashChainFSM) applyAttestation(l *raft.Log) interface{} {
+	var attestation models.AttestationResponse
+	if err := json.Unmarshal(l.Data, &attestation); err != nil {
+		return fmt.Sprintf("Error: Failed to parse attestation: %v", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.appendAttestation(l, &attestation)
+}
+
+// appendAttestation validates an attestation against the hash chain and stores it (caller must hold the lock)
+func (f *HashChainFSM) appendAttestation(l *raft.Log, attestation *models.AttestationResponse) interface{} {
+	payload, err := attestation.GetChainedPayload()
+	if err != nil {
+		return fmt.Sprintf("Error: Failed to get chained payload: %v", err)
+	}
+
+	// Validate hash chain integrity
+	if err := f.validateHashChain(attestation, payload); err != nil {
+		return fmt.Sprintf("Error: Hash chain validation failed: %v", err)
+	}
+
+	// Create log entry
+	entry := &models.LogEntry{
+		Index:       uint64(l.Index),
+		Term:        uint64(l.Term),
+		Attestation: attestation,
+	}
+
+	// Store the attestation and log entry
+	f.latest = attestation
+	f.logEntries = append(f.logEntries, entry)
+
+	return fmt.Sprintf("Applied attestation: index=%d, lms_index=%d, sequence=%d",
+		l.Index, payload.LMSIndex, payload.SequenceNumber)
+}
+
 // validateHashChain validates that the previous_hash in the new attestation
 // matches the hash of the previous entry in the chain
 func (f *HashChainFSM) validateHashChain(attestation *models.AttestationResponse, payload *models.ChainedPayload) error {
 	// If this is the first entry (genesis), previous_hash should match genesis hash
-	if len(f.attestations) == 0 {
+	if f.latest == nil {
 		if payload.PreviousHash != f.genesisHash {
 			return fmt.Errorf("genesis entry previous_hash mismatch: expected %s, got %s",
 				f.genesisHash, payload.PreviousHash)
@@ -100,7 +122,7 @@ func (f *HashChainFSM) validateHashChain(attestation *models.AttestationResponse
 	}
 
 	// Get the previous attestation
-	prevAttestation := f.attestations[len(f.attestations)-1]
+	prevAttestation := f.latest
 
 	// Compute hash of previous attestation
 	prevHash, err := prevAttestation.ComputeHash()
@@ -139,32 +161,177 @@ func (f *HashChainFSM) Snapshot() (raft.FSMSnapshot, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
+	// Copy the slices so later appends don't race with Persist; saved positions are read from the store
+	logEntries := make([]*models.LogEntry, len(f.logEntries))
+	copy(logEntries, f.logEntries)
+	simpleMessages := make([]string, len(f.simpleMessages))
+	copy(simpleMessages, f.simpleMessages)
+
 	return &hashChainSnapshot{
-		attestations: f.attestations,
-		logEntries:   f.logEntries,
-		genesisHash:  f.genesisHash,
+		logEntries:     logEntries,
+		simpleMessages: simpleMessages,
+		savedLog:       f.savedLog,
+		savedMessages:  f.savedMessages,
+		genesisHash:    f.genesisHash,
 	}, nil
 }
 
 // Restore restores the FSM from a snapshot
+// The FSM state is replaced entirely by the snapshot contents
 func (f *HashChainFSM) Restore(r io.ReadCloser) error {
-	// For now, restore is a no-op
-	// In a production system, this would deserialize from the snapshot
-	// Will be enhanced in future if needed
+	defer r.Close()
+
+	return f.restoreFrom(json.NewDecoder(r))
+}
+
+// restoreFromBytes replaces the FSM state with a serialized snapshot
+func (f *HashChainFSM) restoreFromBytes(raw []byte) error {
+	return f.restoreFrom(json.NewDecoder(bytes.NewReader(raw)))
+}
+
+// restoreFrom replaces the FSM state with a snapshot decoded from a stream
+func (f *HashChainFSM) restoreFrom(dec *json.Decoder) error {
+	var data hashChainSnapshotData
+	err := decodeObject(dec, func(name string) error {
+		return data.decodeMember(name, dec)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to decode hash chain snapshot: %v", err)
+	}
+
+	f.restoreData(&data)
 	return nil
 }
 
+// restoreData replaces the FSM state with decoded snapshot data
+// Everything is held in memory until a CombinedFSM stores it and calls markSaved.
+func (f *HashChainFSM) restoreData(data *hashChainSnapshotData) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.logEntries = data.LogEntries
+	if f.logEntries == nil {
+		f.logEntries = make([]*models.LogEntry, 0)
+	}
+	f.simpleMessages = data.SimpleMessages
+	if f.simpleMessages == nil {
+		f.simpleMessages = make([]string, 0)
+	}
+	f.savedLog, f.savedMessages = 0, 0
+
+	// The attestations are those of the log entries
+	f.latest = nil
+	for i := len(f.logEntries) - 1; i >= 0 && f.latest == nil; i-- {
+		f.latest = f.logEntries[i].Attestation
+	}
+
+	// Keep the configured genesis hash if the snapshot doesn't carry one
+	if data.GenesisHash != "" {
+		f.genesisHash = data.GenesisHash
+	}
+}
+
+// resume continues from state a CombinedFSM stored: the counts of stored log entries and messages and the chain head
+func (f *HashChainFSM) resume(genesisHash string, logCount, messageCount int, latest *models.AttestationResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.logEntries = make([]*models.LogEntry, 0)
+	f.simpleMessages = make([]string, 0)
+	f.savedLog, f.savedMessages = logCount, messageCount
+	f.latest = latest
+	if genesisHash != "" {
+		f.genesisHash = genesisHash
+	}
+}
+
+// unsavedRecords encodes the log entries and messages appended since the last markSaved by record key
+func (f *HashChainFSM) unsavedRecords() map[string][]byte {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	records := make(map[string][]byte, len(f.logEntries)+len(f.simpleMessages))
+	for i, entry := range f.logEntries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			panic(fmt.Sprintf("fsm: failed to encode hash chain log entry %d: %v", f.savedLog+i, err))
+		}
+		records[hashChainRecordKey(hashChainLogPrefix, f.savedLog+i)] = data
+	}
+	for i, message := range f.simpleMessages {
+		records[hashChainRecordKey(hashChainMessagePrefix, f.savedMessages+i)] = []byte(message)
+	}
+	return records
+}
+
+// markSaved releases the log entries and messages the store now holds; they are read back through stored
+func (f *HashChainFSM) markSaved() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.savedLog += len(f.logEntries)
+	f.savedMessages += len(f.simpleMessages)
+	f.logEntries = make([]*models.LogEntry, 0)
+	f.simpleMessages = make([]string, 0)
+}
+
+// logEntryAt returns the log entry at a position (< logCount; caller must hold the lock)
+// Entries returned are shared and must not be modified.
+func (f *HashChainFSM) logEntryAt(pos int) *models.LogEntry {
+	if pos >= f.savedLog {
+		return f.logEntries[pos-f.savedLog]
+	}
+	return decodeStoredLogEntry(f.stored, pos)
+}
+
+// messageAt returns the simple message at a position (< messageCount; caller must hold the lock)
+func (f *HashChainFSM) messageAt(pos int) string {
+	if pos >= f.savedMessages {
+		return f.simpleMessages[pos-f.savedMessages]
+	}
+	return string(storedHashChainRecord(f.stored, hashChainMessagePrefix, pos))
+}
+
+// logCount returns the number of log entries (caller must hold the lock)
+func (f *HashChainFSM) logCount() int {
+	return f.savedLog + len(f.logEntries)
+}
+
+// messageCount returns the number of simple messages (caller must hold the lock)
+func (f *HashChainFSM) messageCount() int {
+	return f.savedMessages + len(f.simpleMessages)
+}
+
+// storedHashChainRecord reads a stored log entry or message; the store is written only by commits,
+// so a position below the saved count that is missing is corruption
+func storedHashChainRecord(stored func(key string) []byte, prefix string, pos int) []byte {
+	data := stored(hashChainRecordKey(prefix, pos))
+	if data == nil {
+		panic(fmt.Sprintf("fsm: hash chain record %s%d missing from the FSM store", prefix, pos))
+	}
+	return data
+}
+
+// decodeStoredLogEntry reads and decodes a stored log entry
+func decodeStoredLogEntry(stored func(key string) []byte, pos int) *models.LogEntry {
+	var entry models.LogEntry
+	if err := json.Unmarshal(storedHashChainRecord(stored, hashChainLogPrefix, pos), &entry); err != nil {
+		panic(fmt.Sprintf("fsm: corrupt hash chain log entry %d in the FSM store: %v", pos, err))
+	}
+	return &entry
+}
+
 // GetLatestAttestation returns the latest committed attestation
 func (f *HashChainFSM) GetLatestAttestation() (*models.AttestationResponse, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	if len(f.attestations) == 0 {
+	if f.latest == nil {
 		return nil, fmt.Errorf("no attestations committed yet")
 	}
 
 	// Return a copy to avoid race conditions
-	latest := f.attestations[len(f.attestations)-1]
+	latest := f.latest
 	
 	// Create a deep copy by serializing and deserializing
 	data, err := latest.ToJSON()
@@ -185,12 +352,12 @@ func (f *HashChainFSM) GetLogEntry(index uint64) (*models.LogEntry, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	if index == 0 || index > uint64(len(f.logEntries)) {
+	if index == 0 || index > uint64(f.logCount()) {
 		return nil, fmt.Errorf("invalid log index: %d (valid range: 1-%d)",
-			index, len(f.logEntries))
+			index, f.logCount())
 	}
 
-	entry := f.logEntries[index-1]
+	entry := f.logEntryAt(int(index - 1))
 	
 	// Return a copy
 	data, err := entry.ToBytes()
@@ -210,7 +377,7 @@ func (f *HashChainFSM) GetLogEntry(index uint64) (*models.LogEntry, error) {
 func (f *HashChainFSM) GetLogCount() uint64 {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
-	return uint64(len(f.logEntries))
+	return uint64(f.logCount())
 }
 
 // GetAllLogs returns all log entries (for simple string messages)
@@ -237,9 +404,9 @@ func (f *HashChainFSM) GetAllLogEntries() []*models.LogEntry {
 	defer f.mu.RUnlock()
 	
 	// Return copies to avoid race conditions
-	entries := make([]*models.LogEntry, 0, len(f.logEntries))
-	for _, entry := range f.logEntries {
-		data, err := entry.ToBytes()
+	entries := make([]*models.LogEntry, 0, f.logCount())
+	for pos := 0; pos < f.logCount(); pos++ {
+		data, err := f.logEntryAt(pos).ToBytes()
 		if err != nil {
 			continue
 		}
@@ -258,8 +425,10 @@ func (f *HashChainFSM) GetSimpleMessages() []string {
 	defer f.mu.RUnlock()
 	
 	// Return a copy
-	messages := make([]string, len(f.simpleMessages))
-	copy(messages, f.simpleMessages)
+	messages := make([]string, f.messageCount())
+	for pos := range messages {
+		messages[pos] = f.messageAt(pos)
+	}
 	return messages
 }
 
@@ -268,12 +437,11 @@ func (f *HashChainFSM) GetChainHeadHash() (string, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	if len(f.attestations) == 0 {
+	if f.latest == nil {
 		return f.genesisHash, nil
 	}
 
-	latest := f.attestations[len(f.attestations)-1]
-	return latest.ComputeHash()
+	return f.latest.ComputeHash()
 }
 
 // GetGenesisHash returns the genesis hash
@@ -298,14 +466,20 @@ func (f *HashChainFSM) VerifyChainIntegrity() error {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	if len(f.attestations) == 0 {
+	if f.latest == nil {
 		return nil // Empty chain is valid
 	}
 
 	// Start from genesis
 	expectedPrevHash := f.genesisHash
 
-	for i, attestation := range f.attestations {
+	// The attestations are those of the log entries, read one at a time
+	var prevAttestation *models.AttestationResponse
+	for pos, i := 0, 0; pos < f.logCount(); pos++ {
+		attestation := f.logEntryAt(pos).Attestation
+		if attestation == nil {
+			continue
+		}
 		payload, err := attestation.GetChainedPayload()
 		if err != nil {
 			return fmt.Errorf("entry %d: failed to get payload: %v", i, err)
@@ -326,7 +500,7 @@ func (f *HashChainFSM) VerifyChainIntegrity() error {
 
 		// Verify sequence monotonicity (except for first entry)
 		if i > 0 {
-			prevPayload, err := f.attestations[i-1].GetChainedPayload()
+			prevPayload, err := prevAttestation.GetChainedPayload()
 			if err != nil {
 				return fmt.Errorf("entry %d: failed to get previous payload: %v", i, err)
 			}
@@ -341,36 +515,153 @@ func (f *HashChainFSM) VerifyChainIntegrity() error {
 					i, payload.LMSIndex, prevPayload.LMSIndex)
 			}
 		}
+		prevAttestation = attestation
+		i++
 	}
 
 	return nil
 }
 
+// hashChainSnapshotData is the decoded state of a hash chain snapshot
+// Snapshots also list the attestations, which are those of the log entries; a restore derives them instead.
+type hashChainSnapshotData struct {
+	LogEntries     []*models.LogEntry
+	SimpleMessages []string
+	GenesisHash    string
+}
+
+// decodeMember decodes one member of a snapshot: attestations, log_entries, simple_messages or genesis_hash
+func (d *hashChainSnapshotData) decodeMember(name string, dec *json.Decoder) error {
+	switch name {
+	case "log_entries":
+		return decodeArray(dec, func() error {
+			var entry models.LogEntry
+			if err := dec.Decode(&entry); err != nil {
+				return err
+			}
+			d.LogEntries = append(d.LogEntries, &entry)
+			return nil
+		})
+	case "simple_messages":
+		return decodeArray(dec, func() error {
+			var message string
+			if err := dec.Decode(&message); err != nil {
+				return err
+			}
+			d.SimpleMessages = append(d.SimpleMessages, message)
+			return nil
+		})
+	case "genesis_hash":
+		return dec.Decode(&d.GenesisHash)
+	}
+	return skipValue(dec)
+}
+
 // hashChainSnapshot represents a snapshot of the FSM state
 type hashChainSnapshot struct {
-	attestations []*models.AttestationResponse
-	logEntries   []*models.LogEntry
-	genesisHash  string
+	logEntries     []*models.LogEntry // Entries from position savedLog on
+	simpleMessages []string           // Messages from position savedMessages on
+	genesisHash    string
+
+	// Entries and messages before these positions are read from stored (a CombinedFSM store view)
+	savedLog, savedMessages int
+	stored                  func(key string) []byte
 }
 
-func (s *hashChainSnapshot) Persist(sink raft.SnapshotSink) error {
-	// Serialize snapshot data
-	snapshotData := struct {
-		Attestations []*models.AttestationResponse `json:"attestations"`
-		LogEntries   []*models.LogEntry            `json:"log_entries"`
-		GenesisHash  string                        `json:"genesis_hash"`
-	}{
-		Attestations: s.attestations,
-		LogEntries:   s.logEntries,
-		GenesisHash:  s.genesisHash,
-	}
-
-	data, err := json.Marshal(snapshotData)
+// eachLogEntry calls fn for every log entry in order until it returns an error
+func (s *hashChainSnapshot) eachLogEntry(fn func(entry *models.LogEntry) error) error {
+	for pos := 0; pos < s.savedLog; pos++ {
+		if err := fn(decodeStoredLogEntry(s.stored, pos)); err != nil {
+			return err
+		}
+	}
+	for _, entry := range s.logEntries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTo streams the snapshot as JSON one entry at a time (also used by CombinedFSM):
+// {"attestations":[...],"log_entries":[...],"simple_messages":[...],"genesis_hash":"..."}
+func (s *hashChainSnapshot) writeTo(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	writeList := func(name string, first bool, each func(fn func(v interface{}) error) error) error {
+		separator := ","
+		if first {
+			separator = "{"
+		}
+		if _, err := fmt.Fprintf(w, `%s%q:[`, separator, name); err != nil {
+			return err
+		}
+		count := 0
+		err := each(func(v interface{}) error {
+			if count > 0 {
+				if _, err := io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			count++
+			return encoder.Encode(v)
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, "]")
+		return err
+	}
+
+	err := writeList("attestations", true, func(fn func(v interface{}) error) error {
+		return s.eachLogEntry(func(entry *models.LogEntry) error {
+			if entry.Attestation == nil {
+				return nil
+			}
+			return fn(entry.Attestation)
+		})
+	})
+	if err == nil {
+		err = writeList("log_entries", false, func(fn func(v interface{}) error) error {
+			return s.eachLogEntry(func(entry *models.LogEntry) error {
+				return fn(entry)
+			})
+		})
+	}
+	if err == nil && s.savedMessages+len(s.simpleMessages) > 0 {
+		err = writeList("simple_messages", false, func(fn func(v interface{}) error) error {
+			for pos := 0; pos < s.savedMessages; pos++ {
+				if err := fn(string(storedHashChainRecord(s.stored, hashChainMessagePrefix, pos))); err != nil {
+					return err
+				}
+			}
+			for _, message := range s.simpleMessages {
+				if err := fn(message); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
 	if err != nil {
-		return fmt.Errorf("failed to marshal snapshot: %v", err)
+		return err
 	}
 
-	if _, err := sink.Write(data); err != nil {
+	genesisHash, err := json.Marshal(s.genesisHash)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, `,"genesis_hash":%s}`, genesisHash)
+	return err
+}
+
+func (s *hashChainSnapshot) Persist(sink raft.SnapshotSink) error {
+	w := bufio.NewWriter(sink)
+	err := s.writeTo(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		sink.Cancel()
 		return fmt.Errorf("failed to write snapshot: %v", err)
 	}
 
@@ -378,6 +669,5 @@ func (s *hashChainSnapshot) Persist(sink raft.SnapshotSink) error {
 }
 
 func (s *hashChainSnapshot) Release() {
-	// No cleanup needed for in-memory snapshot
+	// Store views are released by the key index snapshot they belong to
 }
-
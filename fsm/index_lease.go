@@ -0,0 +1,417 @@
+package fsm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// MaxLeaseSize is the largest index range a single reserve_range may lease
+const MaxLeaseSize = 1 << 16
+
+// LeaseDuration is how long a lease stays active without being returned, measured on the time the
+// leader appended the reserve_range command. Must be identical on every node.
+const LeaseDuration = 24 * time.Hour
+
+// LeaseHistoryCapacity is the number of returned and expired leases the key index FSM keeps
+// The lease closed first is evicted first. Must be identical on every node.
+const LeaseHistoryCapacity = 1000
+
+// Lease status values
+const (
+	LeaseActive   = "active"
+	LeaseReturned = "returned"
+	LeaseExpired  = "expired" // Not returned within LeaseDuration; used indices are unknown until a late return
+)
+
+// signatureDomainLeaseReturn separates lease return signatures from all other attestation signatures
+const signatureDomainLeaseReturn = "verifiable-state-chains/lms/key-index-lease-return/v1"
+
+// RangeLeaseRequest asks the FSM to lease count consecutive indices of a pubkey_hash to an HSM instance
+// The lease extends the chain head previous_hash (genesis hash for a new key) and is rejected once it has moved
+type RangeLeaseRequest struct {
+	KeyID        string `json:"key_id"`
+	PubkeyHash   string `json:"pubkey_hash"`
+	PreviousHash string `json:"previous_hash"`
+	HSMInstance  string `json:"hsm_instance"`
+	Count        uint64 `json:"count"`
+	PublicKey    string `json:"public_key"` // Base64 encoded attestation public key
+	Signature    string `json:"signature"`  // Attestation signature over the lease request
+}
+
+// ReserveRangeCommand is the Raft command wrapping a RangeLeaseRequest
+type ReserveRangeCommand struct {
+	Request RangeLeaseRequest `json:"reserve_range"`
+}
+
+// RangeReturnRequest returns a lease and reports which leased indices were used
+// Every leased index not listed in used is recorded as discarded; none are ever reissued
+type RangeReturnRequest struct {
+	LeaseID     string   `json:"lease_id"`
+	HSMInstance string   `json:"hsm_instance"`
+	Used        []uint64 `json:"used"` // Strictly ascending indices that produced signatures
+	PublicKey   string   `json:"public_key"`
+	Signature   string   `json:"signature"`
+}
+
+// ReturnRangeCommand is the Raft command wrapping a RangeReturnRequest
+type ReturnRangeCommand struct {
+	Request RangeReturnRequest `json:"return_range"`
+}
+
+// IndexLease is the FSM record of a leased index range
+type IndexLease struct {
+	LeaseID        string   `json:"lease_id"`
+	KeyID          string   `json:"key_id"`
+	PubkeyHash     string   `json:"pubkey_hash"`
+	HSMInstance    string   `json:"hsm_instance"`
+	AttestationKey string   `json:"attestation_key"` // Base64 attestation public key that took the lease
+	Start          uint64   `json:"start"`
+	End            uint64   `json:"end"` // Inclusive
+	Hash           string   `json:"hash"`
+	Status         string   `json:"status"`
+	RaftIndex      uint64   `json:"raft_index"`
+	ExpiresAt      int64    `json:"expires_at,omitempty"`  // Unix time (0: the command had no append time, never expires)
+	ReturnedAt     uint64   `json:"returned_at,omitempty"` // Raft index of the return_range
+	ExpiredAt      uint64   `json:"expired_at,omitempty"`  // Raft index of the lease command that expired it
+	Used           []uint64 `json:"used,omitempty"`
+	Discarded      []uint64 `json:"discarded,omitempty"`
+}
+
+// clone returns a deep copy of the lease
+func (l *IndexLease) clone() *IndexLease {
+	leaseCopy := *l
+	leaseCopy.Used = append([]uint64(nil), l.Used...)
+	leaseCopy.Discarded = append([]uint64(nil), l.Discarded...)
+	return &leaseCopy
+}
+
+// closedAt returns the Raft index at which the lease was returned or expired (0 while active)
+func (l *IndexLease) closedAt() uint64 {
+	if l.ReturnedAt != 0 {
+		return l.ReturnedAt
+	}
+	return l.ExpiredAt
+}
+
+// SigningDigest returns the digest signed by the attestation key for a lease request
+func (r *RangeLeaseRequest) SigningDigest() [32]byte {
+	return sha256.Sum256(rangeLeasePayload(r.KeyID, r.PubkeyHash, r.PreviousHash, r.HSMInstance, r.Count, r.PublicKey))
+}
+
+// SigningDigest returns the digest signed by the attestation key for a lease return
+func (r *RangeReturnRequest) SigningDigest() [32]byte {
+	fields := [][]byte{
+		[]byte(signatureDomainLeaseReturn),
+		[]byte(r.LeaseID),
+		[]byte(r.HSMInstance),
+		[]byte(r.PublicKey),
+	}
+	for _, index := range r.Used {
+		indexBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(indexBytes, index)
+		fields = append(fields, indexBytes)
+	}
+	return sha256.Sum256(appendLengthPrefixed(make([]byte, 0, 256), fields...))
+}
+
+// SignRangeLease signs a lease request with the attestation private key
+func SignRangeLease(req *RangeLeaseRequest, privKey crypto.Signer) error {
+	pubKey, err := attestationPublicKey(privKey)
+	if err != nil {
+		return err
+	}
+	publicKey, _, err := encodeAttestationKey(pubKey)
+	if err != nil {
+		return err
+	}
+	req.PublicKey = publicKey
+
+	digest := req.SigningDigest()
+	signature, err := privKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("failed to sign lease request: %v", err)
+	}
+	req.Signature = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+// SignRangeReturn signs a lease return with the attestation private key
+func SignRangeReturn(req *RangeReturnRequest, privKey crypto.Signer) error {
+	pubKey, err := attestationPublicKey(privKey)
+	if err != nil {
+		return err
+	}
+	publicKey, _, err := encodeAttestationKey(pubKey)
+	if err != nil {
+		return err
+	}
+	req.PublicKey = publicKey
+
+	digest := req.SigningDigest()
+	signature, err := privKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("failed to sign lease return: %v", err)
+	}
+	req.Signature = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+// verifyAttestationDigest verifies a base64 signature over a digest with a base64 PKIX public key
+func verifyAttestationDigest(publicKey, signature string, digest [32]byte) error {
+	pubKey, err := parseEntryPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %v", err)
+	}
+	if !ecdsa.VerifyASN1(pubKey, digest[:], sigBytes) {
+		return fmt.Errorf("signature verification failed: ECDSA verify returned false")
+	}
+	return nil
+}
+
+// isReserveRangeCommand reports whether raw log data is a reserve_range command
+func isReserveRangeCommand(data []byte) bool {
+	var probe struct {
+		Request json.RawMessage `json:"reserve_range"`
+	}
+	return json.Unmarshal(data, &probe) == nil && len(probe.Request) > 0
+}
+
+// isReturnRangeCommand reports whether raw log data is a return_range command
+func isReturnRangeCommand(data []byte) bool {
+	var probe struct {
+		Request json.RawMessage `json:"return_range"`
+	}
+	return json.Unmarshal(data, &probe) == nil && len(probe.Request) > 0
+}
+
+// applyReserveRange leases the next count indices of a pubkey_hash (caller must hold the lock)
+// A "reserve_range" chain entry at the end of the range moves the head past every leased index,
+// so no other reservation or commit can ever reuse them
+func (f *KeyIndexFSM) applyReserveRange(l *raft.Log) interface{} {
+	var cmd ReserveRangeCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return fmt.Sprintf("Error: Failed to parse reserve_range command: %v", err)
+	}
+	req := cmd.Request
+
+	if req.KeyID == "" || req.PubkeyHash == "" || req.HSMInstance == "" {
+		return "Error: key_id, pubkey_hash and hsm_instance are required for reserve_range"
+	}
+	if req.Count == 0 || req.Count > MaxLeaseSize {
+		return fmt.Sprintf("Error: Lease count %d out of range (1..%d)", req.Count, MaxLeaseSize)
+	}
+	f.expireLeases(l)
+
+	if err := verifyAttestationDigest(req.PublicKey, req.Signature, req.SigningDigest()); err != nil {
+		return fmt.Sprintf("Error: Signature verification failed: %v", err)
+	}
+	if err := f.authorizeKey(req.PublicKey); err != nil {
+		return fmt.Sprintf("Error: Unauthorized attestation key: %v", err)
+	}
+
+	entry := KeyIndexEntry{
+		KeyID:        req.KeyID,
+		PubkeyHash:   req.PubkeyHash,
+		PreviousHash: req.PreviousHash,
+		Signature:    req.Signature,
+		PublicKey:    req.PublicKey,
+		RecordType:   "reserve_range",
+		HSMInstance:  req.HSMInstance,
+
+		SignatureVersion: SignatureVersionLease,
+	}
+	head := GenesisHash
+	if currentIndex, exists := f.pubkeyHashIndices[req.PubkeyHash]; exists {
+		head = f.pubkeyHashHashes[req.PubkeyHash]
+		entry.LeaseStart = currentIndex + 1
+	}
+	if req.PreviousHash != head {
+		return fmt.Sprintf("Error: Lease head mismatch for pubkey_hash %s: signed previous_hash %s, current head %s",
+			req.PubkeyHash, req.PreviousHash, head)
+	}
+	entry.Index = entry.LeaseStart + req.Count - 1
+
+	state, err := f.checkLifecycle(&entry, l.Index)
+	if err != nil {
+		return fmt.Sprintf("Error: Lifecycle violation for pubkey_hash %s: %v", entry.PubkeyHash, err)
+	}
+
+	hash, err := entry.ComputeHash()
+	if err != nil {
+		return fmt.Sprintf("Error: Failed to compute hash: %v", err)
+	}
+	entry.Hash = hash
+
+	f.storeEntry(&entry, l.Index, state)
+
+	lease := &IndexLease{
+		LeaseID:        fmt.Sprintf("lease-%d", l.Index),
+		KeyID:          entry.KeyID,
+		PubkeyHash:     entry.PubkeyHash,
+		HSMInstance:    entry.HSMInstance,
+		AttestationKey: entry.PublicKey,
+		Start:          entry.LeaseStart,
+		End:            entry.Index,
+		Hash:           entry.Hash,
+		Status:         LeaseActive,
+		RaftIndex:      l.Index,
+	}
+	if !l.AppendedAt.IsZero() {
+		lease.ExpiresAt = l.AppendedAt.Add(LeaseDuration).Unix()
+	}
+	f.leases[lease.LeaseID] = lease
+	f.markDirty(stateLeases, lease.LeaseID)
+
+	return lease.clone()
+}
+
+// applyReturnRange closes a lease and records used and discarded indices (caller must hold the lock)
+func (f *KeyIndexFSM) applyReturnRange(l *raft.Log) interface{} {
+	var cmd ReturnRangeCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return fmt.Sprintf("Error: Failed to parse return_range command: %v", err)
+	}
+	req := cmd.Request
+	f.expireLeases(l)
+
+	lease, exists := f.leases[req.LeaseID]
+	if !exists {
+		return fmt.Sprintf("Error: Lease %s not found", req.LeaseID)
+	}
+	// An expired lease may still be returned by its holder to record which indices it used
+	if lease.Status == LeaseReturned {
+		return fmt.Sprintf("Error: Lease %s is already %s", req.LeaseID, lease.Status)
+	}
+	if req.HSMInstance != lease.HSMInstance {
+		return fmt.Sprintf("Error: Lease %s is held by %s, not %s", req.LeaseID, lease.HSMInstance, req.HSMInstance)
+	}
+
+	if err := verifyAttestationDigest(req.PublicKey, req.Signature, req.SigningDigest()); err != nil {
+		return fmt.Sprintf("Error: Signature verification failed: %v", err)
+	}
+	if err := f.authorizeKey(req.PublicKey); err != nil {
+		return fmt.Sprintf("Error: Unauthorized attestation key: %v", err)
+	}
+	// Only the attestation key that took the lease may report its used indices
+	returnedBy, err := AttestationKeyFingerprint(req.PublicKey)
+	if err != nil {
+		return fmt.Sprintf("Error: Invalid attestation key: %v", err)
+	}
+	takenBy, err := AttestationKeyFingerprint(lease.AttestationKey)
+	if err != nil || returnedBy != takenBy {
+		return fmt.Sprintf("Error: Lease %s was not taken by attestation key %s", req.LeaseID, returnedBy)
+	}
+
+	for i, index := range req.Used {
+		if index < lease.Start || index > lease.End {
+			return fmt.Sprintf("Error: Used index %d is outside lease %s [%d, %d]", index, req.LeaseID, lease.Start, lease.End)
+		}
+		if i > 0 && index <= req.Used[i-1] {
+			return "Error: Used indices must be strictly ascending"
+		}
+	}
+
+	discarded := make([]uint64, 0, lease.End-lease.Start+1-uint64(len(req.Used)))
+	next := 0
+	for index := lease.Start; index <= lease.End; index++ {
+		if next < len(req.Used) && req.Used[next] == index {
+			next++
+			continue
+		}
+		discarded = append(discarded, index)
+	}
+
+	lease.Status = LeaseReturned
+	lease.ReturnedAt = l.Index
+	lease.ExpiredAt = 0
+	lease.Used = append([]uint64(nil), req.Used...)
+	lease.Discarded = discarded
+	f.markDirty(stateLeases, lease.LeaseID)
+	result := lease.clone()
+	f.pruneLeases()
+
+	return result
+}
+
+// expireLeases closes the active leases whose LeaseDuration passed before a lease command was appended
+// (caller must hold the lock). The HSM instance holding one is gone or stopped returning it; the chain head
+// is past its range, so its indices are never issued again, whether or not they were used. Expired leases
+// count towards LeaseHistoryCapacity, so abandoned ranges do not accumulate.
+func (f *KeyIndexFSM) expireLeases(l *raft.Log) {
+	if l.AppendedAt.IsZero() {
+		return
+	}
+	now := l.AppendedAt.Unix()
+	expired := false
+	for _, lease := range f.leases {
+		if lease.Status == LeaseActive && lease.ExpiresAt != 0 && now >= lease.ExpiresAt {
+			lease.Status = LeaseExpired
+			lease.ExpiredAt = l.Index
+			f.markDirty(stateLeases, lease.LeaseID)
+			expired = true
+		}
+	}
+	if expired {
+		f.pruneLeases()
+	}
+}
+
+// pruneLeases evicts the earliest closed leases beyond LeaseHistoryCapacity (caller must hold the lock)
+func (f *KeyIndexFSM) pruneLeases() {
+	closed := make([]*IndexLease, 0)
+	for _, lease := range f.leases {
+		if lease.Status != LeaseActive {
+			closed = append(closed, lease)
+		}
+	}
+	if len(closed) <= LeaseHistoryCapacity {
+		return
+	}
+
+	sort.Slice(closed, func(i, j int) bool {
+		if closed[i].closedAt() != closed[j].closedAt() {
+			return closed[i].closedAt() < closed[j].closedAt()
+		}
+		return closed[i].RaftIndex < closed[j].RaftIndex
+	})
+	for _, lease := range closed[:len(closed)-LeaseHistoryCapacity] {
+		delete(f.leases, lease.LeaseID)
+		f.markDirty(stateLeases, lease.LeaseID)
+	}
+}
+
+// GetLeases returns leases for a pubkey_hash (all pubkey_hashes if empty), ordered by Raft index
+func (f *KeyIndexFSM) GetLeases(pubkeyHash string, activeOnly bool) []*IndexLease {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	result := make([]*IndexLease, 0)
+	for _, lease := range f.leases {
+		if pubkeyHash != "" && lease.PubkeyHash != pubkeyHash {
+			continue
+		}
+		if activeOnly && lease.Status != LeaseActive {
+			continue
+		}
+		result = append(result, lease.clone())
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].RaftIndex < result[j].RaftIndex
+	})
+	return result
+}
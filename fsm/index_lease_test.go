@@ -0,0 +1,263 @@
+package fsm
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func applyLeaseCommand(f raft.FSM, raftIndex uint64, cmd interface{}) interface{} {
+	return applyLeaseCommandAt(f, raftIndex, time.Time{}, cmd)
+}
+
+// applyLeaseCommandAt applies a lease command the leader appended at appendedAt
+func applyLeaseCommandAt(f raft.FSM, raftIndex uint64, appendedAt time.Time, cmd interface{}) interface{} {
+	cmdType := CommandReserveRange
+	if _, isReturn := cmd.(ReturnRangeCommand); isReturn {
+		cmdType = CommandReturnRange
+	}
+	data := testLogData(f, cmdType, cmd)
+	return f.Apply(&raft.Log{Type: raft.LogCommand, Index: raftIndex, Term: 1, Data: data, AppendedAt: appendedAt})
+}
+
+func reserveTestRange(t *testing.T, f raft.FSM, privKey *ecdsa.PrivateKey, raftIndex uint64, pubkeyHash, instance string, count uint64) *IndexLease {
+	t.Helper()
+
+	head := GenesisHash
+	if _, hash, exists := f.(interface {
+		GetIndexAndHashByPubkeyHash(pubkeyHash string) (uint64, string, bool)
+	}).GetIndexAndHashByPubkeyHash(pubkeyHash); exists {
+		head = hash
+	}
+
+	req := RangeLeaseRequest{KeyID: "key_a", PubkeyHash: pubkeyHash, PreviousHash: head, HSMInstance: instance, Count: count}
+	if err := SignRangeLease(&req, privKey); err != nil {
+		t.Fatalf("Failed to sign lease request: %v", err)
+	}
+	result := applyLeaseCommand(f, raftIndex, ReserveRangeCommand{Request: req})
+	lease, ok := result.(*IndexLease)
+	if !ok {
+		t.Fatalf("Expected lease, got: %v", result)
+	}
+	return lease
+}
+
+func returnTestRange(t *testing.T, f raft.FSM, privKey *ecdsa.PrivateKey, raftIndex uint64, leaseID, instance string, used []uint64) interface{} {
+	t.Helper()
+
+	req := RangeReturnRequest{LeaseID: leaseID, HSMInstance: instance, Used: used}
+	if err := SignRangeReturn(&req, privKey); err != nil {
+		t.Fatalf("Failed to sign lease return: %v", err)
+	}
+	return applyLeaseCommand(f, raftIndex, ReturnRangeCommand{Request: req})
+}
+
+func TestKeyIndexFSM_ReserveRange(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+
+	create := newTestEntry(t, privKey, "key_a", pubkeyHash, 0, GenesisHash, "create")
+	applyTestEntry(t, f, 1, create)
+
+	lease := reserveTestRange(t, f, privKey, 2, pubkeyHash, "hsm-1", 100)
+	if lease.Start != 1 || lease.End != 100 || lease.Status != LeaseActive || lease.LeaseID != "lease-2" {
+		t.Fatalf("Unexpected lease: %+v", lease)
+	}
+
+	// The chain head moves past the lease, so nothing else can reuse leased indices
+	inside := newTestEntry(t, privKey, "key_a", pubkeyHash, 50, lease.Hash, "sign")
+	if result := applyEntryResult(f, 3, inside); !strings.HasPrefix(result, "Error") {
+		t.Fatalf("Expected commit inside lease to be rejected, got: %s", result)
+	}
+	reserved := applyReservation(f, 4, newTestReservation(t, privKey, "key_a", pubkeyHash, lease.Hash, "sign")).(*IndexReservation)
+	if reserved.Index != 101 || reserved.PreviousHash != lease.Hash {
+		t.Fatalf("Expected reservation after lease at index 101, got %d", reserved.Index)
+	}
+
+	// A second instance gets a disjoint range
+	other := reserveTestRange(t, f, privKey, 5, pubkeyHash, "hsm-2", 10)
+	if other.Start != 102 || other.End != 111 {
+		t.Fatalf("Expected second lease [102, 111], got [%d, %d]", other.Start, other.End)
+	}
+
+	// A replayed lease request signed an old head and must not lease another range
+	replay := RangeLeaseRequest{KeyID: "key_a", PubkeyHash: pubkeyHash, PreviousHash: create.Hash, HSMInstance: "hsm-1", Count: 100}
+	SignRangeLease(&replay, privKey)
+	if result, _ := applyLeaseCommand(f, 6, ReserveRangeCommand{Request: replay}).(string); !strings.Contains(result, "head mismatch") {
+		t.Fatalf("Expected replayed lease to be rejected, got: %v", result)
+	}
+	if index, _ := f.GetIndexByPubkeyHash(pubkeyHash); index != 111 {
+		t.Fatalf("Expected head to stay at 111 after a replayed lease, got %d", index)
+	}
+
+	// Lease entries are verifiable chain entries
+	chain, _ := f.GetChainByPubkeyHash(pubkeyHash)
+	for _, entry := range chain {
+		if err := f.VerifySignature(entry); err != nil {
+			t.Fatalf("Chain entry at index %d does not verify: %v", entry.Index, err)
+		}
+	}
+
+	if active := f.GetLeases(pubkeyHash, true); len(active) != 2 {
+		t.Fatalf("Expected 2 active leases, got %d", len(active))
+	}
+}
+
+func TestKeyIndexFSM_ReturnRange(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+
+	applyTestEntry(t, f, 1, newTestEntry(t, privKey, "key_a", pubkeyHash, 0, GenesisHash, "create"))
+	lease := reserveTestRange(t, f, privKey, 2, pubkeyHash, "hsm-1", 5)
+	if lease.Start != 1 || lease.End != 5 {
+		t.Fatalf("Expected lease [1, 5], got [%d, %d]", lease.Start, lease.End)
+	}
+
+	// Only the holder can return the lease, and only with indices inside it
+	if result, _ := returnTestRange(t, f, privKey, 2, lease.LeaseID, "hsm-2", nil).(string); !strings.HasPrefix(result, "Error") {
+		t.Fatalf("Expected return by another instance to be rejected, got: %s", result)
+	}
+	if result, _ := returnTestRange(t, f, privKey, 3, lease.LeaseID, "hsm-1", []uint64{1, 6}).(string); !strings.HasPrefix(result, "Error") {
+		t.Fatalf("Expected out-of-range index to be rejected, got: %s", result)
+	}
+	if result, _ := returnTestRange(t, f, privKey, 4, lease.LeaseID, "hsm-1", []uint64{3, 2}).(string); !strings.HasPrefix(result, "Error") {
+		t.Fatalf("Expected unordered indices to be rejected, got: %s", result)
+	}
+
+	result := returnTestRange(t, f, privKey, 5, lease.LeaseID, "hsm-1", []uint64{1, 2, 4})
+	returned, ok := result.(*IndexLease)
+	if !ok {
+		t.Fatalf("Expected returned lease, got: %v", result)
+	}
+	if returned.Status != LeaseReturned || len(returned.Used) != 3 || len(returned.Discarded) != 2 ||
+		returned.Discarded[0] != 3 || returned.Discarded[1] != 5 {
+		t.Fatalf("Unexpected returned lease: %+v", returned)
+	}
+
+	if result, _ := returnTestRange(t, f, privKey, 6, lease.LeaseID, "hsm-1", nil).(string); !strings.HasPrefix(result, "Error") {
+		t.Fatalf("Expected double return to be rejected, got: %s", result)
+	}
+
+	// Leases survive snapshot and restore
+	data := persistSnapshot(t, f)
+	restored, _ := NewKeyIndexFSM("")
+	restored.PinAttestationKey(&privKey.PublicKey)
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	leases := restored.GetLeases(pubkeyHash, false)
+	if len(leases) != 1 || leases[0].Status != LeaseReturned || len(leases[0].Discarded) != 2 {
+		t.Fatalf("Lease state lost after restore: %+v", leases)
+	}
+}
+
+func TestKeyIndexFSM_ReturnRangeBoundToLeaseKey(t *testing.T) {
+	holder := generateTestKey(t)
+	other := generateTestKey(t)
+	admins := []*ecdsa.PrivateKey{generateTestKey(t), generateTestKey(t), generateTestKey(t)}
+	f := newRegistryTestFSM(t, holder, admins)
+	if result := applyRegistryResult(f, 2, newRegistryCommand(t, RegistryOpRegister, other, nil, 2, admins[0], admins[1])); strings.HasPrefix(result, "Error") {
+		t.Fatalf("Register rejected: %s", result)
+	}
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+
+	applyTestEntry(t, f, 3, newTestEntry(t, holder, "key_a", pubkeyHash, 0, GenesisHash, "create"))
+	lease := reserveTestRange(t, f, holder, 4, pubkeyHash, "hsm-1", 5)
+
+	// Another registered attestation key cannot report the lease's used indices
+	if result, _ := returnTestRange(t, f, other, 5, lease.LeaseID, "hsm-1", nil).(string); !strings.Contains(result, "was not taken by attestation key") {
+		t.Fatalf("Expected return by another attestation key to be rejected, got: %s", result)
+	}
+	if returned, ok := returnTestRange(t, f, holder, 6, lease.LeaseID, "hsm-1", []uint64{1}).(*IndexLease); !ok || returned.Status != LeaseReturned {
+		t.Fatalf("Expected the lease holder's return to be accepted, got: %v", returned)
+	}
+}
+
+func TestKeyIndexFSM_LeaseExpiry(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+	applyTestEntry(t, f, 1, newTestEntry(t, privKey, "key_a", pubkeyHash, 0, GenesisHash, "create"))
+
+	reserveAt := func(raftIndex uint64, appendedAt time.Time) *IndexLease {
+		_, head, _ := f.GetIndexAndHashByPubkeyHash(pubkeyHash)
+		req := RangeLeaseRequest{KeyID: "key_a", PubkeyHash: pubkeyHash, PreviousHash: head, HSMInstance: "hsm-1", Count: 5}
+		SignRangeLease(&req, privKey)
+		lease, ok := applyLeaseCommandAt(f, raftIndex, appendedAt, ReserveRangeCommand{Request: req}).(*IndexLease)
+		if !ok {
+			t.Fatalf("Expected lease at Raft index %d", raftIndex)
+		}
+		return lease
+	}
+
+	start := time.Unix(1700000000, 0)
+	abandoned := reserveAt(2, start)
+	if abandoned.ExpiresAt != start.Add(LeaseDuration).Unix() {
+		t.Fatalf("Expected lease to expire at %d, got %d", start.Add(LeaseDuration).Unix(), abandoned.ExpiresAt)
+	}
+
+	// A lease command appended before the expiry leaves the lease active
+	reserveAt(3, start.Add(LeaseDuration-time.Second))
+	if active := f.GetLeases(pubkeyHash, true); len(active) != 2 {
+		t.Fatalf("Expected 2 active leases, got %d", len(active))
+	}
+
+	// The first lease command appended after it expires the abandoned lease
+	reserveAt(4, start.Add(LeaseDuration))
+	leases := f.GetLeases(pubkeyHash, false)
+	if leases[0].LeaseID != abandoned.LeaseID || leases[0].Status != LeaseExpired || leases[0].ExpiredAt != 4 {
+		t.Fatalf("Expected %s to expire at Raft index 4, got %+v", abandoned.LeaseID, leases[0])
+	}
+	if active := f.GetLeases(pubkeyHash, true); len(active) != 2 {
+		t.Fatalf("Expected 2 active leases after the expiry, got %d", len(active))
+	}
+
+	// Its holder may still report the used indices, once
+	returned, ok := returnTestRange(t, f, privKey, 5, abandoned.LeaseID, "hsm-1", []uint64{1}).(*IndexLease)
+	if !ok || returned.Status != LeaseReturned || returned.ReturnedAt != 5 || len(returned.Discarded) != 4 {
+		t.Fatalf("Expected the late return to be recorded, got: %+v", returned)
+	}
+	if result, _ := returnTestRange(t, f, privKey, 6, abandoned.LeaseID, "hsm-1", nil).(string); !strings.Contains(result, "already returned") {
+		t.Fatalf("Expected a second return to be rejected, got: %s", result)
+	}
+}
+
+func TestKeyIndexFSM_LeaseHistoryPruned(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+	applyTestEntry(t, f, 1, newTestEntry(t, privKey, "key_a", pubkeyHash, 0, GenesisHash, "create"))
+
+	raftIndex := uint64(1)
+	var first *IndexLease
+	for i := 0; i <= LeaseHistoryCapacity; i++ {
+		raftIndex++
+		lease := reserveTestRange(t, f, privKey, raftIndex, pubkeyHash, "hsm-1", 1)
+		if first == nil {
+			first = lease
+		}
+		raftIndex++
+		if _, ok := returnTestRange(t, f, privKey, raftIndex, lease.LeaseID, "hsm-1", nil).(*IndexLease); !ok {
+			t.Fatalf("Return of %s rejected", lease.LeaseID)
+		}
+	}
+
+	leases := f.GetLeases(pubkeyHash, false)
+	if len(leases) != LeaseHistoryCapacity {
+		t.Fatalf("Expected %d closed leases kept, got %d", LeaseHistoryCapacity, len(leases))
+	}
+	if leases[0].LeaseID == first.LeaseID {
+		t.Fatalf("Expected the earliest closed lease %s to be evicted", first.LeaseID)
+	}
+}
@@ -0,0 +1,98 @@
+package fsm
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/raft"
+)
+
+// ReserveIndexCommand asks the FSM to allocate the next index for a pubkey_hash
+// The entry carries key_id, pubkey_hash, the expected head as previous_hash, record_type, public_key and
+// a reservation signature; index and hash are assigned in Apply. A reservation whose head has moved is
+// rejected, so concurrent signers never share an index and a captured reservation cannot be replayed.
+type ReserveIndexCommand struct {
+	Entry KeyIndexEntry `json:"reserve_index"`
+}
+
+// IndexReservation is the Apply result of a successful ReserveIndexCommand
+type IndexReservation struct {
+	KeyID        string `json:"key_id"`
+	PubkeyHash   string `json:"pubkey_hash"`
+	Index        uint64 `json:"index"`
+	PreviousHash string `json:"previous_hash"`
+	Hash         string `json:"hash"`
+	RaftIndex    uint64 `json:"raft_index"`
+	RaftTerm     uint64 `json:"raft_term"`
+}
+
+// isReserveCommand reports whether raw log data is a reserve_index command
+func isReserveCommand(data []byte) bool {
+	var probe struct {
+		Entry json.RawMessage `json:"reserve_index"`
+	}
+	return json.Unmarshal(data, &probe) == nil && len(probe.Entry) > 0
+}
+
+// applyReserveIndex allocates the next index for a pubkey_hash (caller must hold the lock)
+func (f *KeyIndexFSM) applyReserveIndex(l *raft.Log) interface{} {
+	var cmd ReserveIndexCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return fmt.Sprintf("Error: Failed to parse reserve_index command: %v", err)
+	}
+	entry := cmd.Entry
+
+	if entry.KeyID == "" || entry.PubkeyHash == "" {
+		return "Error: key_id and pubkey_hash are required for reserve_index"
+	}
+	if entry.SignatureVersion != SignatureVersionReserve {
+		return fmt.Sprintf("Error: reserve_index requires signature_version %d, got %d",
+			SignatureVersionReserve, entry.SignatureVersion)
+	}
+	// Lease fields are hashed but not covered by the reservation signature
+	if entry.LeaseStart != 0 || entry.HSMInstance != "" {
+		return "Error: lease_start and hsm_instance are only valid on reserve_range entries"
+	}
+
+	if err := f.verifySignature(&entry); err != nil {
+		return fmt.Sprintf("Error: Signature verification failed: %v", err)
+	}
+	if err := f.authorizeKey(entry.PublicKey); err != nil {
+		return fmt.Sprintf("Error: Unauthorized attestation key: %v", err)
+	}
+
+	// Allocate: next index after the signed head, or 0 for a new pubkey_hash
+	head := GenesisHash
+	entry.Index = 0
+	if currentIndex, exists := f.pubkeyHashIndices[entry.PubkeyHash]; exists {
+		head = f.pubkeyHashHashes[entry.PubkeyHash]
+		entry.Index = currentIndex + 1
+	}
+	if entry.PreviousHash != head {
+		return fmt.Sprintf("Error: Reservation head mismatch for pubkey_hash %s: signed previous_hash %s, current head %s",
+			entry.PubkeyHash, entry.PreviousHash, head)
+	}
+
+	state, err := f.checkLifecycle(&entry, l.Index)
+	if err != nil {
+		return fmt.Sprintf("Error: Lifecycle violation for pubkey_hash %s: %v", entry.PubkeyHash, err)
+	}
+
+	hash, err := entry.ComputeHash()
+	if err != nil {
+		return fmt.Sprintf("Error: Failed to compute hash: %v", err)
+	}
+	entry.Hash = hash
+
+	f.storeEntry(&entry, l.Index, state)
+
+	return &IndexReservation{
+		KeyID:        entry.KeyID,
+		PubkeyHash:   entry.PubkeyHash,
+		Index:        entry.Index,
+		PreviousHash: entry.PreviousHash,
+		Hash:         entry.Hash,
+		RaftIndex:    l.Index,
+		RaftTerm:     l.Term,
+	}
+}
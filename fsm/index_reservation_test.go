@@ -0,0 +1,128 @@
+package fsm
+
+import (
+	"crypto/ecdsa"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+// newTestReservation builds a signed reserve_index command extending the head previousHash
+func newTestReservation(t *testing.T, privKey *ecdsa.PrivateKey, keyID, pubkeyHash, previousHash, recordType string) *ReserveIndexCommand {
+	t.Helper()
+
+	cmd := &ReserveIndexCommand{Entry: KeyIndexEntry{KeyID: keyID, PubkeyHash: pubkeyHash, PreviousHash: previousHash, RecordType: recordType}}
+	if recordType == "create" {
+		cmd.Entry.LMSParams = testKeyParams()
+	}
+	if err := SignReservation(&cmd.Entry, privKey); err != nil {
+		t.Fatalf("Failed to sign reservation: %v", err)
+	}
+	return cmd
+}
+
+func applyReservation(f raft.FSM, raftIndex uint64, cmd *ReserveIndexCommand) interface{} {
+	data := testLogData(f, CommandReserveIndex, cmd)
+	return f.Apply(&raft.Log{Type: raft.LogCommand, Index: raftIndex, Term: 3, Data: data})
+}
+
+func TestKeyIndexFSM_ReserveIndex(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+
+	// First reservation creates the chain at index 0 with the genesis hash
+	result := applyReservation(f, 10, newTestReservation(t, privKey, "key_a", pubkeyHash, GenesisHash, "create"))
+	first, ok := result.(*IndexReservation)
+	if !ok {
+		t.Fatalf("Expected reservation, got: %v", result)
+	}
+	if first.Index != 0 || first.PreviousHash != GenesisHash || first.RaftIndex != 10 || first.RaftTerm != 3 {
+		t.Fatalf("Unexpected first reservation: %+v", first)
+	}
+
+	// Reservations receive consecutive indices chained to the head they signed
+	cmd := newTestReservation(t, privKey, "key_a", pubkeyHash, first.Hash, "sign")
+	second := applyReservation(f, 11, cmd).(*IndexReservation)
+	third := applyReservation(f, 12, newTestReservation(t, privKey, "key_a", pubkeyHash, second.Hash, "sign")).(*IndexReservation)
+	if second.Index != 1 || third.Index != 2 {
+		t.Fatalf("Expected indices 1 and 2, got %d and %d", second.Index, third.Index)
+	}
+	if second.PreviousHash != first.Hash || third.PreviousHash != second.Hash {
+		t.Fatal("Reservations must extend the hash chain")
+	}
+
+	// A replayed reservation signed the old head and must not burn another index
+	if result, _ := applyReservation(f, 13, cmd).(string); !strings.Contains(result, "head mismatch") {
+		t.Fatalf("Expected replayed reservation to be rejected, got: %v", result)
+	}
+
+	// A regular commit continues after the reserved head
+	next := newTestEntry(t, privKey, "key_a", pubkeyHash, 3, third.Hash, "sign")
+	applyTestEntry(t, f, 14, next)
+	if fourth := applyReservation(f, 15, newTestReservation(t, privKey, "key_a", pubkeyHash, next.Hash, "sign")).(*IndexReservation); fourth.Index != 4 {
+		t.Fatalf("Expected index 4 after regular commit, got %d", fourth.Index)
+	}
+
+	chain, _ := f.GetChainByPubkeyHash(pubkeyHash)
+	if len(chain) != 5 {
+		t.Fatalf("Expected 5 chain entries, got %d", len(chain))
+	}
+}
+
+func TestKeyIndexFSM_ReserveIndexRejectsBadSignatures(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+
+	// Tampered reservation
+	cmd := newTestReservation(t, privKey, "key_a", pubkeyHash, GenesisHash, "sign")
+	cmd.Entry.PubkeyHash = ComputePubkeyHash([]byte("pk_b"))
+	if result, _ := applyReservation(f, 1, cmd).(string); !strings.HasPrefix(result, "Error") {
+		t.Fatalf("Expected tampered reservation to be rejected, got: %v", result)
+	}
+
+	// A full entry signature is not a reservation signature
+	entry := newTestEntry(t, privKey, "key_a", pubkeyHash, 0, GenesisHash, "create")
+	if result, _ := applyReservation(f, 2, &ReserveIndexCommand{Entry: *entry}).(string); !strings.HasPrefix(result, "Error") {
+		t.Fatalf("Expected v2 signature to be rejected by reserve_index, got: %v", result)
+	}
+
+	// A reservation signature does not bind index, so it cannot be used for a regular commit
+	reserve := newTestReservation(t, privKey, "key_a", pubkeyHash, GenesisHash, "create").Entry
+	reserve.Index = 0
+	reserve.Hash, _ = reserve.ComputeHash()
+	if result := applyEntryResult(f, 3, &reserve); !strings.HasPrefix(result, "Error") {
+		t.Fatalf("Expected reservation signature to be rejected for a regular commit, got: %s", result)
+	}
+
+	// Lease fields are outside the reservation signature
+	leased := newTestReservation(t, privKey, "key_a", pubkeyHash, GenesisHash, "create")
+	leased.Entry.LeaseStart = 5
+	leased.Entry.HSMInstance = "hsm-b"
+	if result, _ := applyReservation(f, 4, leased).(string); !strings.Contains(result, "lease_start and hsm_instance") {
+		t.Fatalf("Expected lease fields to be rejected by reserve_index, got: %v", result)
+	}
+
+	if _, exists := f.GetIndexByPubkeyHash(pubkeyHash); exists {
+		t.Fatal("Rejected reservations must not allocate an index")
+	}
+}
+
+func TestCombinedFSM_RoutesReserveIndex(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+
+	result := applyReservation(f, 1, newTestReservation(t, privKey, "key_a", pubkeyHash, GenesisHash, "create"))
+	if _, ok := result.(*IndexReservation); !ok {
+		t.Fatalf("Expected reservation from combined FSM, got: %v", result)
+	}
+	if f.GetLogCount() != 0 {
+		t.Fatal("reserve_index must not reach the hash chain FSM")
+	}
+}
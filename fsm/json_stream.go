@@ -0,0 +1,78 @@
+package fsm
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Snapshots are decoded as a stream: members and list elements are decoded one at a time as they are read,
+// so a restore never holds the raw snapshot, and entries go to the store without being collected first.
+
+// decodeObject reads a JSON object, calling member with the name of each member; member must decode its value
+func decodeObject(dec *json.Decoder, member func(name string) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		name, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("expected an object member name, got %v", token)
+		}
+		if err := member(name); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// decodeArray reads a JSON array (or null), calling element to decode each element
+func decodeArray(dec *json.Decoder, element func() error) error {
+	token, err := dec.Token()
+	if err != nil || token == nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected an array, got %v", token)
+	}
+	for dec.More() {
+		if err := element(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+// skipValue reads a JSON value without keeping it
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %v, got %v", delim, token)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package fsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// maxHSSLevels is the largest number of HSS levels (RFC 8554)
+const maxHSSLevels = 8
+
+// lmsTypeHeights maps lms_wrapper LMS type codes to tree heights
+// Mirrors lms_wrapper.GetLMSHeight so Raft nodes do not need the native hash-sigs library
+var lmsTypeHeights = map[int]uint{
+	5: 5,  // LMS_SHA256_M32_H5
+	6: 10, // LMS_SHA256_M32_H10
+	7: 15, // LMS_SHA256_M32_H15
+	8: 20, // LMS_SHA256_M32_H20
+	9: 25, // LMS_SHA256_M32_H25
+}
+
+// LMSParams is the HSS parameter set of a key, carried on its create record
+// LmType and OtsType use the lms_wrapper type codes, one per level
+type LMSParams struct {
+	Levels  int   `json:"levels"`
+	LmType  []int `json:"lm_type"`
+	OtsType []int `json:"ots_type"`
+}
+
+// Validate checks that the parameter set is well formed and uses known type codes
+func (p *LMSParams) Validate() error {
+	if p.Levels < 1 || p.Levels > maxHSSLevels {
+		return fmt.Errorf("levels %d out of range (1..%d)", p.Levels, maxHSSLevels)
+	}
+	if len(p.LmType) != p.Levels || len(p.OtsType) != p.Levels {
+		return fmt.Errorf("lm_type and ots_type must have %d entries", p.Levels)
+	}
+	for i := 0; i < p.Levels; i++ {
+		if _, ok := lmsTypeHeights[p.LmType[i]]; !ok {
+			return fmt.Errorf("unknown lm_type %d at level %d", p.LmType[i], i)
+		}
+		if p.OtsType[i] < 1 || p.OtsType[i] > 4 {
+			return fmt.Errorf("unknown ots_type %d at level %d", p.OtsType[i], i)
+		}
+	}
+	return nil
+}
+
+// MaxSignatures returns the number of one-time signatures of the key
+// (the product of lms_wrapper.GetMaxSignatures over all levels, saturating at MaxUint64)
+func (p *LMSParams) MaxSignatures() uint64 {
+	var totalHeight uint
+	for _, lmType := range p.LmType {
+		totalHeight += lmsTypeHeights[lmType]
+	}
+	if totalHeight >= 64 {
+		return math.MaxUint64
+	}
+	return uint64(1) << totalHeight
+}
+
+// signingBytes encodes the parameter set for attestation signatures
+// Layout: levels, then lm_type and ots_type per level, each as a 4-byte big-endian integer
+func (p *LMSParams) signingBytes() []byte {
+	encoded := binary.BigEndian.AppendUint32(make([]byte, 0, 4+8*len(p.LmType)), uint32(p.Levels))
+	for i := range p.LmType {
+		encoded = binary.BigEndian.AppendUint32(encoded, uint32(p.LmType[i]))
+		encoded = binary.BigEndian.AppendUint32(encoded, uint32(p.OtsType[i]))
+	}
+	return encoded
+}
+
+// clone returns a deep copy of the parameter set
+func (p *LMSParams) clone() *LMSParams {
+	if p == nil {
+		return nil
+	}
+	return &LMSParams{
+		Levels:  p.Levels,
+		LmType:  append([]int(nil), p.LmType...),
+		OtsType: append([]int(nil), p.OtsType...),
+	}
+}
+
+// Capacity returns the number of indices of the key (false if its parameters are unknown)
+func (l *KeyLifecycle) Capacity() (uint64, bool) {
+	if l.Params == nil {
+		return 0, false
+	}
+	return l.Params.MaxSignatures(), true
+}
+
+// checkCapacity rejects indices beyond the key's one-time signatures and detects exhaustion
+// Keys created without lms_params (before parameters were recorded) are not bounded
+func checkCapacity(params *LMSParams, recordType string, index uint64, state string) (string, error) {
+	if params == nil || recordType == "delete" {
+		// delete consumes no one-time signature and must stay possible on an exhausted key
+		return state, nil
+	}
+	capacity := params.MaxSignatures()
+	if index >= capacity {
+		return "", fmt.Errorf("index %d exceeds key capacity (%d one-time signatures)", index, capacity)
+	}
+	if index == capacity-1 {
+		return KeyStateExhausted, nil
+	}
+	return state, nil
+}
@@ -0,0 +1,177 @@
+package fsm
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"io"
+	"strings"
+	"testing"
+)
+
+// h5Params is a single-level H5 key with 32 one-time signatures
+func h5Params() *LMSParams {
+	return &LMSParams{Levels: 1, LmType: []int{5}, OtsType: []int{1}}
+}
+
+// testKeyParams is the single-level H25 key the test create records carry, large enough for any test index
+func testKeyParams() *LMSParams {
+	return &LMSParams{Levels: 1, LmType: []int{9}, OtsType: []int{1}}
+}
+
+// newTestCreateEntry builds a signed create entry carrying lms_params
+func newTestCreateEntry(t *testing.T, privKey *ecdsa.PrivateKey, keyID, pubkeyHash string, params *LMSParams) *KeyIndexEntry {
+	t.Helper()
+
+	entry := &KeyIndexEntry{
+		KeyID:        keyID,
+		PubkeyHash:   pubkeyHash,
+		Index:        0,
+		PreviousHash: GenesisHash,
+		RecordType:   "create",
+		LMSParams:    params,
+	}
+	if err := SignEntry(entry, privKey); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	hash, err := entry.ComputeHash()
+	if err != nil {
+		t.Fatalf("Failed to compute hash: %v", err)
+	}
+	entry.Hash = hash
+	return entry
+}
+
+func TestLMSParams_MaxSignatures(t *testing.T) {
+	tests := []struct {
+		params *LMSParams
+		want   uint64
+	}{
+		{h5Params(), 32},
+		{&LMSParams{Levels: 1, LmType: []int{6}, OtsType: []int{4}}, 1024},
+		{&LMSParams{Levels: 2, LmType: []int{8, 6}, OtsType: []int{4, 4}}, 1 << 30},
+		{&LMSParams{Levels: 3, LmType: []int{9, 9, 9}, OtsType: []int{1, 1, 1}}, 1<<64 - 1},
+	}
+	for _, tt := range tests {
+		if got := tt.params.MaxSignatures(); got != tt.want {
+			t.Errorf("MaxSignatures(%+v) = %d, want %d", tt.params, got, tt.want)
+		}
+	}
+
+	if err := (&LMSParams{Levels: 2, LmType: []int{5}, OtsType: []int{1}}).Validate(); err == nil {
+		t.Error("Expected mismatched levels to be rejected")
+	}
+	if err := (&LMSParams{Levels: 1, LmType: []int{4}, OtsType: []int{1}}).Validate(); err == nil {
+		t.Error("Expected unknown lm_type to be rejected")
+	}
+}
+
+func TestKeyCapacity_RejectsIndexBeyondCapacity(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_h5"))
+
+	create := newTestCreateEntry(t, privKey, "key_h5", pubkeyHash, h5Params())
+	applyTestEntry(t, f, 1, create)
+	if lifecycle, _ := f.GetKeyLifecycle(pubkeyHash); lifecycle.Params == nil {
+		t.Fatal("Expected lms_params recorded from the create entry")
+	}
+
+	// Index 40 does not exist for an H5 key, even within the sync window
+	beyond := newTestEntry(t, privKey, "key_h5", pubkeyHash, 40, create.Hash, "sync")
+	if result := applyEntryResult(f, 2, beyond); !strings.Contains(result, "exceeds key capacity") {
+		t.Fatalf("Expected index beyond capacity to be rejected, got: %s", result)
+	}
+
+	// The last index exhausts the key
+	last := newTestEntry(t, privKey, "key_h5", pubkeyHash, 31, create.Hash, "sync")
+	applyTestEntry(t, f, 3, last)
+	if lifecycle, _ := f.GetKeyLifecycle(pubkeyHash); lifecycle.State != KeyStateExhausted {
+		t.Fatalf("Expected state exhausted at the last index, got %s", lifecycle.State)
+	}
+	if result, _ := applyReservation(f, 4, newTestReservation(t, privKey, "key_h5", pubkeyHash, last.Hash, "sign")).(string); !strings.Contains(result, "exhausted") {
+		t.Fatalf("Expected reservation on exhausted key to be rejected, got: %s", result)
+	}
+
+	// delete consumes no one-time signature and stays possible
+	del := newTestEntry(t, privKey, "key_h5", pubkeyHash, 32, last.Hash, "delete")
+	applyTestEntry(t, f, 5, del)
+}
+
+func TestKeyCapacity_ParamsRequiredAfterCutover(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	f.SetLMSParamsCutover(2)
+
+	// Creates without lms_params are replayed up to the cutover; their keys have no known capacity
+	legacy := newTestCreateEntry(t, privKey, "key_legacy", ComputePubkeyHash([]byte("pk_legacy")), nil)
+	applyTestEntry(t, f, 2, legacy)
+	if lifecycle, _ := f.GetKeyLifecycle(legacy.PubkeyHash); lifecycle == nil || lifecycle.Params != nil {
+		t.Fatalf("Expected the legacy key created without lms_params, got %+v", lifecycle)
+	}
+
+	// After the cutover every create must carry them, whether committed or reserved
+	pubkeyHash := ComputePubkeyHash([]byte("pk_new"))
+	if result := applyEntryResult(f, 3, newTestCreateEntry(t, privKey, "key_new", pubkeyHash, nil)); !strings.Contains(result, "require lms_params") {
+		t.Fatalf("Expected a create without lms_params to be rejected, got: %s", result)
+	}
+	reservation := newTestReservation(t, privKey, "key_new", pubkeyHash, GenesisHash, "create")
+	reservation.Entry.LMSParams = nil
+	if err := SignReservation(&reservation.Entry, privKey); err != nil {
+		t.Fatalf("Failed to sign reservation: %v", err)
+	}
+	if result, _ := applyReservation(f, 4, reservation).(string); !strings.Contains(result, "require lms_params") {
+		t.Fatalf("Expected a reserved create without lms_params to be rejected, got: %v", result)
+	}
+	if _, exists := f.GetIndexByPubkeyHash(pubkeyHash); exists {
+		t.Fatal("Rejected creates must not start a chain")
+	}
+
+	// Records after a legacy create still need none
+	applyTestEntry(t, f, 5, newTestEntry(t, privKey, "key_legacy", legacy.PubkeyHash, 1, legacy.Hash, "sign"))
+}
+
+func TestKeyCapacity_ParamsBoundToCreate(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_bound"))
+
+	// The signature covers lms_params: inflating the capacity afterwards invalidates it
+	tampered := newTestCreateEntry(t, privKey, "key_bound", pubkeyHash, h5Params())
+	tampered.LMSParams.LmType[0] = 9
+	tampered.Hash, _ = tampered.ComputeHash()
+	if result := applyEntryResult(f, 1, tampered); !strings.Contains(result, "Signature verification failed") {
+		t.Fatalf("Expected tampered lms_params to be rejected, got: %s", result)
+	}
+
+	invalid := newTestCreateEntry(t, privKey, "key_bound", pubkeyHash, &LMSParams{Levels: 1, LmType: []int{5}, OtsType: []int{7}})
+	if result := applyEntryResult(f, 2, invalid); !strings.Contains(result, "invalid lms_params") {
+		t.Fatalf("Expected invalid lms_params to be rejected, got: %s", result)
+	}
+
+	create := newTestCreateEntry(t, privKey, "key_bound", pubkeyHash, h5Params())
+	applyTestEntry(t, f, 3, create)
+
+	sign := newTestEntry(t, privKey, "key_bound", pubkeyHash, 1, create.Hash, "sign")
+	sign.LMSParams = &LMSParams{Levels: 1, LmType: []int{9}, OtsType: []int{1}}
+	if err := SignEntry(sign, privKey); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	sign.Hash, _ = sign.ComputeHash()
+	if result := applyEntryResult(f, 4, sign); !strings.Contains(result, "only allowed on the create record") {
+		t.Fatalf("Expected lms_params on a sign record to be rejected, got: %s", result)
+	}
+
+	// Parameters survive a snapshot round trip
+	restored, _ := NewKeyIndexFSM("")
+	restored.PinAttestationKey(&privKey.PublicKey)
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(persistSnapshot(t, f)))); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	lifecycle, _ := restored.GetKeyLifecycle(pubkeyHash)
+	if capacity, known := lifecycle.Capacity(); !known || capacity != 32 {
+		t.Fatalf("Expected capacity 32 after restore, got %d (known=%v)", capacity, known)
+	}
+}
@@ -1,12 +1,11 @@
 package fsm
 
 import (
+	"bufio"
 	"crypto/ecdsa"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"io"
 	"os"
@@ -27,6 +26,22 @@ type KeyIndexEntry struct {
 	Signature    string `json:"signature"`     // Base64 encoded EC signature
 	PublicKey    string `json:"public_key"`    // Base64 encoded EC public key (for verification)
 	RecordType   string `json:"record_type"`   // Record type: "create", "sign", "sync", "delete"
+
+	SignatureVersion int `json:"signature_version,omitempty"` // Signature format (0/1: legacy key_id:index, 2: full entry)
+
+	// Range lease entries (record_type "reserve_range") cover indices [lease_start, index]
+	LeaseStart  uint64 `json:"lease_start,omitempty"`
+	HSMInstance string `json:"hsm_instance,omitempty"` // HSM instance holding the lease
+
+	// HSS parameter set, carried only on the create record; bounds the key's indices
+	LMSParams *LMSParams `json:"lms_params,omitempty"`
+}
+
+// clone returns a copy of the entry
+func (e *KeyIndexEntry) clone() *KeyIndexEntry {
+	entryCopy := *e
+	entryCopy.LMSParams = e.LMSParams.clone()
+	return &entryCopy
 }
 
 // ComputeHash computes the SHA-256 hash of the entry
@@ -41,6 +56,13 @@ func (e *KeyIndexEntry) ComputeHash() (string, error) {
 		Signature    string `json:"signature"`
 		PublicKey    string `json:"public_key"`
 		RecordType   string `json:"record_type"`
+
+		SignatureVersion int `json:"signature_version,omitempty"` // omitted for v1 so legacy hashes are unchanged
+
+		LeaseStart  uint64 `json:"lease_start,omitempty"`
+		HSMInstance string `json:"hsm_instance,omitempty"`
+
+		LMSParams *LMSParams `json:"lms_params,omitempty"`
 	}{
 		KeyID:        e.KeyID,
 		PubkeyHash:   e.PubkeyHash,
@@ -49,6 +71,13 @@ func (e *KeyIndexEntry) ComputeHash() (string, error) {
 		Signature:    e.Signature,
 		PublicKey:    e.PublicKey,
 		RecordType:   e.RecordType,
+
+		SignatureVersion: e.SignatureVersion,
+
+		LeaseStart:  e.LeaseStart,
+		HSMInstance: e.HSMInstance,
+
+		LMSParams: e.LMSParams,
 	}
 
 	jsonData, err := json.Marshal(tempEntry)
@@ -72,23 +101,52 @@ const GenesisHash = "00000000000000000000000000000000000000000000000000000000000
 // KeyIndexFSM stores pubkey_hash -> index mappings with EC signature verification and hash chain
 type KeyIndexFSM struct {
 	mu                sync.RWMutex
-	pubkeyHashIndices map[string]uint64           // pubkey_hash -> last used index
-	pubkeyHashHashes  map[string]string           // pubkey_hash -> hash of last entry (for hash chain validation)
-	pubkeyHashEntries map[string][]*KeyIndexEntry // pubkey_hash -> all entries (for full chain retrieval)
-	keyIdToPubkeyHash map[string]string           // key_id -> pubkey_hash (for lookup convenience, latest mapping)
-	attestationPubKey *ecdsa.PublicKey            // Public key for verifying signatures
-	entryToRaftIndex  map[string]uint64           // entry hash -> Raft log index (for chronological ordering)
+	pubkeyHashIndices map[string]uint64 // pubkey_hash -> last used index
+	pubkeyHashHashes  map[string]string // pubkey_hash -> hash of last entry (for hash chain validation)
+	keyIdToPubkeyHash map[string]string // key_id -> pubkey_hash (for lookup convenience, latest mapping)
+	attestationPubKey *ecdsa.PublicKey  // Pinned attestation key, the only one allowed to sign before the registry is bootstrapped
+
+	// v1SignatureCutover is the last Raft log index at which v1 (key_id:index) signatures are accepted
+	// 0 accepts no v1 signatures. Must be identical on every node so all replicas apply the same log the same way.
+	v1SignatureCutover uint64
+
+	// lmsParamsCutover is the last Raft log index at which create records without lms_params are accepted
+	// 0 requires lms_params on every create. Must be identical on every node so all replicas apply the same log the same way.
+	lmsParamsCutover uint64
+
+	registry        *attestationKeyRegistry // Replicated set of authorized attestation keys and its admin quorum
+	bootstrapQuorum *adminQuorum            // Configured admins signing the registry bootstrap command (nil: none)
+
+	leases    map[string]*IndexLease   // lease_id -> leased index range (reserve_range)
+	keyStates map[string]*KeyLifecycle // pubkey_hash -> lifecycle state
+
+	requests *requestDedup // Results of recent commits by client request ID (bounded, replicated)
+
+	store          Store                      // Every stored entry in apply order with its secondary indexes
+	dirty          map[string]map[string]bool // State records changed since the last store commit: bucket -> keys
+	entriesChanged chan struct{}              // Closed and replaced whenever entries are stored (wakes watchers)
+
+	tlog  *transparencyLog // RFC 6962 Merkle tree over all entries in Raft order (derived, rebuilt on restore)
+	state *stateTree       // Sparse Merkle tree of pubkey_hash -> latest index (derived, rebuilt on restore)
 }
 
 // NewKeyIndexFSM creates a new key index FSM
 // attestationPubKeyPath: Path to the attestation public key PEM file
 func NewKeyIndexFSM(attestationPubKeyPath string) (*KeyIndexFSM, error) {
+	store := NewMemoryStore()
 	fsm := &KeyIndexFSM{
 		pubkeyHashIndices: make(map[string]uint64),
 		pubkeyHashHashes:  make(map[string]string),
-		pubkeyHashEntries: make(map[string][]*KeyIndexEntry),
 		keyIdToPubkeyHash: make(map[string]string),
-		entryToRaftIndex:  make(map[string]uint64),
+		leases:            make(map[string]*IndexLease),
+		keyStates:         make(map[string]*KeyLifecycle),
+		requests:          newRequestDedup(RequestDedupCapacity),
+		store:             store,
+		dirty:             make(map[string]map[string]bool),
+		entriesChanged:    make(chan struct{}),
+
+		tlog:  newTransparencyLog(store),
+		state: newStateTree(store),
 	}
 
 	// Load attestation public key
@@ -100,6 +158,9 @@ func NewKeyIndexFSM(attestationPubKeyPath string) (*KeyIndexFSM, error) {
 		fsm.attestationPubKey = pubKey
 	}
 
+	// The registry is seeded by the replicated bootstrap command, not by node configuration
+	fsm.registry = newAttestationKeyRegistry()
+
 	return fsm, nil
 }
 
@@ -110,27 +171,25 @@ func loadAttestationPublicKey(path string) (*ecdsa.PublicKey, error) {
 		path = keysPath
 	}
 
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-
-	block, _ := pem.Decode(data)
-	if block == nil {
-		return nil, fmt.Errorf("failed to decode PEM")
-	}
-
-	pubKeyInterface, err := x509.ParsePKIXPublicKey(block.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse public key: %v", err)
-	}
+	return LoadECPublicKeyPEM(path)
+}
 
-	pubKey, ok := pubKeyInterface.(*ecdsa.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("not an ECDSA public key")
-	}
+// SetV1SignatureCutover sets the last Raft log index at which v1 signatures are accepted
+// Entries with legacy v1 signatures at later log positions are rejected. The default 0 rejects every
+// v1 entry; clusters whose log holds v1 entries set the Raft index of the last one.
+func (f *KeyIndexFSM) SetV1SignatureCutover(raftIndex uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.v1SignatureCutover = raftIndex
+}
 
-	return pubKey, nil
+// SetLMSParamsCutover sets the last Raft log index at which create records without lms_params are accepted
+// Later creates must carry the key's LMS parameters, so the FSM can bound its indices. The default 0
+// requires them on every create; clusters whose log holds creates without them set the Raft index of the last one.
+func (f *KeyIndexFSM) SetLMSParamsCutover(raftIndex uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lmsParamsCutover = raftIndex
 }
 
 // Apply applies a Raft log entry
@@ -142,26 +201,102 @@ func (f *KeyIndexFSM) Apply(l *raft.Log) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Try to parse as KeyIndexEntry
+	// Entries already in a persistent store were applied before the restart
+	if f.appliedLocked(l.Index) {
+		return nil
+	}
+	result := f.applyLog(l)
+	f.commitLocked(l.Index, nil)
+	return result
+}
+
+// applyLog dispatches a raw (pre-envelope) Raft log entry (caller must hold the lock)
+func (f *KeyIndexFSM) applyLog(l *raft.Log) interface{} {
+	// Registry commands change the set of authorized attestation keys
+	if isRegistryCommand(l.Data) {
+		return f.applyRegistryCommand(l)
+	}
+
+	// Reservations allocate the next index inside Apply
+	if isReserveCommand(l.Data) {
+		return f.applyReserveIndex(l)
+	}
+
+	// Range leases hand a block of indices to one HSM instance
+	if isReserveRangeCommand(l.Data) {
+		return f.applyReserveRange(l)
+	}
+	if isReturnRangeCommand(l.Data) {
+		return f.applyReturnRange(l)
+	}
+
+	return f.applyKeyIndexEntry(l)
+}
+
+// locked wraps a payload handler as a command handler running under the FSM lock
+func (f *KeyIndexFSM) locked(apply func(l *raft.Log) interface{}) commandFunc {
+	return func(l *raft.Log, _ *Command) interface{} {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return apply(l)
+	}
+}
+
+// applyKeyIndexEntry commits a signed KeyIndexEntry (caller must hold the lock)
+func (f *KeyIndexFSM) applyKeyIndexEntry(l *raft.Log) interface{} {
 	var entry KeyIndexEntry
 	if err := json.Unmarshal(l.Data, &entry); err != nil {
 		return fmt.Sprintf("Error: Failed to parse key index entry: %v", err)
 	}
 
+	state, err := f.checkEntry(&entry, l.Index)
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+
+	f.storeEntry(&entry, l.Index, state)
+
+	return fmt.Sprintf("Applied key index: key_id=%s, pubkey_hash=%s, index=%d, hash=%s", entry.KeyID, entry.PubkeyHash, entry.Index, entry.Hash)
+}
+
+// checkEntry validates a signed entry against the current chain head and returns its lifecycle state
+// Genesis entries get their computed hash. The caller must hold the lock.
+func (f *KeyIndexFSM) checkEntry(entry *KeyIndexEntry, raftIndex uint64) (string, error) {
+	// Reservation and lease signatures do not cover index and are only valid for their commands
+	if entry.SignatureVersion == SignatureVersionReserve || entry.SignatureVersion == SignatureVersionLease {
+		return "", fmt.Errorf("Reservation signatures can only be used with reserve_index or reserve_range")
+	}
+
+	// Reject legacy v1 signatures once the cutover has passed
+	if entry.EffectiveSignatureVersion() == SignatureVersionV1 && raftIndex > f.v1SignatureCutover {
+		return "", fmt.Errorf("Signature version 1 is no longer accepted after Raft index %d (entry at Raft index %d)",
+			f.v1SignatureCutover, raftIndex)
+	}
+
+	// Lease fields are hashed but only signed by lease signatures
+	if entry.LeaseStart != 0 || entry.HSMInstance != "" {
+		return "", fmt.Errorf("lease_start and hsm_instance are only valid on reserve_range entries")
+	}
+
 	// Verify EC signature using the public key from the entry
-	if err := f.verifySignature(&entry); err != nil {
-		return fmt.Sprintf("Error: Signature verification failed: %v", err)
+	if err := f.verifySignature(entry); err != nil {
+		return "", fmt.Errorf("Signature verification failed: %v", err)
+	}
+
+	// The signing key must be active in the registry as of this log position
+	if err := f.authorizeKey(entry.PublicKey); err != nil {
+		return "", fmt.Errorf("Unauthorized attestation key: %v", err)
 	}
 
 	// Validate hash chain integrity
-	if err := f.validateHashChain(&entry); err != nil {
-		return fmt.Sprintf("Error: Hash chain validation failed: %v", err)
+	if err := f.validateHashChain(entry); err != nil {
+		return "", fmt.Errorf("Hash chain validation failed: %v", err)
 	}
 
 	// Compute and verify hash
 	computedHash, err := entry.ComputeHash()
 	if err != nil {
-		return fmt.Sprintf("Error: Failed to compute hash: %v", err)
+		return "", fmt.Errorf("Failed to compute hash: %v", err)
 	}
 
 	// For genesis entries (index 0 with genesis previous_hash), skip hash mismatch check
@@ -171,12 +306,12 @@ func (f *KeyIndexFSM) Apply(l *raft.Log) interface{} {
 		entry.Hash = computedHash
 	} else if entry.Hash != computedHash {
 		// For non-genesis entries, hash must match
-		return fmt.Sprintf("Error: Hash mismatch: expected %s, got %s", computedHash, entry.Hash)
+		return "", fmt.Errorf("Hash mismatch: expected %s, got %s", computedHash, entry.Hash)
 	}
 
 	// Validate that pubkey_hash is present (required for Phase B)
 	if entry.PubkeyHash == "" {
-		return fmt.Sprintf("Error: pubkey_hash is required but missing in entry")
+		return "", fmt.Errorf("pubkey_hash is required but missing in entry")
 	}
 
 	// Use pubkey_hash as the primary identifier for lookups
@@ -186,11 +321,23 @@ func (f *KeyIndexFSM) Apply(l *raft.Log) interface{} {
 	// Check if index is valid (must be > current index for this pubkey_hash)
 	currentIndex, exists := f.pubkeyHashIndices[pubkeyHash]
 	if exists && entry.Index <= currentIndex {
-		return fmt.Sprintf("Error: Index %d is not greater than current index %d for pubkey_hash %s",
+		return "", fmt.Errorf("Index %d is not greater than current index %d for pubkey_hash %s",
 			entry.Index, currentIndex, pubkeyHash)
 	}
 
-	// Store the index and hash using pubkey_hash (the hash is the actual hash of this commit, computed above)
+	// Enforce the key lifecycle (created -> active -> exhausted/deleted)
+	state, err := f.checkLifecycle(entry, raftIndex)
+	if err != nil {
+		return "", fmt.Errorf("Lifecycle violation for pubkey_hash %s: %v", pubkeyHash, err)
+	}
+	return state, nil
+}
+
+// storeEntry records a validated entry as the new head of its chain (caller must hold the lock)
+func (f *KeyIndexFSM) storeEntry(entry *KeyIndexEntry, raftIndex uint64, state string) {
+	pubkeyHash := entry.PubkeyHash
+
+	// Store the index and hash using pubkey_hash (the hash is the actual hash of this commit)
 	// This stored hash will be used as previous_hash for the next entry - never recomputed
 	f.pubkeyHashIndices[pubkeyHash] = entry.Index
 	f.pubkeyHashHashes[pubkeyHash] = entry.Hash
@@ -198,23 +345,14 @@ func (f *KeyIndexFSM) Apply(l *raft.Log) interface{} {
 	// Store key_id -> pubkey_hash mapping for lookup convenience (latest mapping)
 	f.keyIdToPubkeyHash[entry.KeyID] = pubkeyHash
 
-	// Store the full entry for chain retrieval (using pubkey_hash)
-	entryCopy := &KeyIndexEntry{
-		KeyID:        entry.KeyID,
-		PubkeyHash:   entry.PubkeyHash,
-		Index:        entry.Index,
-		PreviousHash: entry.PreviousHash,
-		Hash:         entry.Hash,
-		Signature:    entry.Signature,
-		PublicKey:    entry.PublicKey,
-		RecordType:   entry.RecordType, // Include record type for proper chain retrieval
-	}
-	f.pubkeyHashEntries[pubkeyHash] = append(f.pubkeyHashEntries[pubkeyHash], entryCopy)
-	
-	// Store Raft log index for chronological ordering
-	f.entryToRaftIndex[entry.Hash] = l.Index
+	f.setKeyState(entry, state, raftIndex)
+	f.markDirty(stateKeys, pubkeyHash)
+	f.markDirty(stateKeyIDs, entry.KeyID)
 
-	return fmt.Sprintf("Applied key index: key_id=%s, pubkey_hash=%s, index=%d, hash=%s", entry.KeyID, pubkeyHash, entry.Index, entry.Hash)
+	// Every committed entry is the next leaf of the transparency log and moves its key's state leaf
+	f.appendEntryLog(entry.clone(), raftIndex)
+	f.tlog.appendEntry(entry)
+	f.state.update(pubkeyHash, entry.Index, entry.Hash)
 }
 
 // VerifySignature verifies the signature of a key index entry
@@ -235,31 +373,10 @@ func VerifyCommitSignature(entry *KeyIndexEntry) error {
 		return fmt.Errorf("failed to load expected attestation public key: %v", err)
 	}
 
-	// Create data to verify (key_id:index format)
-	data := fmt.Sprintf("%s:%d", entry.KeyID, entry.Index)
-	hash := sha256.Sum256([]byte(data))
-
-	// Decode signature
-	sigBytes, err := base64.StdEncoding.DecodeString(entry.Signature)
-	if err != nil {
-		return fmt.Errorf("failed to decode signature: %v", err)
-	}
-
-	// Decode public key from request
-	reqPubKeyBytes, err := base64.StdEncoding.DecodeString(entry.PublicKey)
-	if err != nil {
-		return fmt.Errorf("failed to decode public key from request: %v", err)
-	}
-
 	// Parse public key from request
-	reqPubKeyInterface, err := x509.ParsePKIXPublicKey(reqPubKeyBytes)
+	reqPubKey, err := parseEntryPublicKey(entry.PublicKey)
 	if err != nil {
-		return fmt.Errorf("failed to parse public key from request: %v", err)
-	}
-
-	reqPubKey, ok := reqPubKeyInterface.(*ecdsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("public key from request is not ECDSA")
+		return fmt.Errorf("invalid public key in request: %v", err)
 	}
 
 	// CRITICAL: Verify that the public key in the request matches the expected attestation public key
@@ -269,55 +386,22 @@ func VerifyCommitSignature(entry *KeyIndexEntry) error {
 	}
 
 	// Verify signature using the expected attestation public key
-	if !ecdsa.VerifyASN1(pubKey, hash[:], sigBytes) {
-		return fmt.Errorf("signature verification failed (invalid signature)")
+	if err := verifyEntrySignature(entry, pubKey); err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
 	}
 
 	return nil
 }
 
 func (f *KeyIndexFSM) verifySignature(entry *KeyIndexEntry) error {
-	// Create data to verify (key_id + index)
-	data := fmt.Sprintf("%s:%d", entry.KeyID, entry.Index)
-	hash := sha256.Sum256([]byte(data))
-
-	// Debug: log the data being verified (remove in production if needed)
-	fmt.Printf("[DEBUG] Verifying signature for data: %s, hash: %x\n", data, hash)
-
-	// Decode signature (base64 encoded ASN.1)
-	fmt.Printf("[DEBUG] Received signature (base64): %s\n", entry.Signature)
-	fmt.Printf("[DEBUG] Received public key (base64): %s\n", entry.PublicKey)
-
-	sigBytes, err := base64.StdEncoding.DecodeString(entry.Signature)
-	if err != nil {
-		return fmt.Errorf("failed to decode signature: %v", err)
-	}
-	fmt.Printf("[DEBUG] Decoded signature length: %d bytes\n", len(sigBytes))
-
-	// Decode public key from the entry
-	pubKeyBytes, err := base64.StdEncoding.DecodeString(entry.PublicKey)
+	// Parse the public key from the entry
+	pubKey, err := parseEntryPublicKey(entry.PublicKey)
 	if err != nil {
-		return fmt.Errorf("failed to decode public key: %v", err)
-	}
-	fmt.Printf("[DEBUG] Decoded public key length: %d bytes\n", len(pubKeyBytes))
-
-	// Parse public key
-	pubKeyInterface, err := x509.ParsePKIXPublicKey(pubKeyBytes)
-	if err != nil {
-		return fmt.Errorf("failed to parse public key: %v", err)
-	}
-
-	pubKey, ok := pubKeyInterface.(*ecdsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("not an ECDSA public key")
-	}
-
-	// Verify signature (ASN.1 format) using the public key from the entry
-	if !ecdsa.VerifyASN1(pubKey, hash[:], sigBytes) {
-		return fmt.Errorf("signature verification failed: ECDSA verify returned false")
+		return err
 	}
 
-	return nil
+	// Verify signature (ASN.1 format) over the versioned signing payload
+	return verifyEntrySignature(entry, pubKey)
 }
 
 // validateHashChain validates that the previous_hash matches the stored hash from the previous entry
@@ -441,23 +525,14 @@ func (f *KeyIndexFSM) GetChainByPubkeyHash(pubkeyHash string) ([]*KeyIndexEntry,
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	entries, exists := f.pubkeyHashEntries[pubkeyHash]
-	if !exists || len(entries) == 0 {
-		return nil, false
-	}
-
 	// Return copies to avoid race conditions
-	result := make([]*KeyIndexEntry, len(entries))
-	for i, entry := range entries {
-		result[i] = &KeyIndexEntry{
-			KeyID:        entry.KeyID,
-			PubkeyHash:   entry.PubkeyHash,
-			Index:        entry.Index,
-			PreviousHash: entry.PreviousHash,
-			Hash:         entry.Hash,
-			Signature:    entry.Signature,
-			PublicKey:    entry.PublicKey,
-		}
+	var result []*KeyIndexEntry
+	f.store.Scan(IndexPubkeyHash, pubkeyHash, 0, f.store.Len(), false, func(_ int, item RaftEntry) bool {
+		result = append(result, item.Entry.clone())
+		return true
+	})
+	if len(result) == 0 {
+		return nil, false
 	}
 
 	return result, true
@@ -475,21 +550,15 @@ func (f *KeyIndexFSM) GetAllPubkeyHashesByKeyID(keyID string) []string {
 	defer f.mu.RUnlock()
 
 	pubkeyHashes := make(map[string]bool)
-
-	// Iterate through all pubkey_hash entries to find all pubkey_hashes with matching key_id
-	for pubkeyHash, entries := range f.pubkeyHashEntries {
-		for _, entry := range entries {
-			if entry.KeyID == keyID {
-				pubkeyHashes[pubkeyHash] = true
-				break // Found at least one entry for this pubkey_hash
-			}
+	result := make([]string, 0)
+	f.store.Scan(IndexKeyID, keyID, 0, f.store.Len(), false, func(_ int, item RaftEntry) bool {
+		pubkeyHash := item.Entry.PubkeyHash
+		if !pubkeyHashes[pubkeyHash] {
+			pubkeyHashes[pubkeyHash] = true
+			result = append(result, pubkeyHash)
 		}
-	}
-
-	result := make([]string, 0, len(pubkeyHashes))
-	for ph := range pubkeyHashes {
-		result = append(result, ph)
-	}
+		return true
+	})
 
 	return result
 }
@@ -501,35 +570,18 @@ func (f *KeyIndexFSM) GetAllEntriesByKeyID(keyID string) ([]*KeyIndexEntry, bool
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	allEntries := make([]*KeyIndexEntry, 0)
-
-	// Iterate through all pubkey_hash entries to find all entries with matching key_id
-	for _, entries := range f.pubkeyHashEntries {
-		for _, entry := range entries {
-			if entry.KeyID == keyID {
-				// Create a copy
-				entryCopy := &KeyIndexEntry{
-					KeyID:        entry.KeyID,
-					PubkeyHash:   entry.PubkeyHash,
-					Index:        entry.Index,
-					PreviousHash: entry.PreviousHash,
-					Hash:         entry.Hash,
-					Signature:    entry.Signature,
-					PublicKey:    entry.PublicKey,
-					RecordType:   entry.RecordType,
-				}
-				allEntries = append(allEntries, entryCopy)
-			}
-		}
-	}
-
+	var allEntries []*KeyIndexEntry
+	f.store.Scan(IndexKeyID, keyID, 0, f.store.Len(), false, func(_ int, item RaftEntry) bool {
+		allEntries = append(allEntries, item.Entry.clone())
+		return true
+	})
 	if len(allEntries) == 0 {
 		return nil, false
 	}
 
 	// Sort entries: first by pubkey_hash (to group chains), then by index (ascending)
 	// This ensures entries from the same chain stay together
-	sort.Slice(allEntries, func(i, j int) bool {
+	sort.SliceStable(allEntries, func(i, j int) bool {
 		if allEntries[i].PubkeyHash != allEntries[j].PubkeyHash {
 			return allEntries[i].PubkeyHash < allEntries[j].PubkeyHash
 		}
@@ -548,114 +600,306 @@ func (f *KeyIndexFSM) GetAllEntries(limit int) []struct {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
+	count := f.store.Len()
+	if limit > 0 && limit < count {
+		count = limit
+	}
+
 	allEntriesWithIndex := make([]struct {
 		Entry     *KeyIndexEntry
 		RaftIndex uint64
-	}, 0)
-
-	// Collect all entries from all pubkey_hashes
-	for _, entries := range f.pubkeyHashEntries {
-		for _, entry := range entries {
-			raftIndex, hasIndex := f.entryToRaftIndex[entry.Hash]
-			if !hasIndex {
-				// If Raft index not found, skip (shouldn't happen, but be safe)
-				continue
-			}
-
-			// Create a copy
-			entryCopy := &KeyIndexEntry{
-				KeyID:        entry.KeyID,
-				PubkeyHash:   entry.PubkeyHash,
-				Index:        entry.Index,
-				PreviousHash: entry.PreviousHash,
-				Hash:         entry.Hash,
-				Signature:    entry.Signature,
-				PublicKey:    entry.PublicKey,
-				RecordType:   entry.RecordType,
-			}
+	}, 0, count)
 
-			allEntriesWithIndex = append(allEntriesWithIndex, struct {
-				Entry     *KeyIndexEntry
-				RaftIndex uint64
-			}{
-				Entry:     entryCopy,
-				RaftIndex: raftIndex,
-			})
+	// The store is already in Raft order; walk it from the end
+	f.store.Scan(IndexAll, "", 0, f.store.Len(), true, func(_ int, item RaftEntry) bool {
+		if len(allEntriesWithIndex) == count {
+			return false
 		}
-	}
-
-	// Sort by Raft log index (descending - newest first)
-	sort.Slice(allEntriesWithIndex, func(i, j int) bool {
-		return allEntriesWithIndex[i].RaftIndex > allEntriesWithIndex[j].RaftIndex
+		allEntriesWithIndex = append(allEntriesWithIndex, struct {
+			Entry     *KeyIndexEntry
+			RaftIndex uint64
+		}{item.Entry.clone(), item.RaftIndex})
+		return true
 	})
 
-	// Apply limit
-	if limit > 0 && limit < len(allEntriesWithIndex) {
-		return allEntriesWithIndex[:limit]
-	}
-
 	return allEntriesWithIndex
 }
 
+// keyIndexSnapshotVersion is the current on-disk format of KeyIndexFSM snapshots
+// Version 0 (no "version" field) only contained the index/hash/key_id maps
+// Version 1 added entries and Raft indices, version 2 the attestation key registry, version 3 index leases,
+// version 4 key lifecycle states, version 5 the request dedup table, version 6 stores the entries as one
+// list in apply order (streamed from the store) instead of per-chain lists and a Raft index map
+const keyIndexSnapshotVersion = 6
+
+// keyIndexSnapshotData is the serialized form of the complete KeyIndexFSM state
+type keyIndexSnapshotData struct {
+	Version           int                         `json:"version"`
+	PubkeyHashIndices map[string]uint64           `json:"pubkey_hash_indices"`
+	PubkeyHashHashes  map[string]string           `json:"pubkey_hash_hashes"`
+	KeyIdToPubkeyHash map[string]string           `json:"key_id_to_pubkey_hash"`
+	PubkeyHashEntries map[string][]*KeyIndexEntry `json:"pubkey_hash_entries,omitempty"` // Versions 1-5
+	EntryToRaftIndex  map[string]uint64           `json:"entry_to_raft_index,omitempty"` // Versions 1-5
+	Registry          *attestationKeyRegistry     `json:"registry,omitempty"`
+	Leases            map[string]*IndexLease      `json:"leases,omitempty"`
+	KeyStates         map[string]*KeyLifecycle    `json:"key_states,omitempty"`
+	Requests          []*requestRecord            `json:"requests,omitempty"`
+
+	// Version 6+ lists the entries in apply order after every other member; they are streamed to and
+	// from the store one at a time (keyIndexSnapshot.writeTo, restoreFrom) rather than held here
+}
+
 // Snapshot creates a snapshot
+// The entries are not copied: the snapshot reads them from a point-in-time view of the store while it persists
 func (f *KeyIndexFSM) Snapshot() (raft.FSMSnapshot, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	// Create copies to avoid race conditions
-	indicesCopy := make(map[string]uint64)
-	hashesCopy := make(map[string]string)
-	keyIdMappingCopy := make(map[string]string)
+	view, err := f.store.View()
+	if err != nil {
+		return nil, err
+	}
+	return &keyIndexSnapshot{data: f.snapshotData(), entries: view}, nil
+}
+
+// snapshotData copies the FSM state except the entries (caller must hold the lock)
+func (f *KeyIndexFSM) snapshotData() *keyIndexSnapshotData {
+	data := &keyIndexSnapshotData{
+		Version:           keyIndexSnapshotVersion,
+		PubkeyHashIndices: make(map[string]uint64, len(f.pubkeyHashIndices)),
+		PubkeyHashHashes:  make(map[string]string, len(f.pubkeyHashHashes)),
+		KeyIdToPubkeyHash: make(map[string]string, len(f.keyIdToPubkeyHash)),
+		Registry:          f.registry.clone(),
+		Leases:            make(map[string]*IndexLease, len(f.leases)),
+		KeyStates:         make(map[string]*KeyLifecycle, len(f.keyStates)),
+	}
 
 	for k, v := range f.pubkeyHashIndices {
-		indicesCopy[k] = v
+		data.PubkeyHashIndices[k] = v
 	}
 	for k, v := range f.pubkeyHashHashes {
-		hashesCopy[k] = v
+		data.PubkeyHashHashes[k] = v
 	}
 	for k, v := range f.keyIdToPubkeyHash {
-		keyIdMappingCopy[k] = v
+		data.KeyIdToPubkeyHash[k] = v
+	}
+	for k, v := range f.leases {
+		data.Leases[k] = v.clone()
 	}
+	for k, v := range f.keyStates {
+		lifecycle := *v
+		data.KeyStates[k] = &lifecycle
+	}
+	data.Requests = f.requests.snapshot()
 
-	return &keyIndexSnapshot{
-		pubkeyHashIndices: indicesCopy,
-		pubkeyHashHashes:  hashesCopy,
-		keyIdToPubkeyHash: keyIdMappingCopy,
-	}, nil
+	return data
 }
 
 // Restore restores from snapshot
+// The FSM state is replaced entirely by the snapshot contents
 func (f *KeyIndexFSM) Restore(r io.ReadCloser) error {
-	// For now, restore is a no-op
+	defer r.Close()
+
+	if err := f.restoreFrom(json.NewDecoder(r)); err != nil {
+		return err
+	}
+	f.commit(0, nil)
 	return nil
 }
 
-type keyIndexSnapshot struct {
-	pubkeyHashIndices map[string]uint64
-	pubkeyHashHashes  map[string]string
-	keyIdToPubkeyHash map[string]string
+// restoreCommitInterval is the number of restored entries after which a restore commits them to the store
+// so that a restore never holds more than that many decoded entries in memory
+const restoreCommitInterval = 10000
+
+// restoreFrom replaces the FSM state with a snapshot decoded from a stream
+// The store holds the restored state once the caller commits it; the Raft index is unknown here, so every commit
+// is at 0 and a restart restores the snapshot again rather than trusting the store. The entries are stored as they
+// are decoded, so a snapshot that fails to decode part way leaves the state replaced only in part.
+func (f *KeyIndexFSM) restoreFrom(dec *json.Decoder) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Everything but the entries is resident state, decoded once the stream is read
+	var data keyIndexSnapshotData
+	state := make(map[string]json.RawMessage)
+	reset := false
+	err := decodeObject(dec, func(name string) error {
+		// Snapshots start with their version, so a newer one is rejected before the state is touched
+		if name == "version" {
+			if err := dec.Decode(&data.Version); err != nil {
+				return err
+			}
+			if data.Version > keyIndexSnapshotVersion {
+				return fmt.Errorf("unsupported key index snapshot version %d (max supported: %d)",
+					data.Version, keyIndexSnapshotVersion)
+			}
+			return nil
+		}
+		if !reset {
+			f.resetState()
+			reset = true
+		}
+		if name != "entries" {
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return err
+			}
+			state[name] = value
+			return nil
+		}
+		return decodeArray(dec, func() error {
+			var item RaftEntry
+			if err := dec.Decode(&item); err != nil {
+				return err
+			}
+			f.restoreEntry(item)
+			if f.store.Len()%restoreCommitInterval == 0 {
+				f.commitLocked(0, nil)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to decode key index snapshot: %v", err)
+	}
+	if !reset {
+		f.resetState()
+	}
+
+	encoded, err := json.Marshal(state)
+	if err == nil {
+		err = json.Unmarshal(encoded, &data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal key index snapshot: %v", err)
+	}
+
+	f.restoreData(&data)
+	f.markAllDirty()
+	return nil
 }
 
-func (s *keyIndexSnapshot) Persist(sink raft.SnapshotSink) error {
-	snapshot := struct {
-		PubkeyHashIndices map[string]uint64 `json:"pubkey_hash_indices"`
-		PubkeyHashHashes  map[string]string `json:"pubkey_hash_hashes"`
-		KeyIdToPubkeyHash map[string]string `json:"key_id_to_pubkey_hash"`
-	}{
-		PubkeyHashIndices: s.pubkeyHashIndices,
-		PubkeyHashHashes:  s.pubkeyHashHashes,
-		KeyIdToPubkeyHash: s.keyIdToPubkeyHash,
+// resetState empties the FSM and its store before a restore (caller must hold the lock)
+func (f *KeyIndexFSM) resetState() {
+	f.pubkeyHashIndices = make(map[string]uint64)
+	f.pubkeyHashHashes = make(map[string]string)
+	f.keyIdToPubkeyHash = make(map[string]string)
+	f.leases = make(map[string]*IndexLease)
+	f.keyStates = make(map[string]*KeyLifecycle)
+	f.requests = newRequestDedup(RequestDedupCapacity)
+	f.registry = newAttestationKeyRegistry()
+	f.dirty = make(map[string]map[string]bool)
+	f.store.Reset()
+	f.notifyEntriesChanged()
+	f.tlog = newTransparencyLog(f.store)
+	f.state = newStateTree(f.store)
+}
+
+// restoreEntry stores a restored entry at the next position (caller must hold the lock)
+func (f *KeyIndexFSM) restoreEntry(item RaftEntry) {
+	f.store.Append(item.RaftIndex, item.Entry)
+	f.tlog.appendEntry(item.Entry)
+}
+
+// restoreData fills the reset FSM with the decoded snapshot state; version 6+ entries are already stored
+// (caller must hold the lock)
+func (f *KeyIndexFSM) restoreData(data *keyIndexSnapshotData) {
+	// Snapshots before version 2 had no registry
+	if data.Registry != nil {
+		f.registry = data.Registry.clone()
+	}
+
+	for k, v := range data.PubkeyHashIndices {
+		f.pubkeyHashIndices[k] = v
+	}
+	for k, v := range data.PubkeyHashHashes {
+		f.pubkeyHashHashes[k] = v
+	}
+	for k, v := range data.KeyIdToPubkeyHash {
+		f.keyIdToPubkeyHash[k] = v
+	}
+	f.rebuildStateTree()
+
+	// Version 0 snapshots did not include entries or Raft indices
+	// Chains restored from them only know their head index and hash
+	if data.Version == 0 {
+		return
+	}
+
+	if data.PubkeyHashEntries != nil {
+		for _, item := range entriesInApplyOrder(data.PubkeyHashEntries, data.EntryToRaftIndex) {
+			f.restoreEntry(item)
+		}
+	}
+	for k, v := range data.Leases {
+		f.leases[k] = v
 	}
 
-	data, err := json.Marshal(snapshot)
+	// Snapshots before version 4 did not store lifecycle states; derive them from the chains
+	if data.Version < 4 {
+		f.rebuildKeyStates()
+		return
+	}
+	for k, v := range data.KeyStates {
+		f.keyStates[k] = v
+	}
+	f.requests.restore(data.Requests)
+}
+
+type keyIndexSnapshot struct {
+	data    *keyIndexSnapshotData // State without the entries
+	entries StoreView             // Entries as of the snapshot
+}
+
+// writeTo streams the snapshot as JSON: the state, then the entries one at a time (also used by CombinedFSM)
+func (s *keyIndexSnapshot) writeTo(w io.Writer) error {
+	data, err := json.Marshal(s.data)
 	if err != nil {
+		return fmt.Errorf("failed to marshal key index snapshot: %v", err)
+	}
+
+	// Reopen the object to append the entries list
+	if _, err := w.Write(data[:len(data)-1]); err != nil {
 		return err
 	}
-	_, err = sink.Write(data)
-	if err != nil {
+	if _, err := io.WriteString(w, `,"entries":[`); err != nil {
 		return err
 	}
+
+	encoder := json.NewEncoder(w)
+	first := true
+	s.entries.Scan(IndexAll, "", 0, s.entries.Len(), false, func(_ int, item RaftEntry) bool {
+		if !first {
+			if _, err = io.WriteString(w, ","); err != nil {
+				return false
+			}
+		}
+		first = false
+		err = encoder.Encode(item)
+		return err == nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write key index snapshot entry: %v", err)
+	}
+
+	_, err = io.WriteString(w, "]}")
+	return err
+}
+
+func (s *keyIndexSnapshot) Persist(sink raft.SnapshotSink) error {
+	w := bufio.NewWriter(sink)
+	if err := s.writeTo(w); err != nil {
+		sink.Cancel()
+		return fmt.Errorf("failed to write key index snapshot: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		sink.Cancel()
+		return fmt.Errorf("failed to write key index snapshot: %v", err)
+	}
+
 	return sink.Close()
 }
 
-func (s *keyIndexSnapshot) Release() {}
+func (s *keyIndexSnapshot) Release() {
+	s.entries.Release()
+}
@@ -26,6 +26,7 @@ func TestKeyIndexFSM_VerifySignature(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create FSM: %v", err)
 	}
+	fsm.PinAttestationKey(&privKey.PublicKey)
 
 	// Create test entry
 	keyID := "test_key_1"
@@ -48,6 +49,7 @@ func TestKeyIndexFSM_VerifySignature(t *testing.T) {
 	// Create entry with hash chain fields
 	entry := KeyIndexEntry{
 		KeyID:       keyID,
+		PubkeyHash:  ComputePubkeyHash([]byte(keyID)),
 		Index:       index,
 		PreviousHash: GenesisHash, // First entry uses genesis hash
 		Hash:        "",           // Will be computed
@@ -84,6 +86,9 @@ func TestKeyIndexFSM_Apply_ValidSignature(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create FSM: %v", err)
 	}
+	fsm.PinAttestationKey(&privKey.PublicKey)
+	fsm.SetV1SignatureCutover(1) // Legacy v1 entry replayed from the log
+	fsm.SetLMSParamsCutover(1)    // ... from before create records carried lms_params
 
 	// Create and sign entry
 	keyID := "test_key_1"
@@ -95,6 +100,7 @@ func TestKeyIndexFSM_Apply_ValidSignature(t *testing.T) {
 
 	entry := KeyIndexEntry{
 		KeyID:       keyID,
+		PubkeyHash:  ComputePubkeyHash([]byte(keyID)),
 		Index:       index,
 		PreviousHash: GenesisHash, // First entry uses genesis hash
 		Hash:        "",           // Will be computed
@@ -155,6 +161,7 @@ func TestKeyIndexFSM_Apply_InvalidSignature(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create FSM: %v", err)
 	}
+	fsm.PinAttestationKey(&privKey.PublicKey)
 
 	// Create entry with INVALID signature (sign different data)
 	keyID := "test_key_1"
@@ -168,6 +175,7 @@ func TestKeyIndexFSM_Apply_InvalidSignature(t *testing.T) {
 
 	entry := KeyIndexEntry{
 		KeyID:       keyID,
+		PubkeyHash:  ComputePubkeyHash([]byte(keyID)),
 		Index:       index,
 		PreviousHash: GenesisHash, // First entry uses genesis hash
 		Hash:        "",           // Will be computed
@@ -254,6 +262,9 @@ func TestKeyIndexFSM_EndToEnd(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to create FSM: %v", err)
 	}
+	fsm.PinAttestationKey(&privKey.PublicKey)
+	fsm.SetV1SignatureCutover(1) // Legacy v1 entry replayed from the log
+	fsm.SetLMSParamsCutover(1)    // ... from before create records carried lms_params
 
 	// Simulate commitIndexToRaft
 	keyID := "e2e_test_key"
@@ -276,6 +287,7 @@ func TestKeyIndexFSM_EndToEnd(t *testing.T) {
 	// Create entry (same format as sent to Raft)
 	entry := KeyIndexEntry{
 		KeyID:       keyID,
+		PubkeyHash:  ComputePubkeyHash([]byte(keyID)),
 		Index:       index,
 		PreviousHash: GenesisHash, // First entry uses genesis hash
 		Hash:        "",           // Will be computed
@@ -0,0 +1,249 @@
+package fsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// State buckets written to the store with every commit
+const (
+	stateKeys      = "keys"       // pubkey_hash -> keyStateRecord
+	stateKeyIDs    = "key_ids"    // key_id -> pubkey_hash (latest mapping)
+	stateLeases    = "leases"     // lease_id -> IndexLease
+	stateRegistry  = "registry"   // "registry" -> attestationKeyRegistry
+	stateRequests  = "requests"   // request_id -> requestRecord
+	stateLogNodes  = "tlog"       // level, big-endian node position -> transparency log node hash
+	stateTreeNodes = "state_tree" // depth, key prefix -> stateNodeRecord
+	stateHashChain = "hash_chain" // hash chain FSM log entries and messages (CombinedFSM only, see hashChainChanges)
+)
+
+// residentStateBuckets are the buckets the FSM holds in memory and loads whole when opening a store
+// The tree nodes and hash chain records are read one at a time when needed.
+var residentStateBuckets = []string{stateKeys, stateKeyIDs, stateLeases, stateRegistry, stateRequests}
+
+// keyStateRecord is the stored head and lifecycle of one pubkey_hash
+type keyStateRecord struct {
+	Index     uint64        `json:"index"`
+	Hash      string        `json:"hash"`
+	Lifecycle *KeyLifecycle `json:"lifecycle,omitempty"`
+}
+
+// NewKeyIndexFSMWithStore creates a key index FSM backed by a store, loading the state it already holds
+// The FSM owns the store from then on: Close closes it.
+func NewKeyIndexFSMWithStore(attestationPubKeyPath string, store Store) (*KeyIndexFSM, error) {
+	f, err := NewKeyIndexFSM(attestationPubKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.loadState(store); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// AppliedIndex returns the last Raft index the store made durable (0 for an in-memory store)
+// Raft need not restore a snapshot at or below it on startup: the store already holds that state.
+func (f *KeyIndexFSM) AppliedIndex() uint64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.store.AppliedIndex()
+}
+
+// Close closes the store
+func (f *KeyIndexFSM) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.store.Close()
+}
+
+// markDirty records that a state record changed and must be written by the next commit (caller must hold the lock)
+func (f *KeyIndexFSM) markDirty(bucket, key string) {
+	if f.dirty[bucket] == nil {
+		f.dirty[bucket] = make(map[string]bool)
+	}
+	f.dirty[bucket][key] = true
+}
+
+// markAllDirty marks every state record (after a snapshot restore replaced the state; caller must hold the lock)
+func (f *KeyIndexFSM) markAllDirty() {
+	for pubkeyHash := range f.pubkeyHashIndices {
+		f.markDirty(stateKeys, pubkeyHash)
+	}
+	for keyID := range f.keyIdToPubkeyHash {
+		f.markDirty(stateKeyIDs, keyID)
+	}
+	for leaseID := range f.leases {
+		f.markDirty(stateLeases, leaseID)
+	}
+	f.markDirty(stateRegistry, stateRegistry)
+	for requestID := range f.requests.records {
+		f.markDirty(stateRequests, requestID)
+	}
+}
+
+// applied reports whether the store already holds the state after a Raft index (replayed after a restart)
+func (f *KeyIndexFSM) applied(raftIndex uint64) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.appliedLocked(raftIndex)
+}
+
+// appliedLocked is applied for a caller holding the lock
+func (f *KeyIndexFSM) appliedLocked(raftIndex uint64) bool {
+	appliedIndex := f.store.AppliedIndex()
+	return appliedIndex > 0 && raftIndex <= appliedIndex
+}
+
+// commit makes the entries and state changed by a Raft log entry durable with its index
+func (f *KeyIndexFSM) commit(raftIndex uint64, changes StateChanges) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commitLocked(raftIndex, changes)
+}
+
+// commitLocked writes the dirty state records and extra changes in one store commit (caller must hold the lock)
+// A commit that fails leaves this node unable to keep its state consistent with the log, so it panics
+// like Raft does on a failed log write, rather than apply later entries over a lost one.
+func (f *KeyIndexFSM) commitLocked(raftIndex uint64, changes StateChanges) {
+	if changes == nil {
+		changes = make(StateChanges)
+	}
+	for bucket, keys := range f.dirty {
+		for key := range keys {
+			changes.set(bucket, key, f.stateRecord(bucket, key))
+		}
+	}
+	f.dirty = make(map[string]map[string]bool)
+	f.tlog.saveChanges(changes)
+	f.state.saveChanges(changes)
+
+	if err := f.store.Commit(raftIndex, changes); err != nil {
+		panic(fmt.Sprintf("fsm: %v", err))
+	}
+}
+
+// stateRecord encodes the current value of a state record, nil if it no longer exists (caller must hold the lock)
+func (f *KeyIndexFSM) stateRecord(bucket, key string) []byte {
+	var value interface{}
+	switch bucket {
+	case stateKeys:
+		index, exists := f.pubkeyHashIndices[key]
+		if !exists {
+			return nil
+		}
+		value = &keyStateRecord{Index: index, Hash: f.pubkeyHashHashes[key], Lifecycle: f.keyStates[key]}
+	case stateKeyIDs:
+		pubkeyHash, exists := f.keyIdToPubkeyHash[key]
+		if !exists {
+			return nil
+		}
+		return []byte(pubkeyHash)
+	case stateLeases:
+		lease, exists := f.leases[key]
+		if !exists {
+			return nil
+		}
+		value = lease
+	case stateRegistry:
+		value = f.registry
+	case stateRequests:
+		record, exists := f.requests.records[key]
+		if !exists {
+			return nil
+		}
+		value = record
+	default:
+		return nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		panic(fmt.Sprintf("fsm: failed to encode %s record %s: %v", bucket, key, err))
+	}
+	return data
+}
+
+// storedRecord reads a committed state record (for the hash chain FSM, whose own lock does not cover the store)
+func (f *KeyIndexFSM) storedRecord(bucket, key string) []byte {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.store.StateRecord(bucket, key)
+}
+
+// loadState switches to a store and replaces the in-memory state with its records (when opening it)
+// Entries stay in the store; the Merkle trees resume from their stored nodes and read the rest on demand.
+func (f *KeyIndexFSM) loadState(store Store) error {
+	changes, err := store.LoadState(residentStateBuckets...)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.store = store
+
+	decode := func(bucket, key string, data []byte, v interface{}) error {
+		if err := json.Unmarshal(data, v); err != nil {
+			return fmt.Errorf("failed to load %s record %s: %v", bucket, key, err)
+		}
+		return nil
+	}
+
+	for pubkeyHash, data := range changes[stateKeys] {
+		var record keyStateRecord
+		if err := decode(stateKeys, pubkeyHash, data, &record); err != nil {
+			return err
+		}
+		f.pubkeyHashIndices[pubkeyHash] = record.Index
+		f.pubkeyHashHashes[pubkeyHash] = record.Hash
+		if record.Lifecycle != nil {
+			f.keyStates[pubkeyHash] = record.Lifecycle
+		}
+	}
+	for keyID, pubkeyHash := range changes[stateKeyIDs] {
+		f.keyIdToPubkeyHash[keyID] = string(pubkeyHash)
+	}
+	for leaseID, data := range changes[stateLeases] {
+		var lease IndexLease
+		if err := decode(stateLeases, leaseID, data, &lease); err != nil {
+			return err
+		}
+		f.leases[leaseID] = &lease
+	}
+	if data, exists := changes[stateRegistry][stateRegistry]; exists {
+		var registry attestationKeyRegistry
+		if err := decode(stateRegistry, stateRegistry, data, &registry); err != nil {
+			return err
+		}
+		f.registry = &registry
+	}
+
+	// The dedup table evicts in apply order; one command records at most one request ID
+	records := make([]*requestRecord, 0, len(changes[stateRequests]))
+	for requestID, data := range changes[stateRequests] {
+		var record requestRecord
+		if err := decode(stateRequests, requestID, data, &record); err != nil {
+			return err
+		}
+		records = append(records, &record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].RaftIndex < records[j].RaftIndex
+	})
+	f.requests.restore(records)
+
+	// Stores written before the tree nodes were stored rebuild the trees once; the next commit writes them
+	if state, ok := loadStateTree(store, f.pubkeyHashIndices, f.pubkeyHashHashes); ok {
+		f.state = state
+	} else {
+		f.rebuildStateTree()
+	}
+	if tlog, ok := loadTransparencyLog(store, uint64(store.Len())); ok {
+		f.tlog = tlog
+	} else {
+		f.rebuildTransparencyLog()
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package fsm
+
+import "fmt"
+
+// Key lifecycle states per pubkey_hash
+// created -> active -> exhausted/deleted; deleted is terminal, exhausted only allows delete
+const (
+	KeyStateCreated   = "created"   // create record committed at index 0, no signatures yet
+	KeyStateActive    = "active"    // at least one index consumed after create
+	KeyStateExhausted = "exhausted" // every one-time signature index has been consumed
+	KeyStateDeleted   = "deleted"   // delete record committed, no further records accepted
+)
+
+// MaxSyncJump is the largest index advance a single sync record may make
+const MaxSyncJump = 1 << 10
+
+// KeyLifecycle is the lifecycle state of one pubkey_hash
+type KeyLifecycle struct {
+	State          string `json:"state"`
+	LastRecordType string `json:"last_record_type"`
+	UpdatedAt      uint64 `json:"updated_at"` // Raft index of the last record
+
+	Params *LMSParams `json:"lms_params,omitempty"` // From the create record (nil for keys created before parameters were recorded)
+}
+
+// effectiveRecordType returns the record type used for lifecycle checks
+// Entries committed before record_type existed are treated as create (genesis) or sign
+func (e *KeyIndexEntry) effectiveRecordType() string {
+	if e.RecordType != "" {
+		return e.RecordType
+	}
+	if e.Index == 0 && e.PreviousHash == GenesisHash {
+		return "create"
+	}
+	return "sign"
+}
+
+// nextKeyState validates a record against the current lifecycle state and returns the new state
+// current is nil for a pubkey_hash without records; headIndex is its last committed index
+func nextKeyState(current *KeyLifecycle, headIndex uint64, recordType string, index uint64) (string, error) {
+	if current == nil {
+		if recordType != "create" || index != 0 {
+			return "", fmt.Errorf("first record must be create at index 0, got %s at index %d", recordType, index)
+		}
+		return KeyStateCreated, nil
+	}
+
+	switch current.State {
+	case KeyStateDeleted:
+		return "", fmt.Errorf("key is deleted, %s record not allowed", recordType)
+	case KeyStateExhausted:
+		if recordType != "delete" {
+			return "", fmt.Errorf("key is exhausted, only delete is allowed (got %s)", recordType)
+		}
+	}
+
+	switch recordType {
+	case "create":
+		return "", fmt.Errorf("key already created (state %s)", current.State)
+	case "sign":
+		if index != headIndex+1 {
+			return "", fmt.Errorf("sign must use the next index %d, got %d", headIndex+1, index)
+		}
+		return KeyStateActive, nil
+	case "sync":
+		if index <= headIndex || index-headIndex > MaxSyncJump {
+			return "", fmt.Errorf("sync from index %d to %d exceeds the allowed range (1..%d)", headIndex, index, MaxSyncJump)
+		}
+		return KeyStateActive, nil
+	case "reserve_range":
+		return KeyStateActive, nil
+	case "delete":
+		if index != headIndex+1 {
+			return "", fmt.Errorf("delete must use the next index %d, got %d", headIndex+1, index)
+		}
+		return KeyStateDeleted, nil
+	default:
+		return "", fmt.Errorf("unknown record_type %q", recordType)
+	}
+}
+
+// checkLifecycle validates an entry at Raft index raftIndex against its pubkey_hash lifecycle (caller must hold the lock)
+func (f *KeyIndexFSM) checkLifecycle(entry *KeyIndexEntry, raftIndex uint64) (string, error) {
+	headIndex, exists := f.pubkeyHashIndices[entry.PubkeyHash]
+	current := f.keyStates[entry.PubkeyHash]
+	if exists && current == nil {
+		// Head known without lifecycle (restored from a version 0 snapshot): treat as active
+		current = &KeyLifecycle{State: KeyStateActive}
+	}
+	recordType := entry.effectiveRecordType()
+
+	state, err := nextKeyState(current, headIndex, recordType, entry.Index)
+	if err != nil {
+		return "", err
+	}
+
+	params := entry.LMSParams
+	if current == nil {
+		if params == nil && raftIndex > f.lmsParamsCutover {
+			return "", fmt.Errorf("create records require lms_params after Raft index %d (entry at Raft index %d)",
+				f.lmsParamsCutover, raftIndex)
+		}
+		if params != nil {
+			if err := params.Validate(); err != nil {
+				return "", fmt.Errorf("invalid lms_params: %v", err)
+			}
+		}
+	} else {
+		if params != nil {
+			return "", fmt.Errorf("lms_params is only allowed on the create record")
+		}
+		params = current.Params
+	}
+	return checkCapacity(params, recordType, entry.Index, state)
+}
+
+// setKeyState records the lifecycle transition of a stored entry (caller must hold the lock)
+func (f *KeyIndexFSM) setKeyState(entry *KeyIndexEntry, state string, raftIndex uint64) {
+	params := entry.LMSParams.clone()
+	if previous, exists := f.keyStates[entry.PubkeyHash]; exists && params == nil {
+		params = previous.Params
+	}
+	f.keyStates[entry.PubkeyHash] = &KeyLifecycle{
+		State:          state,
+		LastRecordType: entry.effectiveRecordType(),
+		UpdatedAt:      raftIndex,
+		Params:         params,
+	}
+}
+
+// rebuildKeyStates derives lifecycle states from stored chains (snapshots before version 4)
+// Chains are replayed without rejecting anything: historical records were already accepted
+func (f *KeyIndexFSM) rebuildKeyStates() {
+	chains := make(map[string][]RaftEntry)
+	f.store.Scan(IndexAll, "", 0, f.store.Len(), false, func(_ int, item RaftEntry) bool {
+		chains[item.Entry.PubkeyHash] = append(chains[item.Entry.PubkeyHash], item)
+		return true
+	})
+
+	f.keyStates = make(map[string]*KeyLifecycle)
+	for pubkeyHash, chain := range chains {
+		var current *KeyLifecycle
+		var headIndex uint64
+		var params *LMSParams
+		for _, item := range chain {
+			entry := item.Entry
+			if entry.LMSParams != nil && current == nil {
+				params = entry.LMSParams.clone()
+			}
+			state, err := nextKeyState(current, headIndex, entry.effectiveRecordType(), entry.Index)
+			if err == nil {
+				state, err = checkCapacity(params, entry.effectiveRecordType(), entry.Index, state)
+			}
+			if err != nil {
+				state = KeyStateActive
+				if entry.effectiveRecordType() == "delete" {
+					state = KeyStateDeleted
+				}
+			}
+			current = &KeyLifecycle{
+				State:          state,
+				LastRecordType: entry.effectiveRecordType(),
+				UpdatedAt:      item.RaftIndex,
+				Params:         params,
+			}
+			headIndex = entry.Index
+		}
+		if current != nil {
+			f.keyStates[pubkeyHash] = current
+		}
+	}
+}
+
+// GetKeyLifecycle returns the lifecycle state of a pubkey_hash
+func (f *KeyIndexFSM) GetKeyLifecycle(pubkeyHash string) (*KeyLifecycle, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	lifecycle, exists := f.keyStates[pubkeyHash]
+	if !exists {
+		return nil, false
+	}
+	lifecycleCopy := *lifecycle
+	lifecycleCopy.Params = lifecycle.Params.clone()
+	return &lifecycleCopy, true
+}
+
+// KeyStateCounts returns the number of pubkey_hashes in each lifecycle state
+func (f *KeyIndexFSM) KeyStateCounts() map[string]int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, lifecycle := range f.keyStates {
+		counts[lifecycle.State]++
+	}
+	return counts
+}
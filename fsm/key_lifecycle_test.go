@@ -0,0 +1,107 @@
+package fsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestKeyLifecycle_Transitions(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+
+	// The first record must be create at index 0
+	sign := newTestEntry(t, privKey, "key_a", pubkeyHash, 0, GenesisHash, "sign")
+	if result := applyEntryResult(f, 1, sign); !strings.Contains(result, "Lifecycle violation") {
+		t.Fatalf("Expected sign before create to be rejected, got: %s", result)
+	}
+
+	create := newTestEntry(t, privKey, "key_a", pubkeyHash, 0, GenesisHash, "create")
+	applyTestEntry(t, f, 2, create)
+	if lifecycle, _ := f.GetKeyLifecycle(pubkeyHash); lifecycle.State != KeyStateCreated {
+		t.Fatalf("Expected state created, got %s", lifecycle.State)
+	}
+
+	// A second create and a skipped index are illegal
+	again := newTestEntry(t, privKey, "key_a", pubkeyHash, 1, create.Hash, "create")
+	if result := applyEntryResult(f, 3, again); !strings.Contains(result, "already created") {
+		t.Fatalf("Expected second create to be rejected, got: %s", result)
+	}
+	skip := newTestEntry(t, privKey, "key_a", pubkeyHash, 2, create.Hash, "sign")
+	if result := applyEntryResult(f, 4, skip); !strings.Contains(result, "next index 1") {
+		t.Fatalf("Expected skipped index to be rejected, got: %s", result)
+	}
+
+	next := newTestEntry(t, privKey, "key_a", pubkeyHash, 1, create.Hash, "sign")
+	applyTestEntry(t, f, 5, next)
+	if lifecycle, _ := f.GetKeyLifecycle(pubkeyHash); lifecycle.State != KeyStateActive || lifecycle.LastRecordType != "sign" {
+		t.Fatalf("Expected state active after sign, got %+v", lifecycle)
+	}
+
+	// sync may jump forward, but only within MaxSyncJump
+	farSync := newTestEntry(t, privKey, "key_a", pubkeyHash, 1+MaxSyncJump+1, next.Hash, "sync")
+	if result := applyEntryResult(f, 6, farSync); !strings.Contains(result, "sync from index") {
+		t.Fatalf("Expected oversized sync to be rejected, got: %s", result)
+	}
+	sync := newTestEntry(t, privKey, "key_a", pubkeyHash, 10, next.Hash, "sync")
+	applyTestEntry(t, f, 7, sync)
+
+	unknown := newTestEntry(t, privKey, "key_a", pubkeyHash, 11, sync.Hash, "rotate")
+	if result := applyEntryResult(f, 8, unknown); !strings.Contains(result, "unknown record_type") {
+		t.Fatalf("Expected unknown record type to be rejected, got: %s", result)
+	}
+
+	del := newTestEntry(t, privKey, "key_a", pubkeyHash, 11, sync.Hash, "delete")
+	applyTestEntry(t, f, 9, del)
+	if lifecycle, _ := f.GetKeyLifecycle(pubkeyHash); lifecycle.State != KeyStateDeleted {
+		t.Fatalf("Expected state deleted, got %s", lifecycle.State)
+	}
+
+	// Nothing follows a delete, including reservations
+	after := newTestEntry(t, privKey, "key_a", pubkeyHash, 12, del.Hash, "sign")
+	if result := applyEntryResult(f, 10, after); !strings.Contains(result, "key is deleted") {
+		t.Fatalf("Expected sign after delete to be rejected, got: %s", result)
+	}
+	if result, _ := applyReservation(f, 11, newTestReservation(t, privKey, "key_a", pubkeyHash, del.Hash, "sign")).(string); !strings.Contains(result, "key is deleted") {
+		t.Fatalf("Expected reservation after delete to be rejected, got: %s", result)
+	}
+}
+
+func TestKeyLifecycle_ExhaustedOnlyAllowsDelete(t *testing.T) {
+	if _, err := nextKeyState(&KeyLifecycle{State: KeyStateExhausted}, 31, "sign", 32); err == nil {
+		t.Fatal("Expected sign on exhausted key to be rejected")
+	}
+	if state, err := nextKeyState(&KeyLifecycle{State: KeyStateExhausted}, 31, "delete", 32); err != nil || state != KeyStateDeleted {
+		t.Fatalf("Expected delete on exhausted key to succeed, got state=%s err=%v", state, err)
+	}
+}
+
+func TestKeyLifecycle_RebuiltFromOlderSnapshot(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	raftIndex := uint64(0)
+	last := buildTestChain(t, f, privKey, "key_a", 2, &raftIndex)
+	del := newTestEntry(t, privKey, "key_a", last.PubkeyHash, last.Index+1, last.Hash, "delete")
+	applyTestEntry(t, f, raftIndex+1, del)
+
+	// Downgrade the snapshot to version 3 (no lifecycle states)
+	var data map[string]json.RawMessage
+	json.Unmarshal(persistSnapshot(t, f), &data)
+	delete(data, "key_states")
+	data["version"] = json.RawMessage("3")
+	legacy, _ := json.Marshal(data)
+
+	restored, _ := NewKeyIndexFSM("")
+	restored.PinAttestationKey(&privKey.PublicKey)
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(legacy))); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if lifecycle, exists := restored.GetKeyLifecycle(last.PubkeyHash); !exists || lifecycle.State != KeyStateDeleted {
+		t.Fatalf("Expected deleted state rebuilt from chain, got %+v", lifecycle)
+	}
+}
@@ -0,0 +1,486 @@
+package fsm
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/hashicorp/raft"
+)
+
+// Attestation key registry operations
+const (
+	RegistryOpBootstrap = "bootstrap" // Seeds the first attestation key and the admin quorum (sequence 1, once, signed by the configured bootstrap quorum)
+	RegistryOpRegister  = "register"
+	RegistryOpRotate    = "rotate"
+	RegistryOpRevoke    = "revoke"
+)
+
+// Attestation key status values
+const (
+	AttestationKeyActive  = "active"
+	AttestationKeyRotated = "rotated"
+	AttestationKeyRevoked = "revoked"
+)
+
+// registryDomain separates admin registry signatures from any other use of the admin keys
+const registryDomain = "verifiable-state-chains/lms/attestation-key-registry/v1"
+
+// AdminSignature is one admin's signature over a registry command
+type AdminSignature struct {
+	AdminKey  string `json:"admin_key"` // Base64 encoded PKIX EC public key of the admin
+	Signature string `json:"signature"` // Base64 encoded ASN.1 ECDSA signature over the command digest
+}
+
+// RegistryCommand changes the set of attestation keys allowed to commit key index entries
+type RegistryCommand struct {
+	Op           string `json:"registry_op"`              // bootstrap, register, rotate or revoke
+	PublicKey    string `json:"public_key"`               // Key being registered, rotated in or revoked (base64 PKIX)
+	OldPublicKey string `json:"old_public_key,omitempty"` // Key being rotated out (rotate only)
+	Label        string `json:"label,omitempty"`          // Human readable name, e.g. the HSM instance
+	Sequence     uint64 `json:"sequence"`                 // Must be registry sequence + 1 (prevents replay of old commands)
+
+	// Admin quorum seeded by the bootstrap command; signed by threshold of these admins
+	AdminKeys      []string `json:"admin_keys,omitempty"` // Base64 PKIX EC public keys
+	AdminThreshold int      `json:"admin_threshold,omitempty"`
+
+	AdminSignatures []AdminSignature `json:"admin_signatures"`
+}
+
+// AttestationKeyRecord is the registry state of one attestation public key
+type AttestationKeyRecord struct {
+	Fingerprint  string `json:"fingerprint"` // Hex SHA-256 of the PKIX encoded key
+	PublicKey    string `json:"public_key"`
+	Label        string `json:"label,omitempty"`
+	Status       string `json:"status"`
+	RegisteredAt uint64 `json:"registered_at"`        // Raft index of registration (0: bootstrap key)
+	RetiredAt    uint64 `json:"retired_at,omitempty"` // Raft index of rotation or revocation
+}
+
+// attestationKeyRegistry is the replicated set of attestation keys and the admin quorum that changes it
+// Both are seeded only by the bootstrap command in the log, so every node decides from the same state.
+// The bootstrap command must be signed by the bootstrap quorum every node is configured with, and until
+// it is applied only the pinned attestation key may sign entries (KeyIndexFSM.authorizeKey).
+type attestationKeyRegistry struct {
+	Keys     map[string]*AttestationKeyRecord `json:"keys"`
+	Sequence uint64                           `json:"sequence"`
+
+	Admins    map[string]string `json:"admins,omitempty"`    // fingerprint -> base64 PKIX admin key
+	Threshold int               `json:"threshold,omitempty"` // 0: not bootstrapped
+}
+
+// newAttestationKeyRegistry creates an empty registry awaiting its bootstrap command
+func newAttestationKeyRegistry() *attestationKeyRegistry {
+	return &attestationKeyRegistry{Keys: make(map[string]*AttestationKeyRecord)}
+}
+
+// clone returns a deep copy of the registry
+func (r *attestationKeyRegistry) clone() *attestationKeyRegistry {
+	result := &attestationKeyRegistry{
+		Keys:      make(map[string]*AttestationKeyRecord, len(r.Keys)),
+		Sequence:  r.Sequence,
+		Threshold: r.Threshold,
+	}
+	for k, v := range r.Keys {
+		record := *v
+		result.Keys[k] = &record
+	}
+	if r.Admins != nil {
+		result.Admins = make(map[string]string, len(r.Admins))
+		for k, v := range r.Admins {
+			result.Admins[k] = v
+		}
+	}
+	return result
+}
+
+// bootstrapped reports whether the bootstrap command has been applied
+func (r *attestationKeyRegistry) bootstrapped() bool {
+	return r.Threshold > 0
+}
+
+// records returns copies of all key records sorted by registration index
+func (r *attestationKeyRegistry) records() []AttestationKeyRecord {
+	result := make([]AttestationKeyRecord, 0, len(r.Keys))
+	for _, record := range r.Keys {
+		result = append(result, *record)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].RegisteredAt != result[j].RegisteredAt {
+			return result[i].RegisteredAt < result[j].RegisteredAt
+		}
+		return result[i].Fingerprint < result[j].Fingerprint
+	})
+	return result
+}
+
+// authorizeKey checks that a base64 PKIX attestation key is active in the registry
+func (r *attestationKeyRegistry) authorizeKey(publicKey string) error {
+	fingerprint, err := AttestationKeyFingerprint(publicKey)
+	if err != nil {
+		return err
+	}
+
+	record, exists := r.Keys[fingerprint]
+	if !exists {
+		return fmt.Errorf("attestation key %s is not registered", fingerprint)
+	}
+	if record.Status != AttestationKeyActive {
+		return fmt.Errorf("attestation key %s is %s (since Raft index %d)", fingerprint, record.Status, record.RetiredAt)
+	}
+	return nil
+}
+
+// apply executes a registry command that has already passed admin quorum verification
+func (r *attestationKeyRegistry) apply(cmd *RegistryCommand, raftIndex uint64) error {
+	if cmd.Sequence != r.Sequence+1 {
+		return fmt.Errorf("sequence %d does not follow registry sequence %d", cmd.Sequence, r.Sequence)
+	}
+
+	fingerprint, err := AttestationKeyFingerprint(cmd.PublicKey)
+	if err != nil {
+		return err
+	}
+	existing, exists := r.Keys[fingerprint]
+	if cmd.Op != RegistryOpBootstrap && (len(cmd.AdminKeys) > 0 || cmd.AdminThreshold != 0) {
+		return fmt.Errorf("admin_keys and admin_threshold are only valid on bootstrap")
+	}
+
+	switch cmd.Op {
+	case RegistryOpBootstrap:
+		if r.bootstrapped() {
+			return fmt.Errorf("registry is already bootstrapped")
+		}
+		quorum, err := newAdminQuorum(cmd.AdminKeys, cmd.AdminThreshold)
+		if err != nil {
+			return err
+		}
+		r.Admins = quorum.encoded
+		r.Threshold = quorum.threshold
+	case RegistryOpRegister:
+		if exists {
+			return fmt.Errorf("attestation key %s is already registered (%s)", fingerprint, existing.Status)
+		}
+	case RegistryOpRotate:
+		if exists {
+			return fmt.Errorf("attestation key %s is already registered (%s)", fingerprint, existing.Status)
+		}
+		oldFingerprint, err := AttestationKeyFingerprint(cmd.OldPublicKey)
+		if err != nil {
+			return fmt.Errorf("invalid old_public_key: %v", err)
+		}
+		old, oldExists := r.Keys[oldFingerprint]
+		if !oldExists || old.Status != AttestationKeyActive {
+			return fmt.Errorf("attestation key %s is not active", oldFingerprint)
+		}
+		old.Status = AttestationKeyRotated
+		old.RetiredAt = raftIndex
+	case RegistryOpRevoke:
+		if !exists || existing.Status == AttestationKeyRevoked {
+			return fmt.Errorf("attestation key %s is not registered or already revoked", fingerprint)
+		}
+		existing.Status = AttestationKeyRevoked
+		existing.RetiredAt = raftIndex
+		r.Sequence = cmd.Sequence
+		return nil
+	default:
+		return fmt.Errorf("unknown registry operation %q", cmd.Op)
+	}
+
+	r.Keys[fingerprint] = &AttestationKeyRecord{
+		Fingerprint:  fingerprint,
+		PublicKey:    cmd.PublicKey,
+		Label:        cmd.Label,
+		Status:       AttestationKeyActive,
+		RegisteredAt: raftIndex,
+	}
+	r.Sequence = cmd.Sequence
+	return nil
+}
+
+// adminQuorum is the set of admin keys allowed to change the registry
+type adminQuorum struct {
+	keys      map[string]*ecdsa.PublicKey // fingerprint -> admin public key
+	encoded   map[string]string           // fingerprint -> base64 PKIX admin key
+	threshold int
+}
+
+// newAdminQuorum parses base64 PKIX admin keys into a quorum of threshold distinct keys
+func newAdminQuorum(adminKeys []string, threshold int) (*adminQuorum, error) {
+	quorum := &adminQuorum{
+		keys:      make(map[string]*ecdsa.PublicKey),
+		encoded:   make(map[string]string),
+		threshold: threshold,
+	}
+	for _, encoded := range adminKeys {
+		key, err := parseEntryPublicKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin key: %v", err)
+		}
+		_, fingerprint, err := encodeAttestationKey(key)
+		if err != nil {
+			return nil, err
+		}
+		quorum.keys[fingerprint] = key
+		quorum.encoded[fingerprint] = encoded
+	}
+	if threshold < 1 || threshold > len(quorum.keys) {
+		return nil, fmt.Errorf("admin threshold %d out of range (1..%d distinct admin keys)", threshold, len(quorum.keys))
+	}
+	return quorum, nil
+}
+
+// quorum returns the admin quorum that signs registry commands
+// The bootstrap command is signed by the configured bootstrap quorum, never by the quorum it carries;
+// later commands by the replicated quorum.
+func (r *attestationKeyRegistry) quorum(cmd *RegistryCommand, bootstrapQuorum *adminQuorum) (*adminQuorum, error) {
+	if cmd.Op == RegistryOpBootstrap {
+		if bootstrapQuorum == nil {
+			return nil, fmt.Errorf("no registry bootstrap quorum is configured")
+		}
+		return bootstrapQuorum, nil
+	}
+	if !r.bootstrapped() {
+		return nil, fmt.Errorf("registry is not bootstrapped")
+	}
+	admins := make([]string, 0, len(r.Admins))
+	for _, encoded := range r.Admins {
+		admins = append(admins, encoded)
+	}
+	return newAdminQuorum(admins, r.Threshold)
+}
+
+// verify checks that at least threshold distinct admins signed the command
+func (q *adminQuorum) verify(cmd *RegistryCommand) error {
+
+	digest := cmd.SigningDigest()
+	signers := make(map[string]bool)
+	for _, sig := range cmd.AdminSignatures {
+		fingerprint, err := AttestationKeyFingerprint(sig.AdminKey)
+		if err != nil {
+			continue
+		}
+		adminKey, ok := q.keys[fingerprint]
+		if !ok {
+			continue
+		}
+		sigBytes, err := base64.StdEncoding.DecodeString(sig.Signature)
+		if err != nil {
+			continue
+		}
+		if ecdsa.VerifyASN1(adminKey, digest[:], sigBytes) {
+			signers[fingerprint] = true
+		}
+	}
+
+	if len(signers) < q.threshold {
+		return fmt.Errorf("admin quorum not met: %d of %d required signatures", len(signers), q.threshold)
+	}
+	return nil
+}
+
+// SigningDigest returns the digest admins sign for a registry command
+// Each field is length prefixed after the domain, so fields cannot be shifted into each other
+func (c *RegistryCommand) SigningDigest() [32]byte {
+	sequence := make([]byte, 8)
+	binary.BigEndian.PutUint64(sequence, c.Sequence)
+
+	payload := appendLengthPrefixed(make([]byte, 0, 256),
+		[]byte(registryDomain),
+		[]byte(c.Op),
+		[]byte(c.PublicKey),
+		[]byte(c.OldPublicKey),
+		[]byte(c.Label),
+		sequence,
+	)
+
+	// The bootstrap command also signs the quorum it seeds
+	if c.Op == RegistryOpBootstrap {
+		threshold := make([]byte, 8)
+		binary.BigEndian.PutUint64(threshold, uint64(c.AdminThreshold))
+		payload = appendLengthPrefixed(payload, threshold)
+		for _, adminKey := range c.AdminKeys {
+			payload = appendLengthPrefixed(payload, []byte(adminKey))
+		}
+	}
+	return sha256.Sum256(payload)
+}
+
+// SignRegistryCommand adds an admin signature to a registry command
+func SignRegistryCommand(cmd *RegistryCommand, adminKey *ecdsa.PrivateKey) error {
+	encoded, _, err := encodeAttestationKey(&adminKey.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	digest := cmd.SigningDigest()
+	signature, err := ecdsa.SignASN1(rand.Reader, adminKey, digest[:])
+	if err != nil {
+		return fmt.Errorf("failed to sign registry command: %v", err)
+	}
+
+	cmd.AdminSignatures = append(cmd.AdminSignatures, AdminSignature{
+		AdminKey:  encoded,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	})
+	return nil
+}
+
+// AttestationKeyFingerprint returns the hex SHA-256 of a base64 PKIX EC public key
+func AttestationKeyFingerprint(encoded string) (string, error) {
+	pubKey, err := parseEntryPublicKey(encoded)
+	if err != nil {
+		return "", err
+	}
+	_, fingerprint, err := encodeAttestationKey(pubKey)
+	return fingerprint, err
+}
+
+// encodeAttestationKey returns the base64 PKIX encoding and fingerprint of a public key
+func encodeAttestationKey(pubKey *ecdsa.PublicKey) (string, string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal public key: %v", err)
+	}
+	sum := sha256.Sum256(der)
+	return base64.StdEncoding.EncodeToString(der), hex.EncodeToString(sum[:]), nil
+}
+
+// LoadECPublicKeyPEM loads a PKIX EC public key from a PEM file
+func LoadECPublicKeyPEM(path string) (*ecdsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM")
+	}
+
+	pubKeyInterface, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+
+	pubKey, ok := pubKeyInterface.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ECDSA public key")
+	}
+
+	return pubKey, nil
+}
+
+// isRegistryCommand reports whether raw log data is a registry command
+func isRegistryCommand(data []byte) bool {
+	var probe struct {
+		Op string `json:"registry_op"`
+	}
+	return json.Unmarshal(data, &probe) == nil && probe.Op != ""
+}
+
+// applyRegistryCommand verifies and applies a registry command (caller must hold the lock)
+func (f *KeyIndexFSM) applyRegistryCommand(l *raft.Log) interface{} {
+	var cmd RegistryCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return fmt.Sprintf("Error: Failed to parse registry command: %v", err)
+	}
+
+	quorum, err := f.registry.quorum(&cmd, f.bootstrapQuorum)
+	if err == nil {
+		err = quorum.verify(&cmd)
+	}
+	if err != nil {
+		return fmt.Sprintf("Error: Registry command rejected: %v", err)
+	}
+
+	if err := f.registry.apply(&cmd, l.Index); err != nil {
+		return fmt.Sprintf("Error: Registry command rejected: %v", err)
+	}
+	f.markDirty(stateRegistry, stateRegistry)
+
+	fingerprint, _ := AttestationKeyFingerprint(cmd.PublicKey)
+	return fmt.Sprintf("Applied registry %s: fingerprint=%s, sequence=%d", cmd.Op, fingerprint, cmd.Sequence)
+}
+
+// VerifyEntryAuthorization checks an entry's signature and that its attestation key is active in the registry
+// Called by the API server BEFORE applying to Raft; Apply performs the same check on every node
+func (f *KeyIndexFSM) VerifyEntryAuthorization(entry *KeyIndexEntry) error {
+	if err := f.verifySignature(entry); err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.authorizeKey(entry.PublicKey)
+}
+
+// authorizeKey checks that an attestation key may sign at this log position (caller must hold the lock)
+// Before the registry is bootstrapped only the pinned attestation key may; afterwards the registry decides.
+func (f *KeyIndexFSM) authorizeKey(publicKey string) error {
+	if f.registry.bootstrapped() {
+		return f.registry.authorizeKey(publicKey)
+	}
+	if f.attestationPubKey == nil {
+		return fmt.Errorf("the attestation key registry is not bootstrapped and no attestation key is pinned")
+	}
+
+	fingerprint, err := AttestationKeyFingerprint(publicKey)
+	if err != nil {
+		return err
+	}
+	_, pinned, err := encodeAttestationKey(f.attestationPubKey)
+	if err != nil {
+		return err
+	}
+	if fingerprint != pinned {
+		return fmt.Errorf("attestation key %s is not the pinned attestation key (the registry is not bootstrapped)", fingerprint)
+	}
+	return nil
+}
+
+// PinAttestationKey sets the attestation key allowed to sign entries until the registry is bootstrapped
+// NewKeyIndexFSM pins the key it loads. Must be identical on every node so all replicas apply the same log the same way.
+func (f *KeyIndexFSM) PinAttestationKey(pubKey *ecdsa.PublicKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attestationPubKey = pubKey
+}
+
+// SetRegistryBootstrapQuorum sets the admins whose threshold signatures authorize the bootstrap command
+// Must be identical on every node so all replicas apply the same log the same way.
+func (f *KeyIndexFSM) SetRegistryBootstrapQuorum(adminKeys []*ecdsa.PublicKey, threshold int) error {
+	encoded := make([]string, 0, len(adminKeys))
+	for _, key := range adminKeys {
+		adminKey, _, err := encodeAttestationKey(key)
+		if err != nil {
+			return err
+		}
+		encoded = append(encoded, adminKey)
+	}
+	quorum, err := newAdminQuorum(encoded, threshold)
+	if err != nil {
+		return fmt.Errorf("invalid registry bootstrap quorum: %v", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bootstrapQuorum = quorum
+	return nil
+}
+
+// GetAttestationKeys returns all registered attestation keys and the registry sequence
+func (f *KeyIndexFSM) GetAttestationKeys() ([]AttestationKeyRecord, uint64) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.registry.records(), f.registry.Sequence
+}
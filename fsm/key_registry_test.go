@@ -0,0 +1,293 @@
+package fsm
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func generateTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return key
+}
+
+// newRegistryCommand builds a registry command signed by the given admins
+func newRegistryCommand(t *testing.T, op string, key, oldKey *ecdsa.PrivateKey, sequence uint64, admins ...*ecdsa.PrivateKey) *RegistryCommand {
+	t.Helper()
+
+	cmd := &RegistryCommand{Op: op, Sequence: sequence, Label: "hsm"}
+	cmd.PublicKey, _, _ = encodeAttestationKey(&key.PublicKey)
+	if oldKey != nil {
+		cmd.OldPublicKey, _, _ = encodeAttestationKey(&oldKey.PublicKey)
+	}
+	for _, admin := range admins {
+		if err := SignRegistryCommand(cmd, admin); err != nil {
+			t.Fatalf("Failed to sign registry command: %v", err)
+		}
+	}
+	return cmd
+}
+
+func applyRegistryResult(f raft.FSM, raftIndex uint64, cmd *RegistryCommand) string {
+	data := testLogData(f, CommandRegistry, cmd)
+	result, _ := f.Apply(&raft.Log{Type: raft.LogCommand, Index: raftIndex, Term: 1, Data: data}).(string)
+	return result
+}
+
+// newBootstrapCommand builds the bootstrap command seeding key and a 2-of-n admin quorum
+func newBootstrapCommand(t *testing.T, key *ecdsa.PrivateKey, admins []*ecdsa.PrivateKey, signers ...*ecdsa.PrivateKey) *RegistryCommand {
+	t.Helper()
+
+	cmd := &RegistryCommand{Op: RegistryOpBootstrap, Sequence: 1, Label: "bootstrap", AdminThreshold: 2}
+	cmd.PublicKey, _, _ = encodeAttestationKey(&key.PublicKey)
+	for _, admin := range admins {
+		encoded, _, _ := encodeAttestationKey(&admin.PublicKey)
+		cmd.AdminKeys = append(cmd.AdminKeys, encoded)
+	}
+	for _, signer := range signers {
+		if err := SignRegistryCommand(cmd, signer); err != nil {
+			t.Fatalf("Failed to sign bootstrap command: %v", err)
+		}
+	}
+	return cmd
+}
+
+// newRegistryBootstrapFSM creates an FSM configured with a 2-of-n bootstrap quorum of admins
+func newRegistryBootstrapFSM(t *testing.T, admins []*ecdsa.PrivateKey) *KeyIndexFSM {
+	t.Helper()
+
+	f, _ := NewKeyIndexFSM("")
+	publicKeys := make([]*ecdsa.PublicKey, 0, len(admins))
+	for _, admin := range admins {
+		publicKeys = append(publicKeys, &admin.PublicKey)
+	}
+	if err := f.SetRegistryBootstrapQuorum(publicKeys, 2); err != nil {
+		t.Fatalf("SetRegistryBootstrapQuorum failed: %v", err)
+	}
+	return f
+}
+
+// newRegistryTestFSM creates an FSM bootstrapped at Raft index 1 with an attestation key and a 2-of-3 admin quorum
+func newRegistryTestFSM(t *testing.T, bootstrap *ecdsa.PrivateKey, admins []*ecdsa.PrivateKey) *KeyIndexFSM {
+	t.Helper()
+
+	f := newRegistryBootstrapFSM(t, admins)
+	cmd := newBootstrapCommand(t, bootstrap, admins, admins[0], admins[1])
+	if result := applyRegistryResult(f, 1, cmd); strings.HasPrefix(result, "Error") {
+		t.Fatalf("Bootstrap rejected: %s", result)
+	}
+	return f
+}
+
+func TestKeyRegistry_Bootstrap(t *testing.T) {
+	bootstrap := generateTestKey(t)
+	admins := []*ecdsa.PrivateKey{generateTestKey(t), generateTestKey(t), generateTestKey(t)}
+
+	// Without a configured bootstrap quorum nobody can bootstrap the registry
+	unconfigured, _ := NewKeyIndexFSM("")
+	cmd := newBootstrapCommand(t, bootstrap, admins, admins[0], admins[1])
+	if result := applyRegistryResult(unconfigured, 1, cmd); !strings.Contains(result, "no registry bootstrap quorum") {
+		t.Fatalf("Expected bootstrap without a configured quorum to be rejected, got: %s", result)
+	}
+
+	f := newRegistryBootstrapFSM(t, admins)
+	f.PinAttestationKey(&bootstrap.PublicKey)
+
+	// Registry commands need the replicated quorum, which only the bootstrap command seeds
+	register := newRegistryCommand(t, RegistryOpRegister, generateTestKey(t), nil, 1, admins[0], admins[1])
+	if result := applyRegistryResult(f, 1, register); !strings.Contains(result, "not bootstrapped") {
+		t.Fatalf("Expected register before bootstrap to be rejected, got: %s", result)
+	}
+
+	// The bootstrap command must be signed by the configured quorum, not by the quorum it carries
+	rogueAdmins := []*ecdsa.PrivateKey{generateTestKey(t), generateTestKey(t)}
+	cmd = newBootstrapCommand(t, bootstrap, rogueAdmins, rogueAdmins[0], rogueAdmins[1])
+	if result := applyRegistryResult(f, 2, cmd); !strings.Contains(result, "quorum not met") {
+		t.Fatalf("Expected self-authorized bootstrap to be rejected, got: %s", result)
+	}
+	cmd = newBootstrapCommand(t, bootstrap, admins, admins[0])
+	if result := applyRegistryResult(f, 2, cmd); !strings.Contains(result, "quorum not met") {
+		t.Fatalf("Expected under-signed bootstrap to be rejected, got: %s", result)
+	}
+	cmd = newBootstrapCommand(t, bootstrap, admins, admins[0], admins[2])
+	cmd.AdminThreshold = 1
+	if result := applyRegistryResult(f, 3, cmd); !strings.Contains(result, "quorum not met") {
+		t.Fatalf("Expected tampered bootstrap threshold to be rejected, got: %s", result)
+	}
+
+	// Before bootstrap only the pinned attestation key signs entries, afterwards only registered keys
+	rogue := generateTestKey(t)
+	entry := newTestEntry(t, rogue, "key_a", ComputePubkeyHash([]byte("pk_a")), 0, GenesisHash, "create")
+	if result := applyEntryResult(f, 4, entry); !strings.Contains(result, "not the pinned attestation key") {
+		t.Fatalf("Expected an unpinned key to be rejected before bootstrap, got: %s", result)
+	}
+	entry = newTestEntry(t, bootstrap, "key_a", ComputePubkeyHash([]byte("pk_a")), 0, GenesisHash, "create")
+	applyTestEntry(t, f, 4, entry)
+
+	cmd = newBootstrapCommand(t, bootstrap, admins, admins[0], admins[2])
+	if result := applyRegistryResult(f, 5, cmd); strings.HasPrefix(result, "Error") {
+		t.Fatalf("Bootstrap rejected: %s", result)
+	}
+	entry = newTestEntry(t, rogue, "key_b", ComputePubkeyHash([]byte("pk_b")), 0, GenesisHash, "create")
+	if result := applyEntryResult(f, 6, entry); !strings.Contains(result, "Unauthorized attestation key") {
+		t.Fatalf("Expected unregistered key to be rejected after bootstrap, got: %s", result)
+	}
+
+	// A second bootstrap cannot replace the quorum, even signed by the configured admins
+	other := []*ecdsa.PrivateKey{generateTestKey(t), generateTestKey(t)}
+	cmd = newBootstrapCommand(t, rogue, other)
+	cmd.Sequence = 2
+	SignRegistryCommand(cmd, admins[0])
+	SignRegistryCommand(cmd, admins[1])
+	if result := applyRegistryResult(f, 7, cmd); !strings.Contains(result, "already bootstrapped") {
+		t.Fatalf("Expected second bootstrap to be rejected, got: %s", result)
+	}
+
+	// Only the replicated state decides: a node without any local key configuration agrees
+	keys, sequence := f.GetAttestationKeys()
+	if len(keys) != 1 || sequence != 1 || keys[0].RegisteredAt != 5 {
+		t.Fatalf("Unexpected registry state: %+v (sequence %d)", keys, sequence)
+	}
+}
+
+func TestKeyRegistry_RejectsUnregisteredKey(t *testing.T) {
+	bootstrap := generateTestKey(t)
+	admins := []*ecdsa.PrivateKey{generateTestKey(t), generateTestKey(t), generateTestKey(t)}
+	f := newRegistryTestFSM(t, bootstrap, admins)
+
+	// A self-signed entry from an unknown key must be rejected on every node
+	rogue := generateTestKey(t)
+	entry := newTestEntry(t, rogue, "key_a", ComputePubkeyHash([]byte("pk_a")), 0, GenesisHash, "create")
+	if result := applyEntryResult(f, 2, entry); !strings.Contains(result, "Unauthorized attestation key") {
+		t.Fatalf("Expected unregistered key to be rejected, got: %s", result)
+	}
+	if err := f.VerifyEntryAuthorization(entry); err == nil {
+		t.Fatal("VerifyEntryAuthorization accepted an unregistered key")
+	}
+
+	entry = newTestEntry(t, bootstrap, "key_a", ComputePubkeyHash([]byte("pk_a")), 0, GenesisHash, "create")
+	if result := applyEntryResult(f, 3, entry); strings.HasPrefix(result, "Error") {
+		t.Fatalf("Bootstrap key rejected: %s", result)
+	}
+}
+
+func TestKeyRegistry_AdminQuorum(t *testing.T) {
+	bootstrap := generateTestKey(t)
+	admins := []*ecdsa.PrivateKey{generateTestKey(t), generateTestKey(t), generateTestKey(t)}
+	f := newRegistryTestFSM(t, bootstrap, admins)
+	hsm2 := generateTestKey(t)
+
+	// One signature (or the same admin twice) does not meet a 2-of-3 quorum
+	cmd := newRegistryCommand(t, RegistryOpRegister, hsm2, nil, 2, admins[0], admins[0])
+	if result := applyRegistryResult(f, 2, cmd); !strings.Contains(result, "quorum not met") {
+		t.Fatalf("Expected quorum failure, got: %s", result)
+	}
+
+	// Signatures from non-admins do not count
+	cmd = newRegistryCommand(t, RegistryOpRegister, hsm2, nil, 2, admins[0], generateTestKey(t))
+	if result := applyRegistryResult(f, 3, cmd); !strings.Contains(result, "quorum not met") {
+		t.Fatalf("Expected quorum failure for non-admin signer, got: %s", result)
+	}
+
+	// Tampering with a signed command invalidates the signatures
+	cmd = newRegistryCommand(t, RegistryOpRegister, hsm2, nil, 2, admins[0], admins[1])
+	cmd.Label = "tampered"
+	if result := applyRegistryResult(f, 4, cmd); !strings.Contains(result, "quorum not met") {
+		t.Fatalf("Expected tampered command to be rejected, got: %s", result)
+	}
+
+	cmd = newRegistryCommand(t, RegistryOpRegister, hsm2, nil, 2, admins[0], admins[2])
+	if result := applyRegistryResult(f, 5, cmd); strings.HasPrefix(result, "Error") {
+		t.Fatalf("Register rejected: %s", result)
+	}
+
+	// Replaying the same command fails the sequence check
+	if result := applyRegistryResult(f, 6, cmd); !strings.Contains(result, "sequence") {
+		t.Fatalf("Expected replay to be rejected, got: %s", result)
+	}
+
+	keys, sequence := f.GetAttestationKeys()
+	if len(keys) != 2 || sequence != 2 || keys[1].RegisteredAt != 5 {
+		t.Fatalf("Unexpected registry state: %+v (sequence %d)", keys, sequence)
+	}
+}
+
+func TestKeyRegistry_RotateAndRevoke(t *testing.T) {
+	bootstrap := generateTestKey(t)
+	admins := []*ecdsa.PrivateKey{generateTestKey(t), generateTestKey(t), generateTestKey(t)}
+	f := newRegistryTestFSM(t, bootstrap, admins)
+	hsm2 := generateTestKey(t)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+
+	create := newTestEntry(t, bootstrap, "key_a", pubkeyHash, 0, GenesisHash, "create")
+	applyTestEntry(t, f, 2, create)
+
+	// Rotate bootstrap -> hsm2
+	rotate := newRegistryCommand(t, RegistryOpRotate, hsm2, bootstrap, 2, admins[1], admins[2])
+	if result := applyRegistryResult(f, 3, rotate); strings.HasPrefix(result, "Error") {
+		t.Fatalf("Rotate rejected: %s", result)
+	}
+
+	// The rotated-out key can no longer commit, the new one continues the chain
+	stale := newTestEntry(t, bootstrap, "key_a", pubkeyHash, 1, create.Hash, "sign")
+	if result := applyEntryResult(f, 4, stale); !strings.Contains(result, "rotated") {
+		t.Fatalf("Expected rotated key to be rejected, got: %s", result)
+	}
+	next := newTestEntry(t, hsm2, "key_a", pubkeyHash, 1, create.Hash, "sign")
+	applyTestEntry(t, f, 5, next)
+
+	// Revoke hsm2
+	revoke := newRegistryCommand(t, RegistryOpRevoke, hsm2, nil, 3, admins[0], admins[1])
+	if result := applyRegistryResult(f, 6, revoke); strings.HasPrefix(result, "Error") {
+		t.Fatalf("Revoke rejected: %s", result)
+	}
+	after := newTestEntry(t, hsm2, "key_a", pubkeyHash, 2, next.Hash, "sign")
+	if result := applyEntryResult(f, 7, after); !strings.Contains(result, "revoked") {
+		t.Fatalf("Expected revoked key to be rejected, got: %s", result)
+	}
+}
+
+func TestKeyRegistry_SnapshotRestore(t *testing.T) {
+	bootstrap := generateTestKey(t)
+	admins := []*ecdsa.PrivateKey{generateTestKey(t), generateTestKey(t), generateTestKey(t)}
+	f := newRegistryTestFSM(t, bootstrap, admins)
+	hsm2 := generateTestKey(t)
+
+	revoke := newRegistryCommand(t, RegistryOpRevoke, bootstrap, nil, 2, admins[0], admins[1])
+	register := newRegistryCommand(t, RegistryOpRegister, hsm2, nil, 3, admins[0], admins[1])
+	applyRegistryResult(f, 2, revoke)
+	applyRegistryResult(f, 3, register)
+
+	data := persistSnapshot(t, f)
+
+	// The restored node adopts the snapshot registry and its admin quorum
+	restored, _ := NewKeyIndexFSM("")
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	if _, sequence := restored.GetAttestationKeys(); sequence != 3 {
+		t.Fatalf("Expected registry sequence 3 after restore, got %d", sequence)
+	}
+	entry := newTestEntry(t, bootstrap, "key_a", ComputePubkeyHash([]byte("pk_a")), 0, GenesisHash, "create")
+	if result := applyEntryResult(restored, 4, entry); !strings.Contains(result, "revoked") {
+		t.Fatalf("Expected revoked bootstrap key to stay revoked after restore, got: %s", result)
+	}
+	entry = newTestEntry(t, hsm2, "key_a", ComputePubkeyHash([]byte("pk_a")), 0, GenesisHash, "create")
+	applyTestEntry(t, restored, 5, entry)
+
+	revokeHSM2 := newRegistryCommand(t, RegistryOpRevoke, hsm2, nil, 4, admins[1], admins[2])
+	if result := applyRegistryResult(restored, 6, revokeHSM2); strings.HasPrefix(result, "Error") {
+		t.Fatalf("Restored admin quorum rejected a registry command: %s", result)
+	}
+}
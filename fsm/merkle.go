@@ -0,0 +1,259 @@
+package fsm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/bits"
+)
+
+// RFC 6962 hash prefixes: leaves and interior nodes are hashed in separate domains
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleLeafHash returns the RFC 6962 leaf hash SHA-256(0x00 || data)
+func MerkleLeafHash(data []byte) [32]byte {
+	return sha256.Sum256(append([]byte{merkleLeafPrefix}, data...))
+}
+
+// merkleNodeHash returns the RFC 6962 interior node hash SHA-256(0x01 || left || right)
+func merkleNodeHash(left, right [32]byte) [32]byte {
+	buf := make([]byte, 0, 65)
+	buf = append(buf, merkleNodePrefix)
+	buf = append(buf, left[:]...)
+	buf = append(buf, right[:]...)
+	return sha256.Sum256(buf)
+}
+
+// merkleSplit returns the largest power of two strictly smaller than n (n >= 2)
+func merkleSplit(n uint64) uint64 {
+	return uint64(1) << (bits.Len64(n-1) - 1)
+}
+
+// merkleTree is an append-only RFC 6962 Merkle tree
+// Node (k, i) is the root of the complete subtree over leaves [i*2^k, (i+1)*2^k); level 0 holds the
+// leaf hashes. Every subtree visited by the RFC 6962 recursion is either complete and aligned (a lookup)
+// or split further, so roots and proofs for any tree size cost O(log^2 n) hashes.
+// Only the frontier (the last node of each level, which the next appends combine) and the nodes added
+// since they were last taken for the store stay in memory; every other node is read back through stored.
+type merkleTree struct {
+	sizes    []uint64                  // Nodes of each level
+	frontier [][32]byte                // Last node of each level
+	added    map[merkleNodeID][32]byte // Nodes not yet taken for the store
+	stored   func(level int, i uint64) [32]byte
+}
+
+// merkleNodeID names node i of a tree level
+type merkleNodeID struct {
+	level int
+	i     uint64
+}
+
+// newMerkleTree returns an empty tree that reads taken nodes through stored (nil keeps every node in memory)
+func newMerkleTree(stored func(level int, i uint64) [32]byte) *merkleTree {
+	return &merkleTree{added: make(map[merkleNodeID][32]byte), stored: stored}
+}
+
+// loadMerkleTree resumes a tree of size leaves whose nodes are all stored
+func loadMerkleTree(size uint64, stored func(level int, i uint64) [32]byte) *merkleTree {
+	t := newMerkleTree(stored)
+	for k := 0; size>>k > 0; k++ {
+		t.sizes = append(t.sizes, size>>k)
+		t.frontier = append(t.frontier, stored(k, (size>>k)-1))
+	}
+	return t
+}
+
+// size returns the number of leaves
+func (t *merkleTree) size() uint64 {
+	if len(t.sizes) == 0 {
+		return 0
+	}
+	return t.sizes[0]
+}
+
+// append adds a leaf hash and completes any subtrees it closes
+func (t *merkleTree) append(leafHash [32]byte) {
+	hash := leafHash
+	for k := 0; ; k++ {
+		if k == len(t.sizes) {
+			t.sizes = append(t.sizes, 0)
+			t.frontier = append(t.frontier, [32]byte{})
+		}
+		i, left := t.sizes[k], t.frontier[k]
+		t.added[merkleNodeID{k, i}] = hash
+		t.sizes[k]++
+		t.frontier[k] = hash
+		if i%2 == 0 {
+			return
+		}
+		hash = merkleNodeHash(left, hash)
+	}
+}
+
+// node returns node i of a level
+func (t *merkleTree) node(level int, i uint64) [32]byte {
+	if i == t.sizes[level]-1 {
+		return t.frontier[level]
+	}
+	if hash, exists := t.added[merkleNodeID{level, i}]; exists {
+		return hash
+	}
+	return t.stored(level, i)
+}
+
+// takeAdded returns the nodes added since the last call; from then on they are read through stored
+func (t *merkleTree) takeAdded() map[merkleNodeID][32]byte {
+	added := t.added
+	t.added = make(map[merkleNodeID][32]byte)
+	return added
+}
+
+// subtreeHash returns MTH(D[lo:hi]) for 0 <= lo < hi <= size
+func (t *merkleTree) subtreeHash(lo, hi uint64) [32]byte {
+	n := hi - lo
+	if n&(n-1) == 0 && lo%n == 0 {
+		return t.node(bits.TrailingZeros64(n), lo/n)
+	}
+	k := merkleSplit(n)
+	return merkleNodeHash(t.subtreeHash(lo, lo+k), t.subtreeHash(lo+k, hi))
+}
+
+// rootHash returns the root of the tree over its first treeSize leaves
+func (t *merkleTree) rootHash(treeSize uint64) [32]byte {
+	if treeSize == 0 {
+		return sha256.Sum256(nil)
+	}
+	return t.subtreeHash(0, treeSize)
+}
+
+// inclusionPath returns the RFC 6962 audit path PATH(m, D[lo:hi]) for leaf m
+func (t *merkleTree) inclusionPath(m, lo, hi uint64) [][32]byte {
+	n := hi - lo
+	if n == 1 {
+		return nil
+	}
+	k := merkleSplit(n)
+	if m-lo < k {
+		return append(t.inclusionPath(m, lo, lo+k), t.subtreeHash(lo+k, hi))
+	}
+	return append(t.inclusionPath(m, lo+k, hi), t.subtreeHash(lo, lo+k))
+}
+
+// consistencyPath returns the RFC 6962 SUBPROOF(m, D[lo:hi], b)
+func (t *merkleTree) consistencyPath(m, lo, hi uint64, complete bool) [][32]byte {
+	n := hi - lo
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][32]byte{t.subtreeHash(lo, hi)}
+	}
+	k := merkleSplit(n)
+	if m <= k {
+		return append(t.consistencyPath(m, lo, lo+k, complete), t.subtreeHash(lo+k, hi))
+	}
+	return append(t.consistencyPath(m-k, lo+k, hi, false), t.subtreeHash(lo, lo+k))
+}
+
+// VerifyMerkleInclusion checks an RFC 6962 audit path for a leaf hash (RFC 9162 section 2.1.3.2)
+func VerifyMerkleInclusion(leafHash [32]byte, leafIndex, treeSize uint64, path [][32]byte, root [32]byte) error {
+	if leafIndex >= treeSize {
+		return fmt.Errorf("leaf index %d is outside tree size %d", leafIndex, treeSize)
+	}
+
+	fn, sn := leafIndex, treeSize-1
+	r := leafHash
+	for _, p := range path {
+		if sn == 0 {
+			return fmt.Errorf("audit path is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return fmt.Errorf("audit path is too short")
+	}
+	if !bytes.Equal(r[:], root[:]) {
+		return fmt.Errorf("computed root does not match tree root")
+	}
+	return nil
+}
+
+// VerifyMerkleConsistency checks an RFC 6962 consistency proof between two tree roots (RFC 9162 section 2.1.4.2)
+func VerifyMerkleConsistency(firstSize, secondSize uint64, firstRoot, secondRoot [32]byte, proof [][32]byte) error {
+	switch {
+	case firstSize > secondSize:
+		return fmt.Errorf("first tree size %d is larger than second tree size %d", firstSize, secondSize)
+	case firstSize == secondSize:
+		if len(proof) != 0 {
+			return fmt.Errorf("proof must be empty for equal tree sizes")
+		}
+		if !bytes.Equal(firstRoot[:], secondRoot[:]) {
+			return fmt.Errorf("roots differ for equal tree sizes")
+		}
+		return nil
+	case firstSize == 0:
+		// The empty tree is a prefix of every tree
+		if len(proof) != 0 {
+			return fmt.Errorf("proof must be empty for an empty first tree")
+		}
+		return nil
+	}
+
+	if firstSize&(firstSize-1) == 0 {
+		// The first tree is a complete subtree: its root is the first proof node
+		proof = append([][32]byte{firstRoot}, proof...)
+	}
+	if len(proof) == 0 {
+		return fmt.Errorf("empty consistency proof")
+	}
+
+	fn, sn := firstSize-1, secondSize-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return fmt.Errorf("consistency proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = merkleNodeHash(c, fr)
+			sr = merkleNodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = merkleNodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return fmt.Errorf("consistency proof is too short")
+	}
+	if !bytes.Equal(fr[:], firstRoot[:]) {
+		return fmt.Errorf("computed first root does not match")
+	}
+	if !bytes.Equal(sr[:], secondRoot[:]) {
+		return fmt.Errorf("computed second root does not match")
+	}
+	return nil
+}
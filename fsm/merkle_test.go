@@ -0,0 +1,97 @@
+package fsm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// referenceMTH is the RFC 6962 MTH definition, computed directly
+func referenceMTH(leaves [][32]byte) [32]byte {
+	switch len(leaves) {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(uint64(len(leaves)))
+	return merkleNodeHash(referenceMTH(leaves[:k]), referenceMTH(leaves[k:]))
+}
+
+func buildTestTree(n int) (*merkleTree, [][32]byte) {
+	tree := newMerkleTree(nil)
+	leaves := make([][32]byte, n)
+	for i := range leaves {
+		leaves[i] = MerkleLeafHash([]byte(fmt.Sprintf("leaf-%d", i)))
+		tree.append(leaves[i])
+	}
+	return tree, leaves
+}
+
+func TestMerkleTree_RootMatchesReference(t *testing.T) {
+	tree, leaves := buildTestTree(70)
+
+	empty := tree.rootHash(0)
+	if hex.EncodeToString(empty[:]) != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Fatalf("Unexpected empty tree root %x", empty)
+	}
+	for n := 1; n <= len(leaves); n++ {
+		if tree.rootHash(uint64(n)) != referenceMTH(leaves[:n]) {
+			t.Fatalf("Root mismatch at tree size %d", n)
+		}
+	}
+}
+
+func TestMerkleTree_InclusionProofs(t *testing.T) {
+	tree, leaves := buildTestTree(33)
+
+	for n := uint64(1); n <= tree.size(); n++ {
+		root := tree.rootHash(n)
+		for m := uint64(0); m < n; m++ {
+			path := tree.inclusionPath(m, 0, n)
+			if err := VerifyMerkleInclusion(leaves[m], m, n, path, root); err != nil {
+				t.Fatalf("Inclusion of leaf %d in tree %d failed: %v", m, n, err)
+			}
+		}
+	}
+
+	// A proof must not verify for another leaf, index or root
+	path := tree.inclusionPath(5, 0, 20)
+	if VerifyMerkleInclusion(leaves[6], 5, 20, path, tree.rootHash(20)) == nil {
+		t.Error("Expected proof for the wrong leaf to fail")
+	}
+	if VerifyMerkleInclusion(leaves[5], 4, 20, path, tree.rootHash(20)) == nil {
+		t.Error("Expected proof at the wrong index to fail")
+	}
+	if VerifyMerkleInclusion(leaves[5], 5, 20, path, tree.rootHash(21)) == nil {
+		t.Error("Expected proof against another root to fail")
+	}
+	if VerifyMerkleInclusion(leaves[5], 5, 20, path[:len(path)-1], tree.rootHash(20)) == nil {
+		t.Error("Expected truncated proof to fail")
+	}
+}
+
+func TestMerkleTree_ConsistencyProofs(t *testing.T) {
+	tree, _ := buildTestTree(33)
+
+	for n := uint64(1); n <= tree.size(); n++ {
+		for m := uint64(1); m < n; m++ {
+			proof := tree.consistencyPath(m, 0, n, true)
+			if err := VerifyMerkleConsistency(m, n, tree.rootHash(m), tree.rootHash(n), proof); err != nil {
+				t.Fatalf("Consistency %d -> %d failed: %v", m, n, err)
+			}
+		}
+	}
+
+	// A forked history must not verify
+	forked, _ := buildTestTree(7)
+	forked.append(MerkleLeafHash([]byte("forked")))
+	proof := tree.consistencyPath(7, 0, 20, true)
+	if VerifyMerkleConsistency(7, 20, tree.rootHash(7), forked.rootHash(8), proof) == nil {
+		t.Error("Expected proof against a forked second root to fail")
+	}
+	if VerifyMerkleConsistency(8, 20, forked.rootHash(8), tree.rootHash(20), tree.consistencyPath(8, 0, 20, true)) == nil {
+		t.Error("Expected proof from a forked first root to fail")
+	}
+}
@@ -0,0 +1,126 @@
+package fsm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/raft"
+)
+
+// RequestDedupCapacity is the number of client request IDs the key index FSM remembers
+// The oldest request ID is evicted first. Must be identical on every node.
+const RequestDedupCapacity = 10000
+
+// MaxRequestIDLength bounds the length of a client request ID
+const MaxRequestIDLength = 128
+
+// requestRecord is the result of a command applied with a client request ID
+type requestRecord struct {
+	RequestID     string `json:"request_id"`
+	PayloadDigest string `json:"payload_digest"` // Hex SHA-256 of the command payload
+	Result        string `json:"result"`
+	RaftIndex     uint64 `json:"raft_index"`
+}
+
+// requestDedup remembers the results of the most recent request IDs in apply order
+type requestDedup struct {
+	capacity int
+	records  map[string]*requestRecord
+	order    []*requestRecord // Oldest first
+}
+
+func newRequestDedup(capacity int) *requestDedup {
+	return &requestDedup{
+		capacity: capacity,
+		records:  make(map[string]*requestRecord),
+	}
+}
+
+// lookup returns the record of a request ID, or nil if it is unknown
+// Reusing a request ID for a different payload is an error rather than a duplicate
+func (d *requestDedup) lookup(requestID, payloadDigest string) (*requestRecord, error) {
+	record, ok := d.records[requestID]
+	if !ok {
+		return nil, nil
+	}
+	if record.PayloadDigest != payloadDigest {
+		return nil, fmt.Errorf("request_id %s was already used for a different command at Raft index %d", requestID, record.RaftIndex)
+	}
+	return record, nil
+}
+
+// add records a result, evicting the oldest request ID once the table is full
+// Returns the evicted request ID ("" if none)
+func (d *requestDedup) add(record *requestRecord) string {
+	evicted := ""
+	if len(d.order) >= d.capacity {
+		evicted = d.order[0].RequestID
+		delete(d.records, evicted)
+		d.order = d.order[1:]
+	}
+	d.records[record.RequestID] = record
+	d.order = append(d.order, record)
+	return evicted
+}
+
+// snapshot copies the records in apply order
+func (d *requestDedup) snapshot() []*requestRecord {
+	records := make([]*requestRecord, len(d.order))
+	for i, record := range d.order {
+		copied := *record
+		records[i] = &copied
+	}
+	return records
+}
+
+// restore replaces the table with snapshot records (oldest first)
+func (d *requestDedup) restore(records []*requestRecord) {
+	d.records = make(map[string]*requestRecord)
+	d.order = nil
+	for _, record := range records {
+		copied := *record
+		d.add(&copied)
+	}
+}
+
+// applyCommitIndex commits a KeyIndexEntry, deduplicating by the command's request ID
+// A retry of an applied request returns the original result instead of an index conflict.
+// Only successful commits are recorded; a rejected commit changed nothing and may be retried.
+func (f *KeyIndexFSM) applyCommitIndex(l *raft.Log, cmd *Command) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if cmd.RequestID == "" {
+		return f.applyKeyIndexEntry(l)
+	}
+	if len(cmd.RequestID) > MaxRequestIDLength {
+		return fmt.Sprintf("Error: request_id longer than %d bytes", MaxRequestIDLength)
+	}
+
+	sum := sha256.Sum256(l.Data)
+	digest := hex.EncodeToString(sum[:])
+	record, err := f.requests.lookup(cmd.RequestID, digest)
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+	if record != nil {
+		return record.Result
+	}
+
+	result := f.applyKeyIndexEntry(l)
+	if resultStr, ok := result.(string); ok && !strings.HasPrefix(resultStr, "Error:") {
+		evicted := f.requests.add(&requestRecord{
+			RequestID:     cmd.RequestID,
+			PayloadDigest: digest,
+			Result:        resultStr,
+			RaftIndex:     l.Index,
+		})
+		f.markDirty(stateRequests, cmd.RequestID)
+		if evicted != "" {
+			f.markDirty(stateRequests, evicted)
+		}
+	}
+	return result
+}
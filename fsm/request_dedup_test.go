@@ -0,0 +1,93 @@
+package fsm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCombinedFSM_CommitRetryReturnsOriginalResult(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+
+	create, _ := EncodeCommandWithRequestID(CommandCommitIndex, "req-1", newTestEntry(t, privKey, "key_a", pubkeyHash, 0, GenesisHash, "create"))
+	first, _ := applyCommandData(f, 1, create).(string)
+	if strings.HasPrefix(first, "Error:") {
+		t.Fatalf("Commit failed: %s", first)
+	}
+
+	// The retry after a lost response is a duplicate, not an index conflict
+	retry, _ := applyCommandData(f, 2, create).(string)
+	if retry != first {
+		t.Fatalf("Expected the original result %q, got %q", first, retry)
+	}
+	if chain, _ := f.GetChainByPubkeyHash(pubkeyHash); len(chain) != 1 {
+		t.Fatalf("Retry must not append an entry, chain has %d", len(chain))
+	}
+
+	// Without a request ID the same entry conflicts with the chain head
+	data, _ := EncodeCommand(CommandCommitIndex, newTestEntry(t, privKey, "key_a", pubkeyHash, 0, GenesisHash, "create"))
+	if result, _ := applyCommandData(f, 3, data).(string); !strings.HasPrefix(result, "Error:") {
+		t.Fatalf("Expected a conflict without a request_id, got %q", result)
+	}
+
+	// Reusing a request ID for another entry is rejected
+	head, headHash, _ := f.GetIndexAndHashByPubkeyHash(pubkeyHash)
+	other, _ := EncodeCommandWithRequestID(CommandCommitIndex, "req-1", newTestEntry(t, privKey, "key_a", pubkeyHash, head+1, headHash, "sign"))
+	if result, _ := applyCommandData(f, 4, other).(string); !strings.Contains(result, "already used for a different command") {
+		t.Fatalf("Expected request_id reuse to be rejected, got %q", result)
+	}
+}
+
+func TestCombinedFSM_RequestIDOnlyForIdempotentCommands(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewCombinedFSM("genesis_hash_123", "")
+	f.PinAttestationKey(&privKey.PublicKey)
+
+	data, _ := EncodeCommandWithRequestID(CommandReserveIndex, "req-1", newTestReservation(t, privKey, "key_a", ComputePubkeyHash([]byte("pk_a")), GenesisHash, "create"))
+	if result, _ := applyCommandData(f, 1, data).(string); !strings.Contains(result, "do not accept a request_id") {
+		t.Fatalf("Expected reserve_index with a request_id to be rejected, got %q", result)
+	}
+}
+
+func TestRequestDedup_EvictsOldest(t *testing.T) {
+	d := newRequestDedup(3)
+	for i := 1; i <= 5; i++ {
+		d.add(&requestRecord{RequestID: fmt.Sprintf("req-%d", i), PayloadDigest: "digest", RaftIndex: uint64(i)})
+	}
+
+	if len(d.records) != 3 || len(d.order) != 3 {
+		t.Fatalf("Expected 3 records, got %d/%d", len(d.records), len(d.order))
+	}
+	for i := 1; i <= 5; i++ {
+		record, _ := d.lookup(fmt.Sprintf("req-%d", i), "digest")
+		if (record != nil) != (i > 2) {
+			t.Errorf("req-%d: remembered=%v", i, record != nil)
+		}
+	}
+}
+
+func TestKeyIndexFSM_SnapshotKeepsRequestIDs(t *testing.T) {
+	privKey := generateTestKey(t)
+	original, _ := NewCombinedFSM("genesis_hash_123", "")
+	original.PinAttestationKey(&privKey.PublicKey)
+	pubkeyHash := ComputePubkeyHash([]byte("pk_a"))
+
+	create, _ := EncodeCommandWithRequestID(CommandCommitIndex, "req-1", newTestEntry(t, privKey, "key_a", pubkeyHash, 0, GenesisHash, "create"))
+	first, _ := applyCommandData(original, 1, create).(string)
+
+	restored, _ := NewCombinedFSM("genesis_hash_123", "")
+	restored.PinAttestationKey(&privKey.PublicKey)
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(persistSnapshot(t, original)))); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	// A node restored from the snapshot answers the retry like the original
+	if retry, _ := applyCommandData(restored, 2, create).(string); retry != first {
+		t.Fatalf("Expected the original result %q after restore, got %q", first, retry)
+	}
+}
@@ -0,0 +1,284 @@
+package fsm
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/hashicorp/raft"
+	"github.com/verifiable-state-chains/lms/models"
+)
+
+// testSnapshotSink is an in-memory raft.SnapshotSink
+type testSnapshotSink struct {
+	bytes.Buffer
+	cancelled bool
+}
+
+func (s *testSnapshotSink) ID() string    { return "test" }
+func (s *testSnapshotSink) Cancel() error { s.cancelled = true; return nil }
+func (s *testSnapshotSink) Close() error  { return nil }
+
+// persistSnapshot takes a snapshot of an FSM and returns the persisted bytes
+func persistSnapshot(t *testing.T, f raft.FSM) []byte {
+	t.Helper()
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	defer snap.Release()
+
+	sink := &testSnapshotSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+	if sink.cancelled {
+		t.Fatal("Snapshot sink was cancelled")
+	}
+	return sink.Bytes()
+}
+
+// newTestEntry builds a signed KeyIndexEntry as the HSM server would
+func newTestEntry(t *testing.T, privKey *ecdsa.PrivateKey, keyID, pubkeyHash string, index uint64, previousHash, recordType string) *KeyIndexEntry {
+	t.Helper()
+
+	entry := &KeyIndexEntry{
+		KeyID:        keyID,
+		PubkeyHash:   pubkeyHash,
+		Index:        index,
+		PreviousHash: previousHash,
+		RecordType:   recordType,
+	}
+	if recordType == "create" {
+		entry.LMSParams = testKeyParams()
+	}
+	if err := SignEntry(entry, privKey); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	hash, err := entry.ComputeHash()
+	if err != nil {
+		t.Fatalf("Failed to compute hash: %v", err)
+	}
+	entry.Hash = hash
+	return entry
+}
+
+// applyTestEntry applies an entry to an FSM and fails the test on an error result
+// testLogData encodes a payload the way an FSM reads it from the log:
+// in a command envelope for the combined FSM, as bare JSON for a standalone key index FSM
+func testLogData(f raft.FSM, cmdType CommandType, payload interface{}) []byte {
+	if _, combined := f.(interface{ SetLegacyCommandCutover(uint64) }); combined {
+		data, _ := EncodeCommand(cmdType, payload)
+		return data
+	}
+	data, _ := json.Marshal(payload)
+	return data
+}
+
+func applyTestEntry(t *testing.T, f raft.FSM, raftIndex uint64, entry *KeyIndexEntry) {
+	t.Helper()
+
+	data := testLogData(f, CommandCommitIndex, entry)
+	result := f.Apply(&raft.Log{Type: raft.LogCommand, Index: raftIndex, Term: 1, Data: data})
+	if resultStr, ok := result.(string); ok && len(resultStr) >= 5 && resultStr[:5] == "Error" {
+		t.Fatalf("Apply failed: %s", resultStr)
+	}
+}
+
+// buildTestChain applies create + n sign entries for one key and returns the last entry
+func buildTestChain(t *testing.T, f raft.FSM, privKey *ecdsa.PrivateKey, keyID string, n int, raftIndex *uint64) *KeyIndexEntry {
+	t.Helper()
+
+	pubkeyHash := ComputePubkeyHash([]byte("lms-pubkey-" + keyID))
+	entry := newTestEntry(t, privKey, keyID, pubkeyHash, 0, GenesisHash, "create")
+	*raftIndex++
+	applyTestEntry(t, f, *raftIndex, entry)
+
+	for i := 1; i <= n; i++ {
+		entry = newTestEntry(t, privKey, keyID, pubkeyHash, uint64(i), entry.Hash, "sign")
+		*raftIndex++
+		applyTestEntry(t, f, *raftIndex, entry)
+	}
+	return entry
+}
+
+func TestKeyIndexFSM_SnapshotRestore(t *testing.T) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	original, _ := NewKeyIndexFSM("")
+	original.PinAttestationKey(&privKey.PublicKey)
+	raftIndex := uint64(0)
+	lastA := buildTestChain(t, original, privKey, "key_a", 3, &raftIndex)
+	buildTestChain(t, original, privKey, "key_b", 1, &raftIndex)
+
+	data := persistSnapshot(t, original)
+
+	restored, _ := NewKeyIndexFSM("")
+	restored.PinAttestationKey(&privKey.PublicKey)
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	// Full chains must survive the round trip
+	chain, exists := restored.GetChainByPubkeyHash(lastA.PubkeyHash)
+	if !exists || len(chain) != 4 {
+		t.Fatalf("Expected 4 entries for key_a after restore, got %d", len(chain))
+	}
+	if len(restored.GetAllEntries(0)) != len(original.GetAllEntries(0)) {
+		t.Fatalf("Entry count mismatch after restore: %d != %d",
+			len(restored.GetAllEntries(0)), len(original.GetAllEntries(0)))
+	}
+	all := restored.GetAllEntries(1)
+	if len(all) != 1 || all[0].RaftIndex != raftIndex {
+		t.Fatalf("Expected newest entry at raft index %d after restore", raftIndex)
+	}
+
+	// Index reuse must still be rejected after restore
+	replay := newTestEntry(t, privKey, "key_a", lastA.PubkeyHash, lastA.Index, lastA.Hash, "sign")
+	replayData, _ := json.Marshal(replay)
+	result := restored.Apply(&raft.Log{Type: raft.LogCommand, Index: raftIndex + 1, Term: 1, Data: replayData})
+	if resultStr, _ := result.(string); len(resultStr) < 5 || resultStr[:5] != "Error" {
+		t.Fatalf("Expected index reuse to be rejected after restore, got: %v", result)
+	}
+
+	// The chain must continue from the restored head
+	next := newTestEntry(t, privKey, "key_a", lastA.PubkeyHash, lastA.Index+1, lastA.Hash, "sign")
+	applyTestEntry(t, restored, raftIndex+1, next)
+}
+
+func TestKeyIndexFSM_RestoreLegacySnapshot(t *testing.T) {
+	// Version 0 snapshots only carried the index/hash/key_id maps
+	legacy := []byte(`{"pubkey_hash_indices":{"ph1":7},"pubkey_hash_hashes":{"ph1":"h7"},"key_id_to_pubkey_hash":{"k1":"ph1"}}`)
+
+	f, _ := NewKeyIndexFSM("")
+	if err := f.Restore(io.NopCloser(bytes.NewReader(legacy))); err != nil {
+		t.Fatalf("Restore of legacy snapshot failed: %v", err)
+	}
+
+	index, hash, exists := f.GetIndexAndHashByPubkeyHash("ph1")
+	if !exists || index != 7 || hash != "h7" {
+		t.Fatalf("Expected ph1 at index 7 with hash h7, got index=%d hash=%s exists=%v", index, hash, exists)
+	}
+	if keyIndex, ok := f.GetKeyIndex("k1"); !ok || keyIndex != 7 {
+		t.Fatalf("Expected key_id k1 to resolve to index 7, got %d", keyIndex)
+	}
+}
+
+func TestKeyIndexFSM_RestoreRejectsFutureVersion(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	raftIndex := uint64(0)
+	buildTestChain(t, f, privKey, "key_a", 1, &raftIndex)
+
+	data := []byte(fmt.Sprintf(`{"version":%d,"pubkey_hash_indices":{}}`, keyIndexSnapshotVersion+1))
+	if err := f.Restore(io.NopCloser(bytes.NewReader(data))); err == nil {
+		t.Fatal("Expected restore of unknown snapshot version to fail")
+	}
+	if f.EntryCount() != 2 {
+		t.Fatalf("Expected the rejected snapshot to leave the 2 entries, got %d", f.EntryCount())
+	}
+}
+
+func TestCombinedFSM_SnapshotRestore(t *testing.T) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	genesisHash := "genesis_hash_123"
+	original, err := NewCombinedFSM(genesisHash, "")
+	if err != nil {
+		t.Fatalf("Failed to create FSM: %v", err)
+	}
+	original.PinAttestationKey(&privKey.PublicKey)
+
+	// Hash chain attestation
+	attestation := &models.AttestationResponse{}
+	attestation.AttestationResponse.Policy.Value = "LMS_ATTEST_POLICY"
+	attestation.SetChainedPayload(models.CreateGenesisPayload(genesisHash, 0, "message_hash_0"))
+	attestationData, _ := attestation.ToJSON()
+	original.Apply(&raft.Log{Type: raft.LogCommand, Index: 1, Term: 1, Data: testLogData(original, CommandAttestation, json.RawMessage(attestationData))})
+
+	raftIndex := uint64(1)
+	last := buildTestChain(t, original, privKey, "key_a", 2, &raftIndex)
+
+	data := persistSnapshot(t, original)
+
+	restored, _ := NewCombinedFSM(genesisHash, "")
+	restored.PinAttestationKey(&privKey.PublicKey)
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	if restored.GetLogCount() != original.GetLogCount() {
+		t.Fatalf("Log count mismatch after restore: %d != %d", restored.GetLogCount(), original.GetLogCount())
+	}
+	if _, err := restored.GetLatestAttestation(); err != nil {
+		t.Fatalf("Attestation lost after restore: %v", err)
+	}
+	index, hash, exists := restored.GetIndexAndHashByPubkeyHash(last.PubkeyHash)
+	if !exists || index != last.Index || hash != last.Hash {
+		t.Fatalf("Key index state mismatch after restore: index=%d hash=%s exists=%v", index, hash, exists)
+	}
+	if chain, _ := restored.GetChainByPubkeyHash(last.PubkeyHash); len(chain) != 3 {
+		t.Fatalf("Expected 3 chain entries after restore, got %d", len(chain))
+	}
+}
+
+func TestCombinedFSM_RestoreLegacySnapshot(t *testing.T) {
+	genesisHash := "genesis_hash_123"
+	hashChain := NewHashChainFSM(genesisHash)
+
+	attestation := &models.AttestationResponse{}
+	attestation.AttestationResponse.Policy.Value = "LMS_ATTEST_POLICY"
+	attestation.SetChainedPayload(models.CreateGenesisPayload(genesisHash, 0, "message_hash_0"))
+	attestationData, _ := attestation.ToJSON()
+	hashChain.Apply(&raft.Log{Type: raft.LogCommand, Index: 1, Term: 1, Data: attestationData})
+
+	// Version 0 combined snapshots were bare hash chain snapshots
+	legacy := persistSnapshot(t, hashChain)
+
+	restored, _ := NewCombinedFSM(genesisHash, "")
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(legacy))); err != nil {
+		t.Fatalf("Restore of legacy snapshot failed: %v", err)
+	}
+	if restored.GetLogCount() != 1 {
+		t.Fatalf("Expected 1 log entry after legacy restore, got %d", restored.GetLogCount())
+	}
+}
+
+func TestCombinedFSM_RestoreReadsSnapshotAsStream(t *testing.T) {
+	privKey := generateTestKey(t)
+	original, _ := NewCombinedFSM("genesis_hash_123", "")
+	original.PinAttestationKey(&privKey.PublicKey)
+	applyTestAttestation(t, original, 1)
+	raftIndex := uint64(1)
+	buildTestChain(t, original, privKey, "key_a", 3, &raftIndex)
+	data := persistSnapshot(t, original)
+
+	// The snapshot is decoded as it is read and reading stops at its end; the stream is never read whole
+	stream := io.MultiReader(iotest.OneByteReader(bytes.NewReader(data)), iotest.ErrReader(errors.New("read past the snapshot")))
+	restored, _ := NewCombinedFSM("genesis_hash_123", "")
+	restored.PinAttestationKey(&privKey.PublicKey)
+	if err := restored.Restore(io.NopCloser(stream)); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if restored.GetTreeHead() != original.GetTreeHead() || restored.GetLogCount() != original.GetLogCount() {
+		t.Fatalf("Restored state differs: %+v, %d log entries", restored.GetTreeHead(), restored.GetLogCount())
+	}
+	if !bytes.Equal(persistSnapshot(t, restored), data) {
+		t.Error("Expected the restored FSM to persist the same snapshot")
+	}
+}
@@ -0,0 +1,397 @@
+package fsm
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// stateLeafDomain separates state tree leaf values from every other hash in the system
+const stateLeafDomain = "verifiable-state-chains/lms/state-leaf/v1"
+
+// The state tree is a sparse Merkle tree over all 2^256 paths, keyed by SHA-256(pubkey_hash),
+// holding each key's latest index and head hash. Empty subtrees hash to 32 zero bytes and a subtree
+// holding a single leaf hashes to that leaf, so only O(n) nodes are stored and proofs are O(log n):
+//
+//	value = SHA-256(length-prefixed(domain, pubkey_hash, index as 8-byte big-endian, head_hash))
+//	leaf  = SHA-256(0x00 || key || value)
+//	node  = SHA-256(0x01 || left || right)
+//
+// The validation package verifies proofs independently of this implementation.
+
+// StateProof proves the latest index of a pubkey_hash, or that it has never been committed,
+// against the state root of the transparency log tree head of size tree_size
+type StateProof struct {
+	PubkeyHash string   `json:"pubkey_hash"`
+	Exists     bool     `json:"exists"`
+	Index      uint64   `json:"index"`
+	HeadHash   string   `json:"head_hash,omitempty"`
+	Siblings   []string `json:"siblings"` // Sibling hashes from the root down to the terminal position
+
+	// Non-membership where another key's leaf occupies the terminal position (both empty otherwise)
+	OtherKey       string `json:"other_key,omitempty"`
+	OtherValueHash string `json:"other_value_hash,omitempty"`
+
+	StateRoot string `json:"state_root"`
+	TreeSize  uint64 `json:"tree_size"`
+}
+
+// stateLeaf is the committed state of one pubkey_hash
+type stateLeaf struct {
+	key        [32]byte
+	valueHash  [32]byte
+	pubkeyHash string
+	index      uint64
+	headHash   string
+}
+
+// stateNode is a leaf (leaf != nil) or an interior node with at least two leaves below it
+type stateNode struct {
+	left, right *stateNode
+	leaf        *stateLeaf
+	hash        [32]byte
+	stored      bool // Interior node whose children are only in the store (read when a path crosses it)
+}
+
+// stateTreeCacheDepth is the depth of the interior nodes whose children are dropped from memory once
+// committed: at most 2^12 interior nodes stay resident, the rest of the tree is read back from the store
+const stateTreeCacheDepth = 12
+
+// stateTree is the sparse Merkle tree of pubkey_hash -> latest index
+type stateTree struct {
+	root    *stateNode
+	updated map[[32]byte]bool // Keys updated since the last commit
+	records StateReader       // Committed nodes
+}
+
+// newStateTree returns an empty state tree whose committed nodes are read from records
+func newStateTree(records StateReader) *stateTree {
+	return &stateTree{updated: make(map[[32]byte]bool), records: records}
+}
+
+// stateKey returns the tree path of a pubkey_hash
+func stateKey(pubkeyHash string) [32]byte {
+	return sha256.Sum256([]byte(pubkeyHash))
+}
+
+// stateValueHash returns the committed value of a pubkey_hash
+func stateValueHash(pubkeyHash string, index uint64, headHash string) [32]byte {
+	return sha256.Sum256(appendLengthPrefixed(make([]byte, 0, 160),
+		[]byte(stateLeafDomain),
+		[]byte(pubkeyHash),
+		binary.BigEndian.AppendUint64(nil, index),
+		[]byte(headHash),
+	))
+}
+
+// stateLeafHash returns SHA-256(0x00 || key || value)
+func stateLeafHash(key, valueHash [32]byte) [32]byte {
+	buf := make([]byte, 0, 65)
+	buf = append(buf, merkleLeafPrefix)
+	buf = append(buf, key[:]...)
+	buf = append(buf, valueHash[:]...)
+	return sha256.Sum256(buf)
+}
+
+// stateKeyBit returns bit depth of a key, most significant bit first
+func stateKeyBit(key [32]byte, depth int) byte {
+	return (key[depth/8] >> (7 - depth%8)) & 1
+}
+
+func (n *stateNode) hashOrEmpty() [32]byte {
+	if n == nil {
+		return [32]byte{}
+	}
+	return n.hash
+}
+
+func newStateLeafNode(leaf *stateLeaf) *stateNode {
+	return &stateNode{leaf: leaf, hash: stateLeafHash(leaf.key, leaf.valueHash)}
+}
+
+func newStateInteriorNode(left, right *stateNode) *stateNode {
+	return &stateNode{left: left, right: right, hash: merkleNodeHash(left.hashOrEmpty(), right.hashOrEmpty())}
+}
+
+// update sets the latest index and head hash of a pubkey_hash
+func (t *stateTree) update(pubkeyHash string, index uint64, headHash string) {
+	key := stateKey(pubkeyHash)
+	leaf := &stateLeaf{
+		key:        key,
+		valueHash:  stateValueHash(pubkeyHash, index, headHash),
+		pubkeyHash: pubkeyHash,
+		index:      index,
+		headHash:   headHash,
+	}
+	t.root = t.insert(t.root, leaf, 0)
+	t.updated[key] = true
+}
+
+// insert inserts or replaces a leaf below n and returns the new subtree
+func (t *stateTree) insert(n *stateNode, leaf *stateLeaf, depth int) *stateNode {
+	switch {
+	case n == nil:
+		return newStateLeafNode(leaf)
+	case n.leaf != nil && n.leaf.key == leaf.key:
+		return newStateLeafNode(leaf)
+	case n.leaf != nil:
+		return splitStateLeaves(n, newStateLeafNode(leaf), depth)
+	}
+
+	left, right := t.children(n, leaf.key, depth)
+	if stateKeyBit(leaf.key, depth) == 0 {
+		return newStateInteriorNode(t.insert(left, leaf, depth+1), right)
+	}
+	return newStateInteriorNode(left, t.insert(right, leaf, depth+1))
+}
+
+// children returns the children of the interior node at depth on the path of key
+// Stored children are read without being kept, so readers holding only the read lock can call it.
+func (t *stateTree) children(n *stateNode, key [32]byte, depth int) (*stateNode, *stateNode) {
+	if !n.stored {
+		return n.left, n.right
+	}
+	return t.storedNode(withStateKeyBit(key, depth, 0), depth+1), t.storedNode(withStateKeyBit(key, depth, 1), depth+1)
+}
+
+// storedNode reads the node at depth on the path of key (nil for an empty position)
+// The store is written only by commits, so a node that does not decode is corruption.
+func (t *stateTree) storedNode(key [32]byte, depth int) *stateNode {
+	data := t.records.StateRecord(stateTreeNodes, stateNodeKey(key, depth))
+	if data == nil {
+		return nil
+	}
+	n, err := decodeStateNode(data)
+	if err != nil {
+		panic(fmt.Sprintf("fsm: corrupt state tree node in the FSM store: %v", err))
+	}
+	return n
+}
+
+// splitStateLeaves builds the subtree holding two leaves that share a position at depth
+func splitStateLeaves(existing, added *stateNode, depth int) *stateNode {
+	existingBit := stateKeyBit(existing.leaf.key, depth)
+	if existingBit == stateKeyBit(added.leaf.key, depth) {
+		child := splitStateLeaves(existing, added, depth+1)
+		if existingBit == 0 {
+			return newStateInteriorNode(child, nil)
+		}
+		return newStateInteriorNode(nil, child)
+	}
+	if existingBit == 0 {
+		return newStateInteriorNode(existing, added)
+	}
+	return newStateInteriorNode(added, existing)
+}
+
+// rootHash returns the state root (32 zero bytes for an empty tree)
+func (t *stateTree) rootHash() [32]byte {
+	return t.root.hashOrEmpty()
+}
+
+// prove returns the siblings from the root down to the position of pubkeyHash and the leaf found there
+// The leaf is nil if the position is empty, or belongs to another key for a non-membership proof
+func (t *stateTree) prove(pubkeyHash string) ([][32]byte, *stateLeaf) {
+	key := stateKey(pubkeyHash)
+	siblings := make([][32]byte, 0)
+
+	n := t.root
+	for depth := 0; n != nil && n.leaf == nil; depth++ {
+		left, right := t.children(n, key, depth)
+		if stateKeyBit(key, depth) == 0 {
+			siblings = append(siblings, right.hashOrEmpty())
+			n = left
+		} else {
+			siblings = append(siblings, left.hashOrEmpty())
+			n = right
+		}
+	}
+
+	if n == nil {
+		return siblings, nil
+	}
+	return siblings, n.leaf
+}
+
+// stateNodeRecord is a stored state tree node; the leaf fields are set for a leaf only
+type stateNodeRecord struct {
+	Hash       []byte `json:"hash"`
+	PubkeyHash string `json:"pubkey_hash,omitempty"`
+	Index      uint64 `json:"index,omitempty"`
+	HeadHash   string `json:"head_hash,omitempty"`
+	ValueHash  []byte `json:"value_hash,omitempty"`
+}
+
+// stateNodeKey returns the state record key of the node at depth on the path of a key:
+// the depth as 2-byte big-endian, then the first depth bits of the key
+func stateNodeKey(key [32]byte, depth int) string {
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 34), uint16(depth))
+	buf = append(buf, key[:(depth+7)/8]...)
+	if depth%8 != 0 {
+		buf[len(buf)-1] &= 0xff << (8 - depth%8)
+	}
+	return string(buf)
+}
+
+// withStateKeyBit returns a key with bit depth set to bit
+func withStateKeyBit(key [32]byte, depth int, bit byte) [32]byte {
+	mask := byte(1) << (7 - depth%8)
+	key[depth/8] &^= mask
+	if bit == 1 {
+		key[depth/8] |= mask
+	}
+	return key
+}
+
+// record encodes a node for the store
+func (n *stateNode) record() []byte {
+	record := stateNodeRecord{Hash: n.hash[:]}
+	if n.leaf != nil {
+		record.PubkeyHash = n.leaf.pubkeyHash
+		record.Index = n.leaf.index
+		record.HeadHash = n.leaf.headHash
+		record.ValueHash = n.leaf.valueHash[:]
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		panic(fmt.Sprintf("fsm: failed to encode state tree node: %v", err))
+	}
+	return data
+}
+
+// saveChanges records the nodes on the path of every key updated since the last commit
+// Positions never become empty, so nothing is deleted; the only node an update moves is the leaf
+// it splits from, which ends up next to the path and is written with the leaves beside it.
+// Once written, the paths are cut at stateTreeCacheDepth: the nodes below are read back from the store.
+func (t *stateTree) saveChanges(changes StateChanges) {
+	for key := range t.updated {
+		n, depth := t.root, 0
+		for ; n.leaf == nil; depth++ {
+			changes.set(stateTreeNodes, stateNodeKey(key, depth), n.record())
+			next, sibling := n.left, n.right
+			if stateKeyBit(key, depth) == 1 {
+				next, sibling = n.right, n.left
+			}
+			if sibling != nil && sibling.leaf != nil {
+				changes.set(stateTreeNodes, stateNodeKey(sibling.leaf.key, depth+1), sibling.record())
+			}
+			n = next
+		}
+		changes.set(stateTreeNodes, stateNodeKey(key, depth), n.record())
+	}
+
+	// Paths share nodes, so they are cut only after every path was written
+	for key := range t.updated {
+		n := t.root
+		for depth := 0; n.leaf == nil && !n.stored; depth++ {
+			if depth == stateTreeCacheDepth {
+				n.left, n.right, n.stored = nil, nil, true
+				break
+			}
+			if stateKeyBit(key, depth) == 0 {
+				n = n.left
+			} else {
+				n = n.right
+			}
+		}
+	}
+	t.updated = make(map[[32]byte]bool)
+}
+
+// decodeStateNode decodes a stored node; the children of an interior node stay in the store
+func decodeStateNode(data []byte) (*stateNode, error) {
+	var record stateNodeRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	if len(record.Hash) != 32 {
+		return nil, fmt.Errorf("node hash must be 32 bytes, got %d", len(record.Hash))
+	}
+	n := &stateNode{}
+	copy(n.hash[:], record.Hash)
+
+	if record.PubkeyHash == "" {
+		n.stored = true
+		return n, nil
+	}
+	if len(record.ValueHash) != 32 {
+		return nil, fmt.Errorf("leaf value hash must be 32 bytes, got %d", len(record.ValueHash))
+	}
+	n.leaf = &stateLeaf{
+		key:        stateKey(record.PubkeyHash),
+		pubkeyHash: record.PubkeyHash,
+		index:      record.Index,
+		headHash:   record.HeadHash,
+	}
+	copy(n.leaf.valueHash[:], record.ValueHash)
+	return n, nil
+}
+
+// loadStateTree resumes the state tree from the root saveChanges stored; the other nodes are read on demand
+// It returns false if the root does not match the heads (a store written without the tree nodes).
+func loadStateTree(records StateReader, indices map[string]uint64, hashes map[string]string) (*stateTree, bool) {
+	t := newStateTree(records)
+	data := records.StateRecord(stateTreeNodes, stateNodeKey([32]byte{}, 0))
+	if data == nil {
+		return t, len(indices) == 0
+	}
+	root, err := decodeStateNode(data)
+	if err != nil {
+		return nil, false
+	}
+
+	// A single key is its own root
+	if leaf := root.leaf; leaf != nil {
+		index, exists := indices[leaf.pubkeyHash]
+		if len(indices) != 1 || !exists || index != leaf.index || hashes[leaf.pubkeyHash] != leaf.headHash {
+			return nil, false
+		}
+	} else if len(indices) < 2 {
+		return nil, false
+	}
+	t.root = root
+	return t, true
+}
+
+// rebuildStateTree derives the state tree from the chain heads (after a snapshot restore, or opening a
+// store written without the tree nodes)
+func (f *KeyIndexFSM) rebuildStateTree() {
+	f.state = newStateTree(f.store)
+	for pubkeyHash, index := range f.pubkeyHashIndices {
+		f.state.update(pubkeyHash, index, f.pubkeyHashHashes[pubkeyHash])
+	}
+}
+
+// GetStateProof returns a membership or non-membership proof for a pubkey_hash
+// against the current state root, which is signed as part of the tree head
+func (f *KeyIndexFSM) GetStateProof(pubkeyHash string) (*StateProof, error) {
+	if pubkeyHash == "" {
+		return nil, fmt.Errorf("pubkey_hash is required")
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	root := f.state.rootHash()
+	siblings, leaf := f.state.prove(pubkeyHash)
+
+	proof := &StateProof{
+		PubkeyHash: pubkeyHash,
+		Siblings:   encodeMerkleHashes(siblings),
+		StateRoot:  base64.StdEncoding.EncodeToString(root[:]),
+		TreeSize:   f.tlog.tree.size(),
+	}
+	switch {
+	case leaf == nil:
+	case leaf.pubkeyHash == pubkeyHash:
+		proof.Exists = true
+		proof.Index = leaf.index
+		proof.HeadHash = leaf.headHash
+	default:
+		proof.OtherKey = base64.StdEncoding.EncodeToString(leaf.key[:])
+		proof.OtherValueHash = base64.StdEncoding.EncodeToString(leaf.valueHash[:])
+	}
+	return proof, nil
+}
@@ -0,0 +1,92 @@
+package fsm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestStateTree_RootTracksApply(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+
+	if root := f.GetTreeHead().StateRoot; root != encodeMerkleHash([32]byte{}) {
+		t.Fatalf("Expected zero state root for an empty FSM, got %s", root)
+	}
+
+	raftIndex := uint64(0)
+	last := buildTestChain(t, f, privKey, "key_a", 2, &raftIndex)
+	before := f.GetTreeHead().StateRoot
+
+	next := newTestEntry(t, privKey, "key_a", last.PubkeyHash, 3, last.Hash, "sign")
+	applyTestEntry(t, f, raftIndex+1, next)
+	after := f.GetTreeHead().StateRoot
+	if after == before {
+		t.Fatal("Expected state root to change after Apply")
+	}
+
+	proof, err := f.GetStateProof(last.PubkeyHash)
+	if err != nil {
+		t.Fatalf("GetStateProof failed: %v", err)
+	}
+	if !proof.Exists || proof.Index != 3 || proof.HeadHash != next.Hash || proof.StateRoot != after {
+		t.Fatalf("Unexpected state proof: %+v", proof)
+	}
+	if proof.TreeSize != f.GetTreeHead().TreeSize {
+		t.Fatalf("Expected proof tree size %d, got %d", f.GetTreeHead().TreeSize, proof.TreeSize)
+	}
+
+	if proof, _ := f.GetStateProof("never-used"); proof.Exists {
+		t.Fatal("Expected unused pubkey_hash not to exist")
+	}
+
+	// The state tree is rebuilt identically from a snapshot
+	restored, _ := NewKeyIndexFSM("")
+	restored.PinAttestationKey(&privKey.PublicKey)
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(persistSnapshot(t, f)))); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if restored.GetTreeHead().StateRoot != after {
+		t.Fatal("Restored state root does not match")
+	}
+}
+
+func TestStateTree_ReadsCommittedNodesFromStore(t *testing.T) {
+	store := NewMemoryStore()
+	tree, reference := newStateTree(store), newStateTree(NewMemoryStore())
+	for i := 0; i < 3000; i++ {
+		tree.update(fmt.Sprintf("pubkey-%d", i), uint64(i), "head")
+		reference.update(fmt.Sprintf("pubkey-%d", i), uint64(i), "head")
+	}
+	changes := make(StateChanges)
+	tree.saveChanges(changes)
+	store.Commit(1, changes)
+
+	// Once committed, only the top of the tree stays in memory
+	var deepest func(n *stateNode, depth int) int
+	deepest = func(n *stateNode, depth int) int {
+		if n == nil || n.leaf != nil || n.stored {
+			return depth
+		}
+		return max(deepest(n.left, depth+1), deepest(n.right, depth+1))
+	}
+	if depth := deepest(tree.root, 0); depth > stateTreeCacheDepth {
+		t.Fatalf("Expected no nodes below depth %d in memory, found depth %d", stateTreeCacheDepth, depth)
+	}
+
+	// Proofs and updates read the rest back from the store
+	tree.update("pubkey-7", 8, "next")
+	reference.update("pubkey-7", 8, "next")
+	if tree.rootHash() != reference.rootHash() {
+		t.Fatal("State root differs from the tree held in memory")
+	}
+	for _, pubkeyHash := range []string{"pubkey-7", "pubkey-2999", "unknown"} {
+		siblings, leaf := tree.prove(pubkeyHash)
+		wantSiblings, wantLeaf := reference.prove(pubkeyHash)
+		if fmt.Sprint(siblings, leaf) != fmt.Sprint(wantSiblings, wantLeaf) {
+			t.Errorf("Proof of %s differs from the tree held in memory", pubkeyHash)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package fsm
+
+import (
+	"sort"
+	"sync"
+)
+
+// EntryIndex names a secondary index over the stored entries
+type EntryIndex string
+
+// Secondary indexes of a Store
+const (
+	IndexAll        EntryIndex = ""            // Every entry (no index)
+	IndexKeyID      EntryIndex = "key_id"      // Entries by key_id
+	IndexPubkeyHash EntryIndex = "pubkey_hash" // Entries by pubkey_hash (one chain)
+	IndexRecordType EntryIndex = "record_type" // Entries by effective record type (create, sign, ...)
+)
+
+// secondaryIndexes lists the indexes every Store maintains
+var secondaryIndexes = []EntryIndex{IndexKeyID, IndexPubkeyHash, IndexRecordType}
+
+// indexValue returns the value under which an index lists an entry
+func indexValue(index EntryIndex, entry *KeyIndexEntry) string {
+	switch index {
+	case IndexKeyID:
+		return entry.KeyID
+	case IndexPubkeyHash:
+		return entry.PubkeyHash
+	case IndexRecordType:
+		return entry.effectiveRecordType()
+	}
+	return ""
+}
+
+// StateChanges are the state records changed by one applied Raft log entry: bucket -> key -> value (nil deletes)
+// The key index FSM keeps chain heads, lifecycles, leases, the registry and request IDs in memory and
+// writes the records it changed with every commit, so a persistent store can rebuild them on open.
+// Merkle tree nodes and hash chain records are written the same way but read back one at a time.
+type StateChanges map[string]map[string][]byte
+
+// set records a changed value
+func (c StateChanges) set(bucket, key string, value []byte) {
+	if c[bucket] == nil {
+		c[bucket] = make(map[string][]byte)
+	}
+	c[bucket][key] = value
+}
+
+// EntryScanner reads stored entries in apply order
+// Positions number the entries from 0 in the order they were appended.
+type EntryScanner interface {
+	// Len returns the number of entries
+	Len() int
+	// Scan calls fn for the entries at positions [from, to) listed under value in an index
+	// (IndexAll: every entry), ascending or descending, until fn returns false
+	Scan(index EntryIndex, value string, from, to int, descending bool, fn func(pos int, item RaftEntry) bool)
+}
+
+// StateReader reads committed state records one at a time
+type StateReader interface {
+	// StateRecord returns the committed value of a state record (nil if there is none)
+	StateRecord(bucket, key string) []byte
+}
+
+// StoreView is a point-in-time view of a Store, read while the FSM keeps applying (snapshots)
+type StoreView interface {
+	EntryScanner
+	StateReader
+	Release()
+}
+
+// Store holds the entries committed by a KeyIndexFSM with their secondary indexes and, for a persistent
+// store, the state records and Raft index needed to resume after a restart without replaying the log.
+// The FSM lock serializes writes against reads; a Store needs no locking of its own.
+// Entries returned by a Store must not be modified.
+type Store interface {
+	EntryScanner
+	StateReader
+
+	// At returns the entry at a position (< Len)
+	At(pos int) RaftEntry
+	// FirstPosition returns the position of the first entry committed at or after a Raft index (Len if none)
+	FirstPosition(raftIndex uint64) int
+	// PositionOf returns the position of the first entry with a hash
+	PositionOf(entryHash string) (int, bool)
+
+	// Append adds an entry at the next position; it is durable once Commit returns
+	Append(raftIndex uint64, entry *KeyIndexEntry)
+	// Reset removes every entry and state record (before a snapshot restore)
+	Reset()
+	// Commit makes the appended entries and state changes durable with the Raft index that produced them
+	Commit(raftIndex uint64, changes StateChanges) error
+
+	// AppliedIndex returns the Raft index of the last Commit that survives a restart (0 if the store is volatile)
+	AppliedIndex() uint64
+	// LoadState returns every state record of the named buckets (nil for a volatile store)
+	LoadState(buckets ...string) (StateChanges, error)
+	// View returns a point-in-time view of the entries
+	View() (StoreView, error)
+	Close() error
+}
+
+// MemoryStore keeps entries in memory; the FSM rebuilds it by replaying the Raft log on every start
+type MemoryStore struct {
+	entries []RaftEntry
+	indexes map[EntryIndex]map[string][]int // Positions by index value, ascending
+	hashes  map[string]int                  // Entry hash -> first position
+	state   *memoryState                    // Committed state records
+}
+
+// memoryState holds the state records of a MemoryStore
+// Views read it without the FSM lock, so unlike the entries it has a lock of its own. A Reset replaces it,
+// and the records a view reads (hash chain positions below its count) are never rewritten otherwise.
+type memoryState struct {
+	mu      sync.RWMutex
+	records StateChanges
+}
+
+func (s *memoryState) record(bucket, key string) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.records[bucket][key]
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{}
+	s.Reset()
+	return s
+}
+
+func (s *MemoryStore) Len() int {
+	return len(s.entries)
+}
+
+func (s *MemoryStore) At(pos int) RaftEntry {
+	return s.entries[pos]
+}
+
+func (s *MemoryStore) FirstPosition(raftIndex uint64) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return s.entries[i].RaftIndex >= raftIndex
+	})
+}
+
+func (s *MemoryStore) PositionOf(entryHash string) (int, bool) {
+	pos, exists := s.hashes[entryHash]
+	return pos, exists
+}
+
+func (s *MemoryStore) Scan(index EntryIndex, value string, from, to int, descending bool, fn func(pos int, item RaftEntry) bool) {
+	memoryScan(s.entries, s.indexes, index, value, from, to, descending, fn)
+}
+
+func (s *MemoryStore) Append(raftIndex uint64, entry *KeyIndexEntry) {
+	pos := len(s.entries)
+	s.entries = append(s.entries, RaftEntry{RaftIndex: raftIndex, Entry: entry})
+	for _, index := range secondaryIndexes {
+		value := indexValue(index, entry)
+		s.indexes[index][value] = append(s.indexes[index][value], pos)
+	}
+	if _, exists := s.hashes[entry.Hash]; !exists {
+		s.hashes[entry.Hash] = pos
+	}
+}
+
+func (s *MemoryStore) Reset() {
+	s.entries = nil
+	s.indexes = make(map[EntryIndex]map[string][]int)
+	for _, index := range secondaryIndexes {
+		s.indexes[index] = make(map[string][]int)
+	}
+	s.hashes = make(map[string]int)
+	s.state = &memoryState{records: make(StateChanges)}
+}
+
+// Commit keeps the state records the FSM reads back; none of them survive a restart
+func (s *MemoryStore) Commit(raftIndex uint64, changes StateChanges) error {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	for bucket, records := range changes {
+		for key, value := range records {
+			if value == nil {
+				delete(s.state.records[bucket], key)
+			} else {
+				s.state.records.set(bucket, key, value)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) StateRecord(bucket, key string) []byte {
+	return s.state.record(bucket, key)
+}
+
+func (s *MemoryStore) AppliedIndex() uint64 {
+	return 0
+}
+
+func (s *MemoryStore) LoadState(buckets ...string) (StateChanges, error) {
+	return nil, nil
+}
+
+// View captures the current entries: they are append-only, so the captured slices never change
+func (s *MemoryStore) View() (StoreView, error) {
+	view := &memoryView{
+		entries: s.entries[:len(s.entries):len(s.entries)],
+		indexes: make(map[EntryIndex]map[string][]int, len(s.indexes)),
+		state:   s.state,
+	}
+	for index, values := range s.indexes {
+		view.indexes[index] = make(map[string][]int, len(values))
+		for value, positions := range values {
+			view.indexes[index][value] = positions[:len(positions):len(positions)]
+		}
+	}
+	return view, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+type memoryView struct {
+	entries []RaftEntry
+	indexes map[EntryIndex]map[string][]int
+	state   *memoryState
+}
+
+func (v *memoryView) Len() int {
+	return len(v.entries)
+}
+
+func (v *memoryView) Scan(index EntryIndex, value string, from, to int, descending bool, fn func(pos int, item RaftEntry) bool) {
+	memoryScan(v.entries, v.indexes, index, value, from, to, descending, fn)
+}
+
+func (v *memoryView) StateRecord(bucket, key string) []byte {
+	return v.state.record(bucket, key)
+}
+
+func (v *memoryView) Release() {}
+
+// memoryScan implements Scan over in-memory entries and position lists
+func memoryScan(entries []RaftEntry, indexes map[EntryIndex]map[string][]int, index EntryIndex, value string,
+	from, to int, descending bool, fn func(pos int, item RaftEntry) bool) {
+	from, to = max(from, 0), min(to, len(entries))
+	if from >= to {
+		return
+	}
+
+	// Candidate positions, ascending: an index list or [from, to)
+	count := to - from
+	position := func(i int) int { return from + i }
+	if index != IndexAll {
+		positions := indexes[index][value]
+		lo := sort.SearchInts(positions, from)
+		hi := sort.SearchInts(positions, to)
+		positions = positions[lo:hi]
+		count = len(positions)
+		position = func(i int) int { return positions[i] }
+	}
+
+	for i := 0; i < count; i++ {
+		pos := position(i)
+		if descending {
+			pos = position(count - 1 - i)
+		}
+		if !fn(pos, entries[pos]) {
+			return
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package fsm
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// signatureDomainTreeHead separates tree head signatures from every other signature in the system
+const signatureDomainTreeHead = "verifiable-state-chains/lms/tree-head/v2"
+
+// The transparency log is an RFC 6962 Merkle tree over every committed KeyIndexEntry in Raft order.
+// The leaf input of an entry is its hash string (base64), which already commits to every other field,
+// so an auditor recomputes a leaf from the entry alone: MerkleLeafHash([]byte(entry.Hash)).
+// All hashes in the API are base64 encoded, like entry hashes.
+
+// TreeHead is the size and root of the transparency log, with the state root after its last entry
+type TreeHead struct {
+	TreeSize  uint64 `json:"tree_size"`
+	RootHash  string `json:"root_hash"`
+	StateRoot string `json:"state_root"` // Root of the pubkey_hash -> latest index state tree
+}
+
+// SignedTreeHead is a tree head signed by the serving node's log key
+type SignedTreeHead struct {
+	TreeSize  uint64 `json:"tree_size"`
+	Timestamp int64  `json:"timestamp"` // Milliseconds since the Unix epoch
+	RootHash  string `json:"root_hash"`
+	StateRoot string `json:"state_root"`
+	PublicKey string `json:"public_key"` // Base64 PKIX EC public key of the log key
+	Signature string `json:"signature"`  // Base64 ASN.1 ECDSA signature
+}
+
+// InclusionProof proves that an entry is a leaf of the tree of size tree_size
+type InclusionProof struct {
+	EntryHash string   `json:"entry_hash"`
+	LeafIndex uint64   `json:"leaf_index"`
+	TreeSize  uint64   `json:"tree_size"`
+	RootHash  string   `json:"root_hash"`
+	AuditPath []string `json:"audit_path"`
+}
+
+// ConsistencyProof proves that the tree of size from_size is a prefix of the tree of size to_size
+type ConsistencyProof struct {
+	FromSize uint64   `json:"from_size"`
+	ToSize   uint64   `json:"to_size"`
+	FromRoot string   `json:"from_root"`
+	ToRoot   string   `json:"to_root"`
+	Proof    []string `json:"proof"`
+}
+
+// transparencyLog is the Merkle tree over the stored entries
+// Leaf i is the entry at store position i, so the store finds the leaf of an entry hash.
+type transparencyLog struct {
+	tree *merkleTree
+}
+
+// newTransparencyLog returns an empty log whose committed nodes are read from records
+func newTransparencyLog(records StateReader) *transparencyLog {
+	return &transparencyLog{tree: newMerkleTree(tlogStoredNode(records))}
+}
+
+// tlogStoredNode reads the nodes saveChanges stored; the store is written only by commits, so a missing node is corruption
+func tlogStoredNode(records StateReader) func(level int, i uint64) [32]byte {
+	return func(level int, i uint64) [32]byte {
+		var hash [32]byte
+		data := records.StateRecord(stateLogNodes, tlogNodeKey(level, i))
+		if len(data) != len(hash) {
+			panic(fmt.Sprintf("fsm: transparency log node %d/%d missing from the FSM store", level, i))
+		}
+		copy(hash[:], data)
+		return hash
+	}
+}
+
+// appendEntry adds a committed entry as the next leaf
+func (l *transparencyLog) appendEntry(entry *KeyIndexEntry) {
+	l.tree.append(MerkleLeafHash([]byte(entry.Hash)))
+}
+
+// tlogNodeKey returns the state record key of node i of a tree level
+func tlogNodeKey(level int, i uint64) string {
+	return string(binary.BigEndian.AppendUint64([]byte{byte(level)}, i))
+}
+
+// saveChanges records the tree nodes added since the last commit
+// Nodes never change once added, so each is written once and then read back from the store.
+func (l *transparencyLog) saveChanges(changes StateChanges) {
+	for id, hash := range l.tree.takeAdded() {
+		changes.set(stateLogNodes, tlogNodeKey(id.level, id.i), append([]byte(nil), hash[:]...))
+	}
+}
+
+// loadTransparencyLog resumes a log of size leaves from the nodes saveChanges stored
+// Only the frontier is read. It returns false if the store holds no nodes for that tree (a store written without them).
+func loadTransparencyLog(records StateReader, size uint64) (*transparencyLog, bool) {
+	for k := 0; size>>k > 0; k++ {
+		if len(records.StateRecord(stateLogNodes, tlogNodeKey(k, (size>>k)-1))) != 32 {
+			return nil, false
+		}
+	}
+	if records.StateRecord(stateLogNodes, tlogNodeKey(0, size)) != nil {
+		return nil, false
+	}
+	return &transparencyLog{tree: loadMerkleTree(size, tlogStoredNode(records))}, true
+}
+
+// rebuildTransparencyLog replays the stored entries (after a snapshot restore, or opening a store
+// written without the tree nodes). The log is derived state: the stored entries in apply order fully determine it
+func (f *KeyIndexFSM) rebuildTransparencyLog() {
+	f.tlog = newTransparencyLog(f.store)
+	f.store.Scan(IndexAll, "", 0, f.store.Len(), false, func(_ int, item RaftEntry) bool {
+		f.tlog.appendEntry(item.Entry)
+		return true
+	})
+}
+
+// GetTreeHead returns the current size and root of the transparency log
+func (f *KeyIndexFSM) GetTreeHead() TreeHead {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	size := f.tlog.tree.size()
+	return TreeHead{
+		TreeSize:  size,
+		RootHash:  encodeMerkleHash(f.tlog.tree.rootHash(size)),
+		StateRoot: encodeMerkleHash(f.state.rootHash()),
+	}
+}
+
+// GetInclusionProof returns the audit path of an entry in the tree of size treeSize (0 = current size)
+func (f *KeyIndexFSM) GetInclusionProof(entryHash string, treeSize uint64) (*InclusionProof, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if treeSize == 0 {
+		treeSize = f.tlog.tree.size()
+	}
+	if treeSize > f.tlog.tree.size() {
+		return nil, fmt.Errorf("tree size %d exceeds current size %d", treeSize, f.tlog.tree.size())
+	}
+
+	pos, exists := f.store.PositionOf(entryHash)
+	leafIndex := uint64(pos)
+	if !exists {
+		return nil, fmt.Errorf("entry %s not found in the log", entryHash)
+	}
+	if leafIndex >= treeSize {
+		return nil, fmt.Errorf("entry %s was appended after tree size %d", entryHash, treeSize)
+	}
+
+	return &InclusionProof{
+		EntryHash: entryHash,
+		LeafIndex: leafIndex,
+		TreeSize:  treeSize,
+		RootHash:  encodeMerkleHash(f.tlog.tree.rootHash(treeSize)),
+		AuditPath: encodeMerkleHashes(f.tlog.tree.inclusionPath(leafIndex, 0, treeSize)),
+	}, nil
+}
+
+// GetConsistencyProof returns the proof that the tree of size fromSize is a prefix of the tree of size toSize
+func (f *KeyIndexFSM) GetConsistencyProof(fromSize, toSize uint64) (*ConsistencyProof, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if toSize > f.tlog.tree.size() {
+		return nil, fmt.Errorf("tree size %d exceeds current size %d", toSize, f.tlog.tree.size())
+	}
+	if fromSize > toSize {
+		return nil, fmt.Errorf("from size %d is larger than to size %d", fromSize, toSize)
+	}
+
+	proof := &ConsistencyProof{
+		FromSize: fromSize,
+		ToSize:   toSize,
+		FromRoot: encodeMerkleHash(f.tlog.tree.rootHash(fromSize)),
+		ToRoot:   encodeMerkleHash(f.tlog.tree.rootHash(toSize)),
+		Proof:    []string{},
+	}
+	if fromSize > 0 && fromSize < toSize {
+		proof.Proof = encodeMerkleHashes(f.tlog.tree.consistencyPath(fromSize, 0, toSize, true))
+	}
+	return proof, nil
+}
+
+// SigningDigest returns the digest signed by the log key
+func (sth *SignedTreeHead) SigningDigest() ([32]byte, error) {
+	root, err := decodeMerkleHash(sth.RootHash)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	stateRoot, err := decodeMerkleHash(sth.StateRoot)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	sizeBytes := binary.BigEndian.AppendUint64(nil, sth.TreeSize)
+	timestampBytes := binary.BigEndian.AppendUint64(nil, uint64(sth.Timestamp))
+
+	return sha256.Sum256(appendLengthPrefixed(make([]byte, 0, 128),
+		[]byte(signatureDomainTreeHead),
+		sizeBytes,
+		timestampBytes,
+		root[:],
+		stateRoot[:],
+	)), nil
+}
+
+// SignTreeHead signs a tree head with the log private key at the current time
+func SignTreeHead(head TreeHead, privKey *ecdsa.PrivateKey) (*SignedTreeHead, error) {
+	publicKey, _, err := encodeAttestationKey(&privKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sth := &SignedTreeHead{
+		TreeSize:  head.TreeSize,
+		Timestamp: time.Now().UnixMilli(),
+		RootHash:  head.RootHash,
+		StateRoot: head.StateRoot,
+		PublicKey: publicKey,
+	}
+	digest, err := sth.SigningDigest()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := ecdsa.SignASN1(rand.Reader, privKey, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign tree head: %v", err)
+	}
+	sth.Signature = base64.StdEncoding.EncodeToString(signature)
+	return sth, nil
+}
+
+// Verify checks the tree head signature against a pinned log public key
+// Auditors must pin the key out of band; the embedded public_key is informational
+func (sth *SignedTreeHead) Verify(logKey *ecdsa.PublicKey) error {
+	digest, err := sth.SigningDigest()
+	if err != nil {
+		return err
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(sth.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %v", err)
+	}
+	if !ecdsa.VerifyASN1(logKey, digest[:], sigBytes) {
+		return fmt.Errorf("tree head signature verification failed")
+	}
+	return nil
+}
+
+// Verify checks the inclusion proof for an entry against the proof's root
+// The caller must also check root_hash against a verified SignedTreeHead of the same size
+func (p *InclusionProof) Verify(entry *KeyIndexEntry) error {
+	if entry.Hash != p.EntryHash {
+		return fmt.Errorf("entry hash %s does not match proof entry hash %s", entry.Hash, p.EntryHash)
+	}
+	root, err := decodeMerkleHash(p.RootHash)
+	if err != nil {
+		return err
+	}
+	path, err := decodeMerkleHashes(p.AuditPath)
+	if err != nil {
+		return err
+	}
+	return VerifyMerkleInclusion(MerkleLeafHash([]byte(entry.Hash)), p.LeafIndex, p.TreeSize, path, root)
+}
+
+// Verify checks the consistency proof between its two roots
+func (p *ConsistencyProof) Verify() error {
+	fromRoot, err := decodeMerkleHash(p.FromRoot)
+	if err != nil {
+		return err
+	}
+	toRoot, err := decodeMerkleHash(p.ToRoot)
+	if err != nil {
+		return err
+	}
+	proof, err := decodeMerkleHashes(p.Proof)
+	if err != nil {
+		return err
+	}
+	return VerifyMerkleConsistency(p.FromSize, p.ToSize, fromRoot, toRoot, proof)
+}
+
+func encodeMerkleHash(hash [32]byte) string {
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func encodeMerkleHashes(hashes [][32]byte) []string {
+	encoded := make([]string, len(hashes))
+	for i, hash := range hashes {
+		encoded[i] = encodeMerkleHash(hash)
+	}
+	return encoded
+}
+
+func decodeMerkleHash(encoded string) ([32]byte, error) {
+	var hash [32]byte
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return hash, fmt.Errorf("failed to decode hash: %v", err)
+	}
+	if len(decoded) != len(hash) {
+		return hash, fmt.Errorf("hash must be %d bytes, got %d", len(hash), len(decoded))
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
+func decodeMerkleHashes(encoded []string) ([][32]byte, error) {
+	hashes := make([][32]byte, len(encoded))
+	for i, e := range encoded {
+		hash, err := decodeMerkleHash(e)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = hash
+	}
+	return hashes, nil
+}
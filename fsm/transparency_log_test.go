@@ -0,0 +1,97 @@
+package fsm
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestTransparencyLog_ProofsOverEntries(t *testing.T) {
+	privKey := generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	raftIndex := uint64(0)
+
+	// create + 2 signs, then create + 4 signs
+	first := buildTestChain(t, f, privKey, "key_a", 2, &raftIndex)
+	oldHead := f.GetTreeHead()
+	if oldHead.TreeSize != 3 {
+		t.Fatalf("Expected tree size 3, got %d", oldHead.TreeSize)
+	}
+	buildTestChain(t, f, privKey, "key_b", 4, &raftIndex)
+	head := f.GetTreeHead()
+	if head.TreeSize != 8 {
+		t.Fatalf("Expected tree size 8, got %d", head.TreeSize)
+	}
+
+	// Inclusion in the current tree and in the older tree head
+	proof, err := f.GetInclusionProof(first.Hash, 0)
+	if err != nil {
+		t.Fatalf("GetInclusionProof failed: %v", err)
+	}
+	if proof.LeafIndex != 2 || proof.RootHash != head.RootHash {
+		t.Fatalf("Unexpected proof: leaf %d root %s", proof.LeafIndex, proof.RootHash)
+	}
+	if err := proof.Verify(first); err != nil {
+		t.Fatalf("Inclusion proof did not verify: %v", err)
+	}
+	oldProof, err := f.GetInclusionProof(first.Hash, oldHead.TreeSize)
+	if err != nil || oldProof.RootHash != oldHead.RootHash {
+		t.Fatalf("Expected proof against the older tree head, got %+v (%v)", oldProof, err)
+	}
+	if err := oldProof.Verify(first); err != nil {
+		t.Fatalf("Old inclusion proof did not verify: %v", err)
+	}
+
+	consistency, err := f.GetConsistencyProof(oldHead.TreeSize, head.TreeSize)
+	if err != nil {
+		t.Fatalf("GetConsistencyProof failed: %v", err)
+	}
+	if consistency.FromRoot != oldHead.RootHash || consistency.ToRoot != head.RootHash {
+		t.Fatal("Consistency proof roots do not match the tree heads")
+	}
+	if err := consistency.Verify(); err != nil {
+		t.Fatalf("Consistency proof did not verify: %v", err)
+	}
+
+	if _, err := f.GetInclusionProof("unknown", 0); err == nil {
+		t.Error("Expected unknown entry hash to be rejected")
+	}
+	if _, err := f.GetConsistencyProof(2, 99); err == nil {
+		t.Error("Expected tree size beyond the log to be rejected")
+	}
+
+	// The log is rebuilt identically from a snapshot
+	restored, _ := NewKeyIndexFSM("")
+	restored.PinAttestationKey(&privKey.PublicKey)
+	if err := restored.Restore(io.NopCloser(bytes.NewReader(persistSnapshot(t, f)))); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if restored.GetTreeHead() != head {
+		t.Fatalf("Restored tree head %+v does not match %+v", restored.GetTreeHead(), head)
+	}
+}
+
+func TestSignedTreeHead_Verify(t *testing.T) {
+	logKey, privKey := generateTestKey(t), generateTestKey(t)
+	f, _ := NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+	raftIndex := uint64(0)
+	buildTestChain(t, f, privKey, "key_a", 2, &raftIndex)
+
+	sth, err := SignTreeHead(f.GetTreeHead(), logKey)
+	if err != nil {
+		t.Fatalf("SignTreeHead failed: %v", err)
+	}
+	if err := sth.Verify(&logKey.PublicKey); err != nil {
+		t.Fatalf("Signed tree head did not verify: %v", err)
+	}
+
+	if err := sth.Verify(&generateTestKey(t).PublicKey); err == nil {
+		t.Error("Expected verification with another key to fail")
+	}
+	sth.TreeSize++
+	if err := sth.Verify(&logKey.PublicKey); err == nil {
+		t.Error("Expected modified tree size to fail verification")
+	}
+}
@@ -1,6 +1,8 @@
 package hsm_server
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -13,13 +15,32 @@ import (
 const (
 	dbFileName = "hsm-data/keys.db"
 	bucketName = "lms_keys"
+
+	burnedBucketName  = "burned_indices"  // key_id, 0, big-endian index -> BurnedIndex
+	pendingBucketName = "pending_indices" // key_id -> big-endian index being signed
+	leaseBucketName   = "index_leases"    // lease_id -> indexLease held by this instance
 )
 
+// BurnedIndex is an index whose signature was discarded instead of released (Discard Rule)
+type BurnedIndex struct {
+	KeyID  string `json:"key_id"`
+	Index  uint64 `json:"index"`
+	Step   string `json:"step"`   // Signing step that failed (leaf_check, persist, commit)
+	Reason string `json:"reason"` // Error of the failed step
+	Time   string `json:"time"`
+}
+
 // KeyDB manages persistent storage for LMS keys
 type KeyDB struct {
 	db   *bbolt.DB
 	mu   sync.RWMutex
 	path string
+
+	// Envelope encryption (NewEncryptedKeyDB); nil master: keys are stored in plaintext
+	master     MasterKey
+	masterKeys map[string]MasterKey // ID -> master key, current and being rotated out
+	dataKeyMu  sync.Mutex
+	dataKeys   map[string]*dataKey // key_id -> unwrapped data key
 }
 
 // NewKeyDB creates or opens a new key database
@@ -35,10 +56,14 @@ func NewKeyDB(dbPath string) (*KeyDB, error) {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
 
-	// Create bucket if it doesn't exist
+	// Create buckets if they don't exist
 	err = db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-		return err
+		for _, name := range []string{bucketName, burnedBucketName, pendingBucketName, leaseBucketName} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 	if err != nil {
 		db.Close()
@@ -56,13 +81,12 @@ func (kdb *KeyDB) StoreKey(keyID string, key *LMSKey) error {
 	kdb.mu.Lock()
 	defer kdb.mu.Unlock()
 
-	data, err := json.Marshal(key)
-	if err != nil {
-		return fmt.Errorf("failed to marshal key: %v", err)
-	}
-
 	return kdb.db.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucketName))
+		data, err := kdb.encodeKey(keyID, key, bucket.Get([]byte(keyID)))
+		if err != nil {
+			return err
+		}
 		return bucket.Put([]byte(keyID), data)
 	})
 }
@@ -80,8 +104,9 @@ func (kdb *KeyDB) GetKey(keyID string) (*LMSKey, error) {
 			return fmt.Errorf("key not found: %s", keyID)
 		}
 
-		key = &LMSKey{}
-		return json.Unmarshal(data, key)
+		var err error
+		key, err = kdb.decodeKey(keyID, data)
+		return err
 	})
 
 	return key, err
@@ -113,8 +138,8 @@ func (kdb *KeyDB) GetAllKeys() ([]*LMSKey, error) {
 	err := kdb.db.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucketName))
 		return bucket.ForEach(func(k, v []byte) error {
-			key := &LMSKey{}
-			if err := json.Unmarshal(v, key); err != nil {
+			key, err := kdb.decodeKey(string(k), v)
+			if err != nil {
 				return err
 			}
 			keys = append(keys, key)
@@ -137,13 +162,13 @@ func (kdb *KeyDB) UpdateKeyIndex(keyID string, newIndex uint64) error {
 			return fmt.Errorf("key not found: %s", keyID)
 		}
 
-		key := &LMSKey{}
-		if err := json.Unmarshal(data, key); err != nil {
+		key, err := kdb.decodeKey(keyID, data)
+		if err != nil {
 			return err
 		}
 
 		key.Index = newIndex
-		updatedData, err := json.Marshal(key)
+		updatedData, err := kdb.encodeKey(keyID, key, data)
 		if err != nil {
 			return err
 		}
@@ -152,10 +177,144 @@ func (kdb *KeyDB) UpdateKeyIndex(keyID string, newIndex uint64) error {
 	})
 }
 
+// burnedIndexKey returns the bucket key of a burned index, ordered by key_id then index
+func burnedIndexKey(keyID string, index uint64) []byte {
+	key := make([]byte, len(keyID)+1+8)
+	copy(key, keyID)
+	binary.BigEndian.PutUint64(key[len(keyID)+1:], index)
+	return key
+}
+
+// RecordBurnedIndex records an index whose signature was discarded
+func (kdb *KeyDB) RecordBurnedIndex(burned *BurnedIndex) error {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	data, err := json.Marshal(burned)
+	if err != nil {
+		return fmt.Errorf("failed to marshal burned index: %v", err)
+	}
+
+	return kdb.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(burnedBucketName))
+		return bucket.Put(burnedIndexKey(burned.KeyID, burned.Index), data)
+	})
+}
+
+// GetBurnedIndices returns the burned indices of a key in index order
+func (kdb *KeyDB) GetBurnedIndices(keyID string) ([]*BurnedIndex, error) {
+	kdb.mu.RLock()
+	defer kdb.mu.RUnlock()
+
+	prefix := append([]byte(keyID), 0)
+	var burned []*BurnedIndex
+	err := kdb.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte(burnedBucketName)).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			record := &BurnedIndex{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+			burned = append(burned, record)
+		}
+		return nil
+	})
+
+	return burned, err
+}
+
+// RecordPendingIndex durably records the index a key is about to sign (intent to burn)
+// Until ClearPendingIndex, the index counts as burned once the key's leaf has moved past it.
+func (kdb *KeyDB) RecordPendingIndex(keyID string, index uint64) error {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, index)
+	return kdb.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(pendingBucketName)).Put([]byte(keyID), value)
+	})
+}
+
+// GetPendingIndex returns the pending index of a key, if its last signature was not released
+func (kdb *KeyDB) GetPendingIndex(keyID string) (uint64, bool, error) {
+	kdb.mu.RLock()
+	defer kdb.mu.RUnlock()
+
+	var index uint64
+	var exists bool
+	err := kdb.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket([]byte(pendingBucketName)).Get([]byte(keyID))
+		if value == nil {
+			return nil
+		}
+		if len(value) != 8 {
+			return fmt.Errorf("invalid pending index of %s", keyID)
+		}
+		index, exists = binary.BigEndian.Uint64(value), true
+		return nil
+	})
+	return index, exists, err
+}
+
+// ClearPendingIndex removes a key's pending index once its signature is committed
+func (kdb *KeyDB) ClearPendingIndex(keyID string) error {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	return kdb.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(pendingBucketName)).Delete([]byte(keyID))
+	})
+}
+
+// StoreIndexLease durably records a lease held by this instance and its next index
+func (kdb *KeyDB) StoreIndexLease(lease *indexLease) error {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lease: %v", err)
+	}
+	return kdb.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(leaseBucketName)).Put([]byte(lease.LeaseID), data)
+	})
+}
+
+// GetIndexLeases returns every lease recorded by this instance
+func (kdb *KeyDB) GetIndexLeases() ([]*indexLease, error) {
+	kdb.mu.RLock()
+	defer kdb.mu.RUnlock()
+
+	var leases []*indexLease
+	err := kdb.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(leaseBucketName)).ForEach(func(k, v []byte) error {
+			var lease indexLease
+			if err := json.Unmarshal(v, &lease); err != nil {
+				return fmt.Errorf("failed to unmarshal lease %s: %v", k, err)
+			}
+			leases = append(leases, &lease)
+			return nil
+		})
+	})
+	return leases, err
+}
+
+// DeleteIndexLease removes a lease once the cluster no longer holds it active
+func (kdb *KeyDB) DeleteIndexLease(leaseID string) error {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	return kdb.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(leaseBucketName)).Delete([]byte(leaseID))
+	})
+}
+
 // DeleteAllKeys deletes all keys from the database
 func (kdb *KeyDB) DeleteAllKeys() error {
 	kdb.mu.Lock()
 	defer kdb.mu.Unlock()
+	kdb.forgetAllDataKeys()
 
 	return kdb.db.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucketName))
@@ -178,12 +337,16 @@ func (kdb *KeyDB) DeleteAllKeys() error {
 func (kdb *KeyDB) DeleteKey(keyID string) error {
 	kdb.mu.Lock()
 	defer kdb.mu.Unlock()
+	kdb.forgetDataKey(keyID)
 
 	return kdb.db.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucketName))
 		if bucket == nil {
 			return fmt.Errorf("bucket not found")
 		}
+		if err := tx.Bucket([]byte(pendingBucketName)).Delete([]byte(keyID)); err != nil {
+			return err
+		}
 		return bucket.Delete([]byte(keyID))
 	})
 }
@@ -192,5 +355,6 @@ func (kdb *KeyDB) DeleteKey(keyID string) error {
 func (kdb *KeyDB) Close() error {
 	kdb.mu.Lock()
 	defer kdb.mu.Unlock()
+	kdb.forgetAllDataKeys()
 	return kdb.db.Close()
 }
@@ -0,0 +1,372 @@
+package hsm_server
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.etcd.io/bbolt"
+)
+
+// sealedRecordVersion is the format of sealed lms_keys records
+const sealedRecordVersion = 1
+
+// sealedRecord is the stored form of an LMSKey in an encrypted database
+// Plaintext records (LMSKey JSON) have no sealed_version.
+type sealedRecord struct {
+	Version        int    `json:"sealed_version"`
+	MasterKeyID    string `json:"master_key_id"`    // Master key wrapping the data key
+	WrappedDataKey []byte `json:"wrapped_data_key"` // Data key wrapped with key_id as associated data
+	Ciphertext     []byte `json:"ciphertext"`       // Nonce || AES-256-GCM(LMSKey JSON) with key_id as associated data
+}
+
+// dataKey is an unwrapped data key cached for its LMS key, with the wrapped form it was read as
+type dataKey struct {
+	aead        cipher.AEAD
+	masterKeyID string
+	wrapped     []byte
+}
+
+// NewEncryptedKeyDB opens a key database whose LMS keys are encrypted under master
+// previous are master keys being rotated out: keys wrapped by them stay readable until RotateMasterKey
+// re-wraps them. Plaintext keys of a database created before encryption are encrypted on open, and the
+// file is compacted so that no page holding a plaintext private key is left in it.
+func NewEncryptedKeyDB(dbPath string, master MasterKey, previous ...MasterKey) (*KeyDB, error) {
+	if master == nil {
+		return nil, fmt.Errorf("no master key")
+	}
+	kdb, err := NewKeyDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	kdb.master = master
+	kdb.masterKeys = map[string]MasterKey{master.ID(): master}
+	for _, key := range previous {
+		kdb.masterKeys[key.ID()] = key
+	}
+
+	migrated, err := kdb.migratePlaintextKeys()
+	if err != nil {
+		kdb.Close()
+		return nil, fmt.Errorf("failed to encrypt plaintext keys: %v", err)
+	}
+	if migrated > 0 {
+		kdb.mu.Lock()
+		err = kdb.compact()
+		kdb.mu.Unlock()
+		if err != nil {
+			kdb.Close()
+			return nil, fmt.Errorf("failed to compact database after encrypting %d keys: %v", migrated, err)
+		}
+	}
+	return kdb, nil
+}
+
+// MasterKeyID returns the ID of the master key new data keys are wrapped by ("" if not encrypted)
+func (kdb *KeyDB) MasterKeyID() string {
+	if kdb.master == nil {
+		return ""
+	}
+	return kdb.master.ID()
+}
+
+// RotateMasterKey re-wraps every data key not wrapped by the current master key and returns their number
+// Keys are re-wrapped one per transaction, so signing goes on during the rotation. The previous master
+// keys can be dropped once it returns.
+func (kdb *KeyDB) RotateMasterKey() (int, error) {
+	return kdb.resealKeys(true)
+}
+
+// migratePlaintextKeys encrypts the keys stored in plaintext and returns their number
+func (kdb *KeyDB) migratePlaintextKeys() (int, error) {
+	return kdb.resealKeys(false)
+}
+
+// resealKeys encrypts plaintext keys and, if rewrap, re-wraps data keys under the current master key
+func (kdb *KeyDB) resealKeys(rewrap bool) (int, error) {
+	if kdb.master == nil {
+		return 0, fmt.Errorf("database is not encrypted")
+	}
+	keyIDs, err := kdb.ListAllKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	resealed := 0
+	for _, keyID := range keyIDs {
+		changed, err := kdb.resealKey(keyID, rewrap)
+		if err != nil {
+			return resealed, fmt.Errorf("key %s: %v", keyID, err)
+		}
+		if changed {
+			resealed++
+		}
+	}
+	return resealed, nil
+}
+
+// resealKey encrypts one plaintext key or re-wraps its data key, reporting whether it was rewritten
+func (kdb *KeyDB) resealKey(keyID string, rewrap bool) (bool, error) {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	changed := false
+	err := kdb.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+		data := bucket.Get([]byte(keyID))
+		if data == nil {
+			return nil // Deleted since listed
+		}
+
+		var record sealedRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		if record.Version == 0 {
+			key := &LMSKey{}
+			if err := json.Unmarshal(data, key); err != nil {
+				return err
+			}
+			sealed, err := kdb.encodeKey(keyID, key, nil)
+			if err != nil {
+				return err
+			}
+			changed = true
+			return bucket.Put([]byte(keyID), sealed)
+		}
+		if !rewrap || record.MasterKeyID == kdb.master.ID() {
+			return nil
+		}
+
+		plainDataKey, err := kdb.unwrapDataKey(keyID, &record)
+		if err != nil {
+			return err
+		}
+		wrapped, err := kdb.master.Wrap(plainDataKey, []byte(keyID))
+		if err != nil {
+			return fmt.Errorf("failed to wrap data key: %v", err)
+		}
+		record.MasterKeyID = kdb.master.ID()
+		record.WrappedDataKey = wrapped
+		updated, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		changed = true
+		kdb.forgetDataKey(keyID)
+		return bucket.Put([]byte(keyID), updated)
+	})
+	return changed, err
+}
+
+// encodeKey returns the stored form of a key: sealed under its data key if the database is encrypted
+// stored is the key's current record, whose data key is kept (nil: none)
+func (kdb *KeyDB) encodeKey(keyID string, key *LMSKey, stored []byte) ([]byte, error) {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal key: %v", err)
+	}
+	if kdb.master == nil {
+		return data, nil
+	}
+
+	dk, err := kdb.dataKeyFor(keyID, stored)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := seal(dk.aead, data, []byte(keyID))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&sealedRecord{
+		Version:        sealedRecordVersion,
+		MasterKeyID:    dk.masterKeyID,
+		WrappedDataKey: dk.wrapped,
+		Ciphertext:     ciphertext,
+	})
+}
+
+// decodeKey returns the key of a stored record, decrypting it if sealed
+func (kdb *KeyDB) decodeKey(keyID string, data []byte) (*LMSKey, error) {
+	var record sealedRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	key := &LMSKey{}
+	if record.Version == 0 {
+		return key, json.Unmarshal(data, key)
+	}
+	if record.Version != sealedRecordVersion {
+		return nil, fmt.Errorf("key %s: unsupported sealed record version %d", keyID, record.Version)
+	}
+
+	dk, err := kdb.sealedDataKey(keyID, &record)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %v", keyID, err)
+	}
+	plaintext, err := open(dk.aead, record.Ciphertext, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("key %s: failed to decrypt: %v", keyID, err)
+	}
+	return key, json.Unmarshal(plaintext, key)
+}
+
+// dataKeyFor returns the data key to seal a key with: the one of its stored record, or a new one
+func (kdb *KeyDB) dataKeyFor(keyID string, stored []byte) (*dataKey, error) {
+	if stored != nil {
+		var record sealedRecord
+		if err := json.Unmarshal(stored, &record); err == nil && record.Version == sealedRecordVersion {
+			return kdb.sealedDataKey(keyID, &record)
+		}
+	}
+
+	plainDataKey := make([]byte, masterKeySize)
+	if _, err := io.ReadFull(rand.Reader, plainDataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %v", err)
+	}
+	wrapped, err := kdb.master.Wrap(plainDataKey, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %v", err)
+	}
+	return kdb.cacheDataKey(keyID, plainDataKey, kdb.master.ID(), wrapped)
+}
+
+// sealedDataKey returns the data key of a sealed record, unwrapping it unless cached
+func (kdb *KeyDB) sealedDataKey(keyID string, record *sealedRecord) (*dataKey, error) {
+	kdb.dataKeyMu.Lock()
+	dk, exists := kdb.dataKeys[keyID]
+	kdb.dataKeyMu.Unlock()
+	if exists && dk.masterKeyID == record.MasterKeyID && string(dk.wrapped) == string(record.WrappedDataKey) {
+		return dk, nil
+	}
+
+	plainDataKey, err := kdb.unwrapDataKey(keyID, record)
+	if err != nil {
+		return nil, err
+	}
+	return kdb.cacheDataKey(keyID, plainDataKey, record.MasterKeyID, record.WrappedDataKey)
+}
+
+// unwrapDataKey unwraps the data key of a sealed record with the master key that wrapped it
+func (kdb *KeyDB) unwrapDataKey(keyID string, record *sealedRecord) ([]byte, error) {
+	if kdb.master == nil {
+		return nil, fmt.Errorf("key is encrypted and no master key is configured")
+	}
+	master, exists := kdb.masterKeys[record.MasterKeyID]
+	if !exists {
+		return nil, fmt.Errorf("data key is wrapped by unknown master key %s", record.MasterKeyID)
+	}
+	plainDataKey, err := master.Unwrap(record.WrappedDataKey, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key with master key %s: %v", record.MasterKeyID, err)
+	}
+	if len(plainDataKey) != masterKeySize {
+		return nil, fmt.Errorf("unwrapped data key has %d bytes", len(plainDataKey))
+	}
+	return plainDataKey, nil
+}
+
+// cacheDataKey keeps an unwrapped data key, so a KMS is called once per key rather than per signature
+func (kdb *KeyDB) cacheDataKey(keyID string, plainDataKey []byte, masterKeyID string, wrapped []byte) (*dataKey, error) {
+	aead, err := newGCM(plainDataKey)
+	if err != nil {
+		return nil, err
+	}
+	dk := &dataKey{
+		aead:        aead,
+		masterKeyID: masterKeyID,
+		wrapped:     append([]byte(nil), wrapped...),
+	}
+
+	kdb.dataKeyMu.Lock()
+	defer kdb.dataKeyMu.Unlock()
+	if kdb.dataKeys == nil {
+		kdb.dataKeys = make(map[string]*dataKey)
+	}
+	kdb.dataKeys[keyID] = dk
+	return dk, nil
+}
+
+// forgetDataKey drops a cached data key (key deleted or re-wrapped)
+func (kdb *KeyDB) forgetDataKey(keyID string) {
+	kdb.dataKeyMu.Lock()
+	defer kdb.dataKeyMu.Unlock()
+	delete(kdb.dataKeys, keyID)
+}
+
+// forgetAllDataKeys drops every cached data key
+func (kdb *KeyDB) forgetAllDataKeys() {
+	kdb.dataKeyMu.Lock()
+	defer kdb.dataKeyMu.Unlock()
+	kdb.dataKeys = nil
+}
+
+// compact rewrites the database file with only its live pages (caller must hold kdb.mu)
+// bbolt keeps overwritten values in free pages, which would otherwise still hold plaintext private keys.
+func (kdb *KeyDB) compact() error {
+	tmpPath := kdb.path + ".compact"
+	os.Remove(tmpPath)
+	dst, err := bbolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return err
+	}
+
+	err = kdb.db.View(func(srcTx *bbolt.Tx) error {
+		return dst.Update(func(dstTx *bbolt.Tx) error {
+			return srcTx.ForEach(func(name []byte, src *bbolt.Bucket) error {
+				bucket, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return src.ForEach(func(k, v []byte) error {
+					if v == nil {
+						return fmt.Errorf("nested bucket %s/%s not supported", name, k)
+					}
+					return bucket.Put(k, v)
+				})
+			})
+		})
+	})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := kdb.db.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	renameErr := renameFile(tmpPath, kdb.path)
+	if renameErr != nil {
+		// Keep serving from the original file
+		os.Remove(tmpPath)
+	} else if err := syncDir(filepath.Dir(kdb.path)); err != nil {
+		renameErr = fmt.Errorf("failed to sync %s after compaction: %v", filepath.Dir(kdb.path), err)
+	}
+	db, err := bbolt.Open(kdb.path, 0600, nil)
+	if err != nil {
+		return fmt.Errorf("failed to reopen database after compaction: %v", err)
+	}
+	kdb.db = db
+	return renameErr
+}
+
+// renameFile is os.Rename, replaced by tests to fail the swap of a compacted database
+var renameFile = os.Rename
+
+// syncDir fsyncs a directory, making a rename within it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,249 @@
+package hsm_server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+// testMasterKey returns a random local master key
+func testMasterKey(t *testing.T) MasterKey {
+	t.Helper()
+	key := make([]byte, masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	master, err := NewLocalMasterKey(key)
+	if err != nil {
+		t.Fatalf("NewLocalMasterKey failed: %v", err)
+	}
+	return master
+}
+
+// testStoredKey returns a key whose private key is a recognizable secret
+func testStoredKey(keyID string) *LMSKey {
+	return &LMSKey{
+		KeyID:      keyID,
+		Index:      3,
+		PrivateKey: append([]byte("SECRET-"+keyID+"-"), testPrivateKey(3)...),
+		Levels:     1,
+	}
+}
+
+// rawRecord reads a stored lms_keys record bypassing decryption
+func rawRecord(t *testing.T, kdb *KeyDB, keyID string) []byte {
+	t.Helper()
+	var data []byte
+	kdb.db.View(func(tx *bbolt.Tx) error {
+		data = append([]byte(nil), tx.Bucket([]byte(bucketName)).Get([]byte(keyID))...)
+		return nil
+	})
+	return data
+}
+
+func TestEncryptedKeyDB_SealsPrivateKeys(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "keys.db")
+	kdb, err := NewEncryptedKeyDB(dbPath, testMasterKey(t))
+	if err != nil {
+		t.Fatalf("NewEncryptedKeyDB failed: %v", err)
+	}
+	defer kdb.Close()
+
+	for _, keyID := range []string{"key_a", "key_b"} {
+		if err := kdb.StoreKey(keyID, testStoredKey(keyID)); err != nil {
+			t.Fatalf("StoreKey failed: %v", err)
+		}
+	}
+	if err := kdb.UpdateKeyIndex("key_a", 4); err != nil {
+		t.Fatalf("UpdateKeyIndex failed: %v", err)
+	}
+	if bytes.Contains(rawRecord(t, kdb, "key_a"), []byte("SECRET")) {
+		t.Fatal("Private key stored in plaintext")
+	}
+	key, err := kdb.GetKey("key_a")
+	if err != nil || key.Index != 4 || !bytes.Equal(key.PrivateKey, testStoredKey("key_a").PrivateKey) {
+		t.Fatalf("Expected the key decrypted at index 4, got %+v (%v)", key, err)
+	}
+
+	// key_id is associated data: a record moved to another key_id does not decrypt
+	kdb.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(bucketName)).Put([]byte("key_b"), rawRecord(t, kdb, "key_a"))
+	})
+	kdb.forgetAllDataKeys()
+	if _, err := kdb.GetKey("key_b"); err == nil {
+		t.Fatal("Expected a record swapped between key IDs to fail authentication")
+	}
+}
+
+func TestEncryptedKeyDB_MigratesPlaintextDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "keys.db")
+	plain, err := NewKeyDB(dbPath)
+	if err != nil {
+		t.Fatalf("NewKeyDB failed: %v", err)
+	}
+	if err := plain.StoreKey("key_a", testStoredKey("key_a")); err != nil {
+		t.Fatalf("StoreKey failed: %v", err)
+	}
+	plain.RecordBurnedIndex(&BurnedIndex{KeyID: "key_a", Index: 1, Step: discardStepCommit})
+	plain.Close()
+
+	kdb, err := NewEncryptedKeyDB(dbPath, testMasterKey(t))
+	if err != nil {
+		t.Fatalf("NewEncryptedKeyDB failed: %v", err)
+	}
+	key, err := kdb.GetKey("key_a")
+	if err != nil || !bytes.Equal(key.PrivateKey, testStoredKey("key_a").PrivateKey) {
+		t.Fatalf("Expected the migrated key, got %+v (%v)", key, err)
+	}
+	if burned, _ := kdb.GetBurnedIndices("key_a"); len(burned) != 1 {
+		t.Errorf("Expected the burned index kept by compaction, got %d", len(burned))
+	}
+	kdb.Close()
+
+	// Compaction leaves no free page holding the plaintext record
+	file, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(file, []byte("SECRET")) {
+		t.Fatal("Plaintext private key left in the database file")
+	}
+}
+
+func TestKeyDB_CompactKeepsDatabaseOnFailedRename(t *testing.T) {
+	kdb, err := NewKeyDB(filepath.Join(t.TempDir(), "keys.db"))
+	if err != nil {
+		t.Fatalf("NewKeyDB failed: %v", err)
+	}
+	defer kdb.Close()
+	if err := kdb.StoreKey("key_a", testStoredKey("key_a")); err != nil {
+		t.Fatalf("StoreKey failed: %v", err)
+	}
+
+	renameFile = func(string, string) error { return errors.New("rename failed") }
+	kdb.mu.Lock()
+	err = kdb.compact()
+	kdb.mu.Unlock()
+	renameFile = os.Rename
+	if err == nil {
+		t.Fatal("Expected the failed rename to be reported")
+	}
+	if _, err := os.Stat(kdb.path + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("Expected the compacted copy removed, got %v", err)
+	}
+
+	// The original file is reopened and still serves reads and writes
+	if _, err := kdb.GetKey("key_a"); err != nil {
+		t.Fatalf("Expected key_a after the failed compaction: %v", err)
+	}
+	if err := kdb.UpdateKeyIndex("key_a", 2); err != nil {
+		t.Fatalf("UpdateKeyIndex failed after the failed compaction: %v", err)
+	}
+
+	kdb.mu.Lock()
+	err = kdb.compact()
+	kdb.mu.Unlock()
+	if key, getErr := kdb.GetKey("key_a"); err != nil || getErr != nil || key.Index != 2 {
+		t.Fatalf("Expected key_a at index 2 after compaction (%v, %v)", err, getErr)
+	}
+}
+
+func TestEncryptedKeyDB_RotatesMasterKey(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "keys.db")
+	oldMaster, newMaster := testMasterKey(t), testMasterKey(t)
+
+	kdb, err := NewEncryptedKeyDB(dbPath, oldMaster)
+	if err != nil {
+		t.Fatalf("NewEncryptedKeyDB failed: %v", err)
+	}
+	for _, keyID := range []string{"key_a", "key_b"} {
+		kdb.StoreKey(keyID, testStoredKey(keyID))
+	}
+	kdb.Close()
+
+	if kdb, err := NewEncryptedKeyDB(dbPath, newMaster); err == nil {
+		_, err = kdb.GetKey("key_a")
+		kdb.Close()
+		if err == nil {
+			t.Fatal("Expected keys wrapped by an unknown master key not to decrypt")
+		}
+	}
+
+	// During rotation both master keys are known; keys stay usable before and after re-wrapping
+	kdb, err = NewEncryptedKeyDB(dbPath, newMaster, oldMaster)
+	if err != nil {
+		t.Fatalf("NewEncryptedKeyDB failed: %v", err)
+	}
+	if err := kdb.UpdateKeyIndex("key_a", 4); err != nil {
+		t.Fatalf("UpdateKeyIndex during rotation failed: %v", err)
+	}
+	if rewrapped, err := kdb.RotateMasterKey(); err != nil || rewrapped != 2 {
+		t.Fatalf("Expected 2 data keys re-wrapped, got %d (%v)", rewrapped, err)
+	}
+	if rewrapped, err := kdb.RotateMasterKey(); err != nil || rewrapped != 0 {
+		t.Fatalf("Expected nothing left to re-wrap, got %d (%v)", rewrapped, err)
+	}
+	kdb.Close()
+
+	kdb, err = NewEncryptedKeyDB(dbPath, newMaster)
+	if err != nil {
+		t.Fatalf("NewEncryptedKeyDB failed: %v", err)
+	}
+	defer kdb.Close()
+	keys, err := kdb.GetAllKeys()
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("Expected both keys readable with the new master key only, got %d (%v)", len(keys), err)
+	}
+	if key, _ := kdb.GetKey("key_a"); key.Index != 4 {
+		t.Errorf("Expected the update made during rotation kept, got index %d", key.Index)
+	}
+}
+
+func TestMasterKeySources(t *testing.T) {
+	dir := t.TempDir()
+	saltPath := filepath.Join(dir, "master.salt")
+
+	first, err := LoadPassphraseMasterKey([]byte("correct horse"), saltPath)
+	if err != nil {
+		t.Fatalf("LoadPassphraseMasterKey failed: %v", err)
+	}
+	again, _ := LoadPassphraseMasterKey([]byte("correct horse"), saltPath)
+	other, _ := LoadPassphraseMasterKey([]byte("battery staple"), saltPath)
+	if first.ID() != again.ID() || first.ID() == other.ID() {
+		t.Fatalf("Expected the same passphrase and salt to derive the same key only: %s %s %s", first.ID(), again.ID(), other.ID())
+	}
+
+	wrapped, err := first.Wrap([]byte("data key"), []byte("key_a"))
+	if err != nil {
+		t.Fatalf("Wrap failed: %v", err)
+	}
+	if dataKey, err := again.Unwrap(wrapped, []byte("key_a")); err != nil || string(dataKey) != "data key" {
+		t.Fatalf("Expected the data key unwrapped, got %q (%v)", dataKey, err)
+	}
+	if _, err := again.Unwrap(wrapped, []byte("key_b")); err == nil {
+		t.Fatal("Expected unwrapping with other associated data to fail")
+	}
+
+	keyPath := filepath.Join(dir, "master.key")
+	os.WriteFile(keyPath, []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), 0600)
+	fromHex, err := LoadMasterKeyFile(keyPath)
+	if err != nil {
+		t.Fatalf("LoadMasterKeyFile failed: %v", err)
+	}
+	raw := make([]byte, masterKeySize)
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+	if fromRaw, _ := NewLocalMasterKey(raw); fromRaw.ID() != fromHex.ID() {
+		t.Errorf("Expected hex and raw key files to be the same key")
+	}
+	os.WriteFile(keyPath, []byte("short"), 0600)
+	if _, err := LoadMasterKeyFile(keyPath); err == nil {
+		t.Error("Expected a short key file to be rejected")
+	}
+}
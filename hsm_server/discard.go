@@ -0,0 +1,90 @@
+package hsm_server
+
+import (
+	"log"
+	"time"
+)
+
+// Discard Rule: a signature leaves the HSM only once the private key state that produced it is durable
+// and its index is committed. hash-sigs advances the private key while it signs, so the signature is
+// held in memory, unreleased, until both steps succeed; if either fails it is discarded and its index
+// burned. A crash before release loses only an unreleased signature, so no one-time key is ever
+// exposed twice. The index is recorded as pending before signing: after a crash, a reserved index the
+// key state never moved past is signed again, and one it moved past counts as burned.
+
+// Signing steps after which a failure discards the signature
+const (
+	discardStepLeafCheck = "leaf_check" // Checking the signature's leaf index against the index to commit
+	discardStepPersist   = "persist"    // Persisting the advanced private key state
+	discardStepCommit    = "commit"     // Committing the index to Raft (or the blockchain fallback)
+)
+
+// Signing steps after which a crash leaves durable state behind (HSMServer.signStepHook)
+const (
+	signStepAllocated = "allocated" // Index reserved or leased, and recorded as pending
+	signStepSigned    = "signed"    // Signature generated and its leaf checked, key state not yet persisted
+	signStepPersisted = "persisted" // Advanced key state persisted, index not yet committed or released
+)
+
+// signStepDone runs the signing step hook, if any
+func (s *HSMServer) signStepDone(step string) {
+	if s.signStepHook != nil {
+		s.signStepHook(step)
+	}
+}
+
+// lmsSigner signs a message with a stored key, returning the signature and the advanced private key state
+type lmsSigner func(key *LMSKey, message []byte) (signature []byte, privateKey []byte, err error)
+
+// lmsSign signs with the server's signer (the key's backend unless replaced)
+func (s *HSMServer) lmsSign(key *LMSKey, message []byte) ([]byte, []byte, error) {
+	if s.signer != nil {
+		return s.signer(key, message)
+	}
+	signer, err := s.keySigner(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer.Sign(key, message)
+}
+
+// persistKeyState durably stores the private key state advanced past index, then updates the cache
+// A key held by a token has no private key state in its record: the token advanced it while signing.
+// The stored key is a copy: key may be the cached entry, which must not run ahead of the database.
+func (s *HSMServer) persistKeyState(keyID string, key *LMSKey, index uint64, privateKey []byte) error {
+	advanced := *key
+	advanced.PrivateKey = privateKey
+	advanced.Index = index + 1
+	if err := s.db.StoreKey(keyID, &advanced); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if cachedKey, exists := s.keys[keyID]; exists {
+		cachedKey.PrivateKey = advanced.PrivateKey
+		cachedKey.Index = advanced.Index
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// discardSignature wipes a signature that must not be released and records its index as burned
+func (s *HSMServer) discardSignature(keyID string, index uint64, signature []byte, step string, cause error) {
+	for i := range signature {
+		signature[i] = 0
+	}
+	signDiscards.Inc(step)
+	s.workingKeys.invalidate(keyID)
+	log.Printf("[DISCARD] Discarded signature of key %s at index %d (%s failed): %v", keyID, index, step, cause)
+
+	burned := &BurnedIndex{
+		KeyID:  keyID,
+		Index:  index,
+		Step:   step,
+		Reason: cause.Error(),
+		Time:   time.Now().Format(time.RFC3339),
+	}
+	if err := s.db.RecordBurnedIndex(burned); err != nil {
+		log.Printf("[WARNING] Failed to record burned index %d of key %s: %v", index, keyID, err)
+	}
+}
@@ -0,0 +1,363 @@
+package hsm_server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/verifiable-state-chains/lms/fsm"
+	"github.com/verifiable-state-chains/lms/lms_wrapper"
+)
+
+// signTestCluster serves the /pubkey_hash, /reserve_index and /commit_index endpoints used by handleSign
+// from a KeyIndexFSM
+type signTestCluster struct {
+	*httptest.Server
+	fsm         *fsm.KeyIndexFSM
+	commits     int32       // Commit and reservation requests received
+	failCommits atomic.Bool // Reject every commit and reservation with a 500
+}
+
+func newSignTestCluster(t *testing.T) *signTestCluster {
+	t.Helper()
+
+	c := &signTestCluster{}
+	c.fsm, _ = fsm.NewKeyIndexFSM("")
+	var raftIndex uint64
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/pubkey_hash/"):
+			pubkeyHash := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/pubkey_hash/"), "/index")
+			index, hash, exists := c.fsm.GetIndexAndHashByPubkeyHash(pubkeyHash)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "exists": exists, "index": index, "hash": hash})
+		case r.URL.Path == "/reserve_index":
+			atomic.AddInt32(&c.commits, 1)
+			if c.failCommits.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "no leader"})
+				return
+			}
+			var entry fsm.KeyIndexEntry
+			json.NewDecoder(r.Body).Decode(&entry)
+			data, _ := json.Marshal(fsm.ReserveIndexCommand{Entry: entry})
+			result := c.fsm.Apply(&raft.Log{Type: raft.LogCommand, Index: atomic.AddUint64(&raftIndex, 1), Data: data})
+			reservation, ok := result.(*fsm.IndexReservation)
+			if !ok {
+				if message, _ := result.(string); strings.Contains(message, "head mismatch") {
+					w.WriteHeader(http.StatusConflict)
+				} else {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": result})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "index": reservation.Index, "hash": reservation.Hash, "raft_index": reservation.RaftIndex})
+		case r.URL.Path == "/commit_index":
+			atomic.AddInt32(&c.commits, 1)
+			if c.failCommits.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": "no leader"})
+				return
+			}
+			var entry fsm.KeyIndexEntry
+			json.NewDecoder(r.Body).Decode(&entry)
+			data, _ := json.Marshal(entry)
+			result := c.fsm.Apply(&raft.Log{Type: raft.LogCommand, Index: atomic.AddUint64(&raftIndex, 1), Data: data})
+			if message, _ := result.(string); strings.HasPrefix(message, "Error") {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": message})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "committed": true})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(c.Server.Close)
+	return c
+}
+
+// testPrivateKey returns a hash-sigs style private key state about to sign leaf
+func testPrivateKey(leaf uint64) []byte {
+	privKey := make([]byte, 48)
+	binary.BigEndian.PutUint64(privKey, leaf)
+	return privKey
+}
+
+// testHSSSignature returns a one-level (H5, W1) HSS signature by leaf q, with the message digest as C
+func testHSSSignature(q uint32, message []byte) []byte {
+	var signature []byte
+	signature = binary.BigEndian.AppendUint32(signature, 0) // Nspk
+	signature = binary.BigEndian.AppendUint32(signature, q)
+	signature = binary.BigEndian.AppendUint32(signature, lms_wrapper.LMOTS_SHA256_N32_W1)
+	digest := sha256.Sum256(message)
+	signature = append(signature, digest[:]...)
+	signature = append(signature, make([]byte, 265*32)...) // y[p]
+	signature = binary.BigEndian.AppendUint32(signature, lms_wrapper.LMS_SHA256_M32_H5)
+	return append(signature, make([]byte, 5*32)...) // path[h]
+}
+
+// testSigner stands in for hash-sigs, advancing the leaf counter of testPrivateKey with every signature
+type testSigner struct {
+	err        error    // Returned instead of a signature when set
+	leafSkew   uint32   // Added to the leaf recorded in the signature
+	signatures [][]byte // Every signature generated, released or not
+}
+
+func (ts *testSigner) sign(key *LMSKey, message []byte) ([]byte, []byte, error) {
+	if ts.err != nil {
+		return nil, nil, ts.err
+	}
+	leaf, err := lms_wrapper.PrivateKeyIndex(key.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	signature := testHSSSignature(uint32(leaf)+ts.leafSkew, message)
+	ts.signatures = append(ts.signatures, signature)
+	return signature, testPrivateKey(leaf + 1), nil
+}
+
+// newDiscardTestServer creates an HSM server with one stored key at leaf 0
+func newDiscardTestServer(t *testing.T, cluster *signTestCluster, signer *testSigner) *HSMServer {
+	t.Helper()
+
+	db, err := NewKeyDB(filepath.Join(t.TempDir(), "keys.db"))
+	if err != nil {
+		t.Fatalf("NewKeyDB failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	privKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cluster.fsm.PinAttestationKey(&privKey.PublicKey)
+
+	key := &LMSKey{
+		KeyID:      "key_a",
+		PrivateKey: testPrivateKey(0),
+		PublicKey:  []byte("lms-public-key"),
+		Levels:     1,
+		LmType:     []int{lms_wrapper.LMS_SHA256_M32_H5},
+		OtsType:    []int{lms_wrapper.LMOTS_SHA256_N32_W1},
+	}
+	if err := db.StoreKey(key.KeyID, key); err != nil {
+		t.Fatalf("StoreKey failed: %v", err)
+	}
+	cached := *key
+
+	return &HSMServer{
+		keys:               map[string]*LMSKey{key.KeyID: &cached},
+		db:                 db,
+		raftEndpoints:      []string{cluster.URL},
+		attestationPrivKey: privKey,
+		signer:             signer.sign,
+		leases:             make(map[string]*indexLease),
+	}
+}
+
+// signTestMessage sends a /sign request to the server
+func signTestMessage(s *HSMServer, message string) (int, SignResponse) {
+	body, _ := json.Marshal(SignRequest{KeyID: "key_a", Message: message})
+	recorder := httptest.NewRecorder()
+	s.handleSign(recorder, httptest.NewRequest(http.MethodPost, "/sign", bytes.NewReader(body)))
+
+	var response SignResponse
+	json.NewDecoder(recorder.Body).Decode(&response)
+	return recorder.Code, response
+}
+
+func TestDiscardRule_ReleasesAfterPersistAndCommit(t *testing.T) {
+	cluster := newSignTestCluster(t)
+	signer := &testSigner{}
+	s := newDiscardTestServer(t, cluster, signer)
+
+	for i := uint64(0); i < 3; i++ {
+		status, response := signTestMessage(s, "hello")
+		if status != http.StatusOK || !response.Success {
+			t.Fatalf("Sign %d failed: %d %s", i, status, response.Error)
+		}
+		if response.Index != i || response.Signature == nil {
+			t.Fatalf("Expected a signature at index %d, got %+v", i, response)
+		}
+	}
+
+	key, _ := s.db.GetKey("key_a")
+	if key.Index != 3 || !bytes.Equal(key.PrivateKey, testPrivateKey(3)) {
+		t.Errorf("Expected the stored key advanced to leaf 3, got index %d, private key %v", key.Index, key.PrivateKey)
+	}
+	if index, _, _ := cluster.fsm.GetIndexAndHashByPubkeyHash(fsm.ComputePubkeyHash(key.PublicKey)); index != 2 {
+		t.Errorf("Expected Raft head at index 2, got %d", index)
+	}
+	if burned, _ := s.db.GetBurnedIndices("key_a"); len(burned) != 0 {
+		t.Errorf("Expected no burned indices, got %+v", burned)
+	}
+}
+
+func TestDiscardRule_SignFailureResumesReservation(t *testing.T) {
+	cluster := newSignTestCluster(t)
+	signer := &testSigner{err: fmt.Errorf("working key unavailable")}
+	s := newDiscardTestServer(t, cluster, signer)
+
+	status, response := signTestMessage(s, "hello")
+	if status != http.StatusInternalServerError || response.Success || response.Signature != nil {
+		t.Fatalf("Expected the sign request to fail, got %d %+v", status, response)
+	}
+	if key, _ := s.db.GetKey("key_a"); key.Index != 0 || !bytes.Equal(key.PrivateKey, testPrivateKey(0)) {
+		t.Errorf("Expected the stored key unchanged, got index %d, private key %v", key.Index, key.PrivateKey)
+	}
+
+	// Index 0 was reserved before signing; its leaf is unspent, so the next request signs it
+	signer.err = nil
+	status, response = signTestMessage(s, "hello")
+	if status != http.StatusOK || response.Index != 0 {
+		t.Fatalf("Expected the reserved index 0 signed, got %d %+v", status, response)
+	}
+	if atomic.LoadInt32(&cluster.commits) != 1 {
+		t.Errorf("Expected the reservation resumed, got %d reservations", cluster.commits)
+	}
+	if _, exists, _ := s.db.GetPendingIndex("key_a"); exists {
+		t.Error("Expected the pending index cleared after release")
+	}
+}
+
+// failingKeyStore fails key record writes while pending and burned indices are still recorded
+type failingKeyStore struct {
+	KeyStore
+}
+
+func (f *failingKeyStore) StoreKey(keyID string, key *LMSKey) error {
+	return fmt.Errorf("disk full")
+}
+
+func TestDiscardRule_PersistFailureDiscardsSignature(t *testing.T) {
+	cluster := newSignTestCluster(t)
+	signer := &testSigner{}
+	s := newDiscardTestServer(t, cluster, signer)
+	db := s.db
+	s.db = &failingKeyStore{db}
+
+	status, response := signTestMessage(s, "hello")
+	if status != http.StatusInternalServerError || response.Success || response.Signature != nil {
+		t.Fatalf("Expected the signature to be discarded, got %d %+v", status, response)
+	}
+	if len(signer.signatures) != 1 || !bytes.Equal(signer.signatures[0], make([]byte, len(signer.signatures[0]))) {
+		t.Errorf("Expected the discarded signature to be wiped, got %q", signer.signatures)
+	}
+	if !bytes.Equal(s.keys["key_a"].PrivateKey, testPrivateKey(0)) {
+		t.Errorf("Expected the cached key to stay with the database, got %v", s.keys["key_a"].PrivateKey)
+	}
+	if burned, _ := db.GetBurnedIndices("key_a"); len(burned) != 1 || burned[0].Step != discardStepPersist {
+		t.Fatalf("Expected index 0 discarded at the persist step, got %+v", burned)
+	}
+
+	// The key state never moved past the reserved index: it is signed once the database recovers
+	s.db = db
+	if status, response := signTestMessage(s, "hello"); status != http.StatusOK || response.Index != 0 {
+		t.Fatalf("Expected the reserved index 0 signed, got %d %+v", status, response)
+	}
+	if atomic.LoadInt32(&cluster.commits) != 1 {
+		t.Errorf("Expected one reservation, got %d", cluster.commits)
+	}
+}
+
+func TestDiscardRule_ReservationFailureSignsNothing(t *testing.T) {
+	cluster := newSignTestCluster(t)
+	signer := &testSigner{}
+	s := newDiscardTestServer(t, cluster, signer)
+
+	cluster.failCommits.Store(true)
+	status, response := signTestMessage(s, "hello")
+	if status != http.StatusInternalServerError || response.Success || response.Signature != nil {
+		t.Fatalf("Expected the sign request to fail, got %d %+v", status, response)
+	}
+	if len(signer.signatures) != 0 {
+		t.Errorf("Expected no signature without a reserved index, got %d", len(signer.signatures))
+	}
+	if key, _ := s.db.GetKey("key_a"); key.Index != 0 || !bytes.Equal(key.PrivateKey, testPrivateKey(0)) {
+		t.Errorf("Expected the stored key unchanged, got index %d, private key %v", key.Index, key.PrivateKey)
+	}
+	if _, _, exists := cluster.fsm.GetIndexAndHashByPubkeyHash(fsm.ComputePubkeyHash([]byte("lms-public-key"))); exists {
+		t.Error("Expected nothing committed to Raft")
+	}
+
+	cluster.failCommits.Store(false)
+	if status, response := signTestMessage(s, "hello"); status != http.StatusOK || response.Index != 0 {
+		t.Fatalf("Expected index 0 signed once Raft is back, got %d %+v", status, response)
+	}
+}
+
+// restartTestServer returns a server over the same database and cluster, as after a restart
+func restartTestServer(s *HSMServer, signer *testSigner) *HSMServer {
+	keys := make(map[string]*LMSKey)
+	if key, err := s.db.GetKey("key_a"); err == nil {
+		keys[key.KeyID] = key
+	}
+	return &HSMServer{
+		keys:               keys,
+		db:                 s.db,
+		raftEndpoints:      s.raftEndpoints,
+		attestationPrivKey: s.attestationPrivKey,
+		signer:             signer.sign,
+		leases:             make(map[string]*indexLease),
+	}
+}
+
+func TestDiscardRule_CrashAtEachStepRecovers(t *testing.T) {
+	tests := []struct {
+		step      string
+		nextIndex uint64 // Index signed after the restart
+	}{
+		{signStepAllocated, 1}, // Reserved, leaf unspent: the reservation is signed
+		{signStepSigned, 1},    // Signature lost before the key state was persisted: signed again
+		{signStepPersisted, 2}, // Key state persisted past index 1, never released: index 1 is lost
+	}
+	for _, tt := range tests {
+		t.Run(tt.step, func(t *testing.T) {
+			cluster := newSignTestCluster(t)
+			signer := &testSigner{}
+			s := newDiscardTestServer(t, cluster, signer)
+			if status, response := signTestMessage(s, "create"); status != http.StatusOK {
+				t.Fatalf("Create failed: %s", response.Error)
+			}
+
+			s.signStepHook = func(step string) {
+				if step == tt.step {
+					panic("crash")
+				}
+			}
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Fatalf("Expected a crash after step %s", tt.step)
+					}
+				}()
+				signTestMessage(s, "lost")
+			}()
+
+			restarted := restartTestServer(s, signer)
+			status, response := signTestMessage(restarted, "hello")
+			if status != http.StatusOK || response.Index != tt.nextIndex {
+				t.Fatalf("Expected a signature at index %d after the restart, got %d %+v", tt.nextIndex, status, response)
+			}
+			pubkeyHash := fsm.ComputePubkeyHash([]byte("lms-public-key"))
+			if index, _, _ := cluster.fsm.GetIndexAndHashByPubkeyHash(pubkeyHash); index != tt.nextIndex {
+				t.Errorf("Expected Raft head at index %d, got %d", tt.nextIndex, index)
+			}
+			if key, _ := s.db.GetKey("key_a"); key.Index != tt.nextIndex+1 {
+				t.Errorf("Expected the stored key at leaf %d, got %d", tt.nextIndex+1, key.Index)
+			}
+			if _, exists, _ := s.db.GetPendingIndex("key_a"); exists {
+				t.Error("Expected the pending index cleared after release")
+			}
+		})
+	}
+}
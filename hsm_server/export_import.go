@@ -122,6 +122,18 @@ func (s *HSMServer) handleExportKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A token key's private key cannot leave the token
+	if key.Backend != backendSoftware {
+		response := ExportKeyResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Key %s is held by a %s token and cannot be exported", key.KeyID, key.Backend),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
 	// Export the key (including private key)
 	response := ExportKeyResponse{
 		Success:    true,
@@ -384,56 +396,60 @@ func (s *HSMServer) handleDeleteKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Before deleting, commit a "delete" record to Raft and blockchain (if enabled)
-	// This preserves the deletion event in the attestation chain
-	pubkeyHashBase64 := fsm.ComputePubkeyHash(key.PublicKey)
+	// The delete record is committed at the next index: serialize it with the key's signatures
+	s.runOnKeyActor(req.KeyID, func() {
+		// Before deleting, commit a "delete" record to Raft and blockchain (if enabled)
+		// This preserves the deletion event in the attestation chain
+		pubkeyHashBase64 := fsm.ComputePubkeyHash(key.PublicKey)
 	
-	// Query Raft for current index and hash (use base64 format as stored in Raft)
-	raftIndex, raftHash, raftExists, err := s.queryRaftByPubkeyHash(pubkeyHashBase64)
-	if err != nil {
-		log.Printf("[WARNING] Failed to query Raft for key %s before deletion: %v. Proceeding with deletion anyway.", req.KeyID, err)
-	} else if raftExists {
-		// Commit delete record with next index
-		deleteIndex := raftIndex + 1
-		if raftHash == "" {
-			// If no hash in response, use GenesisHash (shouldn't happen, but be safe)
-			raftHash = fsm.GenesisHash
-		}
+		// Query Raft for current index and hash (use base64 format as stored in Raft)
+		raftIndex, raftHash, raftExists, err := s.queryRaftByPubkeyHash(pubkeyHashBase64)
+		if err != nil {
+			log.Printf("[WARNING] Failed to query Raft for key %s before deletion: %v. Proceeding with deletion anyway.", req.KeyID, err)
+		} else if raftExists {
+			// Commit delete record with next index
+			deleteIndex := raftIndex + 1
+			if raftHash == "" {
+				// If no hash in response, use GenesisHash (shouldn't happen, but be safe)
+				raftHash = fsm.GenesisHash
+			}
 
-		log.Printf("[INFO] Committing delete record for key %s at index %d (previous_hash=%s)", req.KeyID, deleteIndex, raftHash)
-		if err := s.commitIndexToRaft(req.KeyID, deleteIndex, raftHash, key.PublicKey, req.WalletAddress, req.BlockchainEnabled, "delete"); err != nil {
-			log.Printf("[WARNING] Failed to commit delete record for key %s: %v. Proceeding with deletion anyway.", req.KeyID, err)
+			log.Printf("[INFO] Committing delete record for key %s at index %d (previous_hash=%s)", req.KeyID, deleteIndex, raftHash)
+			if err := s.commitIndexToRaft(req.KeyID, deleteIndex, raftHash, key.PublicKey, req.WalletAddress, req.BlockchainEnabled, "delete", nil); err != nil {
+				log.Printf("[WARNING] Failed to commit delete record for key %s: %v. Proceeding with deletion anyway.", req.KeyID, err)
+			} else {
+				log.Printf("[INFO] Successfully committed delete record for key %s at index %d", req.KeyID, deleteIndex)
+			}
 		} else {
-			log.Printf("[INFO] Successfully committed delete record for key %s at index %d", req.KeyID, deleteIndex)
+			log.Printf("[INFO] Key %s has no Raft entries - skipping delete record commit", req.KeyID)
 		}
-	} else {
-		log.Printf("[INFO] Key %s has no Raft entries - skipping delete record commit", req.KeyID)
-	}
 
-	// Delete from database
-	if err := s.db.DeleteKey(req.KeyID); err != nil {
-		response := map[string]interface{}{
-			"success": false,
-			"error":   fmt.Sprintf("Failed to delete key from database: %v", err),
+		// Delete from database
+		if err := s.db.DeleteKey(req.KeyID); err != nil {
+			response := map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to delete key from database: %v", err),
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
 
-	// Remove from memory cache
-	s.mu.Lock()
-	delete(s.keys, req.KeyID)
-	s.mu.Unlock()
+		// Remove from memory cache
+		s.mu.Lock()
+		delete(s.keys, req.KeyID)
+		s.mu.Unlock()
+		s.deleteKeyBackend(key)
 
-	response := map[string]interface{}{
-		"success": true,
-		"message": fmt.Sprintf("Key %s deleted successfully", req.KeyID),
-	}
+		response := map[string]interface{}{
+			"success": true,
+			"message": fmt.Sprintf("Key %s deleted successfully", req.KeyID),
+		}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
 }
 
 // ComputePubkeyHash computes SHA-256 hash of the public key
@@ -1,8 +1,10 @@
 package hsm_server
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -15,6 +17,8 @@ import (
 	"github.com/verifiable-state-chains/lms/blockchain"
 	"github.com/verifiable-state-chains/lms/fsm"
 	"github.com/verifiable-state-chains/lms/lms_wrapper"
+	"github.com/verifiable-state-chains/lms/metrics"
+	"github.com/verifiable-state-chains/lms/tlsutil"
 )
 
 // LMSKey represents an LMS key managed by the HSM server
@@ -31,17 +35,36 @@ type LMSKey struct {
 	Levels  int   `json:"levels"`   // Number of levels
 	LmType  []int `json:"lm_type"`  // LMS parameter set array
 	OtsType []int `json:"ots_type"` // OTS parameter set array
+
+	Backend string `json:"backend,omitempty"` // Where the private key is held: "" (PrivateKey) or "pkcs11" (token)
+}
+
+// lmsKeyParams returns the key's HSS parameter set for its create record (nil if not recorded)
+func lmsKeyParams(key *LMSKey) *fsm.LMSParams {
+	if key.Levels == 0 || len(key.LmType) == 0 || len(key.OtsType) == 0 {
+		return nil
+	}
+	return &fsm.LMSParams{
+		Levels:  key.Levels,
+		LmType:  append([]int(nil), key.LmType...),
+		OtsType: append([]int(nil), key.OtsType...),
+	}
 }
 
 // HSMServer manages LMS keys
 type HSMServer struct {
 	mu                 sync.RWMutex
 	keys               map[string]*LMSKey // key_id -> LMSKey (in-memory cache)
-	db                 *KeyDB             // Persistent database
+	db                 KeyStore           // Persistent database (*KeyDB)
 	port               int
 	raftEndpoints      []string          // Raft cluster endpoints
-	attestationPrivKey *ecdsa.PrivateKey // EC private key for signing
+	raftClient         *http.Client      // Client for the Raft API (nil: http.DefaultClient)
+	attestationPrivKey crypto.Signer     // EC private key for signing (*ecdsa.PrivateKey or a token key)
 	attestationPubKey  *ecdsa.PublicKey  // EC public key
+	signer             lmsSigner         // LMS signer (nil: the key's backend)
+	signStepHook       func(step string) // Called after each durable signing step (tests simulate crashes)
+	token              *PKCS11Token      // PKCS#11 token (nil: software keys only)
+	tokenSigner        LMSSigner         // Signer of LMS keys on the token (nil: new keys use hash-sigs)
 
 	// Standard LMS parameters (h=5, w=1)
 	defaultLevels  int
@@ -52,6 +75,17 @@ type HSMServer struct {
 	blockchainEnabled  bool                    // Enable blockchain commits
 	blockchainClient   *blockchain.VerusClient // Verus RPC client (nil if disabled)
 	blockchainIdentity string                  // Verus identity name (e.g., "sg777z.chips.vrsc@")
+
+	// Index range leases (reserve_range) for large keys
+	leaseMu    sync.Mutex
+	leases     map[string]*indexLease // key_id -> outstanding lease
+	instanceID string                 // HSM instance name recorded on leases
+	leaseSize  uint64                 // Indices per lease (0: leasing disabled)
+
+	// Per-key signing actors and the loaded working keys they sign with
+	actorMu     sync.Mutex
+	actors      map[string]*keySigningActor // key_id -> actor with queued operations
+	workingKeys *workingKeyCache            // nil: load the working key for every signature
 }
 
 // BlockchainConfig holds blockchain configuration for HSM server
@@ -63,7 +97,7 @@ type BlockchainConfig struct {
 	IdentityName string // Verus identity name (e.g., "sg777z.chips.vrsc@")
 }
 
-// NewHSMServer creates a new HSM server
+// NewHSMServer creates a new HSM server with software keys (keys.db, hash-sigs and a PEM attestation key)
 // blockchainConfig can be nil to disable blockchain commits
 func NewHSMServer(port int, raftEndpoints []string, blockchainConfig *BlockchainConfig) (*HSMServer, error) {
 	// Load attestation key pair (must be generated with OpenSSL)
@@ -71,7 +105,27 @@ func NewHSMServer(port int, raftEndpoints []string, blockchainConfig *Blockchain
 	if err != nil {
 		return nil, fmt.Errorf("failed to load/generate attestation keys: %v", err)
 	}
+	return newHSMServer(port, raftEndpoints, blockchainConfig, privKey, pubKey)
+}
+
+// NewPKCS11HSMServer creates an HSM server whose attestation key is on a PKCS#11 token
+// If the token supports HSS, new LMS keys are generated and signed with on the token; keys already in
+// keys.db keep signing with hash-sigs. The server closes the token.
+func NewPKCS11HSMServer(port int, raftEndpoints []string, blockchainConfig *BlockchainConfig, token *PKCS11Token, attestationLabel string) (*HSMServer, error) {
+	attestationKey, err := token.AttestationSigner(attestationLabel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load attestation key from the token: %v", err)
+	}
+	server, err := newHSMServer(port, raftEndpoints, blockchainConfig, attestationKey, attestationKey.Public().(*ecdsa.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	server.token = token
+	server.tokenSigner = token.LMSSigner()
+	return server, nil
+}
 
+func newHSMServer(port int, raftEndpoints []string, blockchainConfig *BlockchainConfig, privKey crypto.Signer, pubKey *ecdsa.PublicKey) (*HSMServer, error) {
 	// Open persistent database
 	db, err := NewKeyDB(dbFileName)
 	if err != nil {
@@ -120,6 +174,9 @@ func NewHSMServer(port int, raftEndpoints []string, blockchainConfig *Blockchain
 		blockchainEnabled:  blockchainEnabled,
 		blockchainClient:   blockchainClient,
 		blockchainIdentity: blockchainIdentity,
+		leases:             make(map[string]*indexLease),
+		actors:             make(map[string]*keySigningActor),
+		workingKeys:        newWorkingKeyCache(defaultWorkingKeyCacheSize, loadWorkingKey),
 	}, nil
 }
 
@@ -244,9 +301,10 @@ func (s *HSMServer) generateKey(keyID string, userID string, username string) (*
 		}
 	}
 
-	// Generate actual LMS key pair using hash-sigs library
+	// Generate actual LMS key pair (hash-sigs, or the PKCS#11 token if it supports HSS)
+	signer := s.newKeySigner()
 	log.Printf("Generating LMS key pair for key_id: %s", keyID)
-	privKey, pubKey, err := lms_wrapper.GenerateKeyPair(s.defaultLevels, s.defaultLmType, s.defaultOtsType)
+	privKey, pubKey, err := signer.GenerateKey(keyID, s.defaultLevels, s.defaultLmType, s.defaultOtsType)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate LMS key pair: %v", err)
 	}
@@ -267,6 +325,7 @@ func (s *HSMServer) generateKey(keyID string, userID string, username string) (*
 		Levels:     s.defaultLevels,
 		LmType:     make([]int, len(s.defaultLmType)),
 		OtsType:    make([]int, len(s.defaultOtsType)),
+		Backend:    signer.Backend(),
 	}
 	copy(key.LmType, s.defaultLmType)
 	copy(key.OtsType, s.defaultOtsType)
@@ -288,7 +347,7 @@ func (s *HSMServer) generateKey(keyID string, userID string, username string) (*
 	blockchainEnabled := false // Keys are created without blockchain enabled
 
 	// Commit index 0 with "create" record type
-	if err := s.commitIndexToRaft(keyID, 0, fsm.GenesisHash, pubKey, "", blockchainEnabled, "create"); err != nil {
+	if err := s.commitIndexToRaft(keyID, 0, fsm.GenesisHash, pubKey, "", blockchainEnabled, "create", lmsKeyParams(key)); err != nil {
 		log.Printf("[WARNING] Failed to commit index 0 (create) for key %s: %v", keyID, err)
 		// Don't fail key generation if commit fails - key is still created
 		// User can retry or the commit will happen on first sign
@@ -432,6 +491,16 @@ func (s *HSMServer) handleDeleteAllKeys(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Token keys are destroyed with their records
+	tokenKeys := make([]*LMSKey, 0)
+	s.mu.RLock()
+	for _, key := range s.keys {
+		if key.Backend != backendSoftware {
+			tokenKeys = append(tokenKeys, key)
+		}
+	}
+	s.mu.RUnlock()
+
 	// Delete all keys from database
 	if err := s.db.DeleteAllKeys(); err != nil {
 		response := map[string]interface{}{
@@ -448,6 +517,12 @@ func (s *HSMServer) handleDeleteAllKeys(w http.ResponseWriter, r *http.Request)
 	s.mu.Lock()
 	s.keys = make(map[string]*LMSKey)
 	s.mu.Unlock()
+	if s.workingKeys != nil {
+		s.workingKeys.close()
+	}
+	for _, key := range tokenKeys {
+		s.deleteKeyBackend(key)
+	}
 
 	response := map[string]interface{}{
 		"success": true,
@@ -469,6 +544,7 @@ func (s *HSMServer) Start() error {
 	mux.HandleFunc("/export_key", s.handleExportKey)
 	mux.HandleFunc("/import_key", s.handleImportKey)
 	mux.HandleFunc("/delete_key", s.handleDeleteKey)
+	mux.Handle("/metrics", metrics.Handler(s.newMetricsRegistry()))
 
 	addr := fmt.Sprintf(":%d", s.port)
 	log.Printf("HSM Server starting on %s", addr)
@@ -481,8 +557,17 @@ func (s *HSMServer) Start() error {
 	log.Printf("  POST   /export_key     - Export key (includes private key)")
 	log.Printf("  POST   /import_key     - Import key")
 	log.Printf("  POST   /delete_key     - Delete a specific key")
+	log.Printf("  GET    /metrics        - Prometheus metrics")
 	log.Printf("Raft endpoints: %v", s.raftEndpoints)
 	log.Printf("Database: %s", dbFileName)
+	if s.token != nil {
+		log.Printf("Attestation key: PKCS#11 token (LMS keys on token: %v)", s.tokenSigner != nil)
+	}
+	if kdb, ok := s.db.(*KeyDB); ok && kdb.MasterKeyID() != "" {
+		log.Printf("Key encryption: ENABLED (master key %s)", kdb.MasterKeyID())
+	} else {
+		log.Printf("Key encryption: DISABLED (private keys stored in plaintext)")
+	}
 	if s.blockchainEnabled {
 		log.Printf("Blockchain commits: ENABLED (identity=%s)", s.blockchainIdentity)
 	} else {
@@ -494,8 +579,84 @@ func (s *HSMServer) Start() error {
 
 // Close closes the HSM server and database
 func (s *HSMServer) Close() error {
+	// Index leases are kept: they are recorded in the key database and resumed by ReclaimLeases
+	if s.workingKeys != nil {
+		s.workingKeys.close()
+	}
+	var err error
 	if s.db != nil {
-		return s.db.Close()
+		err = s.db.Close()
+	}
+	if s.token != nil {
+		if tokenErr := s.token.Close(); err == nil {
+			err = tokenErr
+		}
+	}
+	return err
+}
+
+// SetWorkingKeyCacheSize sets how many loaded working keys are kept between signatures (0 disables caching)
+// Call it before Start.
+func (s *HSMServer) SetWorkingKeyCacheSize(size int) {
+	if s.workingKeys != nil {
+		s.workingKeys.close()
+	}
+	s.workingKeys = newWorkingKeyCache(size, loadWorkingKey)
+}
+
+// SetKeyEncryption reopens the key database with its keys encrypted under master (envelope encryption)
+// Plaintext keys are encrypted on open. Keys wrapped by a previous master key are re-wrapped under master
+// in the background while the server runs. Call it before Start.
+func (s *HSMServer) SetKeyEncryption(master MasterKey, previous ...MasterKey) error {
+	kdb, ok := s.db.(*KeyDB)
+	if !ok {
+		return fmt.Errorf("key encryption needs the bbolt key database")
+	}
+	dbPath := kdb.path
+	if err := kdb.Close(); err != nil {
+		return fmt.Errorf("failed to close key database: %v", err)
+	}
+	db, err := NewEncryptedKeyDB(dbPath, master, previous...)
+	if err != nil {
+		return fmt.Errorf("failed to open encrypted key database: %v", err)
+	}
+	keys, err := db.GetAllKeys()
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("failed to load keys: %v", err)
+	}
+
+	s.mu.Lock()
+	s.db = db
+	s.keys = make(map[string]*LMSKey)
+	for _, key := range keys {
+		s.keys[key.KeyID] = key
+	}
+	s.mu.Unlock()
+
+	if len(previous) > 0 {
+		go func() {
+			rewrapped, err := db.RotateMasterKey()
+			if err != nil {
+				log.Printf("[WARNING] Master key rotation stopped after %d keys: %v", rewrapped, err)
+				return
+			}
+			log.Printf("[INFO] Master key rotation done: %d data keys re-wrapped under %s, previous master keys are no longer needed", rewrapped, master.ID())
+		}()
 	}
 	return nil
 }
+
+// SetRaftClientTLS makes Raft API requests over TLS with the given configuration
+// (cluster CA and, for clusters requiring client certificates, this HSM's certificate)
+func (s *HSMServer) SetRaftClientTLS(config *tls.Config) {
+	s.raftClient = tlsutil.NewHTTPClient(config, 0)
+}
+
+// raftHTTPClient returns the client for Raft API requests
+func (s *HSMServer) raftHTTPClient() *http.Client {
+	if s.raftClient == nil {
+		return http.DefaultClient
+	}
+	return s.raftClient
+}
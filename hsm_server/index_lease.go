@@ -0,0 +1,413 @@
+package hsm_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+	"github.com/verifiable-state-chains/lms/lms_wrapper"
+)
+
+// leaseMinSignatures is the smallest key capacity that signs from leased ranges (H20 and above)
+// Smaller keys keep one Raft round trip per signature
+const leaseMinSignatures = 1 << 20
+
+// indexLease is a range of indices leased from the Raft cluster and consumed locally
+// It is recorded in the key database whenever an index is handed out or used, so a restart resumes
+// the lease where it stopped: the key's leaf is inside it and the next lease starts after its end.
+type indexLease struct {
+	LeaseID string   `json:"lease_id"`
+	KeyID   string   `json:"key_id"`
+	Start   uint64   `json:"start"`
+	End     uint64   `json:"end"`            // Inclusive
+	Next    uint64   `json:"next"`           // Next index to hand out
+	Used    []uint64 `json:"used,omitempty"` // Indices that produced a released signature
+	Closed  bool     `json:"closed,omitempty"`
+}
+
+// signable reports whether the key may sign its leaf from this lease
+// The leaf is unspent, so it may have been handed out before to a signature that failed; at or below the
+// last used index it would reuse a released one-time key (a restored key state).
+func (l *indexLease) signable(leaf uint64) bool {
+	if leaf < l.Start || leaf > l.End {
+		return false
+	}
+	return len(l.Used) == 0 || leaf > l.Used[len(l.Used)-1]
+}
+
+// SetIndexLeasing enables range leases of leaseSize indices for large keys (0 disables leasing)
+// instanceID names this HSM server in the cluster's lease table and must be unique per instance
+func (s *HSMServer) SetIndexLeasing(instanceID string, leaseSize uint64) {
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	s.instanceID = instanceID
+	s.leaseSize = leaseSize
+}
+
+// usesIndexLease reports whether signatures for this key are drawn from a leased range
+func (s *HSMServer) usesIndexLease(key *LMSKey) bool {
+	s.leaseMu.Lock()
+	enabled := s.leaseSize > 0 && s.instanceID != ""
+	s.leaseMu.Unlock()
+	if !enabled || len(key.LmType) == 0 {
+		return false
+	}
+
+	capacity := 1
+	for _, lmType := range key.LmType {
+		capacity *= lms_wrapper.GetMaxSignatures(lmType)
+	}
+	return capacity >= leaseMinSignatures
+}
+
+// nextLeasedIndex hands out the key's leaf from its lease, leasing the next range once the leaf is past it
+// Leased indices the leaf skipped (spent by discarded signatures) are never marked used, so returning the
+// lease records them as discarded. A leaf the lease cannot sign is answered with the lease's next index,
+// which signingLeafIndex rejects. Runs on the key's signing actor: leaseMu only guards the lease table
+// and is never held across a Raft round trip.
+func (s *HSMServer) nextLeasedIndex(keyID string, lmsPublicKey []byte, leaf uint64) (uint64, error) {
+	s.leaseMu.Lock()
+	lease := s.leases[keyID]
+	leaseSize := s.leaseSize
+	s.leaseMu.Unlock()
+
+	if lease == nil {
+		// After a restart the key's lease is recorded even if ReclaimLeases could not reach the cluster
+		recorded, err := s.recordedLease(keyID)
+		if err != nil {
+			return 0, err
+		}
+		lease = recorded
+	}
+	if lease != nil && leaf > lease.End {
+		// Exhausted: report it back before leasing the next range
+		if err := s.closeLease(lease); err != nil {
+			log.Printf("[WARNING] Failed to return exhausted lease %s: %v", lease.LeaseID, err)
+		}
+		lease = nil
+	}
+
+	if lease == nil {
+		leased, err := s.reserveRangeFromRaft(keyID, lmsPublicKey, leaseSize)
+		if err != nil {
+			return 0, err
+		}
+		lease = &indexLease{
+			LeaseID: leased.LeaseID,
+			KeyID:   keyID,
+			Start:   leased.Start,
+			End:     leased.End,
+			Next:    leased.Start,
+		}
+		s.leaseMu.Lock()
+		s.leases[keyID] = lease
+		s.leaseMu.Unlock()
+		log.Printf("[INFO] Leased indices [%d, %d] for key %s (%s)", lease.Start, lease.End, keyID, lease.LeaseID)
+	}
+
+	if !lease.signable(leaf) {
+		return lease.Next, nil
+	}
+	if leaf > lease.Next {
+		log.Printf("[INFO] Key %s skips leased indices [%d, %d)", keyID, lease.Next, leaf)
+	}
+
+	// The lease is durable before any of its indices is signed; a crash before this leaves it to ReclaimLeases
+	next := lease.Next
+	lease.Next = leaf + 1
+	if err := s.db.StoreIndexLease(lease); err != nil {
+		lease.Next = next
+		return 0, fmt.Errorf("failed to record lease %s: %v", lease.LeaseID, err)
+	}
+	return leaf, nil
+}
+
+// recordedLease returns the open lease of a key recorded in the key database, nil if there is none
+func (s *HSMServer) recordedLease(keyID string) (*indexLease, error) {
+	recorded, err := s.db.GetIndexLeases()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recorded leases: %v", err)
+	}
+	for _, lease := range recorded {
+		if lease.KeyID == keyID && !lease.Closed {
+			s.leaseMu.Lock()
+			s.leases[keyID] = lease
+			s.leaseMu.Unlock()
+			return lease, nil
+		}
+	}
+	return nil, nil
+}
+
+// markLeasedIndexUsed durably records that a leased index produced a signature, before it is released
+func (s *HSMServer) markLeasedIndexUsed(keyID string, index uint64) error {
+	s.leaseMu.Lock()
+	lease, exists := s.leases[keyID]
+	s.leaseMu.Unlock()
+	if !exists || index < lease.Start || index > lease.End {
+		return fmt.Errorf("index %d of key %s is not in its lease", index, keyID)
+	}
+
+	lease.Used = append(lease.Used, index)
+	if err := s.db.StoreIndexLease(lease); err != nil {
+		lease.Used = lease.Used[:len(lease.Used)-1]
+		return fmt.Errorf("failed to record lease %s: %v", lease.LeaseID, err)
+	}
+	return nil
+}
+
+// closeLease stops signing from a lease and returns it to the Raft cluster with its used indices
+// A lease that cannot be returned stays recorded as closed; ReclaimLeases returns it after a restart,
+// and otherwise the cluster expires it.
+func (s *HSMServer) closeLease(lease *indexLease) error {
+	s.leaseMu.Lock()
+	if s.leases[lease.KeyID] == lease {
+		delete(s.leases, lease.KeyID)
+	}
+	s.leaseMu.Unlock()
+
+	lease.Closed = true
+	if err := s.db.StoreIndexLease(lease); err != nil {
+		log.Printf("[WARNING] Failed to record lease %s as closed: %v", lease.LeaseID, err)
+	}
+	if err := s.returnRangeToRaft(lease); err != nil {
+		return err
+	}
+	return s.db.DeleteIndexLease(lease.LeaseID)
+}
+
+// ReclaimLeases resumes this instance's leases after a restart (call before serving)
+// A recorded lease the cluster still holds active is signed from again, or returned if it was closed;
+// one the cluster returned or expired is forgotten. An active lease that was never recorded was reserved
+// just before a crash, before any of its indices was handed out: it becomes its key's lease if the key
+// has none (the key's leaf is at its start), and is returned otherwise.
+func (s *HSMServer) ReclaimLeases() error {
+	s.leaseMu.Lock()
+	enabled := s.leaseSize > 0 && s.instanceID != ""
+	s.leaseMu.Unlock()
+	if !enabled {
+		return nil
+	}
+
+	recorded, err := s.db.GetIndexLeases()
+	if err != nil {
+		return fmt.Errorf("failed to read recorded leases: %v", err)
+	}
+	active, err := s.activeLeasesFromRaft()
+	if err != nil {
+		return err
+	}
+	held := make(map[string]*fsm.IndexLease)
+	for _, lease := range active {
+		if lease.HSMInstance == s.instanceID {
+			held[lease.LeaseID] = lease
+		}
+	}
+
+	var lastErr error
+	resumed := make(map[string]*indexLease)
+	var unreturned []*indexLease
+	for _, lease := range recorded {
+		if held[lease.LeaseID] == nil {
+			if err := s.db.DeleteIndexLease(lease.LeaseID); err != nil {
+				lastErr = err
+			}
+			continue
+		}
+		delete(held, lease.LeaseID)
+		if lease.Closed {
+			unreturned = append(unreturned, lease)
+			continue
+		}
+		resumed[lease.KeyID] = lease
+		log.Printf("[INFO] Resumed lease %s of key %s at index %d", lease.LeaseID, lease.KeyID, lease.Next)
+	}
+
+	orphans := make([]*fsm.IndexLease, 0, len(held))
+	for _, lease := range held {
+		orphans = append(orphans, lease)
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].RaftIndex < orphans[j].RaftIndex
+	})
+	for _, orphan := range orphans {
+		lease := &indexLease{
+			LeaseID: orphan.LeaseID,
+			KeyID:   orphan.KeyID,
+			Start:   orphan.Start,
+			End:     orphan.End,
+			Next:    orphan.Start,
+		}
+		if _, exists := resumed[lease.KeyID]; exists {
+			unreturned = append(unreturned, lease)
+			continue
+		}
+		resumed[lease.KeyID] = lease
+		log.Printf("[INFO] Reclaimed unrecorded lease %s of key %s", lease.LeaseID, lease.KeyID)
+	}
+
+	s.leaseMu.Lock()
+	for keyID, lease := range resumed {
+		s.leases[keyID] = lease
+	}
+	s.leaseMu.Unlock()
+
+	for _, lease := range unreturned {
+		if err := s.returnRangeToRaft(lease); err != nil {
+			log.Printf("[WARNING] Failed to return lease %s of key %s: %v", lease.LeaseID, lease.KeyID, err)
+			lastErr = err
+			continue
+		}
+		if err := s.db.DeleteIndexLease(lease.LeaseID); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// ReturnLeases returns every outstanding lease to the Raft cluster, recording unused indices as discarded
+// The keys' leaves stay inside the returned ranges and the next leases start past them, so a key cannot
+// sign from leases again: call it only when the instance stops signing for good. A restart keeps its leases.
+func (s *HSMServer) ReturnLeases() error {
+	s.leaseMu.Lock()
+	keyIDs := make([]string, 0, len(s.leases))
+	for keyID := range s.leases {
+		keyIDs = append(keyIDs, keyID)
+	}
+	s.leaseMu.Unlock()
+
+	var lastErr error
+	for _, keyID := range keyIDs {
+		s.runOnKeyActor(keyID, func() {
+			s.leaseMu.Lock()
+			lease, exists := s.leases[keyID]
+			s.leaseMu.Unlock()
+			if !exists {
+				return
+			}
+			if err := s.closeLease(lease); err != nil {
+				log.Printf("[WARNING] Failed to return lease %s for key %s: %v", lease.LeaseID, keyID, err)
+				lastErr = err
+			}
+		})
+	}
+	return lastErr
+}
+
+// reserveRangeFromRaft leases count indices for an LMS key from the Raft cluster
+// The lease is signed for the current chain head; the cluster rejects it if the head moves first
+func (s *HSMServer) reserveRangeFromRaft(keyID string, lmsPublicKey []byte, count uint64) (*fsm.IndexLease, error) {
+	pubkeyHash := fsm.ComputePubkeyHash(lmsPublicKey)
+	_, head, exists, err := s.queryRaftByPubkeyHash(pubkeyHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chain head: %v", err)
+	}
+	if !exists {
+		head = fsm.GenesisHash
+	}
+
+	req := fsm.RangeLeaseRequest{
+		KeyID:        keyID,
+		PubkeyHash:   pubkeyHash,
+		PreviousHash: head,
+		HSMInstance:  s.instanceID,
+		Count:        count,
+	}
+	if err := fsm.SignRangeLease(&req, s.attestationPrivKey); err != nil {
+		return nil, err
+	}
+
+	return s.postLeaseCommand("/reserve_range", req)
+}
+
+// returnRangeToRaft returns a lease to the Raft cluster with its used indices
+func (s *HSMServer) returnRangeToRaft(lease *indexLease) error {
+	req := fsm.RangeReturnRequest{
+		LeaseID:     lease.LeaseID,
+		HSMInstance: s.instanceID,
+		Used:        lease.Used,
+	}
+	if err := fsm.SignRangeReturn(&req, s.attestationPrivKey); err != nil {
+		return err
+	}
+
+	returned, err := s.postLeaseCommand("/return_range", req)
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Returned lease %s: %d used, %d discarded", returned.LeaseID, len(returned.Used), len(returned.Discarded))
+	return nil
+}
+
+// postLeaseCommand posts a lease request to the Raft cluster and returns the resulting lease
+func (s *HSMServer) postLeaseCommand(path string, req interface{}) (*fsm.IndexLease, error) {
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	var lastErr error
+	for _, endpoint := range s.raftEndpoints {
+		resp, err := s.raftHTTPClient().Post(endpoint+path, "application/json", bytes.NewBuffer(reqBody))
+		if err != nil {
+			lastErr = fmt.Errorf("failed to connect to %s: %v", endpoint, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		var response struct {
+			Success bool            `json:"success"`
+			Lease   *fsm.IndexLease `json:"lease"`
+			Error   string          `json:"error"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			lastErr = fmt.Errorf("error from %s: status %d, body: %s", endpoint, resp.StatusCode, string(body))
+			continue
+		}
+		if resp.StatusCode != http.StatusOK || !response.Success || response.Lease == nil {
+			lastErr = fmt.Errorf("%s failed at %s: %s", path, endpoint, response.Error)
+			continue
+		}
+
+		return response.Lease, nil
+	}
+
+	return nil, fmt.Errorf("all endpoints failed: %v", lastErr)
+}
+
+// activeLeasesFromRaft lists the active leases of the Raft cluster
+func (s *HSMServer) activeLeasesFromRaft() ([]*fsm.IndexLease, error) {
+	var lastErr error
+	for _, endpoint := range s.raftEndpoints {
+		resp, err := s.raftHTTPClient().Get(endpoint + "/leases?active=true")
+		if err != nil {
+			lastErr = fmt.Errorf("failed to connect to %s: %v", endpoint, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		var response struct {
+			Success bool              `json:"success"`
+			Leases  []*fsm.IndexLease `json:"leases"`
+			Error   string            `json:"error"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			lastErr = fmt.Errorf("error from %s: status %d, body: %s", endpoint, resp.StatusCode, string(body))
+			continue
+		}
+		if resp.StatusCode != http.StatusOK || !response.Success {
+			lastErr = fmt.Errorf("/leases failed at %s: %s", endpoint, response.Error)
+			continue
+		}
+		return response.Leases, nil
+	}
+
+	return nil, fmt.Errorf("all endpoints failed: %v", lastErr)
+}
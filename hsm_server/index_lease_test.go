@@ -0,0 +1,285 @@
+package hsm_server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/verifiable-state-chains/lms/fsm"
+	"github.com/verifiable-state-chains/lms/lms_wrapper"
+)
+
+// newLeaseTestCluster serves /reserve_range, /return_range and chain head reads straight from a KeyIndexFSM
+func newLeaseTestCluster(t *testing.T) (*httptest.Server, *fsm.KeyIndexFSM) {
+	t.Helper()
+
+	keyIndexFSM, _ := fsm.NewKeyIndexFSM("")
+	var raftIndex uint64
+	handler := func(wrap func(body json.RawMessage) interface{}) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var body json.RawMessage
+			json.NewDecoder(r.Body).Decode(&body)
+			data, _ := json.Marshal(wrap(body))
+			result := keyIndexFSM.Apply(&raft.Log{Type: raft.LogCommand, Index: atomic.AddUint64(&raftIndex, 1), Data: data})
+
+			lease, ok := result.(*fsm.IndexLease)
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": result})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "lease": lease})
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pubkey_hash/", func(w http.ResponseWriter, r *http.Request) {
+		pubkeyHash := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/pubkey_hash/"), "/index")
+		index, hash, exists := keyIndexFSM.GetIndexAndHashByPubkeyHash(pubkeyHash)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "exists": exists, "index": index, "hash": hash})
+	})
+	mux.HandleFunc("/reserve_range", handler(func(body json.RawMessage) interface{} {
+		return map[string]json.RawMessage{"reserve_range": body}
+	}))
+	mux.HandleFunc("/return_range", handler(func(body json.RawMessage) interface{} {
+		return map[string]json.RawMessage{"return_range": body}
+	}))
+	mux.HandleFunc("/leases", func(w http.ResponseWriter, r *http.Request) {
+		leases := keyIndexFSM.GetLeases("", r.URL.Query().Get("active") == "true")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "leases": leases})
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, keyIndexFSM
+}
+
+// newLeaseTestServer creates an HSM server leasing 4 indices at a time from the cluster, with its key database at dbPath
+func newLeaseTestServer(t *testing.T, cluster *httptest.Server, privKey *ecdsa.PrivateKey, dbPath string) *HSMServer {
+	t.Helper()
+
+	db, err := NewKeyDB(dbPath)
+	if err != nil {
+		t.Fatalf("NewKeyDB failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	s := &HSMServer{
+		db:                 db,
+		raftEndpoints:      []string{cluster.URL},
+		attestationPrivKey: privKey,
+		leases:             make(map[string]*indexLease),
+	}
+	s.SetIndexLeasing("hsm-test", 4)
+	return s
+}
+
+// createLeaseTestKey commits the create record of key_a at index 0, before any lease
+func createLeaseTestKey(t *testing.T, keyIndexFSM *fsm.KeyIndexFSM, privKey *ecdsa.PrivateKey, lmsPublicKey []byte) {
+	t.Helper()
+
+	create := fsm.KeyIndexEntry{KeyID: "key_a", PubkeyHash: fsm.ComputePubkeyHash(lmsPublicKey), PreviousHash: fsm.GenesisHash, RecordType: "create",
+		LMSParams: &fsm.LMSParams{Levels: 1, LmType: []int{lms_wrapper.LMS_SHA256_M32_H20}, OtsType: []int{lms_wrapper.LMOTS_SHA256_N32_W1}}}
+	fsm.SignEntry(&create, privKey)
+	create.Hash, _ = create.ComputeHash()
+	createData, _ := json.Marshal(create)
+	keyIndexFSM.Apply(&raft.Log{Type: raft.LogCommand, Index: 1000, Data: createData})
+}
+
+func TestIndexLease_SignLocallyAndReturn(t *testing.T) {
+	cluster, keyIndexFSM := newLeaseTestCluster(t)
+	privKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyIndexFSM.PinAttestationKey(&privKey.PublicKey)
+	s := newLeaseTestServer(t, cluster, privKey, filepath.Join(t.TempDir(), "keys.db"))
+	lmsPublicKey := []byte("lms-public-key")
+	pubkeyHash := fsm.ComputePubkeyHash(lmsPublicKey)
+	createLeaseTestKey(t, keyIndexFSM, privKey, lmsPublicKey)
+
+	// Six signatures span two leases; index 3's signature is discarded and never marked used
+	for leaf := uint64(1); leaf <= 6; leaf++ {
+		index, err := s.nextLeasedIndex("key_a", lmsPublicKey, leaf)
+		if err != nil {
+			t.Fatalf("nextLeasedIndex failed: %v", err)
+		}
+		if index != leaf {
+			t.Fatalf("Expected index %d, got %d", leaf, index)
+		}
+		if index != 3 {
+			if err := s.markLeasedIndexUsed("key_a", index); err != nil {
+				t.Fatalf("markLeasedIndexUsed failed: %v", err)
+			}
+		}
+	}
+
+	if err := s.ReturnLeases(); err != nil {
+		t.Fatalf("ReturnLeases failed: %v", err)
+	}
+
+	leases := keyIndexFSM.GetLeases(pubkeyHash, false)
+	if len(leases) != 2 {
+		t.Fatalf("Expected 2 leases, got %d", len(leases))
+	}
+	first, second := leases[0], leases[1]
+	if first.Status != fsm.LeaseReturned || len(first.Used) != 3 || len(first.Discarded) != 1 || first.Discarded[0] != 3 {
+		t.Fatalf("Unexpected first lease: %+v", first)
+	}
+	if second.Status != fsm.LeaseReturned || len(second.Used) != 2 || len(second.Discarded) != 2 {
+		t.Fatalf("Unexpected second lease: %+v", second)
+	}
+	if recorded, _ := s.db.GetIndexLeases(); len(recorded) != 0 {
+		t.Fatalf("Expected returned leases to be forgotten, %d still recorded", len(recorded))
+	}
+
+	t.Logf("✅ Signed 5 of 6 leased indices across 2 leases, index 3 recorded as discarded")
+}
+
+func TestIndexLease_FollowsLeafAcrossRestarts(t *testing.T) {
+	cluster, keyIndexFSM := newLeaseTestCluster(t)
+	privKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyIndexFSM.PinAttestationKey(&privKey.PublicKey)
+	dbPath := filepath.Join(t.TempDir(), "keys.db")
+	s := newLeaseTestServer(t, cluster, privKey, dbPath)
+	lmsPublicKey := []byte("lms-public-key")
+	pubkeyHash := fsm.ComputePubkeyHash(lmsPublicKey)
+	createLeaseTestKey(t, keyIndexFSM, privKey, lmsPublicKey)
+
+	sign := func(s *HSMServer, leaf uint64, used bool) {
+		t.Helper()
+		index, err := s.nextLeasedIndex("key_a", lmsPublicKey, leaf)
+		if err != nil {
+			t.Fatalf("nextLeasedIndex failed: %v", err)
+		}
+		if index != leaf {
+			t.Fatalf("Expected leased index %d for leaf %d, got %d", leaf, leaf, index)
+		}
+		if used {
+			if err := s.markLeasedIndexUsed("key_a", index); err != nil {
+				t.Fatalf("markLeasedIndexUsed failed: %v", err)
+			}
+		}
+	}
+
+	// Index 2 is handed out but its signature fails before the leaf is spent
+	sign(s, 1, true)
+	sign(s, 2, false)
+
+	// After a crash the recorded lease is resumed at the key's leaf, without leasing another range
+	s.db.Close()
+	s = newLeaseTestServer(t, cluster, privKey, dbPath)
+	sign(s, 2, true)
+	if leases := keyIndexFSM.GetLeases(pubkeyHash, false); len(leases) != 1 {
+		t.Fatalf("Expected the lease to be resumed, the cluster holds %d leases", len(leases))
+	}
+
+	// A restored key state behind the last used index is refused
+	if index, _ := s.nextLeasedIndex("key_a", lmsPublicKey, 2); index == 2 {
+		t.Fatal("Leaf 2 was handed out again after its signature was released")
+	}
+
+	// Index 3 was spent by a discarded signature: the leaf skips it, and the next lease follows the leaf
+	sign(s, 4, true)
+	sign(s, 5, true)
+	leases := keyIndexFSM.GetLeases(pubkeyHash, false)
+	if len(leases) != 2 || leases[0].Status != fsm.LeaseReturned || len(leases[0].Discarded) != 1 || leases[0].Discarded[0] != 3 {
+		t.Fatalf("Expected the first lease returned with index 3 discarded, got %+v", leases)
+	}
+	if leases[1].Start != 5 {
+		t.Fatalf("Expected the second lease to start at 5, got %d", leases[1].Start)
+	}
+}
+
+func TestIndexLease_ReclaimLeases(t *testing.T) {
+	cluster, keyIndexFSM := newLeaseTestCluster(t)
+	privKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyIndexFSM.PinAttestationKey(&privKey.PublicKey)
+	dbPath := filepath.Join(t.TempDir(), "keys.db")
+	s := newLeaseTestServer(t, cluster, privKey, dbPath)
+	lmsPublicKey := []byte("lms-public-key")
+	pubkeyHash := fsm.ComputePubkeyHash(lmsPublicKey)
+	createLeaseTestKey(t, keyIndexFSM, privKey, lmsPublicKey)
+
+	// A crash right after the cluster leased a range, before it was recorded
+	orphan, err := s.reserveRangeFromRaft("key_a", lmsPublicKey, 4)
+	if err != nil {
+		t.Fatalf("reserveRangeFromRaft failed: %v", err)
+	}
+	s.db.Close()
+
+	s = newLeaseTestServer(t, cluster, privKey, dbPath)
+	if err := s.ReclaimLeases(); err != nil {
+		t.Fatalf("ReclaimLeases failed: %v", err)
+	}
+	index, err := s.nextLeasedIndex("key_a", lmsPublicKey, orphan.Start)
+	if err != nil || index != orphan.Start {
+		t.Fatalf("Expected the unrecorded lease to be reclaimed at index %d, got %d (%v)", orphan.Start, index, err)
+	}
+	if leases := keyIndexFSM.GetLeases(pubkeyHash, false); len(leases) != 1 {
+		t.Fatalf("Expected the unrecorded lease to be reclaimed, the cluster holds %d leases", len(leases))
+	}
+
+	// A lease closed while the cluster was unreachable is returned at the next start
+	lease := s.leases["key_a"]
+	lease.Closed = true
+	s.db.StoreIndexLease(lease)
+	s.db.Close()
+
+	s = newLeaseTestServer(t, cluster, privKey, dbPath)
+	if err := s.ReclaimLeases(); err != nil {
+		t.Fatalf("ReclaimLeases failed: %v", err)
+	}
+	if leases := keyIndexFSM.GetLeases(pubkeyHash, false); leases[0].Status != fsm.LeaseReturned {
+		t.Fatalf("Expected the closed lease to be returned, got %+v", leases[0])
+	}
+	if recorded, _ := s.db.GetIndexLeases(); len(recorded) != 0 || len(s.leases) != 0 {
+		t.Fatalf("Expected no lease after returning the closed one, %d recorded, %d held", len(recorded), len(s.leases))
+	}
+}
+
+func TestIndexLease_OnlyLargeKeys(t *testing.T) {
+	s := &HSMServer{leases: make(map[string]*indexLease)}
+	s.SetIndexLeasing("hsm-test", 100)
+
+	if s.usesIndexLease(&LMSKey{Levels: 1, LmType: []int{lms_wrapper.LMS_SHA256_M32_H5}}) {
+		t.Fatal("H5 keys must not use leases")
+	}
+	if !s.usesIndexLease(&LMSKey{Levels: 1, LmType: []int{lms_wrapper.LMS_SHA256_M32_H20}}) {
+		t.Fatal("H20 keys must use leases")
+	}
+
+	s.SetIndexLeasing("hsm-test", 0)
+	if s.usesIndexLease(&LMSKey{Levels: 1, LmType: []int{lms_wrapper.LMS_SHA256_M32_H20}}) {
+		t.Fatal("Leasing must be disabled with lease size 0")
+	}
+}
+
+func TestLMSKeyParams_MatchesWrapperCapacity(t *testing.T) {
+	lmTypes := []int{
+		lms_wrapper.LMS_SHA256_M32_H5,
+		lms_wrapper.LMS_SHA256_M32_H10,
+		lms_wrapper.LMS_SHA256_M32_H15,
+		lms_wrapper.LMS_SHA256_M32_H20,
+		lms_wrapper.LMS_SHA256_M32_H25,
+	}
+	for _, lmType := range lmTypes {
+		key := &LMSKey{Levels: 1, LmType: []int{lmType}, OtsType: []int{lms_wrapper.LMOTS_SHA256_N32_W4}}
+		params := lmsKeyParams(key)
+		if err := params.Validate(); err != nil {
+			t.Fatalf("lm_type %d: %v", lmType, err)
+		}
+		if got, want := params.MaxSignatures(), uint64(lms_wrapper.GetMaxSignatures(lmType)); got != want {
+			t.Errorf("lm_type %d: FSM capacity %d, lms_wrapper %d", lmType, got, want)
+		}
+	}
+
+	if lmsKeyParams(&LMSKey{}) != nil {
+		t.Error("Expected nil params for a key without recorded parameters")
+	}
+}
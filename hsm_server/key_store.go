@@ -0,0 +1,116 @@
+package hsm_server
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/verifiable-state-chains/lms/lms_wrapper"
+)
+
+// Key backends: where the HSM keeps key records and the private keys it signs with.
+// The software backend stores LMS private keys in keys.db (KeyDB) and signs with hash-sigs; the
+// attestation key is a PEM file. The PKCS#11 backend keeps the attestation key on a token, and the LMS
+// private keys too when the token supports HSS; key records then hold only public metadata.
+
+// Where an LMS key's private key is held (LMSKey.Backend)
+const (
+	backendSoftware = ""       // LMSKey.PrivateKey, signed with hash-sigs
+	backendPKCS11   = "pkcs11" // Non-extractable PKCS#11 token object labelled with the key_id
+)
+
+// KeyStore persists key records, the burned and pending indices of their keys and the index leases
+// this instance holds (*KeyDB)
+type KeyStore interface {
+	StoreKey(keyID string, key *LMSKey) error
+	GetKey(keyID string) (*LMSKey, error)
+	ListAllKeys() ([]string, error)
+	GetAllKeys() ([]*LMSKey, error)
+	UpdateKeyIndex(keyID string, newIndex uint64) error
+	DeleteKey(keyID string) error
+	DeleteAllKeys() error
+	RecordBurnedIndex(burned *BurnedIndex) error
+	GetBurnedIndices(keyID string) ([]*BurnedIndex, error)
+	RecordPendingIndex(keyID string, index uint64) error
+	GetPendingIndex(keyID string) (uint64, bool, error)
+	ClearPendingIndex(keyID string) error
+	StoreIndexLease(lease *indexLease) error
+	GetIndexLeases() ([]*indexLease, error)
+	DeleteIndexLease(leaseID string) error
+	Close() error
+}
+
+// LMSSigner generates LMS keys and signs with them
+type LMSSigner interface {
+	// Backend names where the private keys are held (LMSKey.Backend)
+	Backend() string
+	// GenerateKey generates an HSS key pair; privateKey is nil if the private key stays in the backend
+	GenerateKey(keyID string, levels int, lmType, otsType []int) (privateKey, publicKey []byte, err error)
+	// Sign signs a message, returning the signature and the advanced private key state (nil if held by the backend)
+	Sign(key *LMSKey, message []byte) (signature, privateKey []byte, err error)
+	// LeafIndex returns the leaf q the key signs with next
+	LeafIndex(key *LMSKey) (uint64, error)
+	// DeleteKey destroys the private key held by the backend
+	DeleteKey(key *LMSKey) error
+}
+
+// hashSigsSigner signs with hash-sigs working keys over private keys stored in the key record
+type hashSigsSigner struct {
+	workingKeys *workingKeyCache // nil: load the working key for every signature
+}
+
+func (h *hashSigsSigner) Backend() string {
+	return backendSoftware
+}
+
+func (h *hashSigsSigner) GenerateKey(keyID string, levels int, lmType, otsType []int) ([]byte, []byte, error) {
+	return lms_wrapper.GenerateKeyPair(levels, lmType, otsType)
+}
+
+func (h *hashSigsSigner) Sign(key *LMSKey, message []byte) ([]byte, []byte, error) {
+	if h.workingKeys == nil {
+		return newWorkingKeyCache(0, loadWorkingKey).sign(key, message)
+	}
+	return h.workingKeys.sign(key, message)
+}
+
+func (h *hashSigsSigner) LeafIndex(key *LMSKey) (uint64, error) {
+	return lms_wrapper.PrivateKeyIndex(key.PrivateKey)
+}
+
+func (h *hashSigsSigner) DeleteKey(key *LMSKey) error {
+	h.workingKeys.invalidate(key.KeyID)
+	return nil
+}
+
+// keySigner returns the signer of the backend holding a key's private key
+func (s *HSMServer) keySigner(key *LMSKey) (LMSSigner, error) {
+	switch key.Backend {
+	case backendSoftware:
+		return &hashSigsSigner{workingKeys: s.workingKeys}, nil
+	case backendPKCS11:
+		if s.tokenSigner == nil {
+			return nil, fmt.Errorf("key %s is held by a PKCS#11 token and no token is configured", key.KeyID)
+		}
+		return s.tokenSigner, nil
+	}
+	return nil, fmt.Errorf("key %s has unknown backend %q", key.KeyID, key.Backend)
+}
+
+// newKeySigner returns the signer generating new keys: the token if it supports HSS, else hash-sigs
+func (s *HSMServer) newKeySigner() LMSSigner {
+	if s.tokenSigner != nil {
+		return s.tokenSigner
+	}
+	return &hashSigsSigner{workingKeys: s.workingKeys}
+}
+
+// deleteKeyBackend destroys the private key the backend holds for a deleted key record
+func (s *HSMServer) deleteKeyBackend(key *LMSKey) {
+	signer, err := s.keySigner(key)
+	if err == nil {
+		err = signer.DeleteKey(key)
+	}
+	if err != nil {
+		log.Printf("[WARNING] Failed to delete the private key of %s: %v", key.KeyID, err)
+	}
+}
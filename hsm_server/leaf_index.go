@@ -0,0 +1,128 @@
+package hsm_server
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+	"github.com/verifiable-state-chains/lms/lms_wrapper"
+)
+
+// The Raft cluster allocates the index committed (a reserved or leased index), while hash-sigs signs
+// with whatever leaf q its private key state holds. A signature is released only if the two agree:
+// otherwise the chain would record a one-time key that was never used and hide the reuse of one that was.
+
+// Where a leaf index was read from
+const (
+	leafSourcePrivateKey = "private_key" // Private key state, before signing
+	leafSourceSignature  = "signature"   // Generated signature
+)
+
+// signingLeafIndex returns the index to sign and commit: the leaf the key's private key state signs next
+// It must be indexToUse, or past it over indices all burned by discarded signatures, which are skipped
+// when canSkip (the create record must be index 0 and nextLeasedIndex already chose a leased index from the leaf).
+func (s *HSMServer) signingLeafIndex(keyID string, key *LMSKey, indexToUse uint64, canSkip bool) (uint64, error) {
+	leaf, err := s.privateKeyLeafIndex(key)
+	if err != nil {
+		return 0, err
+	}
+	if leaf == indexToUse {
+		return leaf, nil
+	}
+	if canSkip && leaf > indexToUse && s.allBurned(keyID, indexToUse, leaf) {
+		log.Printf("[INFO] Key %s skips burned indices [%d, %d)", keyID, indexToUse, leaf)
+		return leaf, nil
+	}
+	return 0, s.raiseLeafIndexAlarm(keyID, leafSourcePrivateKey, leaf, indexToUse)
+}
+
+// privateKeyLeafIndex returns the leaf the key's private key state signs next
+func (s *HSMServer) privateKeyLeafIndex(key *LMSKey) (uint64, error) {
+	signer, err := s.keySigner(key)
+	if err != nil {
+		return 0, err
+	}
+	leaf, err := signer.LeafIndex(key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the private key leaf index: %v", err)
+	}
+	return leaf, nil
+}
+
+// resumablePendingIndex returns the pending index of a key if its reservation is the chain head and the
+// key's leaf is still at it: the reservation committed but the signature was never persisted or released
+// (a crash or failure after reserving), so the key signs the reserved index instead of reserving another.
+func (s *HSMServer) resumablePendingIndex(keyID string, key *LMSKey, headIndex uint64, headExists bool) (uint64, bool) {
+	pending, exists, err := s.db.GetPendingIndex(keyID)
+	if err != nil || !exists || !headExists || pending != headIndex {
+		return 0, false
+	}
+	signer, err := s.keySigner(key)
+	if err != nil {
+		return 0, false
+	}
+	if leaf, err := signer.LeafIndex(key); err != nil || leaf != pending {
+		return 0, false
+	}
+	return pending, true
+}
+
+// syncBurnedIndices commits a sync record over skipped burned indices, up to index
+// It returns the record's hash, the previous hash of the signature committed after it.
+func (s *HSMServer) syncBurnedIndices(keyID string, index uint64, previousHash string, lmsPublicKey []byte, fundingAddress string, blockchainEnabled bool) (string, error) {
+	if err := s.syncIndexes(keyID, index, previousHash, lmsPublicKey, fundingAddress, blockchainEnabled); err != nil {
+		return "", err
+	}
+	syncedIndex, syncedHash, syncedExists, err := s.queryRaftByPubkeyHash(fsm.ComputePubkeyHash(lmsPublicKey))
+	if err != nil {
+		return "", err
+	}
+	if !syncedExists || syncedIndex != index {
+		return "", fmt.Errorf("chain head is at index %d after syncing to %d", syncedIndex, index)
+	}
+	return syncedHash, nil
+}
+
+// checkSignatureLeafIndex verifies that a signature used the leaf of the index it is committed at
+func (s *HSMServer) checkSignatureLeafIndex(keyID string, signature []byte, index uint64) error {
+	leaf, err := lms_wrapper.SignatureLeafIndex(signature)
+	if err != nil {
+		return fmt.Errorf("failed to read the signature leaf index: %v", err)
+	}
+	if leaf != index {
+		return s.raiseLeafIndexAlarm(keyID, leafSourceSignature, leaf, index)
+	}
+	return nil
+}
+
+// allBurned reports whether every index in [from, to) of a key is recorded as burned
+// The pending index counts as burned: the leaf is past it, so its key state was persisted, but its
+// signature was never released (a crash before the commit).
+func (s *HSMServer) allBurned(keyID string, from, to uint64) bool {
+	burned, err := s.db.GetBurnedIndices(keyID)
+	if err != nil {
+		return false
+	}
+	indices := make(map[uint64]bool, len(burned)+1)
+	for _, record := range burned {
+		indices[record.Index] = true
+	}
+	if pending, exists, err := s.db.GetPendingIndex(keyID); err == nil && exists {
+		indices[pending] = true
+	}
+	for index := from; index < to; index++ {
+		if !indices[index] {
+			return false
+		}
+	}
+	return true
+}
+
+// raiseLeafIndexAlarm reports a leaf index that differs from the committed index and returns it as an error
+// The key's state no longer matches its chain (a restored backup, a lost write, a bug): an operator must
+// reconcile them before the key signs again.
+func (s *HSMServer) raiseLeafIndexAlarm(keyID, source string, leaf, index uint64) error {
+	leafIndexMismatches.Inc(source)
+	log.Printf("[CRITICAL] Key %s: %s leaf index %d does not match committed index %d, signature withheld", keyID, source, leaf, index)
+	return fmt.Errorf("%s leaf index %d does not match committed index %d", source, leaf, index)
+}
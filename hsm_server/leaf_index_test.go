@@ -0,0 +1,87 @@
+package hsm_server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+)
+
+func TestLeafIndex_PrivateKeyBehindChainIsRefused(t *testing.T) {
+	cluster := newSignTestCluster(t)
+	signer := &testSigner{}
+	s := newDiscardTestServer(t, cluster, signer)
+
+	for i := 0; i < 3; i++ {
+		if status, response := signTestMessage(s, "hello"); status != http.StatusOK {
+			t.Fatalf("Sign %d failed: %s", i, response.Error)
+		}
+	}
+
+	// An old backup of the key is restored: its next leaf (1) was already signed and committed
+	key, _ := s.db.GetKey("key_a")
+	key.PrivateKey = testPrivateKey(1)
+	s.db.StoreKey("key_a", key)
+
+	status, response := signTestMessage(s, "hello")
+	if status != http.StatusInternalServerError || response.Signature != nil {
+		t.Fatalf("Expected the sign request to be refused, got %d %+v", status, response)
+	}
+	if len(signer.signatures) != 3 {
+		t.Errorf("Expected no signature generated from a stale key, got %d signatures", len(signer.signatures))
+	}
+	if atomic.LoadInt32(&cluster.commits) != 3 {
+		t.Errorf("Expected no commit for a stale key, got %d commits", cluster.commits)
+	}
+}
+
+func TestLeafIndex_SignatureLeafMismatchIsDiscarded(t *testing.T) {
+	cluster := newSignTestCluster(t)
+	signer := &testSigner{leafSkew: 4}
+	s := newDiscardTestServer(t, cluster, signer)
+
+	status, response := signTestMessage(s, "hello")
+	if status != http.StatusInternalServerError || response.Signature != nil {
+		t.Fatalf("Expected the signature to be discarded, got %d %+v", status, response)
+	}
+	if atomic.LoadInt32(&cluster.commits) != 1 {
+		t.Errorf("Expected only the reservation of index 0, got %d commits", cluster.commits)
+	}
+
+	burned, _ := s.db.GetBurnedIndices("key_a")
+	if len(burned) != 1 || burned[0].Step != discardStepLeafCheck {
+		t.Fatalf("Expected index 0 burned at the leaf check, got %+v", burned)
+	}
+	if key, _ := s.db.GetKey("key_a"); key.Index != 0 {
+		t.Errorf("Expected the key state not persisted, got index %d", key.Index)
+	}
+}
+
+func TestLeafIndex_SkipsBurnedIndices(t *testing.T) {
+	cluster := newSignTestCluster(t)
+	signer := &testSigner{}
+	s := newDiscardTestServer(t, cluster, signer)
+
+	if status, response := signTestMessage(s, "create"); status != http.StatusOK {
+		t.Fatalf("Create failed: %s", response.Error)
+	}
+
+	// Signing without Raft spent leaves 1 and 2: index 1 failed its commit, and the server stopped
+	// after persisting index 2, leaving it pending
+	s.db.RecordBurnedIndex(&BurnedIndex{KeyID: "key_a", Index: 1, Step: discardStepCommit})
+	s.db.RecordPendingIndex("key_a", 2)
+	key, _ := s.db.GetKey("key_a")
+	key.PrivateKey, key.Index = testPrivateKey(3), 3
+	s.db.StoreKey("key_a", key)
+	s.keys["key_a"] = key
+
+	status, response := signTestMessage(s, "hello")
+	if status != http.StatusOK || response.Index != 3 {
+		t.Fatalf("Expected a signature at index 3 past the burned indices, got %d %+v", status, response)
+	}
+	pubkeyHash := fsm.ComputePubkeyHash([]byte("lms-public-key"))
+	if index, _, _ := cluster.fsm.GetIndexAndHashByPubkeyHash(pubkeyHash); index != 3 {
+		t.Errorf("Expected Raft head at index 3, got %d", index)
+	}
+}
@@ -0,0 +1,188 @@
+package hsm_server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Envelope encryption of keys.db: every LMS key is encrypted with its own random data key, and the
+// data key is stored wrapped by a master key. Only the master key has to be kept outside the database;
+// rotating it re-wraps the data keys without re-encrypting the keys.
+
+const (
+	masterKeySize = 32 // AES-256
+	saltSize      = 16
+
+	// Argon2id parameters for passphrase master keys (RFC 9106 second recommended option)
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+)
+
+// MasterKey wraps and unwraps the data keys of keys.db
+// An external KMS is used through NewKMSMasterKey; local master keys come from a key file or a passphrase.
+type MasterKey interface {
+	// ID names the master key; it is stored with every data key it wraps
+	ID() string
+	// Wrap encrypts a data key, authenticating associatedData (the key_id)
+	Wrap(dataKey, associatedData []byte) ([]byte, error)
+	// Unwrap decrypts a wrapped data key, failing if it or associatedData was altered
+	Unwrap(wrapped, associatedData []byte) ([]byte, error)
+}
+
+// KMS is an external key management service holding master keys that never leave it
+type KMS interface {
+	Encrypt(keyName string, plaintext, associatedData []byte) ([]byte, error)
+	Decrypt(keyName string, ciphertext, associatedData []byte) ([]byte, error)
+}
+
+// kmsMasterKey is a master key held by a KMS
+type kmsMasterKey struct {
+	kms     KMS
+	keyName string
+}
+
+// NewKMSMasterKey returns the master key named keyName in a KMS
+func NewKMSMasterKey(kms KMS, keyName string) MasterKey {
+	return &kmsMasterKey{kms: kms, keyName: keyName}
+}
+
+func (k *kmsMasterKey) ID() string {
+	return "kms:" + k.keyName
+}
+
+func (k *kmsMasterKey) Wrap(dataKey, associatedData []byte) ([]byte, error) {
+	return k.kms.Encrypt(k.keyName, dataKey, associatedData)
+}
+
+func (k *kmsMasterKey) Unwrap(wrapped, associatedData []byte) ([]byte, error) {
+	return k.kms.Decrypt(k.keyName, wrapped, associatedData)
+}
+
+// localMasterKey is a master key held in memory, wrapping with AES-256-GCM
+type localMasterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewLocalMasterKey returns a master key from 32 key bytes
+// Its ID is a fingerprint of the key, so the same key has the same ID whether read from a file or derived.
+func NewLocalMasterKey(key []byte) (MasterKey, error) {
+	if len(key) != masterKeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", masterKeySize, len(key))
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha256.Sum256(append([]byte("lms-hsm master key\x00"), key...))
+	return &localMasterKey{
+		id:   "local:" + hex.EncodeToString(fingerprint[:8]),
+		aead: aead,
+	}, nil
+}
+
+// LoadMasterKeyFile reads a master key file holding 32 raw bytes or 64 hex digits
+// Create one with: head -c 32 /dev/urandom > master.key && chmod 600 master.key
+func LoadMasterKeyFile(path string) (MasterKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master key file: %v", err)
+	}
+	key := data
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 2*masterKeySize {
+		if decoded, err := hex.DecodeString(string(trimmed)); err == nil {
+			key = decoded
+		}
+	}
+	if len(key) != masterKeySize {
+		return nil, fmt.Errorf("master key file %s must hold %d raw bytes or %d hex digits", path, masterKeySize, 2*masterKeySize)
+	}
+	return NewLocalMasterKey(key)
+}
+
+// NewPassphraseMasterKey derives a master key from a passphrase with Argon2id
+func NewPassphraseMasterKey(passphrase, salt []byte) (MasterKey, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	if len(salt) < saltSize {
+		return nil, fmt.Errorf("salt must be at least %d bytes", saltSize)
+	}
+	key := argon2.IDKey(passphrase, salt, argon2Time, argon2Memory, argon2Threads, masterKeySize)
+	return NewLocalMasterKey(key)
+}
+
+// LoadPassphraseMasterKey derives a master key from a passphrase with the salt in saltPath,
+// creating a random salt on first use (the salt is not secret, but losing it loses the master key)
+func LoadPassphraseMasterKey(passphrase []byte, saltPath string) (MasterKey, error) {
+	salt, err := os.ReadFile(saltPath)
+	if os.IsNotExist(err) {
+		salt = make([]byte, saltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, fmt.Errorf("failed to generate salt: %v", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(saltPath), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create salt directory: %v", err)
+		}
+		if err := os.WriteFile(saltPath, salt, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write salt: %v", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read salt: %v", err)
+	}
+	return NewPassphraseMasterKey(passphrase, salt)
+}
+
+func (k *localMasterKey) ID() string {
+	return k.id
+}
+
+func (k *localMasterKey) Wrap(dataKey, associatedData []byte) ([]byte, error) {
+	return seal(k.aead, dataKey, associatedData)
+}
+
+func (k *localMasterKey) Unwrap(wrapped, associatedData []byte) ([]byte, error) {
+	return open(k.aead, wrapped, associatedData)
+}
+
+// newGCM returns AES-GCM with a 32-byte key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts with a random nonce, returning nonce || ciphertext
+func seal(aead cipher.AEAD, plaintext, associatedData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+// open decrypts nonce || ciphertext from seal
+func open(aead cipher.AEAD, sealed, associatedData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("authentication failed")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,62 @@
+package hsm_server
+
+import (
+	"github.com/verifiable-state-chains/lms/metrics"
+)
+
+var (
+	signRequests      = metrics.NewCounterVec("lms_hsm_sign_requests_total", "Sign requests by result", "result")
+	signPhaseDuration = metrics.NewHistogramVec("lms_hsm_sign_phase_duration_seconds",
+		"Time spent in each phase of a successful sign request", nil, "phase")
+	signDiscards        = metrics.NewCounterVec("lms_hsm_sign_discards_total", "Signatures discarded by the failed signing step", "step")
+	leafIndexMismatches = metrics.NewCounterVec("lms_hsm_leaf_index_mismatches_total",
+		"Signatures withheld because the hash-sigs leaf index differed from the committed index (critical)", "source")
+	workingKeyLookups = metrics.NewCounterVec("lms_hsm_working_key_cache_total", "Working key cache lookups by result", "result")
+)
+
+// Sign request results
+const (
+	signResultSuccess   = "success"
+	signResultError     = "error"
+	signResultDiscarded = "discarded" // A signature was generated but discarded (see discardSignature)
+)
+
+// Working key cache lookup results
+const (
+	workingKeyHit  = "hit"
+	workingKeyMiss = "miss" // Loaded from the stored private key
+)
+
+// Sign request phases
+const (
+	signPhaseRaftQuery = "raft_query" // Reading the key's chain head from Raft
+	signPhaseCommit    = "commit"     // Reserving the index in Raft (or committing it after signing) and the blockchain commit
+	signPhaseLMSSign   = "lms_sign"   // Loading the working key, signing and persisting the new private key
+)
+
+// newMetricsRegistry exposes the remaining one-time signatures of every key, read from the database on every scrape
+func (s *HSMServer) newMetricsRegistry() *metrics.Registry {
+	registry := metrics.NewRegistry()
+	registry.NewGaugeFunc("lms_hsm_key_remaining_signatures", "One-time signatures left on each key", []string{"key_id"},
+		func(set func(float64, ...string)) {
+			if s.db == nil {
+				return
+			}
+			keys, err := s.db.GetAllKeys()
+			if err != nil {
+				return
+			}
+			for _, key := range keys {
+				params := lmsKeyParams(key)
+				if params == nil {
+					continue
+				}
+				remaining := uint64(0)
+				if capacity := params.MaxSignatures(); key.Index < capacity {
+					remaining = capacity - key.Index
+				}
+				set(float64(remaining), key.KeyID)
+			}
+		})
+	return registry
+}
@@ -0,0 +1,393 @@
+package hsm_server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"github.com/verifiable-state-chains/lms/lms_wrapper"
+)
+
+// HSS/LMS in PKCS#11 v3.1 (not defined by github.com/miekg/pkcs11)
+const (
+	ckkHSS              = 0x00000046
+	ckmHSSKeyPairGen    = 0x00004032
+	ckmHSS              = 0x00004033
+	ckaHSSLevels        = 0x00000617
+	ckaHSSLMSTypes      = 0x0000061a
+	ckaHSSLMOTSTypes    = 0x0000061b
+	ckaHSSKeysRemaining = 0x0000061c
+)
+
+// oidP256 is the DER encoding of the prime256v1 OID (CKA_EC_PARAMS of the attestation key)
+var oidP256 = []byte{0x06, 0x08, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+
+// PKCS11Config selects a PKCS#11 token
+type PKCS11Config struct {
+	ModulePath string // PKCS#11 library (e.g. /usr/lib/softhsm/libsofthsm2.so)
+	TokenLabel string // Label of the token
+	PIN        string // User PIN
+}
+
+// PKCS11Token is a logged-in session on a PKCS#11 token
+type PKCS11Token struct {
+	mu      sync.Mutex // A session is used by one operation at a time
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	hss     bool // Token implements CKM_HSS_KEY_PAIR_GEN and CKM_HSS
+}
+
+// OpenPKCS11Token loads a PKCS#11 module and logs in to the token with the configured label
+func OpenPKCS11Token(config *PKCS11Config) (*PKCS11Token, error) {
+	ctx := pkcs11.New(config.ModulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s", config.ModulePath)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module: %v", err)
+	}
+	token := &PKCS11Token{ctx: ctx}
+
+	slot, err := token.findSlot(config.TokenLabel)
+	if err != nil {
+		token.finalize()
+		return nil, err
+	}
+	token.session, err = ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		token.finalize()
+		return nil, fmt.Errorf("failed to open PKCS#11 session: %v", err)
+	}
+	if err := ctx.Login(token.session, pkcs11.CKU_USER, config.PIN); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		token.Close()
+		return nil, fmt.Errorf("failed to log in to token %s: %v", config.TokenLabel, err)
+	}
+
+	mechanisms, err := ctx.GetMechanismList(slot)
+	if err != nil {
+		token.Close()
+		return nil, fmt.Errorf("failed to list token mechanisms: %v", err)
+	}
+	var keyGen, sign bool
+	for _, mechanism := range mechanisms {
+		keyGen = keyGen || mechanism.Mechanism == ckmHSSKeyPairGen
+		sign = sign || mechanism.Mechanism == ckmHSS
+	}
+	token.hss = keyGen && sign
+	return token, nil
+}
+
+// findSlot returns the slot of the token with a label
+func (t *PKCS11Token) findSlot(label string) (uint, error) {
+	slots, err := t.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list PKCS#11 slots: %v", err)
+	}
+	for _, slot := range slots {
+		info, err := t.ctx.GetTokenInfo(slot)
+		if err == nil && strings.TrimRight(info.Label, " \x00") == label {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("no PKCS#11 token labelled %q", label)
+}
+
+// SupportsHSS reports whether the token generates and signs with HSS/LMS keys
+func (t *PKCS11Token) SupportsHSS() bool {
+	return t.hss
+}
+
+// LMSSigner returns the signer of LMS keys held on the token (nil if the token does not support HSS)
+func (t *PKCS11Token) LMSSigner() LMSSigner {
+	if !t.hss {
+		return nil
+	}
+	return &pkcs11LMSSigner{token: t}
+}
+
+// AttestationSigner returns the ECDSA P-256 attestation key pair with a label
+// Create it on the token with: pkcs11-tool --keypairgen --key-type EC:prime256v1 --label <label>
+func (t *PKCS11Token) AttestationSigner(label string) (crypto.Signer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	privateKey, err := t.findObject(pkcs11.CKO_PRIVATE_KEY, pkcs11.CKK_EC, label)
+	if err != nil {
+		return nil, fmt.Errorf("attestation private key: %v", err)
+	}
+	publicKey, err := t.findObject(pkcs11.CKO_PUBLIC_KEY, pkcs11.CKK_EC, label)
+	if err != nil {
+		return nil, fmt.Errorf("attestation public key: %v", err)
+	}
+	attributes, err := t.ctx.GetAttributeValue(t.session, publicKey, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attestation public key: %v", err)
+	}
+	if !bytes.Equal(attributes[0].Value, oidP256) {
+		return nil, fmt.Errorf("attestation key %s is not a P-256 key", label)
+	}
+	pubKey, err := parseECPoint(attributes[1].Value)
+	if err != nil {
+		return nil, err
+	}
+	return &pkcs11ECDSASigner{token: t, privateKey: privateKey, publicKey: pubKey}, nil
+}
+
+// Close logs out and unloads the PKCS#11 module
+func (t *PKCS11Token) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ctx.Logout(t.session)
+	t.ctx.CloseSession(t.session)
+	return t.finalize()
+}
+
+func (t *PKCS11Token) finalize() error {
+	err := t.ctx.Finalize()
+	t.ctx.Destroy()
+	return err
+}
+
+// findObject returns the only object of a class and key type with a label (caller must hold t.mu)
+func (t *PKCS11Token) findObject(class, keyType uint, label string) (pkcs11.ObjectHandle, error) {
+	objects, err := t.findObjects(class, keyType, label)
+	if err != nil {
+		return 0, err
+	}
+	if len(objects) != 1 {
+		return 0, fmt.Errorf("found %d objects labelled %q on the token, expected 1", len(objects), label)
+	}
+	return objects[0], nil
+}
+
+// findObjects returns the objects of a class and key type with a label (caller must hold t.mu)
+func (t *PKCS11Token) findObjects(class, keyType uint, label string) ([]pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := t.ctx.FindObjectsInit(t.session, template); err != nil {
+		return nil, fmt.Errorf("failed to search the token: %v", err)
+	}
+	objects, _, err := t.ctx.FindObjects(t.session, 2)
+	if finalErr := t.ctx.FindObjectsFinal(t.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to search the token: %v", err)
+	}
+	return objects, nil
+}
+
+// pkcs11ECDSASigner is an ECDSA private key on a token; it signs SHA-256 digests
+type pkcs11ECDSASigner struct {
+	token      *PKCS11Token
+	privateKey pkcs11.ObjectHandle
+	publicKey  *ecdsa.PublicKey
+}
+
+func (k *pkcs11ECDSASigner) Public() crypto.PublicKey {
+	return k.publicKey
+}
+
+// Sign returns an ASN.1 DER signature of a digest, like *ecdsa.PrivateKey (rand is not used)
+func (k *pkcs11ECDSASigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 || len(digest) != crypto.SHA256.Size() {
+		return nil, fmt.Errorf("attestation key signs SHA-256 digests only")
+	}
+
+	k.token.mu.Lock()
+	defer k.token.mu.Unlock()
+	if err := k.token.ctx.SignInit(k.token.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, k.privateKey); err != nil {
+		return nil, fmt.Errorf("failed to start ECDSA signature: %v", err)
+	}
+	signature, err := k.token.ctx.Sign(k.token.session, digest)
+	if err != nil {
+		return nil, fmt.Errorf("ECDSA signature failed: %v", err)
+	}
+	return ecdsaSignatureToASN1(signature)
+}
+
+// pkcs11LMSSigner generates and signs with HSS keys held on a token, labelled with their key_id
+// The token keeps the private key state and advances it before returning a signature.
+type pkcs11LMSSigner struct {
+	token *PKCS11Token
+}
+
+func (p *pkcs11LMSSigner) Backend() string {
+	return backendPKCS11
+}
+
+func (p *pkcs11LMSSigner) GenerateKey(keyID string, levels int, lmType, otsType []int) ([]byte, []byte, error) {
+	common := func(class uint) []*pkcs11.Attribute {
+		return []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, ckkHSS),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyID),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(keyID)),
+		}
+	}
+	public := append(common(pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(ckaHSSLevels, uint(levels)),
+		pkcs11.NewAttribute(ckaHSSLMSTypes, ulongArray(lmType)),
+		pkcs11.NewAttribute(ckaHSSLMOTSTypes, ulongArray(otsType)),
+	)
+	private := append(common(pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+	)
+
+	p.token.mu.Lock()
+	defer p.token.mu.Unlock()
+	publicKey, _, err := p.token.ctx.GenerateKeyPair(p.token.session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(ckmHSSKeyPairGen, nil)}, public, private)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate HSS key pair on the token: %v", err)
+	}
+	attributes, err := p.token.ctx.GetAttributeValue(p.token.session, publicKey, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read HSS public key: %v", err)
+	}
+	return nil, attributes[0].Value, nil
+}
+
+func (p *pkcs11LMSSigner) Sign(key *LMSKey, message []byte) ([]byte, []byte, error) {
+	p.token.mu.Lock()
+	defer p.token.mu.Unlock()
+
+	privateKey, err := p.token.findObject(pkcs11.CKO_PRIVATE_KEY, ckkHSS, key.KeyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := p.token.ctx.SignInit(p.token.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmHSS, nil)}, privateKey); err != nil {
+		return nil, nil, fmt.Errorf("failed to start HSS signature: %v", err)
+	}
+	signature, err := p.token.ctx.Sign(p.token.session, message)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate LMS signature: %v", err)
+	}
+	return signature, nil, nil
+}
+
+func (p *pkcs11LMSSigner) LeafIndex(key *LMSKey) (uint64, error) {
+	p.token.mu.Lock()
+	defer p.token.mu.Unlock()
+
+	privateKey, err := p.token.findObject(pkcs11.CKO_PRIVATE_KEY, ckkHSS, key.KeyID)
+	if err != nil {
+		return 0, err
+	}
+	attributes, err := p.token.ctx.GetAttributeValue(p.token.session, privateKey, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(ckaHSSKeysRemaining, nil),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read signatures remaining: %v", err)
+	}
+	remaining, err := bytesToUlong(attributes[0].Value)
+	if err != nil {
+		return 0, err
+	}
+	return hssLeafIndex(key.LmType, remaining)
+}
+
+func (p *pkcs11LMSSigner) DeleteKey(key *LMSKey) error {
+	p.token.mu.Lock()
+	defer p.token.mu.Unlock()
+
+	for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+		objects, err := p.token.findObjects(class, ckkHSS, key.KeyID)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			if err := p.token.ctx.DestroyObject(p.token.session, object); err != nil {
+				return fmt.Errorf("failed to destroy token key %s: %v", key.KeyID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// hssLeafIndex returns the leaf an HSS key signs next from the signatures it has remaining
+func hssLeafIndex(lmType []int, remaining uint64) (uint64, error) {
+	if len(lmType) == 0 {
+		return 0, fmt.Errorf("key has no LMS parameter set")
+	}
+	capacity := uint64(1)
+	for _, t := range lmType {
+		height := lms_wrapper.GetLMSHeight(t)
+		if height < 0 {
+			return 0, fmt.Errorf("unknown LMS type %d", t)
+		}
+		capacity <<= uint(height)
+	}
+	if remaining > capacity {
+		return 0, fmt.Errorf("token reports %d signatures remaining of %d", remaining, capacity)
+	}
+	return capacity - remaining, nil
+}
+
+// ulongArray encodes a CK_ULONG array attribute value
+func ulongArray(values []int) []byte {
+	var encoded []byte
+	for _, v := range values {
+		encoded = append(encoded, pkcs11.NewAttribute(0, uint(v)).Value...)
+	}
+	return encoded
+}
+
+// bytesToUlong decodes a CK_ULONG attribute value (native byte order, 4 or 8 bytes)
+func bytesToUlong(value []byte) (uint64, error) {
+	switch len(value) {
+	case 4:
+		return uint64(binary.NativeEndian.Uint32(value)), nil
+	case 8:
+		return binary.NativeEndian.Uint64(value), nil
+	}
+	return 0, fmt.Errorf("CK_ULONG attribute has %d bytes", len(value))
+}
+
+// parseECPoint parses CKA_EC_POINT (a DER OCTET STRING holding an uncompressed P-256 point)
+func parseECPoint(value []byte) (*ecdsa.PublicKey, error) {
+	var point []byte
+	if rest, err := asn1.Unmarshal(value, &point); err != nil || len(rest) != 0 {
+		point = value // Some tokens return the raw point
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), point)
+	if x == nil {
+		return nil, fmt.Errorf("invalid P-256 public key point")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+// ecdsaSignatureToASN1 converts a PKCS#11 ECDSA signature (r || s) to ASN.1 DER
+func ecdsaSignatureToASN1(signature []byte) ([]byte, error) {
+	if len(signature) == 0 || len(signature)%2 != 0 {
+		return nil, fmt.Errorf("invalid ECDSA signature length %d", len(signature))
+	}
+	half := len(signature) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		R: new(big.Int).SetBytes(signature[:half]),
+		S: new(big.Int).SetBytes(signature[half:]),
+	})
+}
@@ -0,0 +1,233 @@
+package hsm_server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/verifiable-state-chains/lms/lms_wrapper"
+)
+
+// fakeTokenSigner stands in for a PKCS#11 token holding HSS keys and their state
+type fakeTokenSigner struct {
+	leaves  map[string]uint64
+	deleted []string
+}
+
+func (f *fakeTokenSigner) Backend() string {
+	return backendPKCS11
+}
+
+func (f *fakeTokenSigner) GenerateKey(keyID string, levels int, lmType, otsType []int) ([]byte, []byte, error) {
+	f.leaves[keyID] = 0
+	return nil, []byte("token-public-key"), nil
+}
+
+func (f *fakeTokenSigner) Sign(key *LMSKey, message []byte) ([]byte, []byte, error) {
+	signature := testHSSSignature(uint32(f.leaves[key.KeyID]), message)
+	f.leaves[key.KeyID]++
+	return signature, nil, nil
+}
+
+func (f *fakeTokenSigner) LeafIndex(key *LMSKey) (uint64, error) {
+	return f.leaves[key.KeyID], nil
+}
+
+func (f *fakeTokenSigner) DeleteKey(key *LMSKey) error {
+	f.deleted = append(f.deleted, key.KeyID)
+	return nil
+}
+
+// opaqueSigner hides the *ecdsa.PrivateKey behind crypto.Signer, as a token key does
+type opaqueSigner struct {
+	crypto.Signer
+}
+
+func TestSign_TokenHeldKey(t *testing.T) {
+	cluster := newSignTestCluster(t)
+	s := newDiscardTestServer(t, cluster, &testSigner{})
+	token := &fakeTokenSigner{leaves: map[string]uint64{"key_a": 0}}
+	s.signer = nil
+	s.tokenSigner = token
+	s.attestationPrivKey = opaqueSigner{s.attestationPrivKey}
+
+	key, _ := s.db.GetKey("key_a")
+	key.PrivateKey = nil
+	key.Backend = backendPKCS11
+	s.db.StoreKey("key_a", key)
+	s.keys["key_a"] = key
+
+	for i := uint64(0); i < 2; i++ {
+		status, response := signTestMessage(s, "hello")
+		if status != http.StatusOK || response.Index != i {
+			t.Fatalf("Sign %d failed: %d %+v", i, status, response)
+		}
+	}
+	stored, _ := s.db.GetKey("key_a")
+	if stored.Index != 2 || stored.PrivateKey != nil || stored.Backend != backendPKCS11 {
+		t.Fatalf("Expected a token key record at index 2 without private key, got %+v", stored)
+	}
+
+	// A token that lost state the chain has committed is caught before signing
+	token.leaves["key_a"] = 1
+	if status, _ := signTestMessage(s, "hello"); status == http.StatusOK {
+		t.Fatal("Expected a token leaf behind the chain to be refused")
+	}
+
+	s.deleteKeyBackend(stored)
+	if len(token.deleted) != 1 {
+		t.Errorf("Expected the token key destroyed, got %v", token.deleted)
+	}
+}
+
+func TestPKCS11Encodings(t *testing.T) {
+	// PKCS#11 ECDSA signatures are r || s
+	privKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	digest := sha256.Sum256([]byte("attestation"))
+	der, _ := ecdsa.SignASN1(rand.Reader, privKey, digest[:])
+	var rs struct{ R, S *big.Int }
+	asn1.Unmarshal(der, &rs)
+	raw := append(rs.R.FillBytes(make([]byte, 32)), rs.S.FillBytes(make([]byte, 32))...)
+	converted, err := ecdsaSignatureToASN1(raw)
+	if err != nil || !ecdsa.VerifyASN1(&privKey.PublicKey, digest[:], converted) {
+		t.Fatalf("Expected a converted signature to verify (%v)", err)
+	}
+
+	// CKA_EC_POINT is a DER OCTET STRING, or a raw point on some tokens
+	point := elliptic.Marshal(elliptic.P256(), privKey.X, privKey.Y)
+	wrapped, _ := asn1.Marshal(point)
+	for _, value := range [][]byte{wrapped, point} {
+		pubKey, err := parseECPoint(value)
+		if err != nil || !pubKey.Equal(&privKey.PublicKey) {
+			t.Fatalf("Expected the public key parsed (%v)", err)
+		}
+	}
+
+	// Two levels of H5: 1024 signatures
+	lmTypes := []int{lms_wrapper.LMS_SHA256_M32_H5, lms_wrapper.LMS_SHA256_M32_H5}
+	if leaf, err := hssLeafIndex(lmTypes, 1000); err != nil || leaf != 24 {
+		t.Fatalf("Expected leaf 24, got %d (%v)", leaf, err)
+	}
+	if _, err := hssLeafIndex(lmTypes, 1025); err == nil {
+		t.Fatal("Expected more remaining signatures than the key has to be rejected")
+	}
+
+	encoded := ulongArray([]int{lms_wrapper.LMS_SHA256_M32_H10, lms_wrapper.LMS_SHA256_M32_H5})
+	half := len(encoded) / 2
+	if first, _ := bytesToUlong(encoded[:half]); first != lms_wrapper.LMS_SHA256_M32_H10 {
+		t.Errorf("Expected CK_ULONG %d, got %d", lms_wrapper.LMS_SHA256_M32_H10, first)
+	}
+}
+
+// TestPKCS11Token_SoftHSM runs against SoftHSMv2 when SOFTHSM2_MODULE names its library
+// (e.g. SOFTHSM2_MODULE=/usr/lib/softhsm/libsofthsm2.so go test ./hsm_server -run SoftHSM)
+func TestPKCS11Token_SoftHSM(t *testing.T) {
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		t.Skip("SOFTHSM2_MODULE not set")
+	}
+	const label, pin = "lms-test", "1234"
+
+	// A fresh token in a temporary token directory
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+	os.WriteFile(conf, []byte("directories.tokendir = "+dir+"\nobjectstore.backend = file\n"), 0600)
+	t.Setenv("SOFTHSM2_CONF", conf)
+	initSoftHSMToken(t, module, label, pin)
+
+	token, err := OpenPKCS11Token(&PKCS11Config{ModulePath: module, TokenLabel: label, PIN: pin})
+	if err != nil {
+		t.Fatalf("OpenPKCS11Token failed: %v", err)
+	}
+	defer token.Close()
+
+	_, _, err = token.ctx.GenerateKeyPair(token.session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, "attestation"),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oidP256),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, "attestation"),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		})
+	if err != nil {
+		t.Fatalf("Generating the attestation key failed: %v", err)
+	}
+
+	signer, err := token.AttestationSigner("attestation")
+	if err != nil {
+		t.Fatalf("AttestationSigner failed: %v", err)
+	}
+	digest := sha256.Sum256([]byte("attestation"))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	if !ecdsa.VerifyASN1(signer.Public().(*ecdsa.PublicKey), digest[:], signature) {
+		t.Fatal("Token signature does not verify")
+	}
+
+	// SoftHSMv2 has no HSS mechanisms: LMS keys stay with hash-sigs
+	if token.SupportsHSS() != (token.LMSSigner() != nil) {
+		t.Error("Expected an LMS signer exactly when the token supports HSS")
+	}
+}
+
+// initSoftHSMToken initializes the first free SoftHSM slot as a token with a user PIN
+func initSoftHSMToken(t *testing.T, module, label, pin string) {
+	t.Helper()
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		t.Fatalf("Failed to load %s", module)
+	}
+	defer ctx.Destroy()
+	if err := ctx.Initialize(); err != nil {
+		t.Fatalf("Initialize failed: %v", err)
+	}
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("No SoftHSM slot (%v)", err)
+	}
+	if err := ctx.InitToken(slots[0], "so-"+pin, label); err != nil {
+		t.Fatalf("InitToken failed: %v", err)
+	}
+
+	// SoftHSM renumbers an initialized token's slot
+	slots, _ = ctx.GetSlotList(true)
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil || info.Label != label {
+			continue
+		}
+		session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			t.Fatalf("OpenSession failed: %v", err)
+		}
+		defer ctx.CloseSession(session)
+		if err := ctx.Login(session, pkcs11.CKU_SO, "so-"+pin); err != nil {
+			t.Fatalf("SO login failed: %v", err)
+		}
+		if err := ctx.InitPIN(session, pin); err != nil {
+			t.Fatalf("InitPIN failed: %v", err)
+		}
+		ctx.Logout(session)
+		return
+	}
+	t.Fatalf("Initialized token %s not found", label)
+}
@@ -2,17 +2,16 @@ package hsm_server
 
 import (
 	"bytes"
-	"crypto/ecdsa"
 	"crypto/rand"
-	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/verifiable-state-chains/lms/blockchain"
 	"github.com/verifiable-state-chains/lms/fsm"
@@ -45,13 +44,14 @@ type StructuredSignature struct {
 }
 
 // queryRaftByPubkeyHash queries Raft cluster for pubkey_hash's last index and hash
+// The read is linearizable: a stale index here would let the HSM reuse a one-time signature index
 func (s *HSMServer) queryRaftByPubkeyHash(pubkeyHash string) (uint64, string, bool, error) {
 	var lastErr error
 
 	for _, endpoint := range s.raftEndpoints {
-		url := fmt.Sprintf("%s/pubkey_hash/%s/index", endpoint, pubkeyHash)
+		url := fmt.Sprintf("%s/pubkey_hash/%s/index?consistency=linearizable", endpoint, pubkeyHash)
 
-		resp, err := http.Get(url)
+		resp, err := s.raftHTTPClient().Get(url)
 		if err != nil {
 			lastErr = fmt.Errorf("failed to connect to %s: %v", endpoint, err)
 			continue
@@ -104,7 +104,8 @@ func (s *HSMServer) queryRaftByPubkeyHash(pubkeyHash string) (uint64, string, bo
 // fundingAddress: Optional CHIPS address to use for blockchain transaction funding
 // blockchainEnabled: Whether to commit to blockchain for this specific key (per-key control)
 // recordType: Record type - "create" (index 0), "sign" (next index), "sync" (sync to index), "delete" (end lifecycle)
-func (s *HSMServer) commitIndexToRaft(keyID string, index uint64, previousHash string, lmsPublicKey []byte, fundingAddress string, blockchainEnabled bool, recordType string) error {
+// lmsParams: HSS parameter set of the key, sent on create records only (nil otherwise)
+func (s *HSMServer) commitIndexToRaft(keyID string, index uint64, previousHash string, lmsPublicKey []byte, fundingAddress string, blockchainEnabled bool, recordType string, lmsParams *fsm.LMSParams) error {
 	// Compute pubkey_hash from LMS public key (Phase B: primary identifier)
 	pubkeyHash := fsm.ComputePubkeyHash(lmsPublicKey) // Returns base64 string
 	// Decode base64 to get raw bytes, then format as hex for API calls
@@ -114,25 +115,6 @@ func (s *HSMServer) commitIndexToRaft(keyID string, index uint64, previousHash s
 	}
 	pubkeyHashHex := fmt.Sprintf("%x", pubkeyHashBytes)
 
-	// Create data to sign: key_id:index (signature format unchanged for compatibility)
-	data := fmt.Sprintf("%s:%d", keyID, index)
-	dataHash := sha256.Sum256([]byte(data))
-
-	// Debug: log the data being signed (remove in production if needed)
-	fmt.Printf("[DEBUG] Signing data: %s, hash: %x\n", data, dataHash)
-
-	// Sign with EC private key (ASN.1 format)
-	signature, err := ecdsa.SignASN1(rand.Reader, s.attestationPrivKey, dataHash[:])
-	if err != nil {
-		return fmt.Errorf("failed to sign: %v", err)
-	}
-
-	// Encode public key
-	pubKeyBytes, err := x509.MarshalPKIXPublicKey(s.attestationPubKey)
-	if err != nil {
-		return fmt.Errorf("failed to marshal public key: %v", err)
-	}
-
 	// Set default record_type if not provided
 	if recordType == "" {
 		recordType = "sign" // Default to "sign" for backward compatibility
@@ -145,9 +127,14 @@ func (s *HSMServer) commitIndexToRaft(keyID string, index uint64, previousHash s
 		Index:        index,
 		PreviousHash: previousHash,
 		Hash:         "", // Will be computed
-		Signature:    base64.StdEncoding.EncodeToString(signature),
-		PublicKey:    base64.StdEncoding.EncodeToString(pubKeyBytes),
 		RecordType:   recordType,
+		LMSParams:    lmsParams,
+	}
+
+	// Sign every entry field (key_id, pubkey_hash, index, previous_hash, record_type, public_key)
+	// with the attestation EC private key, so the signature cannot be grafted onto another chain position
+	if err := fsm.SignEntry(&entry, s.attestationPrivKey); err != nil {
+		return fmt.Errorf("failed to sign entry: %v", err)
 	}
 
 	// Compute hash of entry (all fields except Hash)
@@ -170,8 +157,21 @@ func (s *HSMServer) commitIndexToRaft(keyID string, index uint64, previousHash s
 		"signature":     entry.Signature,
 		"public_key":    entry.PublicKey,
 		"record_type":   entry.RecordType,
+
+		"signature_version": entry.SignatureVersion,
+	}
+	if entry.LMSParams != nil {
+		commitReq["lms_params"] = entry.LMSParams
 	}
 
+	// One request ID for every endpoint tried: if a timed out attempt was applied, the retry
+	// returns its result instead of an index conflict
+	requestID, err := newCommitRequestID()
+	if err != nil {
+		return err
+	}
+	commitReq["request_id"] = requestID
+
 	reqBody, err := json.Marshal(commitReq)
 	fmt.Printf("[DEBUG] Request body length: %d bytes\n", len(reqBody))
 	if err != nil {
@@ -183,7 +183,7 @@ func (s *HSMServer) commitIndexToRaft(keyID string, index uint64, previousHash s
 	for _, endpoint := range s.raftEndpoints {
 		url := fmt.Sprintf("%s/commit_index", endpoint)
 
-		resp, err := http.Post(url, "application/json", bytes.NewBuffer(reqBody))
+		resp, err := s.raftHTTPClient().Post(url, "application/json", bytes.NewBuffer(reqBody))
 		if err != nil {
 			lastErr = fmt.Errorf("failed to connect to %s: %v", endpoint, err)
 			continue
@@ -221,27 +221,7 @@ func (s *HSMServer) commitIndexToRaft(keyID string, index uint64, previousHash s
 	}
 
 	// Commit to blockchain if enabled
-	blockchainErr := error(nil)
-	// Commit to blockchain only if:
-	// 1. Global blockchain is enabled (s.blockchainEnabled)
-	// 2. Per-key blockchain is enabled (blockchainEnabled parameter)
-	if s.blockchainEnabled && blockchainEnabled && s.blockchainClient != nil && s.blockchainIdentity != "" {
-		// Commit to blockchain (per-key control)
-		// Try to get wallet address from request (set by explorer proxy)
-		// If available, use it explicitly for funding
-
-		_, _, blockchainErr = s.blockchainClient.CommitLMSIndexWithPubkeyHash(
-			s.blockchainIdentity,
-			pubkeyHashHex,
-			fmt.Sprintf("%d", index),
-			fundingAddress, // Pass funding address explicitly
-		)
-		if blockchainErr != nil {
-			log.Printf("[WARNING] Failed to commit index %d to blockchain: %v", index, blockchainErr)
-		} else {
-			log.Printf("[INFO] Committed index %d to blockchain (pubkey_hash=%s, funding=%s)", index, pubkeyHashHex, fundingAddress)
-		}
-	}
+	blockchainErr := s.commitIndexToBlockchain(pubkeyHashHex, index, fundingAddress, blockchainEnabled)
 
 	// Handle different scenarios:
 	// 1. Raft committed successfully -> success (blockchain also committed if enabled)
@@ -269,15 +249,173 @@ func (s *HSMServer) commitIndexToRaft(keyID string, index uint64, previousHash s
 	return nil
 }
 
+// newCommitRequestID returns a random request ID for a /commit_index request
+func newCommitRequestID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate request ID: %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// commitIndexToBlockchain commits an index to the Verus blockchain if enabled globally and for this key
+// Returns nil when blockchain commits are disabled
+func (s *HSMServer) commitIndexToBlockchain(pubkeyHashHex string, index uint64, fundingAddress string, blockchainEnabled bool) error {
+	// Commit to blockchain only if:
+	// 1. Global blockchain is enabled (s.blockchainEnabled)
+	// 2. Per-key blockchain is enabled (blockchainEnabled parameter)
+	if !s.blockchainEnabled || !blockchainEnabled || s.blockchainClient == nil || s.blockchainIdentity == "" {
+		return nil
+	}
+
+	_, _, err := s.blockchainClient.CommitLMSIndexWithPubkeyHash(
+		s.blockchainIdentity,
+		pubkeyHashHex,
+		fmt.Sprintf("%d", index),
+		fundingAddress, // Pass funding address explicitly
+	)
+	if err != nil {
+		log.Printf("[WARNING] Failed to commit index %d to blockchain: %v", index, err)
+	} else {
+		log.Printf("[INFO] Committed index %d to blockchain (pubkey_hash=%s, funding=%s)", index, pubkeyHashHex, fundingAddress)
+	}
+	return err
+}
+
+// reserveIndexAttempts bounds the reservations sent for one signature: a reservation rejected because the
+// chain head moved is signed again for the re-read head, as long as that head still allocates the index
+const reserveIndexAttempts = 3
+
+// reserveIndexFromRaft asks the Raft cluster to allocate and commit index, the next index for an LMS key
+// The FSM assigns the index inside Apply after previousHash, the chain head the reservation is signed
+// for, so concurrent signers always receive distinct indices. A reservation rejected with a head
+// mismatch is retried against the current head; it fails if another signer was allocated the index.
+func (s *HSMServer) reserveIndexFromRaft(keyID string, lmsPublicKey []byte, index uint64, previousHash string, recordType string, lmsParams *fsm.LMSParams) (*fsm.IndexReservation, error) {
+	pubkeyHash := fsm.ComputePubkeyHash(lmsPublicKey)
+
+	for attempt := 1; ; attempt++ {
+		reservation, conflict, err := s.postReservation(keyID, pubkeyHash, previousHash, recordType, lmsParams)
+		if err == nil && reservation.Index != index {
+			return nil, fmt.Errorf("Raft reserved index %d, the key signs index %d", reservation.Index, index)
+		}
+		if !conflict || attempt == reserveIndexAttempts {
+			return reservation, err
+		}
+
+		// The head moved since the reservation was signed: re-read it
+		headIndex, headHash, headExists, queryErr := s.queryRaftByPubkeyHash(pubkeyHash)
+		if queryErr != nil {
+			return nil, fmt.Errorf("%v (re-reading the chain head failed: %v)", err, queryErr)
+		}
+		nextIndex := uint64(0)
+		if headExists {
+			nextIndex = headIndex + 1
+		} else {
+			headHash = fsm.GenesisHash
+		}
+		if nextIndex != index {
+			return nil, fmt.Errorf("index %d was allocated by another signer (chain head at index %d)", index, headIndex)
+		}
+		log.Printf("[WARNING] Reservation of index %d for key %s rejected (%v), retrying with previous_hash %s",
+			index, keyID, err, headHash)
+		previousHash = headHash
+	}
+}
+
+// postReservation signs a reservation for previousHash and sends it to the Raft endpoints
+// conflict reports a reservation rejected because the chain head is no longer previousHash.
+func (s *HSMServer) postReservation(keyID string, pubkeyHash string, previousHash string, recordType string, lmsParams *fsm.LMSParams) (*fsm.IndexReservation, bool, error) {
+	entry := fsm.KeyIndexEntry{
+		KeyID:        keyID,
+		PubkeyHash:   pubkeyHash,
+		PreviousHash: previousHash,
+		RecordType:   recordType,
+		LMSParams:    lmsParams,
+	}
+	if err := fsm.SignReservation(&entry, s.attestationPrivKey); err != nil {
+		return nil, false, fmt.Errorf("failed to sign reservation: %v", err)
+	}
+
+	reservationReq := map[string]interface{}{
+		"key_id":            entry.KeyID,
+		"pubkey_hash":       entry.PubkeyHash,
+		"previous_hash":     entry.PreviousHash,
+		"record_type":       entry.RecordType,
+		"signature":         entry.Signature,
+		"public_key":        entry.PublicKey,
+		"signature_version": entry.SignatureVersion,
+	}
+	if entry.LMSParams != nil {
+		reservationReq["lms_params"] = entry.LMSParams
+	}
+	reqBody, err := json.Marshal(reservationReq)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	var lastErr error
+	for _, endpoint := range s.raftEndpoints {
+		resp, err := s.raftHTTPClient().Post(endpoint+"/reserve_index", "application/json", bytes.NewBuffer(reqBody))
+		if err != nil {
+			lastErr = fmt.Errorf("failed to connect to %s: %v", endpoint, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		var response struct {
+			fsm.IndexReservation
+			Success bool   `json:"success"`
+			Error   string `json:"error"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			lastErr = fmt.Errorf("error from %s: status %d, body: %s", endpoint, resp.StatusCode, string(body))
+			continue
+		}
+		// The leader applied the reservation and rejected its head: another endpoint would only repeat it
+		if resp.StatusCode == http.StatusConflict {
+			return nil, true, fmt.Errorf("reservation rejected at %s: %s", endpoint, response.Error)
+		}
+		if resp.StatusCode != http.StatusOK || !response.Success {
+			lastErr = fmt.Errorf("reservation failed at %s: %s", endpoint, response.Error)
+			continue
+		}
+
+		return &response.IndexReservation, false, nil
+	}
+
+	return nil, false, fmt.Errorf("all endpoints failed: %v", lastErr)
+}
+
 // syncIndexes syncs both Raft and blockchain to the same index (highest between them)
 // This is used when there's a mismatch between Raft and blockchain indices
 // recordType should be "sync"
+// The FSM accepts a sync record at most fsm.MaxSyncJump past the head, so a longer jump is committed to
+// Raft as a series of sync records; only the final one is also committed to the blockchain.
 func (s *HSMServer) syncIndexes(keyID string, targetIndex uint64, previousHash string, lmsPublicKey []byte, fundingAddress string, blockchainEnabled bool) error {
 	log.Printf("[SYNC] Syncing key %s to index %d (previous_hash=%s)", keyID, targetIndex, previousHash)
 
+	pubkeyHash := fsm.ComputePubkeyHash(lmsPublicKey)
+	headIndex, headHash, headExists, err := s.queryRaftByPubkeyHash(pubkeyHash)
+	for err == nil && headExists && targetIndex > headIndex+fsm.MaxSyncJump {
+		stepIndex := headIndex + fsm.MaxSyncJump
+		log.Printf("[SYNC] Syncing key %s to intermediate index %d", keyID, stepIndex)
+		if err := s.commitIndexToRaft(keyID, stepIndex, headHash, lmsPublicKey, fundingAddress, false, "sync", nil); err != nil {
+			return fmt.Errorf("sync to intermediate index %d failed: %v", stepIndex, err)
+		}
+
+		headIndex, headHash, headExists, err = s.queryRaftByPubkeyHash(pubkeyHash)
+		if err == nil && (!headExists || headIndex != stepIndex) {
+			return fmt.Errorf("chain head is at index %d after syncing to %d", headIndex, stepIndex)
+		}
+	}
+	if err == nil && headExists {
+		previousHash = headHash
+	}
+
 	// Use commitIndexToRaft with record_type="sync" to commit to both Raft and blockchain
 	// This will commit the target index to both systems
-	return s.commitIndexToRaft(keyID, targetIndex, previousHash, lmsPublicKey, fundingAddress, blockchainEnabled, "sync")
+	return s.commitIndexToRaft(keyID, targetIndex, previousHash, lmsPublicKey, fundingAddress, blockchainEnabled, "sync", nil)
 }
 
 // handleSign handles sign requests
@@ -287,6 +425,9 @@ func (s *HSMServer) handleSign(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	signResult := signResultError
+	defer func() { signRequests.Inc(signResult) }()
+
 	var req SignRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		response := SignResponse{
@@ -354,6 +495,16 @@ func (s *HSMServer) handleSign(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Everything from reading the key's state to releasing its signature runs on the key's actor
+	s.runOnKeyActor(req.KeyID, func() {
+		signResult = s.signWithKey(w, req)
+	})
+}
+
+// signWithKey signs a request on its key's signing actor and returns the sign request result
+func (s *HSMServer) signWithKey(w http.ResponseWriter, req SignRequest) (signResult string) {
+	signResult = signResultError
+
 	// Step 1: Load LMS key from database (need public key to compute pubkey_hash)
 	lmsKey, err := s.db.GetKey(req.KeyID)
 	if err != nil {
@@ -391,7 +542,9 @@ func (s *HSMServer) handleSign(w http.ResponseWriter, r *http.Request) {
 	pubkeyHashHex := fmt.Sprintf("%x", pubkeyHashBytes)
 
 	// Step 2: Consistency check - fetch last index from both Raft and blockchain (if enabled)
+	queryStart := time.Now()
 	raftIndex, raftHash, raftExists, raftErr := s.queryRaftByPubkeyHash(pubkeyHash)
+	signPhaseDuration.ObserveSince(queryStart, signPhaseRaftQuery)
 
 	var blockchainIndex uint64
 	blockchainAvailable := false
@@ -527,28 +680,12 @@ func (s *HSMServer) handleSign(w http.ResponseWriter, r *http.Request) {
 	lastHash := raftHash
 	exists := raftExists
 
+	// Key not found: index 0 is committed as the key's "create" record, chained to the genesis hash
 	var indexToUse uint64
-	var previousHash string
-
-	if !exists {
-		// Step 3: Key not found, commit index 0 to Raft with genesis hash
-		// This is a "create" record type (first commit for this key)
-		indexToUse = 0
-		previousHash = fsm.GenesisHash
-		if err := s.commitIndexToRaft(req.KeyID, indexToUse, previousHash, lmsKey.PublicKey, req.WalletAddress, req.BlockchainEnabled, "create"); err != nil {
-			response := SignResponse{
-				Success: false,
-				Error:   fmt.Sprintf("Failed to commit index to Raft: %v", err),
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-	} else {
-		// Key exists, use next index and previous entry's stored hash
-		indexToUse = lastIndex + 1
+	previousHash := fsm.GenesisHash
+	recordType := "create"
 
+	if exists {
 		// MUST use the stored hash from previous entry - never recompute or fallback
 		if lastHash == "" {
 			response := SignResponse{
@@ -561,21 +698,12 @@ func (s *HSMServer) handleSign(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Use the actual stored hash from the previous commit
+		// Key exists: the next index, chained to the stored hash of the previous commit
+		indexToUse = lastIndex + 1
 		previousHash = lastHash
-
-		// Step 3: Commit the new index (this is a "sign" record type)
-		if err := s.commitIndexToRaft(req.KeyID, indexToUse, previousHash, lmsKey.PublicKey, req.WalletAddress, req.BlockchainEnabled, "sign"); err != nil {
-			response := SignResponse{
-				Success: false,
-				Error:   fmt.Sprintf("Failed to commit index to Raft: %v", err),
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(response)
-			return
-		}
+		recordType = "sign"
 	}
+	expectedIndex := indexToUse
 
 	// Ensure LmType and OtsType are set (they might be missing from old keys)
 	// If they're empty, use default values (h=5, w=1)
@@ -597,8 +725,7 @@ func (s *HSMServer) handleSign(w http.ResponseWriter, r *http.Request) {
 		s.mu.Unlock()
 	}
 
-	// Step 4: Sign the message with LMS key
-	if len(lmsKey.PrivateKey) == 0 {
+	if lmsKey.Backend == backendSoftware && len(lmsKey.PrivateKey) == 0 {
 		response := SignResponse{
 			Success: false,
 			Error:   fmt.Sprintf("Key %s has no private key (cannot sign)", req.KeyID),
@@ -609,33 +736,114 @@ func (s *HSMServer) handleSign(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Load working key from private key
-	workingKey, err := lms_wrapper.LoadWorkingKey(
-		lmsKey.PrivateKey,
-		lmsKey.Levels,
-		lmsKey.LmType,
-		lmsKey.OtsType,
-		0, // memory target: 0 = minimal memory
-	)
-	if err != nil {
+	// Step 3: Allocate the index. Large keys take it from this instance's leased range (no Raft round
+	// trip; leases extend an existing chain, so the create record always goes through Raft). Otherwise
+	// the Raft cluster reserves it before signing, so concurrent signers never share an index. Only when
+	// Raft is unavailable is the index committed after signing, through the blockchain fallback.
+	usesLease := raftErr == nil && exists && s.usesIndexLease(lmsKey)
+	reserves := raftErr == nil && !usesLease
+	resumed := false
+
+	if usesLease {
+		leaf, err := s.privateKeyLeafIndex(lmsKey)
+		var leasedIndex uint64
+		if err == nil {
+			leasedIndex, err = s.nextLeasedIndex(req.KeyID, lmsKey.PublicKey, leaf)
+		}
+		if err != nil {
+			response := SignResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Failed to lease indices from Raft: %v", err),
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		indexToUse = leasedIndex
+	} else if reserves {
+		// The key's last reservation was committed but never signed: sign it instead of reserving another
+		if pendingIndex, resumable := s.resumablePendingIndex(req.KeyID, lmsKey, lastIndex, exists); resumable {
+			log.Printf("[INFO] Key %s resumes its unsigned reservation of index %d", req.KeyID, pendingIndex)
+			indexToUse = pendingIndex
+			resumed = true
+		}
+	}
+
+	// The private key state must be at the leaf of the index to commit (burned indices may be skipped)
+	if !resumed {
+		indexToUse, err = s.signingLeafIndex(req.KeyID, lmsKey, indexToUse, exists && !usesLease)
+		if err != nil {
+			response := SignResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Refusing to sign: %v", err),
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	if !usesLease && indexToUse > expectedIndex {
+		// Burned indices were skipped: a sync record covers them and the signature chains after it
+		previousHash, err = s.syncBurnedIndices(req.KeyID, indexToUse-1, previousHash, lmsKey.PublicKey, req.WalletAddress, req.BlockchainEnabled)
+		if err != nil {
+			response := SignResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Failed to sync burned indices: %v", err),
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+
+	// Step 4: Durably record the index as pending before its leaf can be spent. Should the server stop
+	// before the signature is released, the index is resumed if the key state never moved past it, and
+	// counted as burned if it did.
+	if err := s.db.RecordPendingIndex(req.KeyID, indexToUse); err != nil {
 		response := SignResponse{
 			Success: false,
-			Error:   fmt.Sprintf("Failed to load working key: %v", err),
+			Error:   fmt.Sprintf("Failed to record pending index %d: %v", indexToUse, err),
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	defer workingKey.Free()
 
-	// Generate LMS signature
-	messageBytes := []byte(req.Message)
-	signatureBytes, err := workingKey.GenerateSignature(messageBytes)
+	var lmsParams *fsm.LMSParams
+	if recordType == "create" {
+		lmsParams = lmsKeyParams(lmsKey)
+	}
+
+	commitStart := time.Now()
+	if reserves && !resumed {
+		reservation, err := s.reserveIndexFromRaft(req.KeyID, lmsKey.PublicKey, indexToUse, previousHash, recordType, lmsParams)
+		if err != nil {
+			response := SignResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Failed to reserve index from Raft: %v", err),
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		log.Printf("[INFO] Reserved index %d for key %s (raft_index=%d)", indexToUse, req.KeyID, reservation.RaftIndex)
+	}
+	commitDuration := time.Since(commitStart)
+	s.signStepDone(signStepAllocated)
+
+	// Step 5: Sign the message with LMS key (held in memory until Step 8, see the Discard Rule)
+	lmsSignStart := time.Now()
+	signatureBytes, updatedPrivKey, err := s.lmsSign(lmsKey, []byte(req.Message))
 	if err != nil {
 		response := SignResponse{
 			Success: false,
-			Error:   fmt.Sprintf("Failed to generate LMS signature: %v", err),
+			Error:   fmt.Sprintf("LMS signing failed: %v", err),
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -643,32 +851,87 @@ func (s *HSMServer) handleSign(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get updated private key state (LMS is stateful)
-	updatedPrivKey := workingKey.GetPrivateKey()
-	if len(updatedPrivKey) == 0 {
+	// ... and the signature must have used that leaf
+	if err := s.checkSignatureLeafIndex(req.KeyID, signatureBytes, indexToUse); err != nil {
+		s.discardSignature(req.KeyID, indexToUse, signatureBytes, discardStepLeafCheck, err)
+		signResult = signResultDiscarded
 		response := SignResponse{
 			Success: false,
-			Error:   "Failed to get updated private key state",
+			Error:   fmt.Sprintf("Signature discarded: %v", err),
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(response)
 		return
 	}
+	s.signStepDone(signStepSigned)
 
-	// Update private key in database (stateful - key changes after each signature)
-	lmsKey.PrivateKey = updatedPrivKey
-	if err := s.db.StoreKey(req.KeyID, lmsKey); err != nil {
-		log.Printf("Warning: Failed to update private key state in DB: %v", err)
+	// Step 6: Durably store the advanced private key state (stateful - key changes after each signature)
+	if err := s.persistKeyState(req.KeyID, lmsKey, indexToUse, updatedPrivKey); err != nil {
+		s.discardSignature(req.KeyID, indexToUse, signatureBytes, discardStepPersist, err)
+		signResult = signResultDiscarded
+		response := SignResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Signature discarded: failed to persist private key state: %v", err),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
 	}
+	signPhaseDuration.ObserveSince(lmsSignStart, signPhaseLMSSign)
+	s.signStepDone(signStepPersisted)
+
+	// Step 7: Commit the index. A reserved or leased index is already in Raft, so only the blockchain
+	// (and the lease's used indices) remain; without Raft the commit goes through the blockchain fallback.
+	commitStart = time.Now()
+	if usesLease {
+		// The leased range is already committed; the index is reported as used when the lease is returned
+		if err := s.markLeasedIndexUsed(req.KeyID, indexToUse); err != nil {
+			s.discardSignature(req.KeyID, indexToUse, signatureBytes, discardStepCommit, err)
+			signResult = signResultDiscarded
+			response := SignResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Signature discarded: failed to record leased index as used: %v", err),
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+	}
+	if reserves || usesLease {
+		// Raft is authoritative; a blockchain failure is only logged
+		s.commitIndexToBlockchain(pubkeyHashHex, indexToUse, req.WalletAddress, req.BlockchainEnabled)
+	} else if err := s.commitIndexToRaft(req.KeyID, indexToUse, previousHash, lmsKey.PublicKey, req.WalletAddress, req.BlockchainEnabled, recordType, lmsParams); err != nil {
+		s.discardSignature(req.KeyID, indexToUse, signatureBytes, discardStepCommit, err)
+		signResult = signResultDiscarded
+		response := SignResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Signature discarded: failed to commit index to Raft: %v", err),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	signPhaseDuration.Observe((commitDuration + time.Since(commitStart)).Seconds(), signPhaseCommit)
 
-	// Also update in-memory cache
-	s.mu.Lock()
-	if cachedKey, exists := s.keys[req.KeyID]; exists {
-		cachedKey.PrivateKey = updatedPrivKey
+	// A pending index left behind would let a restored key state resume it: withhold the signature instead
+	if err := s.db.ClearPendingIndex(req.KeyID); err != nil {
+		s.discardSignature(req.KeyID, indexToUse, signatureBytes, discardStepCommit, fmt.Errorf("failed to clear pending index: %v", err))
+		signResult = signResultDiscarded
+		response := SignResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Signature discarded: failed to clear pending index: %v", err),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
 	}
-	s.mu.Unlock()
 
+	// Step 8: Release the signature - the key state is durable and the index committed
 	// Encode signature and public key as base64 for JSON response
 	signatureB64 := base64.StdEncoding.EncodeToString(signatureBytes)
 	publicKeyB64 := base64.StdEncoding.EncodeToString(lmsKey.PublicKey)
@@ -676,17 +939,6 @@ func (s *HSMServer) handleSign(w http.ResponseWriter, r *http.Request) {
 	log.Printf("[DEBUG] Generated LMS signature for key_id=%s, index=%d, signature_len=%d bytes",
 		req.KeyID, indexToUse, len(signatureBytes))
 
-	// Step 5: Update index in database after signing
-	newIndex := indexToUse + 1
-	if err := s.db.UpdateKeyIndex(req.KeyID, newIndex); err != nil {
-		// Also update in-memory cache
-		s.mu.Lock()
-		if key, exists := s.keys[req.KeyID]; exists {
-			key.Index = newIndex
-		}
-		s.mu.Unlock()
-	}
-
 	// Create structured signature
 	structuredSig := &StructuredSignature{
 		PublicKey: publicKeyB64,
@@ -700,7 +952,9 @@ func (s *HSMServer) handleSign(w http.ResponseWriter, r *http.Request) {
 		Index:     indexToUse,
 		Signature: structuredSig,
 	}
+	signResult = signResultSuccess
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
+	return
 }
@@ -1,23 +1,19 @@
 package hsm_server
 
 import (
-	"crypto/ecdsa"
-	"crypto/rand"
-	"crypto/sha256"
-	"crypto/x509"
-	"encoding/base64"
 	"encoding/json"
 	"testing"
 
 	"github.com/hashicorp/raft"
 	"github.com/verifiable-state-chains/lms/fsm"
+	"github.com/verifiable-state-chains/lms/lms_wrapper"
 )
 
 // TestExactCommandFlow tests the EXACT flow from the command:
 // ./hsm-client sign -key-id lms_key_1 -msg "hello"
 func TestExactCommandFlow(t *testing.T) {
 	// Load the actual keys from the keys directory (same as production)
-	privKey, pubKey, err := LoadAttestationKeyPair()
+	privKey, _, err := LoadAttestationKeyPair()
 	if err != nil {
 		t.Fatalf("Failed to load keys: %v", err)
 	}
@@ -32,30 +28,28 @@ func TestExactCommandFlow(t *testing.T) {
 	keyID := "lms_key_1"
 	index := uint64(0)
 
-	// Step 1: Sign (EXACT same code as commitIndexToRaft)
-	data := "lms_key_1:0" // fmt.Sprintf("%s:%d", keyID, index)
-	hash := sha256.Sum256([]byte(data))
-	
-	t.Logf("Signing data: %s", data)
-	t.Logf("Hash: %x", hash)
-	
-	signature, err := ecdsa.SignASN1(rand.Reader, privKey, hash[:])
-	if err != nil {
-		t.Fatalf("Failed to sign: %v", err)
+	// Step 1: Create entry (EXACT same format as sent to Raft)
+	entry := fsm.KeyIndexEntry{
+		KeyID:        keyID,
+		PubkeyHash:   fsm.ComputePubkeyHash([]byte("lms_key_1_public_key")),
+		Index:        index,
+		PreviousHash: fsm.GenesisHash,
+		RecordType:   "create",
+		LMSParams:    &fsm.LMSParams{Levels: 1, LmType: []int{lms_wrapper.LMS_SHA256_M32_H5}, OtsType: []int{lms_wrapper.LMOTS_SHA256_N32_W1}},
 	}
 
-	// Step 2: Marshal public key (EXACT same code)
-	pubKeyBytes, err := x509.MarshalPKIXPublicKey(pubKey)
-	if err != nil {
-		t.Fatalf("Failed to marshal public key: %v", err)
+	// Step 2: Sign all entry fields (EXACT same code as commitIndexToRaft)
+	if err := fsm.SignEntry(&entry, privKey); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	if entry.SignatureVersion != fsm.SignatureVersionV2 {
+		t.Fatalf("Expected signature version %d, got %d", fsm.SignatureVersionV2, entry.SignatureVersion)
 	}
 
-	// Step 3: Create entry (EXACT same format as sent to Raft)
-	entry := fsm.KeyIndexEntry{
-		KeyID:     keyID,
-		Index:     index,
-		Signature: base64.StdEncoding.EncodeToString(signature),
-		PublicKey: base64.StdEncoding.EncodeToString(pubKeyBytes),
+	// Step 3: Compute entry hash (all fields except hash)
+	entry.Hash, err = entry.ComputeHash()
+	if err != nil {
+		t.Fatalf("Failed to compute hash: %v", err)
 	}
 
 	t.Logf("Entry: key_id=%s, index=%d", entry.KeyID, entry.Index)
@@ -118,18 +112,19 @@ func TestExactCommandFlow_VerifySignatureOnly(t *testing.T) {
 	keyID := "lms_key_1"
 	index := uint64(0)
 
-	// Sign (EXACT same as commitIndexToRaft)
-	data := "lms_key_1:0"
-	hash := sha256.Sum256([]byte(data))
-	signature, _ := ecdsa.SignASN1(rand.Reader, privKey, hash[:])
-	pubKeyBytes, _ := x509.MarshalPKIXPublicKey(pubKey)
-
-	// Create entry
+	// Create and sign entry (EXACT same as commitIndexToRaft)
 	entry := fsm.KeyIndexEntry{
-		KeyID:     keyID,
-		Index:     index,
-		Signature: base64.StdEncoding.EncodeToString(signature),
-		PublicKey: base64.StdEncoding.EncodeToString(pubKeyBytes),
+		KeyID:        keyID,
+		PubkeyHash:   fsm.ComputePubkeyHash([]byte("lms_key_1_public_key")),
+		Index:        index,
+		PreviousHash: fsm.GenesisHash,
+		RecordType:   "create",
+	}
+	if err := fsm.SignEntry(&entry, privKey); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	if !pubKey.Equal(&privKey.PublicKey) {
+		t.Fatal("Attestation key pair is inconsistent")
 	}
 
 	// Verify using the FSM's VerifySignature method
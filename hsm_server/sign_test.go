@@ -7,7 +7,11 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"sync/atomic"
 	"testing"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+	"github.com/verifiable-state-chains/lms/lms_wrapper"
 )
 
 func TestCommitIndexToRaft_SignatureCreation(t *testing.T) {
@@ -97,3 +101,59 @@ func TestSignature_WithCorrectFormat(t *testing.T) {
 	t.Logf("✅ Signature works with correct data format")
 }
 
+func TestSyncIndexes_SplitsLongJumps(t *testing.T) {
+	cluster := newSignTestCluster(t)
+	s := newDiscardTestServer(t, cluster, &testSigner{})
+	lmsPublicKey := []byte("h20-public-key")
+	pubkeyHash := fsm.ComputePubkeyHash(lmsPublicKey)
+	params := &fsm.LMSParams{Levels: 1, LmType: []int{lms_wrapper.LMS_SHA256_M32_H20}, OtsType: []int{lms_wrapper.LMOTS_SHA256_N32_W1}}
+
+	if err := s.commitIndexToRaft("key_b", 0, fsm.GenesisHash, lmsPublicKey, "", false, "create", params); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// A jump over fsm.MaxSyncJump is committed as several sync records
+	target := uint64(2*fsm.MaxSyncJump + 500)
+	if err := s.syncIndexes("key_b", target, fsm.GenesisHash, lmsPublicKey, "", false); err != nil {
+		t.Fatalf("syncIndexes failed: %v", err)
+	}
+	if index, _, _ := cluster.fsm.GetIndexAndHashByPubkeyHash(pubkeyHash); index != target {
+		t.Fatalf("Expected Raft head at index %d, got %d", target, index)
+	}
+	chain, _ := cluster.fsm.GetChainByPubkeyHash(pubkeyHash)
+	if len(chain) != 4 || chain[1].Index != fsm.MaxSyncJump || chain[2].Index != 2*fsm.MaxSyncJump {
+		t.Fatalf("Expected create and three sync records, got %d entries", len(chain))
+	}
+}
+
+func TestReserveIndexFromRaft_RetriesMovedHead(t *testing.T) {
+	cluster := newSignTestCluster(t)
+	s := newDiscardTestServer(t, cluster, &testSigner{})
+	lmsPublicKey := []byte("lms-public-key")
+
+	created, err := s.reserveIndexFromRaft("key_a", lmsPublicKey, 0, fsm.GenesisHash, "create", lmsKeyParams(s.keys["key_a"]))
+	if err != nil {
+		t.Fatalf("Create reservation failed: %v", err)
+	}
+
+	// A reservation signed for a stale head is signed again for the current one
+	reservation, err := s.reserveIndexFromRaft("key_a", lmsPublicKey, 1, "stale-head", "sign", nil)
+	if err != nil {
+		t.Fatalf("Expected the reservation retried against the current head, got: %v", err)
+	}
+	chain, _ := cluster.fsm.GetChainByPubkeyHash(fsm.ComputePubkeyHash(lmsPublicKey))
+	if reservation.Index != 1 || len(chain) != 2 || chain[1].PreviousHash != created.Hash {
+		t.Fatalf("Expected index 1 chained to the create record, got %+v", reservation)
+	}
+
+	// An index allocated to another signer is not retried, and nothing more is reserved
+	if _, err := s.reserveIndexFromRaft("key_a", lmsPublicKey, 1, created.Hash, "sign", nil); err == nil {
+		t.Fatal("Expected the reservation of an allocated index to fail")
+	}
+	if index, _, _ := cluster.fsm.GetIndexAndHashByPubkeyHash(fsm.ComputePubkeyHash(lmsPublicKey)); index != 1 {
+		t.Fatalf("Expected Raft head at index 1, got %d", index)
+	}
+	if commits := atomic.LoadInt32(&cluster.commits); commits != 4 {
+		t.Errorf("Expected 4 reservation requests, got %d", commits)
+	}
+}
@@ -0,0 +1,56 @@
+package hsm_server
+
+import (
+	"fmt"
+)
+
+// keySigningActor runs the signing operations of one key, one at a time
+// Concurrent requests for a key would otherwise load the same private key state, sign with the same
+// leaf and overwrite each other's advanced state. The actor exists while operations are queued for it.
+type keySigningActor struct {
+	ops     chan func()
+	pending int // Operations submitted and not finished (guarded by HSMServer.actorMu)
+}
+
+// runOnKeyActor runs op on the key's signing actor and waits for it to finish
+// Operations on one key never overlap; different keys run in parallel.
+func (s *HSMServer) runOnKeyActor(keyID string, op func()) {
+	s.actorMu.Lock()
+	if s.actors == nil {
+		s.actors = make(map[string]*keySigningActor)
+	}
+	actor, exists := s.actors[keyID]
+	if !exists {
+		actor = &keySigningActor{ops: make(chan func())}
+		s.actors[keyID] = actor
+		go s.runKeyActor(keyID, actor)
+	}
+	actor.pending++
+	s.actorMu.Unlock()
+
+	// A panic in op is raised again in the caller (net/http recovers it per request)
+	done := make(chan interface{}, 1)
+	actor.ops <- func() {
+		defer func() { done <- recover() }()
+		op()
+	}
+	if p := <-done; p != nil {
+		panic(fmt.Sprintf("signing actor for key %s: %v", keyID, p))
+	}
+}
+
+// runKeyActor runs a key's operations until none is pending, then removes the actor
+func (s *HSMServer) runKeyActor(keyID string, actor *keySigningActor) {
+	for op := range actor.ops {
+		op()
+
+		s.actorMu.Lock()
+		actor.pending--
+		if actor.pending == 0 {
+			delete(s.actors, keyID)
+			s.actorMu.Unlock()
+			return
+		}
+		s.actorMu.Unlock()
+	}
+}
@@ -0,0 +1,163 @@
+package hsm_server
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/verifiable-state-chains/lms/lms_wrapper"
+)
+
+// fakeWorkingKey stands in for a hash-sigs working key loaded from testPrivateKey
+type fakeWorkingKey struct {
+	leaf   uint64
+	loader *fakeKeyLoader
+}
+
+func (k *fakeWorkingKey) GenerateSignature(message []byte) ([]byte, error) {
+	signature := testHSSSignature(uint32(k.leaf), message)
+	k.leaf++
+	return signature, nil
+}
+
+func (k *fakeWorkingKey) GetPrivateKey() []byte {
+	return testPrivateKey(k.leaf)
+}
+
+func (k *fakeWorkingKey) Free() {
+	k.loader.mu.Lock()
+	k.loader.freed++
+	k.loader.mu.Unlock()
+}
+
+// fakeKeyLoader loads fakeWorkingKeys and counts loads and frees
+type fakeKeyLoader struct {
+	mu    sync.Mutex
+	loads int
+	freed int
+}
+
+func (l *fakeKeyLoader) load(key *LMSKey) (workingKey, error) {
+	leaf, err := lms_wrapper.PrivateKeyIndex(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.loads++
+	l.mu.Unlock()
+	return &fakeWorkingKey{leaf: leaf, loader: l}, nil
+}
+
+func (l *fakeKeyLoader) counts() (int, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.loads, l.freed
+}
+
+func TestKeyActor_SerializesConcurrentSigns(t *testing.T) {
+	cluster := newSignTestCluster(t)
+	s := newDiscardTestServer(t, cluster, &testSigner{})
+	loader := &fakeKeyLoader{}
+	s.signer = nil
+	s.workingKeys = newWorkingKeyCache(4, loader.load)
+
+	const signers = 8
+	indices := make(chan uint64, signers)
+	var wg sync.WaitGroup
+	for i := 0; i < signers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, response := signTestMessage(s, "hello")
+			if status != http.StatusOK {
+				t.Errorf("Concurrent sign failed: %d %s", status, response.Error)
+				return
+			}
+			indices <- response.Index
+		}()
+	}
+	wg.Wait()
+	close(indices)
+
+	seen := make(map[uint64]bool)
+	for index := range indices {
+		if seen[index] {
+			t.Fatalf("Index %d released twice", index)
+		}
+		seen[index] = true
+	}
+	if len(seen) != signers {
+		t.Fatalf("Expected %d signatures, got %d", signers, len(seen))
+	}
+	if key, _ := s.db.GetKey("key_a"); key.Index != signers {
+		t.Errorf("Expected the stored key at leaf %d, got %d", signers, key.Index)
+	}
+	if loads, _ := loader.counts(); loads != 1 {
+		t.Errorf("Expected the working key loaded once, got %d loads", loads)
+	}
+
+	s.actorMu.Lock()
+	defer s.actorMu.Unlock()
+	if len(s.actors) != 0 {
+		t.Errorf("Expected idle actors to exit, %d left", len(s.actors))
+	}
+}
+
+func TestWorkingKeyCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	loader := &fakeKeyLoader{}
+	cache := newWorkingKeyCache(2, loader.load)
+	keys := map[string]*LMSKey{
+		"a": {KeyID: "a", PrivateKey: testPrivateKey(0)},
+		"b": {KeyID: "b", PrivateKey: testPrivateKey(0)},
+		"c": {KeyID: "c", PrivateKey: testPrivateKey(0)},
+	}
+	sign := func(keyID string) {
+		t.Helper()
+		_, privateKey, err := cache.sign(keys[keyID], []byte("hello"))
+		if err != nil {
+			t.Fatalf("sign %s failed: %v", keyID, err)
+		}
+		keys[keyID].PrivateKey = privateKey
+	}
+
+	// a, b loaded; a hit; c evicts b; b reloaded evicts a
+	for _, keyID := range []string{"a", "b", "a", "c", "b"} {
+		sign(keyID)
+	}
+	if loads, freed := loader.counts(); loads != 4 || freed != 2 {
+		t.Fatalf("Expected 4 loads and 2 frees, got %d loads and %d frees", loads, freed)
+	}
+
+	// A stored state the working key is not at (restored or imported key) is reloaded
+	keys["c"].PrivateKey = testPrivateKey(7)
+	sign("c")
+	if loads, _ := loader.counts(); loads != 5 {
+		t.Fatalf("Expected a stale working key to be reloaded, got %d loads", loads)
+	}
+
+	cache.close()
+	if _, freed := loader.counts(); freed != 5 {
+		t.Errorf("Expected every working key freed on close, got %d frees", freed)
+	}
+}
+
+func TestWorkingKeyCache_FreesEvictedKeyOnRelease(t *testing.T) {
+	loader := &fakeKeyLoader{}
+	cache := newWorkingKeyCache(1, loader.load)
+
+	inUse, err := cache.acquire(&LMSKey{KeyID: "a", PrivateKey: testPrivateKey(0)})
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	if _, _, err := cache.sign(&LMSKey{KeyID: "b", PrivateKey: testPrivateKey(0)}, []byte("hello")); err != nil {
+		t.Fatalf("sign failed: %v", err)
+	}
+	if _, freed := loader.counts(); freed != 0 {
+		t.Fatal("Expected a working key in use not to be freed on eviction")
+	}
+
+	cache.release(inUse, true)
+	if _, freed := loader.counts(); freed != 1 {
+		t.Errorf("Expected the evicted working key freed on release, got %d frees", freed)
+	}
+}
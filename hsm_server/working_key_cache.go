@@ -0,0 +1,177 @@
+package hsm_server
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/verifiable-state-chains/lms/lms_wrapper"
+)
+
+// defaultWorkingKeyCacheSize is the number of working keys kept loaded by default
+const defaultWorkingKeyCacheSize = 16
+
+// workingKey is a loaded private key that signs and advances its state (*lms_wrapper.WorkingKey)
+type workingKey interface {
+	GenerateSignature(message []byte) ([]byte, error)
+	GetPrivateKey() []byte
+	Free()
+}
+
+// loadWorkingKey loads a stored key with hash-sigs
+func loadWorkingKey(key *LMSKey) (workingKey, error) {
+	return lms_wrapper.LoadWorkingKey(
+		key.PrivateKey,
+		key.Levels,
+		key.LmType,
+		key.OtsType,
+		0, // memory target: 0 = minimal memory
+	)
+}
+
+// workingKeyCache keeps the most recently used working keys loaded, up to a capacity (0: no caching)
+// Loading a working key rebuilds its Merkle trees, which dominates signing time for H15 and larger keys.
+// Callers serialize the operations on one key (its signing actor); the lock only guards the LRU list.
+type workingKeyCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element // key_id -> element holding a *workingKeyEntry
+	lru      *list.List               // Most recently used first
+	load     func(key *LMSKey) (workingKey, error)
+}
+
+type workingKeyEntry struct {
+	keyID   string
+	key     workingKey
+	state   []byte // Private key state the working key is at
+	inUse   bool
+	evicted bool // Removed while in use: freed when released
+}
+
+func newWorkingKeyCache(capacity int, load func(key *LMSKey) (workingKey, error)) *workingKeyCache {
+	return &workingKeyCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		load:     load,
+	}
+}
+
+// sign signs with the key's working key, returning the signature and the advanced private key state
+// A cached working key is used only if it is at the stored private key state; otherwise it is reloaded.
+func (c *workingKeyCache) sign(key *LMSKey, message []byte) ([]byte, []byte, error) {
+	entry, err := c.acquire(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load working key: %v", err)
+	}
+
+	signature, err := entry.key.GenerateSignature(message)
+	if err != nil {
+		// The working key's state is unknown after a failure: drop it
+		c.release(entry, false)
+		return nil, nil, fmt.Errorf("failed to generate LMS signature: %v", err)
+	}
+
+	// Get updated private key state (LMS is stateful)
+	privateKey := entry.key.GetPrivateKey()
+	if len(privateKey) == 0 {
+		c.release(entry, false)
+		return nil, nil, fmt.Errorf("failed to get updated private key state")
+	}
+	entry.state = privateKey
+	c.release(entry, true)
+	return signature, privateKey, nil
+}
+
+// acquire returns the key's working key, marked in use, loading it on a miss
+func (c *workingKeyCache) acquire(key *LMSKey) (*workingKeyEntry, error) {
+	c.mu.Lock()
+	if elem, exists := c.entries[key.KeyID]; exists {
+		entry := elem.Value.(*workingKeyEntry)
+		if !entry.inUse && bytes.Equal(entry.state, key.PrivateKey) {
+			entry.inUse = true
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			workingKeyLookups.Inc(workingKeyHit)
+			return entry, nil
+		}
+		// Stale (the stored key changed under it) or, without serialization, in use
+		c.removeLocked(elem)
+	}
+	c.mu.Unlock()
+	workingKeyLookups.Inc(workingKeyMiss)
+
+	loaded, err := c.load(key)
+	if err != nil {
+		return nil, err
+	}
+	entry := &workingKeyEntry{
+		keyID: key.KeyID,
+		key:   loaded,
+		state: append([]byte(nil), key.PrivateKey...),
+		inUse: true,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity <= 0 {
+		entry.evicted = true
+		return entry, nil
+	}
+	if elem, exists := c.entries[key.KeyID]; exists {
+		c.removeLocked(elem)
+	}
+	c.entries[key.KeyID] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.capacity {
+		c.removeLocked(c.lru.Back())
+	}
+	return entry, nil
+}
+
+// release returns a working key to the cache, or frees it if it was evicted or is not to be kept
+func (c *workingKeyCache) release(entry *workingKeyEntry, keep bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.inUse = false
+	if !keep && !entry.evicted {
+		c.removeLocked(c.entries[entry.keyID])
+		return
+	}
+	if entry.evicted {
+		entry.key.Free()
+	}
+}
+
+// invalidate drops a key's working key (its stored state changed or the key was deleted)
+func (c *workingKeyCache) invalidate(keyID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, exists := c.entries[keyID]; exists {
+		c.removeLocked(elem)
+	}
+}
+
+// close frees every working key not in use (the rest are freed when released)
+func (c *workingKeyCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// removeLocked removes an entry from the cache, freeing its working key unless in use (caller must hold the lock)
+func (c *workingKeyCache) removeLocked(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*workingKeyEntry)
+	delete(c.entries, entry.keyID)
+	if entry.inUse {
+		entry.evicted = true
+		return
+	}
+	entry.key.Free()
+}
@@ -0,0 +1,128 @@
+package lms_wrapper
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Sizes of the RFC 8554 structures for the SHA-256/M32/N32 parameter sets
+const (
+	hashLen       = 32 // n (LM-OTS) and m (LMS)
+	identifierLen = 16 // I
+)
+
+// otsChainCount returns p, the number of Winternitz chains of an LM-OTS parameter set (-1 if unknown)
+func otsChainCount(otsType int) int {
+	switch otsType {
+	case LMOTS_SHA256_N32_W1:
+		return 265
+	case LMOTS_SHA256_N32_W2:
+		return 133
+	case LMOTS_SHA256_N32_W4:
+		return 67
+	case LMOTS_SHA256_N32_W8:
+		return 34
+	default:
+		return -1
+	}
+}
+
+// PrivateKeyIndex returns the index of the next signature a hash-sigs private key will generate
+// hash-sigs stores the count of signatures generated so far as a big-endian uint64 at the start of the key.
+func PrivateKeyIndex(privKey []byte) (uint64, error) {
+	if len(privKey) < 8 {
+		return 0, errors.New("private key too short")
+	}
+	return binary.BigEndian.Uint64(privKey[:8]), nil
+}
+
+// SignatureLeafIndex returns the index of the one-time key that produced an HSS signature
+// Each level's LMS signature carries its leaf q; the HSS index is the levels' leaves read as one
+// number, each level counting in units of the signatures under one tree of the levels below it.
+func SignatureLeafIndex(signature []byte) (uint64, error) {
+	r := sigReader{data: signature}
+	signedKeys, err := r.u32()
+	if err != nil {
+		return 0, err
+	}
+	if signedKeys > 7 {
+		return 0, fmt.Errorf("invalid HSS signature: %d signed public keys", signedKeys)
+	}
+
+	var index uint64
+	for level := uint32(0); level <= signedKeys; level++ {
+		q, h, err := r.lmsSignature()
+		if err != nil {
+			return 0, fmt.Errorf("invalid HSS signature at level %d: %v", level, err)
+		}
+		if q >= 1<<h {
+			return 0, fmt.Errorf("invalid HSS signature at level %d: leaf %d outside a tree of height %d", level, q, h)
+		}
+		index = index<<h | uint64(q)
+
+		if level < signedKeys {
+			// Public key of the next level: lms_type, lmots_type, I, T[1]
+			if err := r.skip(4 + 4 + identifierLen + hashLen); err != nil {
+				return 0, fmt.Errorf("invalid HSS signature at level %d: %v", level, err)
+			}
+		}
+	}
+	if len(r.data) != r.pos {
+		return 0, fmt.Errorf("invalid HSS signature: %d trailing bytes", len(r.data)-r.pos)
+	}
+	return index, nil
+}
+
+// sigReader reads the fields of a serialized signature
+type sigReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *sigReader) skip(n int) error {
+	if n < 0 || len(r.data)-r.pos < n {
+		return errors.New("truncated")
+	}
+	r.pos += n
+	return nil
+}
+
+func (r *sigReader) u32() (uint32, error) {
+	start := r.pos
+	if err := r.skip(4); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(r.data[start:]), nil
+}
+
+// lmsSignature reads an LMS signature (q, LM-OTS signature, lms_type, path) and returns q and the tree height
+func (r *sigReader) lmsSignature() (uint32, int, error) {
+	q, err := r.u32()
+	if err != nil {
+		return 0, 0, err
+	}
+	otsType, err := r.u32()
+	if err != nil {
+		return 0, 0, err
+	}
+	p := otsChainCount(int(otsType))
+	if p < 0 {
+		return 0, 0, fmt.Errorf("unknown LM-OTS type %d", otsType)
+	}
+	if err := r.skip(hashLen + p*hashLen); err != nil { // C, y[p]
+		return 0, 0, err
+	}
+	lmType, err := r.u32()
+	if err != nil {
+		return 0, 0, err
+	}
+	h := GetLMSHeight(int(lmType))
+	if h < 0 {
+		return 0, 0, fmt.Errorf("unknown LMS type %d", lmType)
+	}
+	if err := r.skip(h * hashLen); err != nil { // path[h]
+		return 0, 0, err
+	}
+	return q, h, nil
+}
@@ -0,0 +1,62 @@
+package lms_wrapper
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// appendLMSSignature appends an LMS signature by leaf q with zeroed hashes
+func appendLMSSignature(signature []byte, q uint32, lmType, otsType int) []byte {
+	signature = binary.BigEndian.AppendUint32(signature, q)
+	signature = binary.BigEndian.AppendUint32(signature, uint32(otsType))
+	signature = append(signature, make([]byte, hashLen+otsChainCount(otsType)*hashLen)...)
+	signature = binary.BigEndian.AppendUint32(signature, uint32(lmType))
+	return append(signature, make([]byte, GetLMSHeight(lmType)*hashLen)...)
+}
+
+// appendLMSPublicKey appends an LMS public key with zeroed I and T[1]
+func appendLMSPublicKey(signature []byte, lmType, otsType int) []byte {
+	signature = binary.BigEndian.AppendUint32(signature, uint32(lmType))
+	signature = binary.BigEndian.AppendUint32(signature, uint32(otsType))
+	return append(signature, make([]byte, identifierLen+hashLen)...)
+}
+
+func TestSignatureLeafIndex(t *testing.T) {
+	// One level: the leaf is the index
+	single := binary.BigEndian.AppendUint32(nil, 0)
+	single = appendLMSSignature(single, 17, LMS_SHA256_M32_H5, LMOTS_SHA256_N32_W4)
+	if index, err := SignatureLeafIndex(single); err != nil || index != 17 {
+		t.Fatalf("Expected index 17, got %d (%v)", index, err)
+	}
+
+	// Two levels (H10 over H5): the top leaf counts bottom trees of 32 signatures
+	double := binary.BigEndian.AppendUint32(nil, 1)
+	double = appendLMSSignature(double, 3, LMS_SHA256_M32_H10, LMOTS_SHA256_N32_W8)
+	double = appendLMSPublicKey(double, LMS_SHA256_M32_H5, LMOTS_SHA256_N32_W1)
+	double = appendLMSSignature(double, 9, LMS_SHA256_M32_H5, LMOTS_SHA256_N32_W1)
+	if index, err := SignatureLeafIndex(double); err != nil || index != 3*32+9 {
+		t.Fatalf("Expected index %d, got %d (%v)", 3*32+9, index, err)
+	}
+
+	for name, signature := range map[string][]byte{
+		"empty":     nil,
+		"truncated": single[:len(single)-1],
+		"trailing":  append(append([]byte(nil), single...), 0),
+		"leaf":      appendLMSSignature(binary.BigEndian.AppendUint32(nil, 0), 32, LMS_SHA256_M32_H5, LMOTS_SHA256_N32_W1),
+	} {
+		if _, err := SignatureLeafIndex(signature); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestPrivateKeyIndex(t *testing.T) {
+	privKey := make([]byte, 48)
+	binary.BigEndian.PutUint64(privKey, 1<<20+5)
+	if index, err := PrivateKeyIndex(privKey); err != nil || index != 1<<20+5 {
+		t.Fatalf("Expected index %d, got %d (%v)", 1<<20+5, index, err)
+	}
+	if _, err := PrivateKeyIndex(privKey[:7]); err == nil {
+		t.Fatal("Expected an error for a truncated private key")
+	}
+}
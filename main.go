@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,29 +20,70 @@ import (
 
 func main() {
 	// Parse command-line flags
-	nodeID := flag.String("id", "node1", "Node ID (e.g., node1, node2, node3)")
-	nodeAddr := flag.String("addr", "159.69.23.29:7000", "Node address (IP:port for Raft)")
-	apiPort := flag.Int("api-port", 8080, "API server port")
-	raftDir := flag.String("raft-dir", "./raft-data", "Raft data directory")
-	bootstrap := flag.Bool("bootstrap", false, "Bootstrap the cluster")
+	nodeFlags := service.RegisterNodeFlags(flag.CommandLine)
 	genesisHash := flag.String("genesis-hash", "lms_genesis_hash_verifiable_state_chains", "Genesis hash for the chain")
+	adminKeys := flag.String("admin-keys", "", "Comma-separated admin public key PEM files allowed to sign cluster membership changes and the attestation key registry bootstrap (must be identical on every node)")
+	adminThreshold := flag.Int("admin-threshold", 1, "Number of admin signatures required per membership change")
+	nearExhaustionFraction := flag.Float64("near-exhaustion-fraction", 0.1, "Flag keys as near exhaustion when this fraction of their indices remains")
+	nearExhaustionRemaining := flag.Uint64("near-exhaustion-remaining", 0, "Flag keys as near exhaustion when this many indices remain (0 = fraction only)")
+	treeHeadKey := flag.String("tree-head-key", "./keys/log_private_key.pem", "PEM EC private key that signs transparency log tree heads")
+	readConsistency := flag.String("read-consistency", service.ReadLeader, "Default consistency of query endpoints without ?consistency= (stale, leader, linearizable)")
+	join := flag.String("join", "", "API URL (or host:port) of a running cluster member to join instead of bootstrapping")
+	joinKey := flag.String("join-key", "", "Admin private key PEM file signing the -join request")
+	joinNonvoter := flag.Bool("join-nonvoter", false, "Join as a non-voter (promote it once it has caught up)")
+	fsmStore := flag.String("fsm-store", "memory", "Key index state store: memory (rebuilt from the Raft log on start) or bolt (<raft-dir>/<node-id>/fsm.db, resumes on restart)")
 	flag.Parse()
 
-	// Create configuration
-	cfg := service.DefaultConfig()
-	cfg.NodeID = *nodeID
-	cfg.NodeAddr = *nodeAddr
-	cfg.APIPort = *apiPort
-	cfg.RaftDir = *raftDir
-	cfg.Bootstrap = *bootstrap
+	// Create configuration: defaults, then cluster file, environment and explicit flags
+	cfg, err := nodeFlags.Load(flag.CommandLine)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg.NearExhaustionFraction = *nearExhaustionFraction
+	cfg.NearExhaustionRemaining = *nearExhaustionRemaining
+	cfg.TreeHeadKeyPath = *treeHeadKey
+	cfg.DefaultReadConsistency = *readConsistency
+	if err := cfg.Resolve(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *join != "" && cfg.Bootstrap {
+		log.Fatalf("-join and -bootstrap are mutually exclusive")
+	}
+
+	// Admin keys sign cluster membership changes and the attestation key registry bootstrap
+	if *adminKeys != "" {
+		for _, path := range strings.Split(*adminKeys, ",") {
+			key, err := fsm.LoadECPublicKeyPEM(strings.TrimSpace(path))
+			if err != nil {
+				log.Fatalf("Failed to load admin key %s: %v", path, err)
+			}
+			cfg.AdminKeys = append(cfg.AdminKeys, key)
+		}
+		cfg.AdminThreshold = *adminThreshold
+	}
+
+	// The key index state lives in memory or in a bbolt file next to the Raft log
+	var store fsm.Store = fsm.NewMemoryStore()
+	switch *fsmStore {
+	case "memory":
+	case "bolt":
+		boltStore, err := fsm.OpenBoltStore(filepath.Join(cfg.RaftDir, cfg.NodeID, "fsm.db"))
+		if err != nil {
+			log.Fatalf("Failed to open FSM store: %v", err)
+		}
+		store = boltStore
+	default:
+		log.Fatalf("Invalid -fsm-store %q (expected memory or bolt)", *fsmStore)
+	}
 
 	// Create combined FSM (hash-chain + key-index)
 	// Attestation public key path: ./keys/attestation_public_key.pem
 	var svc *service.Service
 	var fsmInstance service.FSMInterface
-	combinedFSM, err := fsm.NewCombinedFSM(*genesisHash, "./keys/attestation_public_key.pem")
+	combinedFSM, err := fsm.NewCombinedFSMWithStore(*genesisHash, "./keys/attestation_public_key.pem", store)
 	if err != nil {
 		log.Printf("Warning: Failed to load attestation public key, continuing without signature verification: %v", err)
+		store.Close()
 		// Fallback to hash-chain only if key not found
 		hashChainFSM := fsm.NewHashChainFSM(*genesisHash)
 		fsmInstance = hashChainFSM
@@ -71,10 +114,11 @@ func main() {
 	// Start service in background
 	go func() {
 		log.Printf("Starting Verifiable State Chains service")
-		log.Printf("  Node ID: %s", *nodeID)
-		log.Printf("  Raft Address: %s", *nodeAddr)
-		log.Printf("  API Port: %d", *apiPort)
-		log.Printf("  Bootstrap: %v", *bootstrap)
+		log.Printf("  Node ID: %s", cfg.NodeID)
+		log.Printf("  Raft Address: %s", cfg.NodeAddr)
+		log.Printf("  API Port: %d", cfg.APIPort)
+		log.Printf("  Cluster Nodes: %d", len(cfg.ClusterNodes))
+		log.Printf("  Bootstrap: %v", cfg.Bootstrap)
 		log.Printf("  Genesis Hash: %s", *genesisHash)
 
 		if err := svc.Start(); err != nil {
@@ -85,11 +129,33 @@ func main() {
 	// Wait a bit for service to start
 	time.Sleep(2 * time.Second)
 
+	// Client for other members' APIs (presents this node's certificate with TLS)
+	apiClient, err := service.NewHTTPClient(cfg.TLS, cfg.RequestTimeout)
+	if err != nil {
+		log.Fatalf("Failed to create API client: %v", err)
+	}
+
+	// Ask the running cluster to add this node
+	if *join != "" {
+		joinURL := *join
+		if !strings.Contains(joinURL, "://") {
+			if cfg.TLS.Enabled() {
+				joinURL = "https://" + joinURL
+			} else {
+				joinURL = "http://" + joinURL
+			}
+		}
+		if err := joinCluster(apiClient, joinURL, *joinKey, cfg.NodeID, cfg.NodeAddr, *joinNonvoter); err != nil {
+			log.Fatalf("Failed to join cluster via %s: %v", *join, err)
+		}
+		log.Printf("Joined cluster via %s", *join)
+	}
+
 	// Add simple CLI interface like the working code
 	raft := svc.GetRaft()
 	scanner := bufio.NewScanner(os.Stdin)
 	fmt.Printf("\n=== LMS Service CLI ===\n")
-	fmt.Printf("Node %s running. Enter commands:\n", *nodeID)
+	fmt.Printf("Node %s running. Enter commands:\n", cfg.NodeID)
 	fmt.Printf("  - Type a message to send to cluster\n")
 	fmt.Printf("  - Type 'list' to see all logs\n")
 	fmt.Printf("  - Type 'health' to check status\n")
@@ -108,17 +174,13 @@ func main() {
 			if !isLeader && leaderAddr != "" {
 				// Not leader - query leader via HTTP API
 				leaderAPIAddr := ""
-				for _, node := range cfg.ClusterNodes {
-					if string(leaderAddr) == node.Address {
-						ip := node.Address[:len(node.Address)-5] // Remove ":7000"
-						leaderAPIAddr = fmt.Sprintf("http://%s:%d", ip, node.APIPort)
-						break
-					}
+				if node := cfg.GetNodeByAddress(string(leaderAddr)); node != nil {
+					leaderAPIAddr = cfg.GetAPIURL(node.ID)
 				}
 				
 				if leaderAPIAddr != "" {
 					fmt.Printf("📋 Querying leader for logs...\n")
-					resp, err := http.Get(leaderAPIAddr + "/list")
+					resp, err := apiClient.Get(leaderAPIAddr + "/list")
 					if err != nil {
 						fmt.Printf("❌ Failed to query leader: %v\n", err)
 						continue
@@ -290,3 +352,39 @@ func main() {
 	}
 }
 
+// joinCluster signs an add request for this node with an admin key and submits it, retrying while the cluster is unavailable
+func joinCluster(client *http.Client, apiURL, keyPath, nodeID, nodeAddr string, nonvoter bool) error {
+	if keyPath == "" {
+		return fmt.Errorf("-join-key is required to sign the join request")
+	}
+	adminKey, err := service.LoadECPrivateKeyPEM(keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load join key %s: %v", keyPath, err)
+	}
+
+	op := service.MembershipAddVoter
+	if nonvoter {
+		op = service.MembershipAddNonvoter
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < 5; attempt++ {
+		if attempt > 0 {
+			time.Sleep(2 * time.Second)
+		}
+		req := &service.MembershipRequest{
+			Op:        op,
+			ID:        nodeID,
+			Address:   nodeAddr,
+			Timestamp: time.Now().Unix(),
+		}
+		if err := service.SignMembershipRequest(req, adminKey); err != nil {
+			return err
+		}
+		if lastErr = service.JoinCluster(client, apiURL, req); lastErr == nil {
+			return nil
+		}
+		log.Printf("Join attempt %d failed: %v", attempt+1, lastErr)
+	}
+	return lastErr
+}
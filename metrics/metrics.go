@@ -0,0 +1,335 @@
+// Package metrics exposes counters, gauges and histograms in the Prometheus text format for the
+// Raft nodes, the HSM server and the explorer
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the latency histogram buckets in seconds (1ms to 10s)
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Default is the registry of the package-level constructors, always served by Handler
+var Default = NewRegistry()
+
+// Registry holds metric families by name
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]family
+}
+
+// family is one named metric with its samples
+type family interface {
+	help() string
+	kind() string
+	write(b *strings.Builder, name string)
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]family)}
+}
+
+func (r *Registry) register(name string, f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.families[name]; exists {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.families[name] = f
+}
+
+// write writes every family of the registry in the Prometheus text format
+func (r *Registry) write(b *strings.Builder) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	families := make(map[string]family, len(r.families))
+	for name, f := range r.families {
+		names = append(names, name)
+		families[name] = f
+	}
+	r.mu.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		f := families[name]
+		fmt.Fprintf(b, "# HELP %s %s\n", name, escapeHelp(f.help()))
+		fmt.Fprintf(b, "# TYPE %s %s\n", name, f.kind())
+		f.write(b, name)
+	}
+}
+
+// Handler serves the Default registry followed by extra registries (e.g. one bound to a server instance)
+func Handler(extra ...*Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		Default.write(&b)
+		for _, registry := range extra {
+			registry.write(&b)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(b.String()))
+	})
+}
+
+// vec holds one value per label value combination
+type vec[V any] struct {
+	helpText string
+	labels   []string
+	mu       sync.Mutex
+	values   map[string]V
+	keys     map[string][]string
+}
+
+func newVec[V any](help string, labels []string) vec[V] {
+	return vec[V]{helpText: help, labels: labels, values: make(map[string]V), keys: make(map[string][]string)}
+}
+
+func (v *vec[V]) help() string { return v.helpText }
+
+// with returns the value for labelValues, creating it with create (caller must hold the lock)
+func (v *vec[V]) with(labelValues []string, create func() V) V {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: got %d label values for labels %v", len(labelValues), v.labels))
+	}
+	key := strings.Join(labelValues, "\xff")
+	value, exists := v.values[key]
+	if !exists {
+		value = create()
+		v.values[key] = value
+		v.keys[key] = append([]string(nil), labelValues...)
+	}
+	return value
+}
+
+// sortedKeys returns the label keys in a stable order (caller must hold the lock)
+func (v *vec[V]) sortedKeys() []string {
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec is a monotonically increasing value per label set
+type CounterVec struct {
+	vec[*float64]
+}
+
+// NewCounterVec registers a counter in the Default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+// NewCounterVec registers a counter in the registry
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec[*float64](help, labels)}
+	r.register(name, c)
+	return c
+}
+
+func (c *CounterVec) kind() string { return "counter" }
+
+// Inc adds one to the counter of a label set
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta (>= 0) to the counter of a label set
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.with(labelValues, func() *float64 { return new(float64) }) += delta
+}
+
+func (c *CounterVec) write(b *strings.Builder, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range c.sortedKeys() {
+		writeSample(b, name, c.labels, c.keys[key], "", "", *c.values[key])
+	}
+}
+
+// GaugeVec is a value per label set that can go up and down
+type GaugeVec struct {
+	vec[*float64]
+}
+
+// NewGaugeVec registers a gauge in the Default registry
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+
+// NewGaugeVec registers a gauge in the registry
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec[*float64](help, labels)}
+	r.register(name, g)
+	return g
+}
+
+func (g *GaugeVec) kind() string { return "gauge" }
+
+// Set sets the gauge of a label set
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*g.with(labelValues, func() *float64 { return new(float64) }) = value
+}
+
+func (g *GaugeVec) write(b *strings.Builder, name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range g.sortedKeys() {
+		writeSample(b, name, g.labels, g.keys[key], "", "", *g.values[key])
+	}
+}
+
+// GaugeFunc reads its samples at scrape time, for values owned by another component (Raft, the FSM, a key store)
+type GaugeFunc struct {
+	helpText string
+	labels   []string
+	collect  func(set func(value float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a gauge whose samples collect reports through set on every scrape
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(set func(value float64, labelValues ...string))) {
+	r.register(name, &GaugeFunc{helpText: help, labels: labels, collect: collect})
+}
+
+func (g *GaugeFunc) help() string { return g.helpText }
+func (g *GaugeFunc) kind() string { return "gauge" }
+
+func (g *GaugeFunc) write(b *strings.Builder, name string) {
+	type sample struct {
+		labelValues []string
+		value       float64
+	}
+	var samples []sample
+	g.collect(func(value float64, labelValues ...string) {
+		if len(labelValues) != len(g.labels) {
+			panic(fmt.Sprintf("metrics: got %d label values for labels %v", len(labelValues), g.labels))
+		}
+		samples = append(samples, sample{append([]string(nil), labelValues...), value})
+	})
+	sort.SliceStable(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labelValues, "\xff") < strings.Join(samples[j].labelValues, "\xff")
+	})
+	for _, s := range samples {
+		writeSample(b, name, g.labels, s.labelValues, "", "", s.value)
+	}
+}
+
+// HistogramVec counts observations into cumulative buckets per label set
+type HistogramVec struct {
+	vec[*histogram]
+	buckets []float64
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a histogram in the Default registry (nil buckets: DefaultBuckets)
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+// NewHistogramVec registers a histogram in the registry (nil buckets: DefaultBuckets)
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{vec: newVec[*histogram](help, labels), buckets: append([]float64(nil), buckets...)}
+	sort.Float64s(h.buckets)
+	r.register(name, h)
+	return h
+}
+
+func (h *HistogramVec) kind() string { return "histogram" }
+
+// Observe records one value for a label set
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist := h.with(labelValues, func() *histogram { return &histogram{counts: make([]uint64, len(h.buckets))} })
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += value
+}
+
+// ObserveSince records the seconds elapsed since start for a label set
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) write(b *strings.Builder, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range h.sortedKeys() {
+		hist, labelValues := h.values[key], h.keys[key]
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			writeSample(b, name+"_bucket", h.labels, labelValues, "le", formatFloat(bound), float64(cumulative))
+		}
+		writeSample(b, name+"_bucket", h.labels, labelValues, "le", "+Inf", float64(hist.count))
+		writeSample(b, name+"_sum", h.labels, labelValues, "", "", hist.sum)
+		writeSample(b, name+"_count", h.labels, labelValues, "", "", float64(hist.count))
+	}
+}
+
+// writeSample writes one sample line, with an optional extra label (the histogram "le")
+func writeSample(b *strings.Builder, name string, labels, labelValues []string, extraLabel, extraValue string, value float64) {
+	b.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		b.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", label, escapeLabel(labelValues[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", extraLabel, extraValue)
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, registry *Registry) string {
+	t.Helper()
+
+	var b strings.Builder
+	registry.write(&b)
+	return b.String()
+}
+
+func TestRegistry_TextFormat(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("test_requests_total", "Requests by result", "result")
+	requests.Inc("ok")
+	requests.Add(2, "ok")
+	requests.Inc(`bad "quote"`)
+
+	latency := r.NewHistogramVec("test_latency_seconds", "Latency", []float64{0.1, 1}, "phase")
+	latency.Observe(0.05, "sign")
+	latency.Observe(0.5, "sign")
+	latency.Observe(5, "sign")
+
+	r.NewGaugeFunc("test_keys", "Keys by state", []string{"state"}, func(set func(float64, ...string)) {
+		set(3, "active")
+		set(1, "exhausted")
+	})
+
+	out := scrape(t, r)
+	for _, want := range []string{
+		"# HELP test_requests_total Requests by result\n# TYPE test_requests_total counter\n",
+		`test_requests_total{result="ok"} 3`,
+		`test_requests_total{result="bad \"quote\""} 1`,
+		"# TYPE test_latency_seconds histogram\n",
+		`test_latency_seconds_bucket{phase="sign",le="0.1"} 1`,
+		`test_latency_seconds_bucket{phase="sign",le="1"} 2`,
+		`test_latency_seconds_bucket{phase="sign",le="+Inf"} 3`,
+		`test_latency_seconds_sum{phase="sign"} 5.55`,
+		`test_latency_seconds_count{phase="sign"} 3`,
+		`test_keys{state="active"} 3`,
+		`test_keys{state="exhausted"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Missing %q in:\n%s", want, out)
+		}
+	}
+
+	// Families are sorted by name
+	if strings.Index(out, "test_keys") > strings.Index(out, "test_latency_seconds") {
+		t.Error("Expected families in name order")
+	}
+}
+
+func TestRegistry_Misuse(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounterVec("test_total", "Test", "a")
+
+	assertPanics(t, "duplicate name", func() { r.NewGaugeVec("test_total", "Test") })
+	assertPanics(t, "wrong label count", func() { counter.Inc("x", "y") })
+}
+
+func assertPanics(t *testing.T, what string, fn func()) {
+	t.Helper()
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s: expected a panic", what)
+		}
+	}()
+	fn()
+}
+
+func TestHandler(t *testing.T) {
+	extra := NewRegistry()
+	extra.NewGaugeVec("test_up", "Up").Set(1)
+
+	w := httptest.NewRecorder()
+	Handler(extra).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "test_up 1\n") {
+		t.Errorf("Extra registry not served:\n%s", w.Body.String())
+	}
+}
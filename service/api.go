@@ -1,12 +1,15 @@
 package service
 
 import (
+	"crypto/ecdsa"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	
 	"github.com/hashicorp/raft"
+	"github.com/verifiable-state-chains/lms/metrics"
 	"github.com/verifiable-state-chains/lms/models"
 	"github.com/verifiable-state-chains/lms/validation"
 )
@@ -18,6 +21,11 @@ type APIServer struct {
 	fsm           FSMInterface
 	config        *Config
 	validator     *validation.AttestationValidator
+	treeHeadKey   *ecdsa.PrivateKey // Signs transparency log tree heads
+
+	// Last term in which a linearizable read committed a barrier
+	readBarrierMu   sync.Mutex
+	readBarrierTerm uint64
 }
 
 // FSMInterface defines the interface our FSM must implement
@@ -47,6 +55,8 @@ func NewAPIServer(r *raft.Raft, fsm FSMInterface, cfg *Config, genesisHash strin
 		fsm:       fsm,
 		config:    cfg,
 		validator: validator,
+
+		treeHeadKey: loadTreeHeadKey(cfg.TreeHeadKeyPath),
 	}
 }
 
@@ -65,11 +75,34 @@ func (s *APIServer) Start() error {
 	mux.HandleFunc("/key/", s.handleKeyIndex) // /key/<key_id>/index (backward compatibility)
 	mux.HandleFunc("/pubkey_hash/", s.handlePubkeyHashIndex) // /pubkey_hash/<pubkey_hash>/index (Phase B)
 	mux.HandleFunc("/commit_index", s.handleCommitIndex)
+	mux.HandleFunc("/commit_batch", s.handleCommitBatch)   // Commit several entries atomically as one Raft log entry
+	mux.HandleFunc("/reserve_index", s.handleReserveIndex) // Server-assigned next index for a pubkey_hash
+	mux.HandleFunc("/reserve_range", s.handleReserveRange) // Lease a block of indices to an HSM instance
+	mux.HandleFunc("/return_range", s.handleReturnRange)   // Return a lease with used indices
+	mux.HandleFunc("/leases", s.handleLeases)              // List index leases
 	mux.HandleFunc("/all_entries", s.handleAllEntries) // Get all entries ordered by Raft log index
+	mux.HandleFunc("/watch", s.handleWatch)             // Server-sent events stream of committed entries
+	mux.HandleFunc("/attestation_keys", s.handleAttestationKeys) // Attestation key registry (list / register / rotate / revoke)
+	mux.HandleFunc("/sth", s.handleSignedTreeHead)                 // Signed transparency log tree head
+	mux.HandleFunc("/proof/inclusion", s.handleInclusionProof)     // ?hash=<entry hash>[&tree_size=<n>]
+	mux.HandleFunc("/proof/consistency", s.handleConsistencyProof) // ?from=<m>[&to=<n>]
+	mux.HandleFunc("/proof/state", s.handleStateProof)             // ?pubkey_hash=<pubkey_hash> (latest index or never used)
+	mux.HandleFunc("/cluster/members", s.handleClusterMembers)     // Raft configuration (list / admin-signed add, promote, demote, remove)
+	mux.Handle("/metrics", metrics.Handler(s.newMetricsRegistry()))  // Prometheus metrics
 	
 	addr := fmt.Sprintf(":%d", s.config.APIPort)
+
+	if s.config.TLS.Enabled() {
+		tlsConfig, err := s.config.apiTLSConfig()
+		if err != nil {
+			return fmt.Errorf("failed to load API TLS configuration: %v", err)
+		}
+		server := &http.Server{Addr: addr, Handler: mux, TLSConfig: tlsConfig}
+		log.Printf("Starting HTTPS API server on %s (client certificates: %s)", addr, s.config.TLS.APIClientAuth)
+		return server.ListenAndServeTLS("", "")
+	}
+
 	log.Printf("Starting API server on %s", addr)
-	
 	return http.ListenAndServe(addr, mux)
 }
 
@@ -127,9 +160,8 @@ func (s *APIServer) handleLatestHead(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// If not leader, forward the request
-	if !s.forwarder.IsLeader() {
-		s.forwarder.ForwardRequest(w, r, "/latest-head")
+	// Serve locally or forward, depending on the read consistency level
+	if !s.routeRead(w, r, "/latest-head") {
 		return
 	}
 	
@@ -196,9 +228,8 @@ func (s *APIServer) handleList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// If not leader, forward the request
-	if !s.forwarder.IsLeader() {
-		s.forwarder.ForwardRequest(w, r, "/list")
+	// Serve locally or forward, depending on the read consistency level
+	if !s.routeRead(w, r, "/list") {
 		return
 	}
 	
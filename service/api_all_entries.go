@@ -2,35 +2,73 @@ package service
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/verifiable-state-chains/lms/fsm"
 )
 
-// handleAllEntries handles requests for all entries from Raft
-// URL format: /all_entries?limit=N
+// handleAllEntries handles requests for committed entries from Raft, one page at a time
+// URL format: /all_entries?limit=N&cursor=C&order=desc|asc&key_id=K&pubkey_hash=P&record_type=T&from_raft_index=A&to_raft_index=B
+// next_cursor in the response fetches the following page; it is absent on the last page.
 func (s *APIServer) handleAllEntries(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// If not leader, forward the request
-	if !s.forwarder.IsLeader() {
-		s.forwarder.ForwardRequest(w, r, r.URL.Path)
+	// Serve locally or forward, depending on the read consistency level
+	if !s.routeRead(w, r, r.URL.Path) {
 		return
 	}
 
 	// Get limit from query parameter (default 10)
-	limit := 10
-	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
-		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
-			limit = parsedLimit
-			if limit > 1000 {
-				limit = 1000 // Max limit
-			}
+	limit := parseLimit(r, 10)
+
+	// Filtered, cursor-paginated query over the FSM's secondary indexes
+	if queryFSM, ok := s.fsm.(entryQueryFSM); ok {
+		query, err := parseEntryQuery(r)
+		if err != nil {
+			s.writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		query.Limit = limit
+		query.Descending = true
+		switch order := r.URL.Query().Get("order"); order {
+		case "", "desc":
+		case "asc":
+			query.Descending = false
+		default:
+			s.writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid order %q: expected asc or desc", order))
+			return
 		}
+
+		page, err := queryFSM.QueryEntries(query)
+		if err != nil {
+			s.writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		entries := make([]map[string]interface{}, len(page.Entries))
+		for i, item := range page.Entries {
+			entries[i] = entryResponse(item.Entry, item.RaftIndex)
+		}
+
+		response := map[string]interface{}{
+			"success": true,
+			"entries": entries,
+			"count":   len(entries),
+			"limit":   limit,
+		}
+		if page.NextCursor != "" {
+			response["next_cursor"] = page.NextCursor
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
 	}
 
 	// Get all entries from FSM (ordered by Raft log index, newest first)
@@ -45,17 +83,7 @@ func (s *APIServer) handleAllEntries(w http.ResponseWriter, r *http.Request) {
 		// Convert to response format
 		entries := make([]map[string]interface{}, len(entriesWithIndex))
 		for i, item := range entriesWithIndex {
-			entries[i] = map[string]interface{}{
-				"key_id":        item.Entry.KeyID,
-				"pubkey_hash":   item.Entry.PubkeyHash,
-				"index":         item.Entry.Index,
-				"previous_hash": item.Entry.PreviousHash,
-				"hash":          item.Entry.Hash,
-				"signature":     item.Entry.Signature,
-				"public_key":    item.Entry.PublicKey,
-				"record_type":   item.Entry.RecordType,
-				"raft_index":    item.RaftIndex,
-			}
+			entries[i] = entryResponse(item.Entry, item.RaftIndex)
 		}
 
 		response := map[string]interface{}{
@@ -80,3 +108,63 @@ func (s *APIServer) handleAllEntries(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// entryQueryFSM is implemented by FSMs with indexed, paginated entry queries
+type entryQueryFSM interface {
+	QueryEntries(fsm.EntryQuery) (*fsm.EntryPage, error)
+}
+
+// parseLimit reads the limit query parameter (invalid or missing: defaultLimit, capped at fsm.MaxQueryLimit)
+func parseLimit(r *http.Request, defaultLimit int) int {
+	limit := defaultLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
+			limit = parsedLimit
+		}
+	}
+	if limit > fsm.MaxQueryLimit {
+		limit = fsm.MaxQueryLimit // Max limit
+	}
+	return limit
+}
+
+// parseEntryQuery reads the cursor and filter query parameters of an entry listing
+func parseEntryQuery(r *http.Request) (fsm.EntryQuery, error) {
+	params := r.URL.Query()
+	query := fsm.EntryQuery{
+		KeyID:      params.Get("key_id"),
+		PubkeyHash: strings.ReplaceAll(params.Get("pubkey_hash"), " ", "+"), // Base64 "+" arrives as a space when not escaped
+		RecordType: params.Get("record_type"),
+		Cursor:     params.Get("cursor"),
+	}
+	for _, bound := range []struct {
+		name  string
+		value *uint64
+	}{
+		{"from_raft_index", &query.FromRaftIndex},
+		{"to_raft_index", &query.ToRaftIndex},
+	} {
+		if str := params.Get(bound.name); str != "" {
+			value, err := strconv.ParseUint(str, 10, 64)
+			if err != nil {
+				return query, fmt.Errorf("invalid %s %q", bound.name, str)
+			}
+			*bound.value = value
+		}
+	}
+	return query, nil
+}
+
+// entryResponse is the JSON form of a committed entry, shared by /all_entries and /watch
+func entryResponse(entry *fsm.KeyIndexEntry, raftIndex uint64) map[string]interface{} {
+	return map[string]interface{}{
+		"key_id":        entry.KeyID,
+		"pubkey_hash":   entry.PubkeyHash,
+		"index":         entry.Index,
+		"previous_hash": entry.PreviousHash,
+		"hash":          entry.Hash,
+		"signature":     entry.Signature,
+		"public_key":    entry.PublicKey,
+		"record_type":   entry.RecordType,
+		"raft_index":    raftIndex,
+	}
+}
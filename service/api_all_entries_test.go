@@ -0,0 +1,128 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+)
+
+// newQueryTestServer commits a chain of n+1 entries for key_a and a create for key_b
+func newQueryTestServer(t *testing.T, n int) *APIServer {
+	t.Helper()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	combinedFSM, err := fsm.NewCombinedFSM("genesis_hash_123", "")
+	if err != nil {
+		t.Fatalf("Failed to create FSM: %v", err)
+	}
+	combinedFSM.PinAttestationKey(&key.PublicKey)
+	r := newTestRaft(t, combinedFSM, true)
+	s := newTestReadServer(r, DefaultConfig())
+	s.fsm = combinedFSM
+
+	entry := newSignedCommitRequest(t, key, "key_a", 0, fsm.GenesisHash, "create")
+	entries := []CommitIndexRequest{entry}
+	for i := 1; i <= n; i++ {
+		entry = newSignedCommitRequest(t, key, "key_a", uint64(i), entry.Hash, "sign")
+		entries = append(entries, entry)
+	}
+	entries = append(entries, newSignedCommitRequest(t, key, "key_b", 0, fsm.GenesisHash, "create"))
+	for _, entry := range entries {
+		if status, response := postCommitBatch(t, s, CommitBatchRequest{Entries: []CommitIndexRequest{entry}}); status != http.StatusOK {
+			t.Fatalf("Failed to commit: %+v", response)
+		}
+	}
+	return s
+}
+
+// getJSON serves a GET request and decodes the JSON response
+func getJSON(t *testing.T, handler http.HandlerFunc, url string) (int, map[string]interface{}) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, url, nil))
+	var response map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("%s: failed to decode response: %v", url, err)
+	}
+	return w.Code, response
+}
+
+func TestAllEntries_CursorAndFilters(t *testing.T) {
+	s := newQueryTestServer(t, 3)
+
+	// Newest first by default, paged through next_cursor
+	var indices []float64
+	url := "/all_entries?limit=2&key_id=key_a"
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("Pagination does not terminate")
+		}
+		status, response := getJSON(t, s.handleAllEntries, url)
+		if status != http.StatusOK {
+			t.Fatalf("%s: status %d: %v", url, status, response)
+		}
+		for _, entry := range response["entries"].([]interface{}) {
+			indices = append(indices, entry.(map[string]interface{})["index"].(float64))
+		}
+		cursor, ok := response["next_cursor"].(string)
+		if !ok {
+			break
+		}
+		url = "/all_entries?limit=2&key_id=key_a&cursor=" + cursor
+	}
+	if len(indices) != 4 || indices[0] != 3 || indices[3] != 0 {
+		t.Errorf("Expected key_a indices 3..0 across pages, got %v", indices)
+	}
+
+	if _, response := getJSON(t, s.handleAllEntries, "/all_entries?record_type=create&order=asc"); response["count"] != float64(2) {
+		t.Errorf("Expected 2 create records, got %v", response["count"])
+	}
+
+	for _, url := range []string{"/all_entries?cursor=bogus", "/all_entries?order=sideways", "/all_entries?from_raft_index=x"} {
+		if status, _ := getJSON(t, s.handleAllEntries, url); status != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", url, status)
+		}
+	}
+}
+
+func TestKeyChain_PagesVerifyAcrossBoundaries(t *testing.T) {
+	s := newQueryTestServer(t, 4)
+
+	url := "/key/key_a/chain?limit=2"
+	count := 0
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("Pagination does not terminate")
+		}
+		status, response := getJSON(t, s.handleKeyIndex, url)
+		if status != http.StatusOK {
+			t.Fatalf("%s: status %d: %v", url, status, response)
+		}
+		verification := response["verification"].(map[string]interface{})
+		if verification["valid"] != true {
+			t.Errorf("Page %d: chain not verified: %v", pages, verification)
+		}
+		chain := response["chain"].([]interface{})
+		first := chain[0].(map[string]interface{})
+		if first["chain_valid"] != true || (pages == 0) != (first["is_genesis"] == true) {
+			t.Errorf("Page %d: first entry not linked to the previous page: %v", pages, first)
+		}
+		count += len(chain)
+
+		cursor, ok := response["next_cursor"].(string)
+		if !ok {
+			break
+		}
+		url = "/key/key_a/chain?limit=2&cursor=" + cursor
+	}
+	if count != 5 {
+		t.Errorf("Expected 5 chain entries across pages, got %d", count)
+	}
+}
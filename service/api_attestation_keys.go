@@ -0,0 +1,129 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+)
+
+// handleAttestationKeys lists the attestation key registry (GET) or submits a registry command (POST)
+// POST body is an fsm.RegistryCommand carrying the admin quorum signatures; the first is the bootstrap command
+func (s *APIServer) handleAttestationKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleListAttestationKeys(w, r)
+	case http.MethodPost:
+		s.handleRegistryCommand(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *APIServer) handleListAttestationKeys(w http.ResponseWriter, r *http.Request) {
+	// Serve locally or forward, depending on the read consistency level
+	if !s.routeRead(w, r, "/attestation_keys") {
+		return
+	}
+
+	registryFSM, ok := s.fsm.(interface {
+		GetAttestationKeys() ([]fsm.AttestationKeyRecord, uint64)
+	})
+	if !ok {
+		response := map[string]interface{}{
+			"success": false,
+			"error":   "FSM does not support the attestation key registry",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotImplemented)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	keys, sequence := registryFSM.GetAttestationKeys()
+	response := map[string]interface{}{
+		"success":  true,
+		"keys":     keys,
+		"sequence": sequence,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *APIServer) handleRegistryCommand(w http.ResponseWriter, r *http.Request) {
+	// If not leader, forward the request
+	if !s.forwarder.IsLeader() {
+		s.forwarder.ForwardRequest(w, r, "/attestation_keys")
+		return
+	}
+
+	var cmd fsm.RegistryCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		response := map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("Invalid request: %v", err),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if cmd.Op == "" || cmd.PublicKey == "" || len(cmd.AdminSignatures) == 0 {
+		response := map[string]interface{}{
+			"success": false,
+			"error":   "registry_op, public_key and admin_signatures are required",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Quorum and sequence are checked in Apply so every node reaches the same decision
+	cmdData, err := fsm.EncodeCommand(fsm.CommandRegistry, cmd)
+	if err != nil {
+		response := map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("Failed to serialize command: %v", err),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	future := s.applyToRaft(fsm.CommandRegistry, cmdData)
+	if err := future.Error(); err != nil {
+		response := map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("Raft apply failed: %v", err),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	result := future.Response()
+	if resultStr, ok := result.(string); ok && strings.HasPrefix(resultStr, "Error:") {
+		response := map[string]interface{}{
+			"success": false,
+			"error":   resultStr,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":    true,
+		"result":     result,
+		"raft_index": future.Index(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
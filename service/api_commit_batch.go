@@ -0,0 +1,145 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+)
+
+// CommitBatchRequest commits several signed entries atomically, in order, as one Raft log entry
+type CommitBatchRequest struct {
+	Entries []CommitIndexRequest `json:"entries"`
+}
+
+// CommitBatchResponse is the response from committing a batch
+// Committed is true only if every entry was committed; otherwise none was.
+type CommitBatchResponse struct {
+	Success   bool                   `json:"success"`
+	Committed bool                   `json:"committed"`
+	RaftIndex uint64                 `json:"raft_index,omitempty"`
+	Results   []fsm.BatchEntryResult `json:"results,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+// handleCommitBatch handles requests to commit a batch of index entries with all-or-nothing semantics
+func (s *APIServer) handleCommitBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// If not leader, forward the request
+	if !s.forwarder.IsLeader() {
+		s.forwarder.ForwardRequest(w, r, "/commit_batch")
+		return
+	}
+
+	writeResponse := func(status int, response CommitBatchResponse) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	}
+
+	var req CommitBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeResponse(http.StatusBadRequest, CommitBatchResponse{Error: fmt.Sprintf("Invalid request: %v", err)})
+		return
+	}
+	if len(req.Entries) == 0 {
+		writeResponse(http.StatusBadRequest, CommitBatchResponse{Error: "entries is required"})
+		return
+	}
+	if len(req.Entries) > fsm.MaxBatchEntries {
+		writeResponse(http.StatusBadRequest, CommitBatchResponse{
+			Error: fmt.Sprintf("batch has %d entries (max %d)", len(req.Entries), fsm.MaxBatchEntries),
+		})
+		return
+	}
+
+	// Early rejection of malformed or unauthorized entries, reported per entry (Apply re-checks on every node)
+	cmd := fsm.CommitBatchCommand{Entries: make([]fsm.KeyIndexEntry, len(req.Entries))}
+	results := make([]fsm.BatchEntryResult, len(req.Entries))
+	status := http.StatusOK
+	for i := range req.Entries {
+		entryReq := &req.Entries[i]
+		results[i] = fsm.BatchEntryResult{
+			Position:   i,
+			KeyID:      entryReq.KeyID,
+			PubkeyHash: entryReq.PubkeyHash,
+			Index:      entryReq.Index,
+			Hash:       entryReq.Hash,
+		}
+
+		entry, err := newCommitEntry(entryReq)
+		if err != nil {
+			status = http.StatusBadRequest
+		} else if err = s.verifyCommitEntry(entry); err != nil && status == http.StatusOK {
+			status = http.StatusUnauthorized
+		}
+		if err != nil {
+			results[i].Status = fsm.BatchEntryRejected
+			results[i].Error = err.Error()
+			continue
+		}
+		cmd.Entries[i] = *entry
+	}
+	if status != http.StatusOK {
+		for i := range results {
+			if results[i].Status == "" {
+				results[i].Status = fsm.BatchEntryAborted
+			}
+		}
+		recordBatchRejections(results)
+		writeResponse(status, CommitBatchResponse{Results: results, Error: "batch rejected: see per-entry results"})
+		return
+	}
+
+	cmdData, err := fsm.EncodeCommand(fsm.CommandCommitBatch, cmd)
+	if err != nil {
+		writeResponse(http.StatusInternalServerError, CommitBatchResponse{Error: fmt.Sprintf("Failed to serialize command: %v", err)})
+		return
+	}
+
+	future := s.applyToRaft(fsm.CommandCommitBatch, cmdData)
+	if err := future.Error(); err != nil {
+		writeResponse(http.StatusInternalServerError, CommitBatchResponse{Error: fmt.Sprintf("Raft apply failed: %v", err)})
+		return
+	}
+
+	switch result := future.Response().(type) {
+	case *fsm.CommitBatchResult:
+		response := CommitBatchResponse{
+			Success:   result.Committed,
+			Committed: result.Committed,
+			RaftIndex: result.RaftIndex,
+			Results:   result.Results,
+		}
+		if !result.Committed {
+			recordBatchRejections(result.Results)
+			response.Error = "batch rejected: see per-entry results"
+			writeResponse(http.StatusBadRequest, response)
+			return
+		}
+		writeResponse(http.StatusOK, response)
+	case string:
+		if strings.HasPrefix(result, "Error:") {
+			writeResponse(http.StatusBadRequest, CommitBatchResponse{Error: result})
+			return
+		}
+		writeResponse(http.StatusInternalServerError, CommitBatchResponse{Error: fmt.Sprintf("unexpected FSM response: %s", result)})
+	default:
+		writeResponse(http.StatusInternalServerError, CommitBatchResponse{Error: fmt.Sprintf("unexpected FSM response: %v", result)})
+	}
+}
+
+// recordBatchRejections counts the rejected entries of a batch (aborted entries were valid)
+func recordBatchRejections(results []fsm.BatchEntryResult) {
+	for _, result := range results {
+		if result.Status == fsm.BatchEntryRejected {
+			recordRejection(result.Error)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+)
+
+// newSignedCommitRequest signs an entry as the HSM server does and returns its commit request
+func newSignedCommitRequest(t *testing.T, key *ecdsa.PrivateKey, keyID string, index uint64, previousHash, recordType string) CommitIndexRequest {
+	t.Helper()
+
+	entry := fsm.KeyIndexEntry{
+		KeyID:        keyID,
+		PubkeyHash:   fsm.ComputePubkeyHash([]byte("lms-pubkey-" + keyID)),
+		Index:        index,
+		PreviousHash: previousHash,
+		RecordType:   recordType,
+	}
+	if recordType == "create" {
+		entry.LMSParams = &fsm.LMSParams{Levels: 1, LmType: []int{9}, OtsType: []int{1}} // H25
+	}
+	if err := fsm.SignEntry(&entry, key); err != nil {
+		t.Fatalf("Failed to sign entry: %v", err)
+	}
+	hash, err := entry.ComputeHash()
+	if err != nil {
+		t.Fatalf("Failed to compute hash: %v", err)
+	}
+	return CommitIndexRequest{
+		KeyID:            entry.KeyID,
+		PubkeyHash:       entry.PubkeyHash,
+		Index:            entry.Index,
+		PreviousHash:     entry.PreviousHash,
+		Hash:             hash,
+		Signature:        entry.Signature,
+		PublicKey:        entry.PublicKey,
+		RecordType:       entry.RecordType,
+		SignatureVersion: entry.SignatureVersion,
+		LMSParams:        entry.LMSParams,
+	}
+}
+
+func postCommitBatch(t *testing.T, s *APIServer, req CommitBatchRequest) (int, CommitBatchResponse) {
+	t.Helper()
+
+	body, _ := json.Marshal(req)
+	w := httptest.NewRecorder()
+	s.handleCommitBatch(w, httptest.NewRequest(http.MethodPost, "/commit_batch", bytes.NewReader(body)))
+
+	var response CommitBatchResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return w.Code, response
+}
+
+func TestHandleCommitBatch(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	combinedFSM, err := fsm.NewCombinedFSM("genesis_hash_123", "")
+	if err != nil {
+		t.Fatalf("Failed to create FSM: %v", err)
+	}
+	combinedFSM.PinAttestationKey(&key.PublicKey)
+	r := newTestRaft(t, combinedFSM, true)
+	s := newTestReadServer(r, DefaultConfig())
+	s.fsm = combinedFSM
+
+	createA := newSignedCommitRequest(t, key, "key_a", 0, fsm.GenesisHash, "create")
+	createB := newSignedCommitRequest(t, key, "key_b", 0, fsm.GenesisHash, "create")
+
+	// An entry with a bad signature rejects the whole batch before Raft
+	forged := newSignedCommitRequest(t, key, "key_c", 0, fsm.GenesisHash, "create")
+	forged.Signature = createA.Signature
+	lastIndex := r.LastIndex()
+	status, response := postCommitBatch(t, s, CommitBatchRequest{Entries: []CommitIndexRequest{createA, forged}})
+	if status != http.StatusUnauthorized || response.Committed {
+		t.Fatalf("Expected 401 without commit, got %d: %+v", status, response)
+	}
+	if response.Results[0].Status != fsm.BatchEntryAborted || response.Results[1].Status != fsm.BatchEntryRejected {
+		t.Errorf("Unexpected per-entry results: %+v", response.Results)
+	}
+	if r.LastIndex() != lastIndex {
+		t.Error("A rejected batch must not reach the Raft log")
+	}
+
+	// A valid batch across two keys commits as one Raft log entry
+	status, response = postCommitBatch(t, s, CommitBatchRequest{Entries: []CommitIndexRequest{createA, createB}})
+	if status != http.StatusOK || !response.Committed {
+		t.Fatalf("Expected the batch to commit, got %d: %+v", status, response)
+	}
+	if r.LastIndex() != lastIndex+1 || response.RaftIndex != lastIndex+1 {
+		t.Errorf("Expected one Raft log entry at %d, got last index %d, raft_index %d", lastIndex+1, r.LastIndex(), response.RaftIndex)
+	}
+	for _, keyID := range []string{"key_a", "key_b"} {
+		if index, exists := combinedFSM.GetKeyIndex(keyID); !exists || index != 0 {
+			t.Errorf("%s: expected index 0, got %d (exists=%v)", keyID, index, exists)
+		}
+	}
+
+	// Replaying the batch conflicts with the committed chain heads and commits nothing
+	status, response = postCommitBatch(t, s, CommitBatchRequest{Entries: []CommitIndexRequest{createA, createB}})
+	if status != http.StatusBadRequest || response.Committed || response.Results[0].Status != fsm.BatchEntryRejected {
+		t.Fatalf("Expected a rejected replay, got %d: %+v", status, response)
+	}
+}
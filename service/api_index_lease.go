@@ -0,0 +1,138 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+)
+
+// handleReserveRange leases a contiguous range of indices for a pubkey_hash to an HSM instance
+// Body: fsm.RangeLeaseRequest signed with the attestation key
+func (s *APIServer) handleReserveRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// If not leader, forward the request
+	if !s.forwarder.IsLeader() {
+		s.forwarder.ForwardRequest(w, r, "/reserve_range")
+		return
+	}
+
+	var req fsm.RangeLeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeLeaseError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if req.KeyID == "" || req.PubkeyHash == "" || req.PreviousHash == "" || req.HSMInstance == "" || req.Count == 0 {
+		s.writeLeaseError(w, http.StatusBadRequest, "key_id, pubkey_hash, previous_hash, hsm_instance and count are required")
+		return
+	}
+
+	s.applyLeaseCommand(w, fsm.CommandReserveRange, fsm.ReserveRangeCommand{Request: req})
+}
+
+// handleReturnRange returns a lease and reports the used indices; the rest are recorded as discarded
+// Body: fsm.RangeReturnRequest signed with the attestation key
+func (s *APIServer) handleReturnRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// If not leader, forward the request
+	if !s.forwarder.IsLeader() {
+		s.forwarder.ForwardRequest(w, r, "/return_range")
+		return
+	}
+
+	var req fsm.RangeReturnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeLeaseError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if req.LeaseID == "" || req.HSMInstance == "" {
+		s.writeLeaseError(w, http.StatusBadRequest, "lease_id and hsm_instance are required")
+		return
+	}
+
+	s.applyLeaseCommand(w, fsm.CommandReturnRange, fsm.ReturnRangeCommand{Request: req})
+}
+
+// handleLeases lists index leases
+// Query params: pubkey_hash (optional), active=true to list only outstanding leases
+func (s *APIServer) handleLeases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Serve locally or forward, depending on the read consistency level
+	if !s.routeRead(w, r, "/leases") {
+		return
+	}
+
+	leaseFSM, ok := s.fsm.(interface {
+		GetLeases(pubkeyHash string, activeOnly bool) []*fsm.IndexLease
+	})
+	if !ok {
+		s.writeLeaseError(w, http.StatusNotImplemented, "FSM does not support index leases")
+		return
+	}
+
+	leases := leaseFSM.GetLeases(r.URL.Query().Get("pubkey_hash"), r.URL.Query().Get("active") == "true")
+	response := map[string]interface{}{
+		"success": true,
+		"leases":  leases,
+		"count":   len(leases),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// applyLeaseCommand applies a lease command through Raft and writes the resulting lease
+func (s *APIServer) applyLeaseCommand(w http.ResponseWriter, cmdType fsm.CommandType, cmd interface{}) {
+	cmdData, err := fsm.EncodeCommand(cmdType, cmd)
+	if err != nil {
+		s.writeLeaseError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to serialize command: %v", err))
+		return
+	}
+
+	future := s.applyToRaft(cmdType, cmdData)
+	if err := future.Error(); err != nil {
+		s.writeLeaseError(w, http.StatusInternalServerError, fmt.Sprintf("Raft apply failed: %v", err))
+		return
+	}
+
+	switch result := future.Response().(type) {
+	case *fsm.IndexLease:
+		response := map[string]interface{}{
+			"success": true,
+			"lease":   result,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	case string:
+		if strings.HasPrefix(result, "Error:") {
+			s.writeLeaseError(w, http.StatusBadRequest, result)
+			return
+		}
+		s.writeLeaseError(w, http.StatusInternalServerError, fmt.Sprintf("unexpected lease result: %s", result))
+	default:
+		s.writeLeaseError(w, http.StatusInternalServerError, "FSM does not support index leases")
+	}
+}
+
+func (s *APIServer) writeLeaseError(w http.ResponseWriter, status int, msg string) {
+	response := map[string]interface{}{
+		"success": false,
+		"error":   msg,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
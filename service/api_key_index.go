@@ -23,9 +23,8 @@ func (s *APIServer) handleKeyIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// If not leader, forward the request
-	if !s.forwarder.IsLeader() {
-		s.forwarder.ForwardRequest(w, r, r.URL.Path)
+	// Serve locally or forward, depending on the read consistency level
+	if !s.routeRead(w, r, r.URL.Path) {
 		return
 	}
 
@@ -93,8 +92,12 @@ func (s *APIServer) handleKeyIndex(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Single or no pubkey_hash - build chain (limit to top 10 entries)
-		chainEntries, verification := s.buildChainFromRaftLog(keyID, 10)
+		// Single or no pubkey_hash - build one page of the chain (10 entries unless limit is given)
+		chainEntries, verification, nextCursor, err := s.buildChainFromRaftLog(keyID, parseLimit(r, 10), r.URL.Query().Get("cursor"))
+		if err != nil {
+			s.writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 
 		if len(chainEntries) == 0 {
 			response := map[string]interface{}{
@@ -118,6 +121,9 @@ func (s *APIServer) handleKeyIndex(w http.ResponseWriter, r *http.Request) {
 			"count":        len(chainEntries),
 			"verification": verification,
 		}
+		if nextCursor != "" {
+			response["next_cursor"] = nextCursor
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 		return
@@ -151,11 +157,11 @@ func (s *APIServer) handleKeyIndex(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// buildChainFromRaftLog builds the full hash chain for a key_id by querying through FSM's stored entries first,
-// then falling back to querying log entries if needed
-// Returns the chain entries and verification results
+// buildChainFromRaftLog builds one page of the hash chain for a key_id from the FSM's stored entries
+// Returns the chain entries, verification results and the cursor of the next page ("" on the last page)
 // limit: maximum number of entries to return (0 = no limit)
-func (s *APIServer) buildChainFromRaftLog(keyID string, limit int) ([]map[string]interface{}, *ChainVerification) {
+// cursor: next_cursor of the previous page ("" for the start of the chain)
+func (s *APIServer) buildChainFromRaftLog(keyID string, limit int, cursor string) ([]map[string]interface{}, *ChainVerification, string, error) {
 	chainEntries := make([]map[string]interface{}, 0)
 	verification := &ChainVerification{
 		Valid:      true,
@@ -163,70 +169,89 @@ func (s *APIServer) buildChainFromRaftLog(keyID string, limit int) ([]map[string
 		BreakIndex: -1,
 	}
 
-	// First try to get from FSM's stored entries (if available)
-	if chainFSM, ok := s.fsm.(interface {
+	var entries []*fsm.KeyIndexEntry
+	var previous *fsm.KeyIndexEntry // Chain entry before the page (nil: the page starts at genesis)
+	nextCursor := ""
+
+	if queryFSM, ok := s.fsm.(entryQueryFSM); ok {
+		// Indexed page of the chain, oldest first
+		page, err := queryFSM.QueryEntries(fsm.EntryQuery{KeyID: keyID, Cursor: cursor, Limit: limit})
+		if err != nil {
+			return chainEntries, verification, "", err
+		}
+		for _, item := range page.Entries {
+			entries = append(entries, item.Entry)
+		}
+		if page.Previous != nil {
+			previous = page.Previous.Entry
+		}
+		nextCursor = page.NextCursor
+	} else if chainFSM, ok := s.fsm.(interface {
 		GetKeyChain(string) ([]*fsm.KeyIndexEntry, bool)
 	}); ok {
-		entries, exists := chainFSM.GetKeyChain(keyID)
-		if exists && len(entries) > 0 {
-			// Apply limit if specified
-			if limit > 0 && limit < len(entries) {
-				entries = entries[:limit]
-			}
-
-			// Convert to response format and verify chain integrity
-			// Note: "hash" is the CURRENT hash of THIS entry (computed on all fields except hash itself)
-			// This hash becomes the "previous_hash" for the next entry in the chain
-
-			// Verify chain integrity
-			verification = s.verifyChainIntegrity(entries)
-
-			for i, entry := range entries {
-				entryMap := map[string]interface{}{
-					"key_id":        entry.KeyID,
-					"pubkey_hash":   entry.PubkeyHash, // Phase B: primary identifier
-					"index":         entry.Index,
-					"previous_hash": entry.PreviousHash, // Hash from previous entry (or genesis)
-					"hash":          entry.Hash,         // Hash of THIS entry (will be previous_hash for next)
-					"signature":     entry.Signature,
-					"public_key":    entry.PublicKey,
-				}
-
-				// Add verification status for this entry
-				if i == verification.BreakIndex {
-					entryMap["chain_broken"] = true
-					entryMap["chain_error"] = verification.Error
-				} else if i > 0 {
-					// Verify this entry's previous_hash matches previous entry's hash
-					prevEntry := entries[i-1]
-					if entry.PreviousHash == prevEntry.Hash {
-						entryMap["chain_valid"] = true
-					} else {
-						entryMap["chain_broken"] = true
-						entryMap["chain_error"] = fmt.Sprintf("previous_hash mismatch: expected %s, got %s", prevEntry.Hash, entry.PreviousHash)
-					}
-				} else {
-					// First entry - verify it uses genesis hash
-					if entry.PreviousHash == fsm.GenesisHash {
-						entryMap["chain_valid"] = true
-						entryMap["is_genesis"] = true
-					} else {
-						entryMap["chain_broken"] = true
-						entryMap["chain_error"] = fmt.Sprintf("first entry should have genesis hash, got %s", entry.PreviousHash)
-					}
-				}
-
-				chainEntries = append(chainEntries, entryMap)
-			}
-			return chainEntries, verification
+		if cursor != "" {
+			return chainEntries, verification, "", fmt.Errorf("cursor not supported by FSM")
+		}
+		entries, _ = chainFSM.GetKeyChain(keyID)
+		// Apply limit if specified
+		if limit > 0 && limit < len(entries) {
+			entries = entries[:limit]
 		}
 	}
+	if len(entries) == 0 {
+		return chainEntries, verification, "", nil
+	}
 
-	// Fallback: Since entries might have been committed before keyEntries storage was added,
-	// and Raft replays logs on startup (calling Apply), they should be in keyEntries now.
-	// If not found, return empty (entries don't exist or weren't KeyIndexEntry types)
+	// Convert to response format and verify chain integrity
+	// Note: "hash" is the CURRENT hash of THIS entry (computed on all fields except hash itself)
+	// This hash becomes the "previous_hash" for the next entry in the chain
 
-	return chainEntries, verification
+	// Verify chain integrity
+	verification = s.verifyChainSegment(entries, previous)
+
+	for i, entry := range entries {
+		entryMap := map[string]interface{}{
+			"key_id":        entry.KeyID,
+			"pubkey_hash":   entry.PubkeyHash, // Phase B: primary identifier
+			"index":         entry.Index,
+			"previous_hash": entry.PreviousHash, // Hash from previous entry (or genesis)
+			"hash":          entry.Hash,         // Hash of THIS entry (will be previous_hash for next)
+			"signature":     entry.Signature,
+			"public_key":    entry.PublicKey,
+		}
+
+		// The entry this one links to: the previous one on the page, or the last one of the previous page
+		prevEntry := previous
+		if i > 0 {
+			prevEntry = entries[i-1]
+		}
+
+		// Add verification status for this entry
+		if i == verification.BreakIndex {
+			entryMap["chain_broken"] = true
+			entryMap["chain_error"] = verification.Error
+		} else if prevEntry != nil {
+			// Verify this entry's previous_hash matches previous entry's hash
+			if entry.PreviousHash == prevEntry.Hash {
+				entryMap["chain_valid"] = true
+			} else {
+				entryMap["chain_broken"] = true
+				entryMap["chain_error"] = fmt.Sprintf("previous_hash mismatch: expected %s, got %s", prevEntry.Hash, entry.PreviousHash)
+			}
+		} else {
+			// First entry - verify it uses genesis hash
+			if entry.PreviousHash == fsm.GenesisHash {
+				entryMap["chain_valid"] = true
+				entryMap["is_genesis"] = true
+			} else {
+				entryMap["chain_broken"] = true
+				entryMap["chain_error"] = fmt.Sprintf("first entry should have genesis hash, got %s", entry.PreviousHash)
+			}
+		}
+
+		chainEntries = append(chainEntries, entryMap)
+	}
+	return chainEntries, verification, nextCursor, nil
 }
 
 // ChainVerification represents the result of chain integrity verification
@@ -238,6 +263,12 @@ type ChainVerification struct {
 
 // verifyChainIntegrity verifies the integrity of a hash chain
 func (s *APIServer) verifyChainIntegrity(entries []*fsm.KeyIndexEntry) *ChainVerification {
+	return s.verifyChainSegment(entries, nil)
+}
+
+// verifyChainSegment verifies a page of a hash chain
+// previous is the chain entry just before the page, already served with the previous page (nil: the page starts at genesis)
+func (s *APIServer) verifyChainSegment(entries []*fsm.KeyIndexEntry, previous *fsm.KeyIndexEntry) *ChainVerification {
 	verification := &ChainVerification{
 		Valid:      true,
 		BreakIndex: -1,
@@ -249,8 +280,29 @@ func (s *APIServer) verifyChainIntegrity(entries []*fsm.KeyIndexEntry) *ChainVer
 		return verification
 	}
 
-	// Verify first entry uses genesis hash
-	if entries[0].PreviousHash != fsm.GenesisHash {
+	// Verify first entry links to the previous page
+	if previous != nil {
+		prevHash := previous.Hash
+		if previous.Index == 0 && previous.PreviousHash == fsm.GenesisHash {
+			// Previous entry is genesis - use computed hash for chain validation
+			if computedHash, err := previous.ComputeHash(); err == nil {
+				prevHash = computedHash
+			}
+		}
+		if entries[0].PreviousHash != prevHash {
+			verification.Valid = false
+			verification.Error = fmt.Sprintf("chain broken at entry 0: previous_hash %s does not match previous entry's hash %s", entries[0].PreviousHash, prevHash)
+			verification.BreakIndex = 0
+			return verification
+		}
+		if entries[0].Index <= previous.Index {
+			verification.Valid = false
+			verification.Error = fmt.Sprintf("chain broken at entry 0: index %d is not greater than previous index %d", entries[0].Index, previous.Index)
+			verification.BreakIndex = 0
+			return verification
+		}
+	} else if entries[0].PreviousHash != fsm.GenesisHash {
+		// Verify first entry uses genesis hash
 		verification.Valid = false
 		verification.Error = fmt.Sprintf("first entry previous_hash mismatch: expected %s (genesis), got %s", fsm.GenesisHash, entries[0].PreviousHash)
 		verification.BreakIndex = 0
@@ -327,6 +379,13 @@ type CommitIndexRequest struct {
 	Signature    string `json:"signature"`     // Base64 encoded EC signature
 	PublicKey    string `json:"public_key"`    // Base64 encoded EC public key
 	RecordType   string `json:"record_type"`   // Record type: "create", "sign", "sync", "delete"
+
+	SignatureVersion int `json:"signature_version,omitempty"` // Signature format (omitted: legacy v1 key_id:index)
+
+	LMSParams *fsm.LMSParams `json:"lms_params,omitempty"` // HSS parameter set (create only)
+
+	// RequestID identifies the commit across retries: a retry of an applied commit returns the original result
+	RequestID string `json:"request_id,omitempty"`
 }
 
 // CommitIndexResponse is the response from committing an index
@@ -335,6 +394,7 @@ type CommitIndexResponse struct {
 	KeyID     string `json:"key_id,omitempty"`
 	Index     uint64 `json:"index,omitempty"`
 	Committed bool   `json:"committed"`
+	RequestID string `json:"request_id,omitempty"`
 	Error     string `json:"error,omitempty"`
 }
 
@@ -363,46 +423,10 @@ func (s *APIServer) handleCommitIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate request format - this service only handles LMS index-related messages
-	if req.KeyID == "" {
-		response := CommitIndexResponse{
-			Success: false,
-			Error:   "key_id is required for LMS index commitment",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	// Validate signature and public key are provided
-	if req.Signature == "" {
-		response := CommitIndexResponse{
-			Success: false,
-			Error:   "signature is required (only HSM server with attestation key can commit)",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	if req.PublicKey == "" {
-		response := CommitIndexResponse{
-			Success: false,
-			Error:   "public_key is required (only HSM server with attestation key can commit)",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
-
-	// Validate pubkey_hash is present (Phase B requirement)
-	if req.PubkeyHash == "" {
+	if len(req.RequestID) > fsm.MaxRequestIDLength {
 		response := CommitIndexResponse{
 			Success: false,
-			Error:   "pubkey_hash is required (Phase B: primary identifier)",
+			Error:   fmt.Sprintf("request_id longer than %d bytes", fsm.MaxRequestIDLength),
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
@@ -410,30 +434,12 @@ func (s *APIServer) handleCommitIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create KeyIndexEntry for validation
-	// Set default record_type if not provided (backward compatibility)
-	recordType := req.RecordType
-	if recordType == "" {
-		recordType = "sign" // Default to "sign" for backward compatibility
-	}
-
-	entry := fsm.KeyIndexEntry{
-		KeyID:        req.KeyID,
-		PubkeyHash:   req.PubkeyHash, // Phase B: primary identifier
-		Index:        req.Index,
-		PreviousHash: req.PreviousHash,
-		Hash:         req.Hash,
-		Signature:    req.Signature,
-		PublicKey:    req.PublicKey,
-		RecordType:   recordType,
-	}
-
-	// Validate message format: should be "key_id:index" format
-	expectedData := fmt.Sprintf("%s:%d", req.KeyID, req.Index)
-	if expectedData == "" {
+	entry, err := newCommitEntry(&req)
+	if err != nil {
+		commitsRejected.Inc(rejectInvalid)
 		response := CommitIndexResponse{
 			Success: false,
-			Error:   "invalid message format for LMS index commitment",
+			Error:   err.Error(),
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
@@ -442,11 +448,11 @@ func (s *APIServer) handleCommitIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify signature BEFORE applying to Raft (early rejection)
-	// This ensures only HSM server with correct attestation key can commit
-	if err := fsm.VerifyCommitSignature(&entry); err != nil {
+	if err := s.verifyCommitEntry(entry); err != nil {
+		recordRejection(err.Error())
 		response := CommitIndexResponse{
 			Success: false,
-			Error:   fmt.Sprintf("signature verification failed: %v (only HSM server with attestation key can commit)", err),
+			Error:   err.Error(),
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnauthorized)
@@ -455,7 +461,7 @@ func (s *APIServer) handleCommitIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Serialize entry
-	entryData, err := json.Marshal(entry)
+	entryData, err := fsm.EncodeCommandWithRequestID(fsm.CommandCommitIndex, req.RequestID, entry)
 	if err != nil {
 		response := CommitIndexResponse{
 			Success: false,
@@ -468,7 +474,7 @@ func (s *APIServer) handleCommitIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Apply to Raft
-	future := s.raft.Apply(entryData, s.config.RequestTimeout)
+	future := s.applyToRaft(fsm.CommandCommitIndex, entryData)
 	if err := future.Error(); err != nil {
 		response := CommitIndexResponse{
 			Success: false,
@@ -483,6 +489,7 @@ func (s *APIServer) handleCommitIndex(w http.ResponseWriter, r *http.Request) {
 	// Check if it was successful
 	result := future.Response()
 	if resultStr, ok := result.(string); ok && strings.HasPrefix(resultStr, "Error:") {
+		recordRejection(resultStr)
 		response := CommitIndexResponse{
 			Success: false,
 			Error:   resultStr,
@@ -498,8 +505,73 @@ func (s *APIServer) handleCommitIndex(w http.ResponseWriter, r *http.Request) {
 		KeyID:     req.KeyID,
 		Index:     req.Index,
 		Committed: true,
+		RequestID: req.RequestID,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+// newCommitEntry validates a commit request and builds its KeyIndexEntry
+// Only LMS index commits signed by an HSM attestation key are accepted
+func newCommitEntry(req *CommitIndexRequest) (*fsm.KeyIndexEntry, error) {
+	// Validate request format - this service only handles LMS index-related messages
+	if req.KeyID == "" {
+		return nil, fmt.Errorf("key_id is required for LMS index commitment")
+	}
+
+	// Validate signature and public key are provided
+	if req.Signature == "" {
+		return nil, fmt.Errorf("signature is required (only HSM server with attestation key can commit)")
+	}
+	if req.PublicKey == "" {
+		return nil, fmt.Errorf("public_key is required (only HSM server with attestation key can commit)")
+	}
+
+	// Validate pubkey_hash is present (Phase B requirement)
+	if req.PubkeyHash == "" {
+		return nil, fmt.Errorf("pubkey_hash is required (Phase B: primary identifier)")
+	}
+
+	// Set default record_type if not provided (backward compatibility)
+	recordType := req.RecordType
+	if recordType == "" {
+		recordType = "sign" // Default to "sign" for backward compatibility
+	}
+
+	entry := &fsm.KeyIndexEntry{
+		KeyID:        req.KeyID,
+		PubkeyHash:   req.PubkeyHash, // Phase B: primary identifier
+		Index:        req.Index,
+		PreviousHash: req.PreviousHash,
+		Hash:         req.Hash,
+		Signature:    req.Signature,
+		PublicKey:    req.PublicKey,
+		RecordType:   recordType,
+
+		SignatureVersion: req.SignatureVersion,
+		LMSParams:        req.LMSParams,
+	}
+
+	// Validate signature format version (the FSM decides whether v1 is still accepted)
+	if _, err := entry.SigningPayload(); err != nil {
+		return nil, fmt.Errorf("invalid signature format for LMS index commitment: %v", err)
+	}
+	return entry, nil
+}
+
+// verifyCommitEntry checks that an entry is signed by a registered attestation key
+// This ensures only HSM servers with a registered attestation key can commit
+// The FSM re-checks the registry in Apply, so followers enforce the same rule
+func (s *APIServer) verifyCommitEntry(entry *fsm.KeyIndexEntry) error {
+	verifyErr := fsm.VerifyCommitSignature
+	if registryFSM, ok := s.fsm.(interface {
+		VerifyEntryAuthorization(entry *fsm.KeyIndexEntry) error
+	}); ok {
+		verifyErr = registryFSM.VerifyEntryAuthorization
+	}
+	if err := verifyErr(entry); err != nil {
+		return fmt.Errorf("signature verification failed: %v (only HSM server with attestation key can commit)", err)
+	}
+	return nil
+}
@@ -12,9 +12,8 @@ func (s *APIServer) handleKeys(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// If not leader, forward the request
-	if !s.forwarder.IsLeader() {
-		s.forwarder.ForwardRequest(w, r, "/keys")
+	// Serve locally or forward, depending on the read consistency level
+	if !s.routeRead(w, r, "/keys") {
 		return
 	}
 
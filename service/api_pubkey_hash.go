@@ -15,9 +15,8 @@ func (s *APIServer) handlePubkeyHashIndex(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// If not leader, forward the request
-	if !s.forwarder.IsLeader() {
-		s.forwarder.ForwardRequest(w, r, r.URL.Path)
+	// Serve locally or forward, depending on the read consistency level
+	if !s.routeRead(w, r, r.URL.Path) {
 		return
 	}
 
@@ -59,50 +58,74 @@ func (s *APIServer) handlePubkeyHashIndex(w http.ResponseWriter, r *http.Request
 
 	// Handle chain endpoint
 	if endpoint == "chain" {
-		// Get chain by pubkey_hash
-		if chainFSM, ok := s.fsm.(interface{ GetChainByPubkeyHash(string) ([]*fsm.KeyIndexEntry, bool) }); ok {
-			entries, exists := chainFSM.GetChainByPubkeyHash(pubkeyHash)
-			if exists && len(entries) > 0 {
-				// Convert to response format and verify chain integrity
-				verification := s.verifyChainIntegrity(entries)
+		// Get chain by pubkey_hash: the full chain, or one page of it when limit or cursor is given
+		var entries []*fsm.KeyIndexEntry
+		var previous *fsm.KeyIndexEntry // Chain entry before the page (nil: the page starts at genesis)
+		var nextCursor string
+		params := r.URL.Query()
+		if queryFSM, ok := s.fsm.(entryQueryFSM); ok && (params.Has("limit") || params.Has("cursor")) {
+			page, err := queryFSM.QueryEntries(fsm.EntryQuery{PubkeyHash: pubkeyHash, Cursor: params.Get("cursor"), Limit: parseLimit(r, 10)})
+			if err != nil {
+				s.writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			for _, item := range page.Entries {
+				entries = append(entries, item.Entry)
+			}
+			if page.Previous != nil {
+				previous = page.Previous.Entry
+			}
+			nextCursor = page.NextCursor
+		} else if chainFSM, ok := s.fsm.(interface{ GetChainByPubkeyHash(string) ([]*fsm.KeyIndexEntry, bool) }); ok {
+			entries, _ = chainFSM.GetChainByPubkeyHash(pubkeyHash)
+		}
+		if len(entries) > 0 {
+			// Convert to response format and verify chain integrity
+			verification := s.verifyChainSegment(entries, previous)
+			
+			chainEntries := make([]map[string]interface{}, len(entries))
+			for i, entry := range entries {
+				entryMap := map[string]interface{}{
+					"key_id":        entry.KeyID,
+					"pubkey_hash":   entry.PubkeyHash,
+					"index":         entry.Index,
+					"previous_hash": entry.PreviousHash,
+					"hash":          entry.Hash,
+					"signature":     entry.Signature,
+					"public_key":    entry.PublicKey,
+				}
 				
-				chainEntries := make([]map[string]interface{}, len(entries))
-				for i, entry := range entries {
-					entryMap := map[string]interface{}{
-						"key_id":        entry.KeyID,
-						"pubkey_hash":   entry.PubkeyHash,
-						"index":         entry.Index,
-						"previous_hash": entry.PreviousHash,
-						"hash":          entry.Hash,
-						"signature":     entry.Signature,
-						"public_key":    entry.PublicKey,
-					}
-					
-					// Add verification status for this entry
-					if i == verification.BreakIndex {
-						entryMap["chain_broken"] = true
-					}
-					
-					// Mark genesis entry
-					if entry.PreviousHash == fsm.GenesisHash {
-						entryMap["is_genesis"] = true
-					}
-					
-					chainEntries[i] = entryMap
+				// Add verification status for this entry
+				if i == verification.BreakIndex {
+					entryMap["chain_broken"] = true
 				}
 				
-				response := map[string]interface{}{
-					"success":      true,
-					"pubkey_hash":  pubkeyHash,
-					"exists":       true,
-					"chain":        chainEntries,
-					"count":        len(chainEntries),
-					"verification": verification,
+				// Mark genesis entry
+				if entry.PreviousHash == fsm.GenesisHash {
+					entryMap["is_genesis"] = true
 				}
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(response)
-				return
+
+				if entry.LMSParams != nil {
+					entryMap["lms_params"] = entry.LMSParams
+				}
+				
+				chainEntries[i] = entryMap
+			}
+			
+			response := map[string]interface{}{
+				"success":      true,
+				"pubkey_hash":  pubkeyHash,
+				"exists":       true,
+				"chain":        chainEntries,
+				"count":        len(chainEntries),
+				"verification": verification,
+			}
+			if nextCursor != "" {
+				response["next_cursor"] = nextCursor
 			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(response)
+			return
 		}
 		
 		// Chain not found
@@ -133,6 +156,28 @@ func (s *APIServer) handlePubkeyHashIndex(w http.ResponseWriter, r *http.Request
 		if exists {
 			response["index"] = index
 			response["hash"] = hash
+
+			// Lifecycle state: created, active, exhausted or deleted
+			if lifecycleFSM, ok := s.fsm.(interface {
+				GetKeyLifecycle(string) (*fsm.KeyLifecycle, bool)
+			}); ok {
+				if lifecycle, found := lifecycleFSM.GetKeyLifecycle(pubkeyHash); found {
+					response["state"] = lifecycle.State
+					response["last_record_type"] = lifecycle.LastRecordType
+
+					// Capacity is only known for keys whose create record carried lms_params
+					if capacity, known := lifecycle.Capacity(); known {
+						remaining := uint64(0)
+						if index < capacity {
+							remaining = capacity - index - 1
+						}
+						response["lms_params"] = lifecycle.Params
+						response["capacity"] = capacity
+						response["remaining"] = remaining
+						response["near_exhaustion"] = s.config.IsNearExhaustion(capacity, remaining)
+					}
+				}
+			}
 		} else {
 			response["index"] = nil
 			response["hash"] = nil
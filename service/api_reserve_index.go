@@ -0,0 +1,148 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+)
+
+// ReserveIndexRequest asks the cluster to allocate the next index for a pubkey_hash
+// The signature is a reservation signature (signature_version 3) over key_id, pubkey_hash, previous_hash,
+// record_type and public_key. previous_hash is the chain head the reservation extends (genesis hash for a new key).
+type ReserveIndexRequest struct {
+	KeyID        string `json:"key_id"`
+	PubkeyHash   string `json:"pubkey_hash"`
+	PreviousHash string `json:"previous_hash"`
+	RecordType   string `json:"record_type"` // Record type of the allocated entry (default "sign")
+	Signature    string `json:"signature"`
+	PublicKey    string `json:"public_key"`
+
+	SignatureVersion int `json:"signature_version"`
+
+	LMSParams *fsm.LMSParams `json:"lms_params,omitempty"` // HSS parameter set (create only)
+}
+
+// ReserveIndexResponse is the response from reserving an index
+type ReserveIndexResponse struct {
+	Success      bool   `json:"success"`
+	KeyID        string `json:"key_id,omitempty"`
+	PubkeyHash   string `json:"pubkey_hash,omitempty"`
+	Index        uint64 `json:"index"`
+	PreviousHash string `json:"previous_hash,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+	RaftIndex    uint64 `json:"raft_index,omitempty"` // Raft log position of the reservation
+	RaftTerm     uint64 `json:"raft_term,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// handleReserveIndex atomically allocates and commits the next index for a pubkey_hash
+func (s *APIServer) handleReserveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// If not leader, forward the request
+	if !s.forwarder.IsLeader() {
+		s.forwarder.ForwardRequest(w, r, "/reserve_index")
+		return
+	}
+
+	writeError := func(status int, msg string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ReserveIndexResponse{Success: false, Error: msg})
+	}
+
+	var req ReserveIndexRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	if req.KeyID == "" || req.PubkeyHash == "" || req.PreviousHash == "" {
+		writeError(http.StatusBadRequest, "key_id, pubkey_hash and previous_hash are required")
+		return
+	}
+	if req.Signature == "" || req.PublicKey == "" {
+		writeError(http.StatusBadRequest, "signature and public_key are required (only HSM server with attestation key can reserve)")
+		return
+	}
+	if req.SignatureVersion != fsm.SignatureVersionReserve {
+		writeError(http.StatusBadRequest, fmt.Sprintf("signature_version must be %d for reserve_index", fsm.SignatureVersionReserve))
+		return
+	}
+
+	recordType := req.RecordType
+	if recordType == "" {
+		recordType = "sign"
+	}
+
+	entry := fsm.KeyIndexEntry{
+		KeyID:        req.KeyID,
+		PubkeyHash:   req.PubkeyHash,
+		PreviousHash: req.PreviousHash,
+		RecordType:   recordType,
+		Signature:    req.Signature,
+		PublicKey:    req.PublicKey,
+
+		SignatureVersion: req.SignatureVersion,
+		LMSParams:        req.LMSParams,
+	}
+
+	// Early rejection of unauthorized reservations (Apply re-checks on every node)
+	if registryFSM, ok := s.fsm.(interface {
+		VerifyEntryAuthorization(entry *fsm.KeyIndexEntry) error
+	}); ok {
+		if err := registryFSM.VerifyEntryAuthorization(&entry); err != nil {
+			commitsRejected.Inc(rejectUnauthorized)
+			writeError(http.StatusUnauthorized, fmt.Sprintf("signature verification failed: %v", err))
+			return
+		}
+	}
+
+	cmdData, err := fsm.EncodeCommand(fsm.CommandReserveIndex, fsm.ReserveIndexCommand{Entry: entry})
+	if err != nil {
+		writeError(http.StatusInternalServerError, fmt.Sprintf("Failed to serialize command: %v", err))
+		return
+	}
+
+	future := s.applyToRaft(fsm.CommandReserveIndex, cmdData)
+	if err := future.Error(); err != nil {
+		writeError(http.StatusInternalServerError, fmt.Sprintf("Raft apply failed: %v", err))
+		return
+	}
+
+	switch result := future.Response().(type) {
+	case *fsm.IndexReservation:
+		response := ReserveIndexResponse{
+			Success:      true,
+			KeyID:        result.KeyID,
+			PubkeyHash:   result.PubkeyHash,
+			Index:        result.Index,
+			PreviousHash: result.PreviousHash,
+			Hash:         result.Hash,
+			RaftIndex:    result.RaftIndex,
+			RaftTerm:     result.RaftTerm,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	case string:
+		if strings.HasPrefix(result, "Error:") {
+			recordRejection(result)
+			// The head moved since the reservation was signed: re-read it and sign again
+			if strings.Contains(result, "head mismatch") {
+				writeError(http.StatusConflict, result)
+				return
+			}
+			writeError(http.StatusBadRequest, result)
+			return
+		}
+		writeError(http.StatusInternalServerError, fmt.Sprintf("unexpected reserve_index result: %s", result))
+	default:
+		writeError(http.StatusInternalServerError, "FSM does not support reserve_index")
+	}
+}
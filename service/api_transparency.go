@@ -0,0 +1,245 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+)
+
+// transparencyLogFSM is implemented by FSMs that maintain the RFC 6962 transparency log
+type transparencyLogFSM interface {
+	GetTreeHead() fsm.TreeHead
+	GetInclusionProof(entryHash string, treeSize uint64) (*fsm.InclusionProof, error)
+	GetConsistencyProof(fromSize, toSize uint64) (*fsm.ConsistencyProof, error)
+}
+
+// stateProofFSM is implemented by FSMs that maintain the pubkey_hash state tree
+type stateProofFSM interface {
+	GetStateProof(pubkeyHash string) (*fsm.StateProof, error)
+}
+
+// loadTreeHeadKey loads the EC private key that signs tree heads
+// Without a key file, a per-process key is generated: its tree heads verify, but auditors cannot pin it
+func loadTreeHeadKey(path string) *ecdsa.PrivateKey {
+	if path != "" {
+		key, err := LoadECPrivateKeyPEM(path)
+		if err == nil {
+			return key
+		}
+		log.Printf("Warning: Failed to load tree head key %s: %v", path, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Printf("Warning: Failed to generate tree head key, signed tree heads disabled: %v", err)
+		return nil
+	}
+	log.Printf("Warning: Signing tree heads with a generated key (set a tree head key file so auditors can pin it)")
+	return key
+}
+
+// LoadECPrivateKeyPEM loads a SEC 1 or PKCS #8 EC private key PEM file
+func LoadECPrivateKeyPEM(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ECDSA private key")
+	}
+	return key, nil
+}
+
+// handleSignedTreeHead returns the current tree head signed by this node's log key
+func (s *APIServer) handleSignedTreeHead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Serve locally or forward, depending on the read consistency level
+	if !s.routeRead(w, r, "/sth") {
+		return
+	}
+
+	tlogFSM, ok := s.fsm.(transparencyLogFSM)
+	if !ok {
+		s.writeJSONError(w, http.StatusNotImplemented, "FSM does not maintain a transparency log")
+		return
+	}
+	if s.treeHeadKey == nil {
+		s.writeJSONError(w, http.StatusServiceUnavailable, "no tree head signing key available")
+		return
+	}
+
+	sth, err := fsm.SignTreeHead(tlogFSM.GetTreeHead(), s.treeHeadKey)
+	if err != nil {
+		s.writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sth)
+}
+
+// handleInclusionProof returns the audit path of an entry
+// Query: hash=<entry hash> (required), tree_size=<n> (optional, default current size)
+func (s *APIServer) handleInclusionProof(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Serve locally or forward, depending on the read consistency level
+	if !s.routeRead(w, r, "/proof/inclusion") {
+		return
+	}
+
+	tlogFSM, ok := s.fsm.(transparencyLogFSM)
+	if !ok {
+		s.writeJSONError(w, http.StatusNotImplemented, "FSM does not maintain a transparency log")
+		return
+	}
+
+	// Entry hashes are base64: an unescaped '+' arrives as a space
+	entryHash := strings.ReplaceAll(r.URL.Query().Get("hash"), " ", "+")
+	if entryHash == "" {
+		s.writeJSONError(w, http.StatusBadRequest, "hash is required")
+		return
+	}
+	treeSize, err := parseTreeSize(r.URL.Query().Get("tree_size"), 0)
+	if err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	proof, err := tlogFSM.GetInclusionProof(entryHash, treeSize)
+	if err != nil {
+		s.writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proof)
+}
+
+// handleConsistencyProof returns the proof that tree size from is a prefix of tree size to
+// Query: from=<m> (required), to=<n> (optional, default current size)
+func (s *APIServer) handleConsistencyProof(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Serve locally or forward, depending on the read consistency level
+	if !s.routeRead(w, r, "/proof/consistency") {
+		return
+	}
+
+	tlogFSM, ok := s.fsm.(transparencyLogFSM)
+	if !ok {
+		s.writeJSONError(w, http.StatusNotImplemented, "FSM does not maintain a transparency log")
+		return
+	}
+
+	if r.URL.Query().Get("from") == "" {
+		s.writeJSONError(w, http.StatusBadRequest, "from is required")
+		return
+	}
+	fromSize, err := parseTreeSize(r.URL.Query().Get("from"), 0)
+	if err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	toSize, err := parseTreeSize(r.URL.Query().Get("to"), tlogFSM.GetTreeHead().TreeSize)
+	if err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	proof, err := tlogFSM.GetConsistencyProof(fromSize, toSize)
+	if err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proof)
+}
+
+// handleStateProof returns a membership or non-membership proof for a pubkey_hash
+// Query: pubkey_hash=<pubkey_hash> (required). The proof's state_root is signed in /sth of the same tree_size
+func (s *APIServer) handleStateProof(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Serve locally or forward, depending on the read consistency level
+	if !s.routeRead(w, r, "/proof/state") {
+		return
+	}
+
+	stateFSM, ok := s.fsm.(stateProofFSM)
+	if !ok {
+		s.writeJSONError(w, http.StatusNotImplemented, "FSM does not maintain a state tree")
+		return
+	}
+
+	// pubkey_hash is base64: an unescaped '+' arrives as a space
+	pubkeyHash := strings.ReplaceAll(r.URL.Query().Get("pubkey_hash"), " ", "+")
+	proof, err := stateFSM.GetStateProof(pubkeyHash)
+	if err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proof)
+}
+
+// parseTreeSize parses a tree size query parameter (empty returns the default)
+func parseTreeSize(value string, defaultSize uint64) (uint64, error) {
+	if value == "" {
+		return defaultSize, nil
+	}
+	size, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid tree size %q", value)
+	}
+	return size, nil
+}
+
+// writeJSONError writes a {"success": false, "error": msg} response
+func (s *APIServer) writeJSONError(w http.ResponseWriter, status int, msg string) {
+	response := map[string]interface{}{
+		"success": false,
+		"error":   msg,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
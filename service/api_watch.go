@@ -0,0 +1,129 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+)
+
+const (
+	// watchBatchSize bounds the entries read from the FSM per pass while a watcher catches up
+	watchBatchSize = 500
+	// watchKeepaliveInterval is how often an idle stream sends a comment to keep proxies from closing it
+	watchKeepaliveInterval = 15 * time.Second
+)
+
+// entryWatcherFSM is implemented by FSMs that can stream committed entries
+type entryWatcherFSM interface {
+	EntriesAfter(raftIndex uint64, limit int) []fsm.RaftEntry
+	EntriesChanged() <-chan struct{}
+	LastEntryRaftIndex() uint64
+}
+
+// handleWatch streams committed entries as server-sent events, oldest first
+// URL format: /watch[?from=<raft_index>][&pubkey_hash=<pubkey_hash>][&key_id=<key_id>]
+// Each event is "event: entry" with the /all_entries JSON of one entry. The event id is the Raft index,
+// set on the last event of each Raft log entry, so a reconnect with Last-Event-ID (or from=) resumes
+// without gaps or duplicates. Without a cursor the stream starts with the next commit.
+// The stream is served from this node's FSM, so a follower delivers entries once it has applied them.
+func (s *APIServer) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	watchFSM, ok := s.fsm.(entryWatcherFSM)
+	if !ok {
+		s.writeJSONError(w, http.StatusInternalServerError, "watch not supported by FSM")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	cursor := watchFSM.LastEntryRaftIndex()
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		from = r.Header.Get("Last-Event-ID")
+	}
+	if from != "" {
+		parsed, err := strconv.ParseUint(from, 10, 64)
+		if err != nil {
+			s.writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid from %q: must be a Raft index", from))
+			return
+		}
+		cursor = parsed
+	}
+	pubkeyHash := strings.ReplaceAll(r.URL.Query().Get("pubkey_hash"), " ", "+")
+	keyID := r.URL.Query().Get("key_id")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable nginx response buffering
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": watching\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(watchKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		// Take the channel before reading so a commit between the two is not missed
+		changed := watchFSM.EntriesChanged()
+		entries := watchFSM.EntriesAfter(cursor, watchBatchSize)
+
+		for start := 0; start < len(entries); {
+			// One Raft log entry (a batch) may hold several entries; the id goes on its last matching event
+			end := start + 1
+			for end < len(entries) && entries[end].RaftIndex == entries[start].RaftIndex {
+				end++
+			}
+			var matching []*fsm.KeyIndexEntry
+			for _, item := range entries[start:end] {
+				if (pubkeyHash == "" || item.Entry.PubkeyHash == pubkeyHash) && (keyID == "" || item.Entry.KeyID == keyID) {
+					matching = append(matching, item.Entry)
+				}
+			}
+			raftIndex := entries[start].RaftIndex
+			for i, entry := range matching {
+				data, err := json.Marshal(entryResponse(entry, raftIndex))
+				if err != nil {
+					return
+				}
+				if i == len(matching)-1 {
+					fmt.Fprintf(w, "id: %d\n", raftIndex)
+				}
+				if _, err := fmt.Fprintf(w, "event: entry\ndata: %s\n\n", data); err != nil {
+					return
+				}
+			}
+			cursor = raftIndex
+			start = end
+		}
+		if len(entries) > 0 {
+			flusher.Flush()
+		}
+		if len(entries) >= watchBatchSize {
+			continue // Still catching up
+		}
+
+		select {
+		case <-changed:
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
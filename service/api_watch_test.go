@@ -0,0 +1,143 @@
+package service
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+)
+
+type watchEvent struct {
+	ID    string
+	Entry map[string]interface{}
+}
+
+// openWatch connects to /watch and returns the received entry events
+func openWatch(t *testing.T, server *httptest.Server, query string, lastEventID string) <-chan watchEvent {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/watch"+query, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open watch: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected watch response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan watchEvent, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		var event watchEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				event.ID = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.Entry)
+			case line == "" && event.Entry != nil:
+				events <- event
+				event = watchEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func nextWatchEvent(t *testing.T, events <-chan watchEvent) watchEvent {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("Watch stream closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a watch event")
+	}
+	return watchEvent{}
+}
+
+func TestHandleWatch(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	combinedFSM, err := fsm.NewCombinedFSM("genesis_hash_123", "")
+	if err != nil {
+		t.Fatalf("Failed to create FSM: %v", err)
+	}
+	combinedFSM.PinAttestationKey(&key.PublicKey)
+	r := newTestRaft(t, combinedFSM, true)
+	s := newTestReadServer(r, DefaultConfig())
+	s.fsm = combinedFSM
+	server := httptest.NewServer(http.HandlerFunc(s.handleWatch))
+	t.Cleanup(server.Close)
+
+	createA := newSignedCommitRequest(t, key, "key_a", 0, fsm.GenesisHash, "create")
+	if status, response := postCommitBatch(t, s, CommitBatchRequest{Entries: []CommitIndexRequest{createA}}); status != http.StatusOK {
+		t.Fatalf("Failed to commit: %+v", response)
+	}
+
+	// A live stream (no cursor) only sees later commits
+	live := openWatch(t, server, "", "")
+	// A filtered stream from the start replays history, then follows
+	filtered := openWatch(t, server, "?from=0&key_id=key_a", "")
+
+	event := nextWatchEvent(t, filtered)
+	if event.Entry["hash"] != createA.Hash {
+		t.Errorf("Expected the key_a create entry first, got %v", event.Entry)
+	}
+
+	createB := newSignedCommitRequest(t, key, "key_b", 0, fsm.GenesisHash, "create")
+	signA := newSignedCommitRequest(t, key, "key_a", 1, createA.Hash, "sign")
+	status, response := postCommitBatch(t, s, CommitBatchRequest{Entries: []CommitIndexRequest{createB, signA}})
+	if status != http.StatusOK {
+		t.Fatalf("Failed to commit batch: %+v", response)
+	}
+	batchID := strconv.FormatUint(response.RaftIndex, 10)
+
+	event = nextWatchEvent(t, filtered)
+	if event.Entry["hash"] != signA.Hash || event.ID != batchID {
+		t.Errorf("Expected key_a index 1 with id %s, got id %q: %v", batchID, event.ID, event.Entry)
+	}
+
+	// Both entries of the batch arrive on the unfiltered stream; only the last carries the id
+	first, second := nextWatchEvent(t, live), nextWatchEvent(t, live)
+	if first.ID != "" || second.ID != batchID {
+		t.Errorf("Expected the id only on the last event of the batch, got %q and %q", first.ID, second.ID)
+	}
+	if first.Entry["raft_index"] != float64(response.RaftIndex) || second.Entry["raft_index"] != float64(response.RaftIndex) {
+		t.Errorf("Expected both events at Raft index %d", response.RaftIndex)
+	}
+
+	// Resuming after the first commit skips it
+	resumed := openWatch(t, server, "", strconv.FormatUint(response.RaftIndex-1, 10))
+	if event := nextWatchEvent(t, resumed); event.Entry["raft_index"] != float64(response.RaftIndex) {
+		t.Errorf("Expected the resumed stream to start at the batch, got %v", event.Entry)
+	}
+}
+
+func TestHandleWatch_InvalidCursor(t *testing.T) {
+	combinedFSM, _ := fsm.NewCombinedFSM("genesis_hash_123", "")
+	s := &APIServer{fsm: combinedFSM}
+
+	w := httptest.NewRecorder()
+	s.handleWatch(w, httptest.NewRequest(http.MethodGet, "/watch?from=abc", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a non-numeric cursor, got %d", w.Code)
+	}
+}
@@ -0,0 +1,350 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/verifiable-state-chains/lms/tlsutil"
+	"go.yaml.in/yaml/v4"
+)
+
+// clusterFile is the on-disk cluster configuration (YAML or JSON, chosen by file extension)
+//
+//	node_id: node1            # optional, usually given per node with -id or LMS_NODE_ID
+//	raft_dir: ./raft-data
+//	request_timeout: 5s
+//	nodes:
+//	  - id: node1
+//	    raft_address: 10.0.0.1:7000
+//	    api_url: https://10.0.0.1:8080
+//	tls:
+//	  ca_file: ./certs/ca.pem
+//	  cert_file: ./certs/node1.pem
+//	  key_file: ./certs/node1-key.pem
+//	  api_client_auth: require  # none, verify_if_given or require
+type clusterFile struct {
+	NodeID         string        `json:"node_id" yaml:"node_id"`
+	RaftDir        string        `json:"raft_dir" yaml:"raft_dir"`
+	RequestTimeout string        `json:"request_timeout" yaml:"request_timeout"`
+	Nodes          []ClusterNode `json:"nodes" yaml:"nodes"`
+	TLS            TLSFiles      `json:"tls" yaml:"tls"`
+}
+
+// Environment variables overriding the cluster file (flags set explicitly override both)
+const (
+	EnvClusterConfig  = "LMS_CLUSTER_CONFIG" // Cluster file path, when no -config flag is given
+	EnvNodeID         = "LMS_NODE_ID"
+	EnvNodeAddr       = "LMS_NODE_ADDR"
+	EnvAPIPort        = "LMS_API_PORT"
+	EnvRaftDir        = "LMS_RAFT_DIR"
+	EnvBootstrap      = "LMS_BOOTSTRAP"
+	EnvRequestTimeout = "LMS_REQUEST_TIMEOUT"
+	EnvTLSCAFile      = "LMS_TLS_CA_FILE"
+	EnvTLSCertFile    = "LMS_TLS_CERT_FILE"
+	EnvTLSKeyFile     = "LMS_TLS_KEY_FILE"
+	EnvAPIClientAuth  = "LMS_TLS_API_CLIENT_AUTH"
+)
+
+// LoadConfig builds the configuration from defaults, the cluster file at path and the environment
+// Without a cluster file the cluster is this node alone, built from its node settings by Resolve.
+// Callers apply explicit flags afterwards and then call Resolve.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if path == "" {
+		cfg.ClusterNodes = nil
+	} else {
+		file, err := readClusterFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// This node's addresses come from its entry in the file
+		cfg.NodeAddr = ""
+		cfg.APIPort = 0
+		cfg.ClusterNodes = file.Nodes
+		cfg.TLS = file.TLS
+		if file.NodeID != "" {
+			cfg.NodeID = file.NodeID
+		}
+		if file.RaftDir != "" {
+			cfg.RaftDir = file.RaftDir
+		}
+		if file.RequestTimeout != "" {
+			timeout, err := time.ParseDuration(file.RequestTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid request_timeout %q: %v", file.RequestTimeout, err)
+			}
+			cfg.RequestTimeout = timeout
+		}
+	}
+
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readClusterFile parses a YAML (.yaml, .yml) or JSON (.json) cluster file, rejecting unknown fields
+func readClusterFile(path string) (*clusterFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster config: %v", err)
+	}
+
+	var file clusterFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&file)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&file)
+	default:
+		return nil, fmt.Errorf("cluster config %s must be .yaml, .yml or .json", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cluster config %s: %v", path, err)
+	}
+	return &file, nil
+}
+
+// applyEnv applies the LMS_* environment overrides
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	if v, ok := lookup(EnvNodeID); ok {
+		c.NodeID = v
+	}
+	if v, ok := lookup(EnvNodeAddr); ok {
+		c.NodeAddr = v
+	}
+	if v, ok := lookup(EnvAPIPort); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", EnvAPIPort, v)
+		}
+		c.APIPort = port
+	}
+	if v, ok := lookup(EnvRaftDir); ok {
+		c.RaftDir = v
+	}
+	if v, ok := lookup(EnvBootstrap); ok {
+		bootstrap, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", EnvBootstrap, v)
+		}
+		c.Bootstrap = bootstrap
+	}
+	if v, ok := lookup(EnvRequestTimeout); ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", EnvRequestTimeout, v)
+		}
+		c.RequestTimeout = timeout
+	}
+	if v, ok := lookup(EnvTLSCAFile); ok {
+		c.TLS.CAFile = v
+	}
+	if v, ok := lookup(EnvTLSCertFile); ok {
+		c.TLS.CertFile = v
+	}
+	if v, ok := lookup(EnvTLSKeyFile); ok {
+		c.TLS.KeyFile = v
+	}
+	if v, ok := lookup(EnvAPIClientAuth); ok {
+		c.TLS.APIClientAuth = v
+	}
+	return nil
+}
+
+// Resolve fills this node's addresses from its cluster entry and validates the configuration
+// Without cluster nodes, the cluster is this node alone at NodeAddr with its API on APIPort.
+func (c *Config) Resolve() error {
+	if c.NodeID == "" {
+		return fmt.Errorf("node id is required")
+	}
+
+	if len(c.ClusterNodes) == 0 {
+		host, _, err := net.SplitHostPort(c.NodeAddr)
+		if err != nil {
+			return fmt.Errorf("invalid node address %q: %v", c.NodeAddr, err)
+		}
+		scheme := "http://"
+		if c.TLS.Enabled() {
+			scheme = "https://"
+		}
+		c.ClusterNodes = []ClusterNode{{
+			ID:      c.NodeID,
+			Address: c.NodeAddr,
+			APIURL:  scheme + net.JoinHostPort(host, strconv.Itoa(c.APIPort)),
+		}}
+	}
+
+	if err := c.validateNodes(); err != nil {
+		return err
+	}
+
+	self := c.GetNodeByID(c.NodeID)
+	if self == nil {
+		return fmt.Errorf("node %s is not listed in the cluster configuration", c.NodeID)
+	}
+	if c.NodeAddr == "" {
+		c.NodeAddr = self.Address
+	} else if c.NodeAddr != self.Address {
+		return fmt.Errorf("node address %s does not match raft_address %s of %s in the cluster configuration", c.NodeAddr, self.Address, c.NodeID)
+	}
+	if c.APIPort == 0 {
+		port, err := apiURLPort(self.APIURL)
+		if err != nil {
+			return err
+		}
+		c.APIPort = port
+	}
+	if c.APIPort < 1 || c.APIPort > 65535 {
+		return fmt.Errorf("API port %d out of range", c.APIPort)
+	}
+
+	if err := c.validateTLS(); err != nil {
+		return err
+	}
+	if c.RequestTimeout <= 0 {
+		return fmt.Errorf("request timeout must be positive")
+	}
+	if c.DefaultReadConsistency != "" {
+		if err := ValidateReadConsistency(c.DefaultReadConsistency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateNodes checks that node IDs and Raft addresses are unique and every address parses
+func (c *Config) validateNodes() error {
+	ids := make(map[string]bool)
+	addresses := make(map[string]bool)
+	for i, node := range c.ClusterNodes {
+		if node.ID == "" {
+			return fmt.Errorf("cluster node %d has no id", i)
+		}
+		if ids[node.ID] {
+			return fmt.Errorf("duplicate cluster node id %s", node.ID)
+		}
+		ids[node.ID] = true
+
+		if err := validateHostPort(node.Address); err != nil {
+			return fmt.Errorf("node %s: invalid raft_address %q: %v", node.ID, node.Address, err)
+		}
+		if addresses[node.Address] {
+			return fmt.Errorf("node %s: duplicate raft_address %s", node.ID, node.Address)
+		}
+		addresses[node.Address] = true
+
+		if err := validateAPIURL(node.APIURL); err != nil {
+			return fmt.Errorf("node %s: invalid api_url %q: %v", node.ID, node.APIURL, err)
+		}
+	}
+	return nil
+}
+
+// validateTLS checks that TLS is either off or fully configured with readable files
+func (c *Config) validateTLS() error {
+	if !c.TLS.Enabled() {
+		for _, node := range c.ClusterNodes {
+			if strings.HasPrefix(node.APIURL, "https://") {
+				return fmt.Errorf("node %s: api_url %s uses https but no tls files are configured", node.ID, node.APIURL)
+			}
+		}
+		if c.TLS.APIClientAuth != "" {
+			return fmt.Errorf("tls api_client_auth requires tls files")
+		}
+		return nil
+	}
+
+	for _, file := range []struct{ name, path string }{
+		{"ca_file", c.TLS.CAFile},
+		{"cert_file", c.TLS.CertFile},
+		{"key_file", c.TLS.KeyFile},
+	} {
+		if file.path == "" {
+			return fmt.Errorf("tls %s is required when TLS is enabled", file.name)
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			return fmt.Errorf("tls %s: %v", file.name, err)
+		}
+	}
+
+	// Every node serves HTTPS once TLS is on, so peers must be addressed with https
+	for _, node := range c.ClusterNodes {
+		if !strings.HasPrefix(node.APIURL, "https://") {
+			return fmt.Errorf("node %s: api_url %s must use https when TLS is enabled", node.ID, node.APIURL)
+		}
+	}
+	if _, err := tlsutil.ParseClientAuth(c.TLS.APIClientAuth); err != nil {
+		return fmt.Errorf("tls api_client_auth: %v", err)
+	}
+	return nil
+}
+
+// validateHostPort checks a host:port address (IPv6 hosts in brackets)
+func validateHostPort(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("port %q out of range", port)
+	}
+	return nil
+}
+
+// validateAPIURL checks an API base URL: http or https, a host and no path
+func validateAPIURL(raw string) error {
+	apiURL, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if apiURL.Scheme != "http" && apiURL.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if apiURL.Hostname() == "" {
+		return fmt.Errorf("host is required")
+	}
+	if (apiURL.Path != "" && apiURL.Path != "/") || apiURL.RawQuery != "" {
+		return fmt.Errorf("must not have a path or query")
+	}
+	if _, err := apiURLPort(raw); err != nil {
+		return err
+	}
+	return nil
+}
+
+// apiURLPort returns the port of an API URL (the scheme's default port if none is given)
+func apiURLPort(raw string) (int, error) {
+	apiURL, err := url.Parse(raw)
+	if err != nil {
+		return 0, err
+	}
+	port := apiURL.Port()
+	if port == "" {
+		if apiURL.Scheme == "https" {
+			return 443, nil
+		}
+		return 80, nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return 0, fmt.Errorf("port %q out of range", port)
+	}
+	return n, nil
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testClusterYAML = `
+raft_dir: /var/lib/lms
+request_timeout: 3s
+nodes:
+  - id: node1
+    raft_address: 10.0.0.1:7100
+    api_url: http://10.0.0.1:9000
+  - id: node2
+    raft_address: "[fd00::2]:7100"
+    api_url: http://[fd00::2]:9001/
+`
+
+func writeClusterFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write cluster file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig_YAML(t *testing.T) {
+	cfg, err := LoadConfig(writeClusterFile(t, "cluster.yaml", testClusterYAML))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	cfg.NodeID = "node2"
+	if err := cfg.Resolve(); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	// Addresses come from the node's entry, including non-default ports and IPv6
+	if cfg.NodeAddr != "[fd00::2]:7100" || cfg.APIPort != 9001 {
+		t.Errorf("Expected node2 at [fd00::2]:7100 with API port 9001, got %s and %d", cfg.NodeAddr, cfg.APIPort)
+	}
+	if cfg.RaftDir != "/var/lib/lms" || cfg.RequestTimeout != 3*time.Second {
+		t.Errorf("File settings not applied: raft_dir=%s request_timeout=%v", cfg.RaftDir, cfg.RequestTimeout)
+	}
+	if got := cfg.GetAPIAddress("node2"); got != "[fd00::2]:9001" {
+		t.Errorf("Expected API address [fd00::2]:9001, got %s", got)
+	}
+	if got := cfg.GetAPIURL("node2"); got != "http://[fd00::2]:9001" {
+		t.Errorf("Expected API URL http://[fd00::2]:9001, got %s", got)
+	}
+	if got := cfg.GetAPIURL("node1"); got != "http://10.0.0.1:9000" {
+		t.Errorf("Expected API URL http://10.0.0.1:9000, got %s", got)
+	}
+}
+
+func TestLoadConfig_JSONAndEnvOverrides(t *testing.T) {
+	path := writeClusterFile(t, "cluster.json", `{
+		"node_id": "node1",
+		"nodes": [
+			{"id": "node1", "raft_address": "10.0.0.1:7000", "api_url": "http://10.0.0.1:8080"},
+			{"id": "node2", "raft_address": "10.0.0.2:7000", "api_url": "http://10.0.0.2:8080"}
+		]
+	}`)
+
+	t.Setenv(EnvNodeID, "node2")
+	t.Setenv(EnvRaftDir, "/tmp/raft")
+	t.Setenv(EnvBootstrap, "true")
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if err := cfg.Resolve(); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if cfg.NodeID != "node2" || cfg.NodeAddr != "10.0.0.2:7000" {
+		t.Errorf("Expected env to select node2 at 10.0.0.2:7000, got %s at %s", cfg.NodeID, cfg.NodeAddr)
+	}
+	if cfg.RaftDir != "/tmp/raft" || !cfg.Bootstrap {
+		t.Errorf("Env overrides not applied: raft_dir=%s bootstrap=%v", cfg.RaftDir, cfg.Bootstrap)
+	}
+
+	t.Setenv(EnvBootstrap, "maybe")
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("Expected an error for an invalid boolean override")
+	}
+}
+
+func TestLoadConfig_SingleNodeWithoutFile(t *testing.T) {
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	cfg.NodeAddr = "192.168.1.5:7005"
+	cfg.APIPort = 8085
+	if err := cfg.Resolve(); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if len(cfg.ClusterNodes) != 1 {
+		t.Fatalf("Expected a single-node cluster, got %d nodes", len(cfg.ClusterNodes))
+	}
+	if got := cfg.GetAPIURL(cfg.NodeID); got != "http://192.168.1.5:8085" {
+		t.Errorf("Expected API URL http://192.168.1.5:8085, got %s", got)
+	}
+}
+
+func TestNodeFlags_Cutovers(t *testing.T) {
+	fs := flag.NewFlagSet("node", flag.ContinueOnError)
+	nodeFlags := RegisterNodeFlags(fs)
+	if err := fs.Parse([]string{"-v1-signature-cutover=42", "-legacy-command-cutover=7", "-lms-params-cutover=9"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	cfg, err := nodeFlags.Load(fs)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.V1SignatureCutover != 42 || cfg.LegacyCommandCutover != 7 || cfg.LMSParamsCutover != 9 {
+		t.Errorf("Expected cutovers 42, 7 and 9, got %d, %d and %d", cfg.V1SignatureCutover, cfg.LegacyCommandCutover, cfg.LMSParamsCutover)
+	}
+}
+
+func TestResolve_Validation(t *testing.T) {
+	cases := map[string]struct {
+		nodeID string
+		file   string
+		errMsg string
+	}{
+		"unknown node":      {"node9", `nodes: [{id: node1, raft_address: "10.0.0.1:7000", api_url: "http://10.0.0.1:8080"}]`, "not listed"},
+		"duplicate id":      {"node1", `nodes: [{id: node1, raft_address: "10.0.0.1:7000", api_url: "http://10.0.0.1:8080"}, {id: node1, raft_address: "10.0.0.2:7000", api_url: "http://10.0.0.2:8080"}]`, "duplicate cluster node id"},
+		"duplicate address": {"node1", `nodes: [{id: node1, raft_address: "10.0.0.1:7000", api_url: "http://10.0.0.1:8080"}, {id: node2, raft_address: "10.0.0.1:7000", api_url: "http://10.0.0.2:8080"}]`, "duplicate raft_address"},
+		"missing port":      {"node1", `nodes: [{id: node1, raft_address: "10.0.0.1", api_url: "http://10.0.0.1:8080"}]`, "invalid raft_address"},
+		"bad scheme":        {"node1", `nodes: [{id: node1, raft_address: "10.0.0.1:7000", api_url: "ftp://10.0.0.1:8080"}]`, "invalid api_url"},
+		"api path":          {"node1", `nodes: [{id: node1, raft_address: "10.0.0.1:7000", api_url: "http://10.0.0.1:8080/api"}]`, "invalid api_url"},
+		"https no tls":      {"node1", `nodes: [{id: node1, raft_address: "10.0.0.1:7000", api_url: "https://10.0.0.1:8443"}]`, "no tls files"},
+		"partial tls":       {"node1", "tls: {ca_file: /nonexistent/ca.pem}\nnodes: [{id: node1, raft_address: \"10.0.0.1:7000\", api_url: \"http://10.0.0.1:8080\"}]", "tls"},
+	}
+
+	for name, tc := range cases {
+		cfg, err := LoadConfig(writeClusterFile(t, "cluster.yaml", tc.file))
+		if err != nil {
+			t.Fatalf("%s: LoadConfig failed: %v", name, err)
+		}
+		cfg.NodeID = tc.nodeID
+		err = cfg.Resolve()
+		if err == nil || !strings.Contains(err.Error(), tc.errMsg) {
+			t.Errorf("%s: expected error containing %q, got %v", name, tc.errMsg, err)
+		}
+	}
+
+	// Unknown fields are rejected rather than silently ignored
+	if _, err := LoadConfig(writeClusterFile(t, "cluster.yaml", "nodes: []\napi_port: 8080\n")); err == nil {
+		t.Error("Expected an error for an unknown field")
+	}
+}
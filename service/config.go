@@ -1,7 +1,9 @@
 package service
 
 import (
-	"fmt"
+	"crypto/ecdsa"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -9,8 +11,8 @@ import (
 type Config struct {
 	// Node configuration
 	NodeID      string
-	NodeAddr    string // IP:port for Raft transport (e.g., "159.69.23.29:7000")
-	APIPort     int    // HTTP API port (e.g., 8080)
+	NodeAddr    string // host:port for Raft transport (e.g., "10.0.0.1:7000"), from the cluster file if unset
+	APIPort     int    // HTTP API listen port (e.g., 8080), from this node's api_url if unset
 	RaftPort    int    // Raft transport port (e.g., 7000)
 	
 	// Raft configuration
@@ -19,38 +21,83 @@ type Config struct {
 	
 	// Cluster configuration
 	ClusterNodes []ClusterNode // All nodes in the cluster
+	TLS          TLSFiles      // Certificates for the Raft transport and the HTTPS API
 	
 	// Timeouts
 	RequestTimeout time.Duration // Timeout for Raft operations
 	LeaderTimeout  time.Duration // Timeout for leader election
+
+	// Near exhaustion: a key is flagged when its remaining indices fall to either threshold
+	NearExhaustionFraction  float64 // Fraction of the key's capacity (e.g., 0.1 = 10% left)
+	NearExhaustionRemaining uint64  // Absolute number of remaining indices (0 disables)
+
+	// Transparency log
+	TreeHeadKeyPath string // PEM EC private key signing tree heads (a key is generated per process if unset)
+
+	// Query endpoints
+	DefaultReadConsistency string // stale, leader or linearizable, used when a query has no ?consistency=
+
+	// Cluster membership admin API (disabled without admin keys)
+	AdminKeys      []*ecdsa.PublicKey // Admin keys allowed to sign membership changes
+	AdminThreshold int                // Distinct admin signatures required per change
+
+	// Log replay cutovers: Raft indices that must be identical on every node so all replicas apply the log alike
+	V1SignatureCutover   uint64 // Last index accepting legacy v1 (key_id:index) entry signatures (0 = none)
+	LegacyCommandCutover uint64 // Last index accepting commands without a command envelope (0 = none)
+	LMSParamsCutover     uint64 // Last index accepting create records without lms_params (0 = none)
 }
 
 // ClusterNode represents a node in the Raft cluster
 type ClusterNode struct {
-	ID      string // Node ID (e.g., "node1")
-	Address string // Raft address (e.g., "159.69.23.29:7000")
-	APIPort int    // API port (e.g., 8080)
+	ID      string `json:"id" yaml:"id"`                     // Node ID (e.g., "node1")
+	Address string `json:"raft_address" yaml:"raft_address"` // Raft address (e.g., "10.0.0.1:7000" or "[fd00::1]:7000")
+	APIURL  string `json:"api_url" yaml:"api_url"`           // Base URL of the HTTP API (e.g., "http://10.0.0.1:8080")
+}
+
+// TLSFiles are PEM files for mutually authenticated TLS (all empty disables TLS)
+// With TLS, Raft peers always authenticate each other; API clients per APIClientAuth
+type TLSFiles struct {
+	CAFile   string `json:"ca_file" yaml:"ca_file"`     // CA that signs every node and client certificate
+	CertFile string `json:"cert_file" yaml:"cert_file"` // This node's certificate (server and client)
+	KeyFile  string `json:"key_file" yaml:"key_file"`   // This node's private key
+
+	APIClientAuth string `json:"api_client_auth" yaml:"api_client_auth"` // none (default), verify_if_given or require
+}
+
+// Enabled reports whether any TLS file is configured
+func (t TLSFiles) Enabled() bool {
+	return t.CAFile != "" || t.CertFile != "" || t.KeyFile != ""
 }
 
-// DefaultConfig returns a default configuration
+// DefaultConfig returns a default configuration: a single local node
+// Multi-node clusters are described by a cluster file (see LoadConfig)
 func DefaultConfig() *Config {
 	return &Config{
 		NodeID:        "node1",
-		NodeAddr:      "159.69.23.29:7000",
+		NodeAddr:      "127.0.0.1:7000",
 		APIPort:       8080,
 		RaftPort:      7000,
 		RaftDir:       "./raft-data",
 		Bootstrap:     false,
 		RequestTimeout: 5 * time.Second,
 		LeaderTimeout:  10 * time.Second,
+		NearExhaustionFraction:  0.1,
+		NearExhaustionRemaining: 0,
+		DefaultReadConsistency:  ReadLeader,
 		ClusterNodes: []ClusterNode{
-			{ID: "node1", Address: "159.69.23.29:7000", APIPort: 8080},
-			{ID: "node2", Address: "159.69.23.30:7000", APIPort: 8080},
-			{ID: "node3", Address: "159.69.23.31:7000", APIPort: 8080},
+			{ID: "node1", Address: "127.0.0.1:7000", APIURL: "http://127.0.0.1:8080"},
 		},
 	}
 }
 
+// IsNearExhaustion reports whether a key with the given capacity and remaining indices is near exhaustion
+func (c *Config) IsNearExhaustion(capacity, remaining uint64) bool {
+	if c.NearExhaustionRemaining > 0 && remaining <= c.NearExhaustionRemaining {
+		return true
+	}
+	return float64(remaining) <= float64(capacity)*c.NearExhaustionFraction
+}
+
 // GetNodeByID returns the cluster node with the given ID
 func (c *Config) GetNodeByID(id string) *ClusterNode {
 	for _, node := range c.ClusterNodes {
@@ -61,14 +108,35 @@ func (c *Config) GetNodeByID(id string) *ClusterNode {
 	return nil
 }
 
-// GetAPIAddress returns the full API address for a node
+// GetNodeByAddress returns the cluster node with the given Raft address
+func (c *Config) GetNodeByAddress(address string) *ClusterNode {
+	for _, node := range c.ClusterNodes {
+		if node.Address == address {
+			return &node
+		}
+	}
+	return nil
+}
+
+// GetAPIAddress returns the API host:port of a node
 func (c *Config) GetAPIAddress(nodeID string) string {
 	node := c.GetNodeByID(nodeID)
 	if node == nil {
 		return ""
 	}
-	// Extract IP from Raft address
-	ip := node.Address[:len(node.Address)-5] // Remove ":7000"
-	return fmt.Sprintf("%s:%d", ip, node.APIPort)
+	apiURL, err := url.Parse(node.APIURL)
+	if err != nil {
+		return ""
+	}
+	return apiURL.Host
+}
+
+// GetAPIURL returns the API base URL of a node, without a trailing slash
+func (c *Config) GetAPIURL(nodeID string) string {
+	node := c.GetNodeByID(nodeID)
+	if node == nil {
+		return ""
+	}
+	return strings.TrimSuffix(node.APIURL, "/")
 }
 
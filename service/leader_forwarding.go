@@ -2,6 +2,7 @@ package service
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"io"
 	"bytes"
@@ -17,13 +18,17 @@ type LeaderForwarder struct {
 }
 
 // NewLeaderForwarder creates a new leader forwarder
+// With TLS, forwarded requests present this node's certificate to the leader
 func NewLeaderForwarder(r *raft.Raft, cfg *Config) *LeaderForwarder {
+	client, err := NewHTTPClient(cfg.TLS, cfg.RequestTimeout)
+	if err != nil {
+		log.Printf("Warning: Failed to load TLS client certificate, forwarding without it: %v", err)
+		client = &http.Client{Timeout: cfg.RequestTimeout}
+	}
 	return &LeaderForwarder{
 		raft:   r,
 		config: cfg,
-		client: &http.Client{
-			Timeout: cfg.RequestTimeout,
-		},
+		client: client,
 	}
 }
 
@@ -55,14 +60,7 @@ func (lf *LeaderForwarder) GetLeaderAPIAddress() string {
 		return ""
 	}
 	
-	node := lf.config.GetNodeByID(leaderID)
-	if node == nil {
-		return ""
-	}
-	
-	// Extract IP from Raft address and construct API address
-	ip := node.Address[:len(node.Address)-5] // Remove ":7000"
-	return fmt.Sprintf("http://%s:%d", ip, node.APIPort)
+	return lf.config.GetAPIURL(leaderID)
 }
 
 // ForwardRequest forwards an HTTP request to the leader
@@ -0,0 +1,329 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/verifiable-state-chains/lms/fsm"
+)
+
+// Cluster membership operations
+const (
+	MembershipAddVoter    = "add_voter"    // Add a voting server
+	MembershipAddNonvoter = "add_nonvoter" // Add a server that replicates the log but does not vote
+	MembershipPromote     = "promote"      // Make a non-voter a voter
+	MembershipDemote      = "demote"       // Make a voter a non-voter
+	MembershipRemove      = "remove"       // Remove a server from the cluster
+)
+
+// membershipDomain separates membership signatures from any other use of the admin keys
+const membershipDomain = "verifiable-state-chains/lms/cluster-membership/v1"
+
+// MembershipMaxAge is how long a signed membership request stays valid (bounds replay)
+const MembershipMaxAge = 5 * time.Minute
+
+// MembershipRequest changes the Raft configuration, signed by the admin quorum
+type MembershipRequest struct {
+	Op        string `json:"op"`
+	ID        string `json:"id"`                // Raft server ID
+	Address   string `json:"address,omitempty"` // Raft address (required to add a server)
+	PrevIndex uint64 `json:"prev_index"`        // Configuration index the change is based on (0 = latest)
+	Timestamp int64  `json:"timestamp"`         // Unix seconds at signing
+
+	AdminSignatures []fsm.AdminSignature `json:"admin_signatures"`
+}
+
+// ClusterMember is one server of the Raft configuration
+type ClusterMember struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"` // Voter, Nonvoter or Staging
+	Leader   bool   `json:"leader"`
+}
+
+// SigningDigest returns the digest admins sign for a membership request
+// Each field is length prefixed after the domain, so fields cannot be shifted into each other
+func (m *MembershipRequest) SigningDigest() [32]byte {
+	var payload []byte
+	for _, field := range [][]byte{
+		[]byte(membershipDomain),
+		[]byte(m.Op),
+		[]byte(m.ID),
+		[]byte(m.Address),
+		binary.BigEndian.AppendUint64(nil, m.PrevIndex),
+		binary.BigEndian.AppendUint64(nil, uint64(m.Timestamp)),
+	} {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(field)))
+		payload = append(payload, field...)
+	}
+	return sha256.Sum256(payload)
+}
+
+// SignMembershipRequest adds an admin signature to a membership request
+func SignMembershipRequest(m *MembershipRequest, adminKey *ecdsa.PrivateKey) error {
+	encoded, _, err := encodeAdminKey(&adminKey.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	digest := m.SigningDigest()
+	signature, err := ecdsa.SignASN1(rand.Reader, adminKey, digest[:])
+	if err != nil {
+		return fmt.Errorf("failed to sign membership request: %v", err)
+	}
+
+	m.AdminSignatures = append(m.AdminSignatures, fsm.AdminSignature{
+		AdminKey:  encoded,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	})
+	return nil
+}
+
+// validate checks the request fields for its operation
+func (m *MembershipRequest) validate() error {
+	switch m.Op {
+	case MembershipAddVoter, MembershipAddNonvoter:
+		if m.Address == "" {
+			return fmt.Errorf("address is required for %s", m.Op)
+		}
+	case MembershipPromote, MembershipDemote, MembershipRemove:
+	default:
+		return fmt.Errorf("unknown op %q", m.Op)
+	}
+	if m.ID == "" {
+		return fmt.Errorf("id is required")
+	}
+	return nil
+}
+
+// verifyMembershipRequest checks that the request is fresh and signed by the admin quorum
+func (s *APIServer) verifyMembershipRequest(m *MembershipRequest, now time.Time) error {
+	if len(s.config.AdminKeys) == 0 {
+		return fmt.Errorf("membership changes are disabled: no admin keys configured")
+	}
+
+	signedAt := time.Unix(m.Timestamp, 0)
+	if signedAt.Before(now.Add(-MembershipMaxAge)) || signedAt.After(now.Add(MembershipMaxAge)) {
+		return fmt.Errorf("request timestamp is outside the %v validity window", MembershipMaxAge)
+	}
+
+	admins := make(map[string]*ecdsa.PublicKey, len(s.config.AdminKeys))
+	for _, key := range s.config.AdminKeys {
+		_, fingerprint, err := encodeAdminKey(key)
+		if err != nil {
+			return err
+		}
+		admins[fingerprint] = key
+	}
+
+	digest := m.SigningDigest()
+	signers := make(map[string]bool)
+	for _, sig := range m.AdminSignatures {
+		fingerprint, err := fsm.AttestationKeyFingerprint(sig.AdminKey)
+		if err != nil {
+			continue
+		}
+		adminKey, ok := admins[fingerprint]
+		if !ok {
+			continue
+		}
+		sigBytes, err := base64.StdEncoding.DecodeString(sig.Signature)
+		if err != nil {
+			continue
+		}
+		if ecdsa.VerifyASN1(adminKey, digest[:], sigBytes) {
+			signers[fingerprint] = true
+		}
+	}
+
+	threshold := s.config.AdminThreshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	if len(signers) < threshold {
+		return fmt.Errorf("admin quorum not met: %d of %d required signatures", len(signers), threshold)
+	}
+	return nil
+}
+
+// encodeAdminKey returns the base64 PKIX encoding and hex SHA-256 fingerprint of an admin key
+func encodeAdminKey(pubKey *ecdsa.PublicKey) (string, string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal public key: %v", err)
+	}
+	sum := sha256.Sum256(der)
+	return base64.StdEncoding.EncodeToString(der), hex.EncodeToString(sum[:]), nil
+}
+
+// handleClusterMembers lists the Raft configuration (GET) or applies a signed membership change (POST)
+func (s *APIServer) handleClusterMembers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleListClusterMembers(w, r)
+	case http.MethodPost:
+		s.handleMembershipChange(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *APIServer) handleListClusterMembers(w http.ResponseWriter, r *http.Request) {
+	// Serve locally or forward, depending on the read consistency level
+	if !s.routeRead(w, r, "/cluster/members") {
+		return
+	}
+
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		s.writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to get configuration: %v", err))
+		return
+	}
+
+	_, leaderID := s.raft.LeaderWithID()
+	members := make([]ClusterMember, 0, len(future.Configuration().Servers))
+	for _, server := range future.Configuration().Servers {
+		members = append(members, ClusterMember{
+			ID:       string(server.ID),
+			Address:  string(server.Address),
+			Suffrage: server.Suffrage.String(),
+			Leader:   server.ID == leaderID,
+		})
+	}
+
+	response := map[string]interface{}{
+		"success":             true,
+		"members":             members,
+		"configuration_index": future.Index(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *APIServer) handleMembershipChange(w http.ResponseWriter, r *http.Request) {
+	// Only the leader can change the configuration
+	if !s.forwarder.IsLeader() {
+		s.forwarder.ForwardRequest(w, r, "/cluster/members")
+		return
+	}
+
+	var req MembershipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if err := req.validate(); err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.verifyMembershipRequest(&req, time.Now()); err != nil {
+		s.writeJSONError(w, http.StatusForbidden, fmt.Sprintf("Membership change rejected: %v", err))
+		return
+	}
+
+	future, err := s.applyMembershipChange(&req)
+	if err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := future.Error(); err != nil {
+		s.writeJSONError(w, http.StatusConflict, fmt.Sprintf("Membership change failed: %v", err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":             true,
+		"op":                  req.Op,
+		"id":                  req.ID,
+		"configuration_index": future.Index(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// applyMembershipChange starts the Raft configuration change for a verified request
+func (s *APIServer) applyMembershipChange(req *MembershipRequest) (raft.IndexFuture, error) {
+	id := raft.ServerID(req.ID)
+	timeout := s.config.RequestTimeout
+
+	switch req.Op {
+	case MembershipAddVoter:
+		return s.raft.AddVoter(id, raft.ServerAddress(req.Address), req.PrevIndex, timeout), nil
+	case MembershipAddNonvoter:
+		return s.raft.AddNonvoter(id, raft.ServerAddress(req.Address), req.PrevIndex, timeout), nil
+	case MembershipPromote:
+		// AddVoter on an existing server changes its suffrage; it needs the current address
+		server, err := s.clusterMember(id)
+		if err != nil {
+			return nil, err
+		}
+		if server.Suffrage == raft.Voter {
+			return nil, fmt.Errorf("server %s is already a voter", req.ID)
+		}
+		return s.raft.AddVoter(id, server.Address, req.PrevIndex, timeout), nil
+	case MembershipDemote:
+		server, err := s.clusterMember(id)
+		if err != nil {
+			return nil, err
+		}
+		if server.Suffrage != raft.Voter {
+			return nil, fmt.Errorf("server %s is not a voter", req.ID)
+		}
+		return s.raft.DemoteVoter(id, req.PrevIndex, timeout), nil
+	case MembershipRemove:
+		if _, err := s.clusterMember(id); err != nil {
+			return nil, err
+		}
+		return s.raft.RemoveServer(id, req.PrevIndex, timeout), nil
+	default:
+		return nil, fmt.Errorf("unknown op %q", req.Op)
+	}
+}
+
+// clusterMember returns a server of the current configuration
+func (s *APIServer) clusterMember(id raft.ServerID) (raft.Server, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return raft.Server{}, fmt.Errorf("failed to get configuration: %v", err)
+	}
+	for _, server := range future.Configuration().Servers {
+		if server.ID == id {
+			return server, nil
+		}
+	}
+	return raft.Server{}, fmt.Errorf("server %s is not a cluster member", id)
+}
+
+// JoinCluster asks a running cluster to add this node
+// apiURL is the API base URL of any member; followers forward the request to the leader
+func JoinCluster(client *http.Client, apiURL string, req *MembershipRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to serialize join request: %v", err)
+	}
+
+	resp, err := client.Post(strings.TrimSuffix(apiURL, "/")+"/cluster/members", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to contact %s: %v", apiURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("join rejected by %s: status %d, body: %s", apiURL, resp.StatusCode, string(respBody))
+	}
+	return nil
+}
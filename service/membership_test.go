@@ -0,0 +1,155 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func generateAdminKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate admin key: %v", err)
+	}
+	return key
+}
+
+// newTestMembershipServer returns a single-node leader whose membership API trusts the given admin keys
+func newTestMembershipServer(t *testing.T, threshold int, admins ...*ecdsa.PrivateKey) (*APIServer, *raft.Raft) {
+	t.Helper()
+	r := newTestRaft(t, NewSimpleFSM(), true)
+	cfg := DefaultConfig()
+	cfg.AdminThreshold = threshold
+	for _, admin := range admins {
+		cfg.AdminKeys = append(cfg.AdminKeys, &admin.PublicKey)
+	}
+	return newTestReadServer(r, cfg), r
+}
+
+func newSignedMembershipRequest(t *testing.T, op, id, address string, signers ...*ecdsa.PrivateKey) *MembershipRequest {
+	t.Helper()
+	req := &MembershipRequest{Op: op, ID: id, Address: address, Timestamp: time.Now().Unix()}
+	for _, signer := range signers {
+		if err := SignMembershipRequest(req, signer); err != nil {
+			t.Fatalf("Failed to sign membership request: %v", err)
+		}
+	}
+	return req
+}
+
+func postMembershipRequest(s *APIServer, req *MembershipRequest) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(req)
+	w := httptest.NewRecorder()
+	s.handleClusterMembers(w, httptest.NewRequest(http.MethodPost, "/cluster/members", bytes.NewReader(body)))
+	return w
+}
+
+func configurationServer(t *testing.T, r *raft.Raft, id string) (raft.Server, bool) {
+	t.Helper()
+	future := r.GetConfiguration()
+	if err := future.Error(); err != nil {
+		t.Fatalf("GetConfiguration failed: %v", err)
+	}
+	for _, server := range future.Configuration().Servers {
+		if string(server.ID) == id {
+			return server, true
+		}
+	}
+	return raft.Server{}, false
+}
+
+func TestMembership_AddAndRemoveNonvoter(t *testing.T) {
+	admin := generateAdminKey(t)
+	s, r := newTestMembershipServer(t, 1, admin)
+
+	w := postMembershipRequest(s, newSignedMembershipRequest(t, MembershipAddNonvoter, "node2", "node2-addr", admin))
+	if w.Code != http.StatusOK {
+		t.Fatalf("add_nonvoter failed: status %d: %s", w.Code, w.Body.String())
+	}
+	server, ok := configurationServer(t, r, "node2")
+	if !ok || server.Suffrage != raft.Nonvoter {
+		t.Fatalf("Expected node2 as a non-voter, got %+v (present=%v)", server, ok)
+	}
+
+	// Demoting a non-voter is rejected before reaching Raft
+	w = postMembershipRequest(s, newSignedMembershipRequest(t, MembershipDemote, "node2", "", admin))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 demoting a non-voter, got %d", w.Code)
+	}
+
+	w = postMembershipRequest(s, newSignedMembershipRequest(t, MembershipRemove, "node2", "", admin))
+	if w.Code != http.StatusOK {
+		t.Fatalf("remove failed: status %d: %s", w.Code, w.Body.String())
+	}
+	if _, ok := configurationServer(t, r, "node2"); ok {
+		t.Error("node2 still in the configuration after remove")
+	}
+
+	// The list shows the remaining leader
+	w = httptest.NewRecorder()
+	s.handleClusterMembers(w, httptest.NewRequest(http.MethodGet, "/cluster/members", nil))
+	var response struct {
+		Members []ClusterMember `json:"members"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode member list: %v", err)
+	}
+	if len(response.Members) != 1 || response.Members[0].ID != "node1" || !response.Members[0].Leader {
+		t.Errorf("Unexpected member list: %+v", response.Members)
+	}
+}
+
+func TestMembership_RequiresAdminQuorum(t *testing.T) {
+	admin1 := generateAdminKey(t)
+	admin2 := generateAdminKey(t)
+	outsider := generateAdminKey(t)
+	s, r := newTestMembershipServer(t, 2, admin1, admin2)
+
+	cases := map[string]*MembershipRequest{
+		"unsigned":      newSignedMembershipRequest(t, MembershipAddNonvoter, "node2", "node2-addr"),
+		"below quorum":  newSignedMembershipRequest(t, MembershipAddNonvoter, "node2", "node2-addr", admin1),
+		"same admin":    newSignedMembershipRequest(t, MembershipAddNonvoter, "node2", "node2-addr", admin1, admin1),
+		"unknown admin": newSignedMembershipRequest(t, MembershipAddNonvoter, "node2", "node2-addr", admin1, outsider),
+	}
+
+	tampered := newSignedMembershipRequest(t, MembershipAddNonvoter, "node2", "node2-addr", admin1, admin2)
+	tampered.Address = "attacker-addr"
+	cases["tampered"] = tampered
+
+	expired := &MembershipRequest{Op: MembershipAddNonvoter, ID: "node2", Address: "node2-addr",
+		Timestamp: time.Now().Add(-2 * MembershipMaxAge).Unix()}
+	SignMembershipRequest(expired, admin1)
+	SignMembershipRequest(expired, admin2)
+	cases["expired"] = expired
+
+	for name, req := range cases {
+		if w := postMembershipRequest(s, req); w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected status 403, got %d: %s", name, w.Code, w.Body.String())
+		}
+	}
+	if _, ok := configurationServer(t, r, "node2"); ok {
+		t.Fatal("Unauthorized request changed the configuration")
+	}
+
+	w := postMembershipRequest(s, newSignedMembershipRequest(t, MembershipAddNonvoter, "node2", "node2-addr", admin1, admin2))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Quorum-signed request failed: status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMembership_DisabledWithoutAdminKeys(t *testing.T) {
+	s, _ := newTestMembershipServer(t, 1)
+	req := newSignedMembershipRequest(t, MembershipAddNonvoter, "node2", "node2-addr", generateAdminKey(t))
+	if w := postMembershipRequest(s, req); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 without admin keys, got %d", w.Code)
+	}
+}
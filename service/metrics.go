@@ -0,0 +1,152 @@
+package service
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/verifiable-state-chains/lms/fsm"
+	"github.com/verifiable-state-chains/lms/metrics"
+)
+
+var (
+	raftCommitDuration = metrics.NewHistogramVec("lms_raft_commit_duration_seconds",
+		"Time from Raft Apply on the leader until the command is committed and applied, by command", nil, "command")
+	fsmApplyDuration = metrics.NewHistogramVec("lms_fsm_apply_duration_seconds",
+		"Time spent in FSM Apply on this node, by command", nil, "command")
+	commitsRejected = metrics.NewCounterVec("lms_commit_rejected_total",
+		"Index commits rejected by the API or the FSM, by reason", "reason")
+)
+
+// Commit rejection reasons
+const (
+	rejectInvalid          = "invalid"           // Malformed request or entry
+	rejectUnauthorized     = "unauthorized"      // Bad signature or unregistered attestation key
+	rejectSignatureVersion = "signature_version" // Legacy v1 signature after the cutover
+	rejectHashChain        = "hash_chain"        // previous_hash or hash does not match the chain
+	rejectStaleIndex       = "stale_index"       // Index not above the current head
+	rejectCapacity         = "capacity"          // Key exhausted or index beyond its capacity
+	rejectLifecycle        = "lifecycle"         // Record type not allowed in the key's state
+	rejectRequestID        = "request_id"        // request_id reused for a different command
+)
+
+// rejectionReason maps a commit error message to a bounded reason label
+func rejectionReason(msg string) string {
+	msg = strings.ToLower(msg)
+	switch {
+	case strings.Contains(msg, "request_id"):
+		return rejectRequestID
+	case strings.Contains(msg, "signature version 1"):
+		return rejectSignatureVersion
+	case strings.Contains(msg, "signature verification failed"), strings.Contains(msg, "unauthorized attestation key"):
+		return rejectUnauthorized
+	case strings.Contains(msg, "hash chain validation failed"), strings.Contains(msg, "hash mismatch"),
+		strings.Contains(msg, "head mismatch"):
+		return rejectHashChain
+	case strings.Contains(msg, "is not greater than current index"):
+		return rejectStaleIndex
+	case strings.Contains(msg, "exceeds key capacity"), strings.Contains(msg, "key is exhausted"):
+		return rejectCapacity
+	case strings.Contains(msg, "lifecycle violation"):
+		return rejectLifecycle
+	default:
+		return rejectInvalid
+	}
+}
+
+// recordRejection counts a rejected commit by the reason found in its error message
+func recordRejection(msg string) {
+	commitsRejected.Inc(rejectionReason(msg))
+}
+
+// applyToRaft applies a command through Raft and waits for it, recording the commit latency
+func (s *APIServer) applyToRaft(cmdType fsm.CommandType, data []byte) raft.ApplyFuture {
+	start := time.Now()
+	future := s.raft.Apply(data, s.config.RequestTimeout)
+	if future.Error() == nil {
+		raftCommitDuration.ObserveSince(start, string(cmdType))
+	}
+	return future
+}
+
+// instrumentedFSM records how long each command spends in FSM Apply
+type instrumentedFSM struct {
+	raft.FSM
+}
+
+func (f instrumentedFSM) Apply(l *raft.Log) interface{} {
+	start := time.Now()
+	result := f.FSM.Apply(l)
+	fsmApplyDuration.ObserveSince(start, commandLabel(l.Data))
+	return result
+}
+
+// commandLabel returns the command type of a log entry ("legacy" for entries without an envelope)
+func commandLabel(data []byte) string {
+	var envelope struct {
+		Command string `json:"command"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.Command == "" {
+		return "legacy"
+	}
+	return envelope.Command
+}
+
+// newMetricsRegistry exposes this node's Raft state and FSM contents, read on every scrape
+func (s *APIServer) newMetricsRegistry() *metrics.Registry {
+	registry := metrics.NewRegistry()
+
+	registry.NewGaugeFunc("lms_raft_state", "Raft state of this node (1 for the current state)", []string{"state"},
+		func(set func(float64, ...string)) {
+			current := s.raft.State()
+			for _, state := range []raft.RaftState{raft.Follower, raft.Candidate, raft.Leader, raft.Shutdown} {
+				value := 0.0
+				if state == current {
+					value = 1
+				}
+				set(value, state.String())
+			}
+		})
+
+	// Counters from raft.Stats
+	for _, stat := range []struct{ name, key, help string }{
+		{"lms_raft_term", "term", "Current Raft term"},
+		{"lms_raft_last_log_index", "last_log_index", "Index of the last entry in this node's Raft log"},
+		{"lms_raft_commit_index", "commit_index", "Raft commit index known to this node"},
+		{"lms_raft_applied_index", "applied_index", "Last Raft index applied to this node's FSM"},
+		{"lms_raft_peers", "num_peers", "Number of other voters in the Raft configuration"},
+	} {
+		key := stat.key
+		registry.NewGaugeFunc(stat.name, stat.help, nil, func(set func(float64, ...string)) {
+			if value, err := strconv.ParseFloat(s.raft.Stats()[key], 64); err == nil {
+				set(value)
+			}
+		})
+	}
+
+	registry.NewGaugeFunc("lms_fsm_attestations", "Attestations stored in the hash chain FSM", nil,
+		func(set func(float64, ...string)) {
+			set(float64(s.fsm.GetLogCount()))
+		})
+	registry.NewGaugeFunc("lms_fsm_entries", "Key index entries stored in the FSM", nil,
+		func(set func(float64, ...string)) {
+			if countFSM, ok := s.fsm.(interface{ EntryCount() int }); ok {
+				set(float64(countFSM.EntryCount()))
+			}
+		})
+	registry.NewGaugeFunc("lms_fsm_keys", "Keys (pubkey_hashes) in the FSM, by lifecycle state", []string{"state"},
+		func(set func(float64, ...string)) {
+			countFSM, ok := s.fsm.(interface{ KeyStateCounts() map[string]int })
+			if !ok {
+				return
+			}
+			counts := countFSM.KeyStateCounts()
+			for _, state := range []string{fsm.KeyStateCreated, fsm.KeyStateActive, fsm.KeyStateExhausted, fsm.KeyStateDeleted} {
+				set(float64(counts[state]), state)
+			}
+		})
+
+	return registry
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/verifiable-state-chains/lms/fsm"
+	"github.com/verifiable-state-chains/lms/metrics"
+)
+
+func TestRejectionReason(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"key_id is required for LMS index commitment", rejectInvalid},
+		{"signature verification failed: unknown key (only HSM server with attestation key can commit)", rejectUnauthorized},
+		{"Error: Unauthorized attestation key: revoked", rejectUnauthorized},
+		{"Error: Signature version 1 is no longer accepted after Raft index 10 (entry at Raft index 12)", rejectSignatureVersion},
+		{"Error: Hash chain validation failed: previous_hash mismatch", rejectHashChain},
+		{"Error: Index 3 is not greater than current index 5 for pubkey_hash abc", rejectStaleIndex},
+		{"Error: Lifecycle violation for pubkey_hash abc: index 32 exceeds key capacity (32 one-time signatures)", rejectCapacity},
+		{"Error: Lifecycle violation for pubkey_hash abc: key is deleted, sign record not allowed", rejectLifecycle},
+		{"Error: request_id r1 was already used for a different command at Raft index 4", rejectRequestID},
+	}
+	for _, tt := range tests {
+		if got := rejectionReason(tt.msg); got != tt.want {
+			t.Errorf("rejectionReason(%q) = %s, want %s", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	combinedFSM, err := fsm.NewCombinedFSM("genesis_hash_123", "")
+	if err != nil {
+		t.Fatalf("Failed to create FSM: %v", err)
+	}
+	combinedFSM.PinAttestationKey(&key.PublicKey)
+	r := newTestRaft(t, instrumentedFSM{combinedFSM}, true)
+	s := newTestReadServer(r, DefaultConfig())
+	s.fsm = combinedFSM
+
+	create := newSignedCommitRequest(t, key, "key_a", 0, fsm.GenesisHash, "create")
+	if status, response := postCommitBatch(t, s, CommitBatchRequest{Entries: []CommitIndexRequest{create}}); status != http.StatusOK {
+		t.Fatalf("Failed to commit: %+v", response)
+	}
+	postCommitBatch(t, s, CommitBatchRequest{Entries: []CommitIndexRequest{create}}) // Replay: rejected by the FSM
+
+	w := httptest.NewRecorder()
+	metrics.Handler(s.newMetricsRegistry()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		`lms_raft_state{state="Leader"} 1`,
+		`lms_raft_state{state="Follower"} 0`,
+		"lms_raft_term ",
+		"lms_fsm_entries 1\n",
+		`lms_fsm_keys{state="created"} 1`,
+		`lms_raft_commit_duration_seconds_count{command="commit_batch"}`,
+		`lms_fsm_apply_duration_seconds_count{command="commit_batch"}`,
+		`lms_commit_rejected_total{reason="`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Missing %q in /metrics output", want)
+		}
+	}
+}
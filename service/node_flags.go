@@ -0,0 +1,73 @@
+package service
+
+import (
+	"flag"
+	"os"
+)
+
+// NodeFlags are the per-node command-line flags shared by the service binaries
+// Flags given explicitly override the cluster file and the environment
+type NodeFlags struct {
+	ConfigPath *string
+	NodeID     *string
+	NodeAddr   *string
+	APIPort    *int
+	RaftDir    *string
+	Bootstrap  *bool
+
+	V1SignatureCutover   *uint64
+	LegacyCommandCutover *uint64
+	LMSParamsCutover     *uint64
+}
+
+// RegisterNodeFlags defines the node flags on fs
+func RegisterNodeFlags(fs *flag.FlagSet) *NodeFlags {
+	defaults := DefaultConfig()
+	return &NodeFlags{
+		ConfigPath: fs.String("config", "", "Cluster config file (.yaml, .yml or .json); defaults to $"+EnvClusterConfig+", else a single-node cluster"),
+		NodeID:     fs.String("id", defaults.NodeID, "Node ID (e.g., node1, node2, node3)"),
+		NodeAddr:   fs.String("addr", defaults.NodeAddr, "Node address (host:port for Raft; taken from the cluster config if omitted)"),
+		APIPort:    fs.Int("api-port", defaults.APIPort, "API server port (taken from this node's api_url if omitted)"),
+		RaftDir:    fs.String("raft-dir", defaults.RaftDir, "Raft data directory"),
+		Bootstrap:  fs.Bool("bootstrap", false, "Bootstrap the cluster"),
+
+		V1SignatureCutover:   fs.Uint64("v1-signature-cutover", 0, "Last Raft index accepting legacy v1 (key_id:index) entry signatures (0 = reject all v1 entries; clusters whose log holds v1 entries must set it, identically on all nodes)"),
+		LegacyCommandCutover: fs.Uint64("legacy-command-cutover", 0, "Last Raft index accepting commands without a command envelope (0 = reject all; clusters whose log predates envelopes must set it, identically on all nodes)"),
+		LMSParamsCutover:     fs.Uint64("lms-params-cutover", 0, "Last Raft index accepting create records without lms_params (0 = reject all; clusters whose log holds such creates must set it, identically on all nodes)"),
+	}
+}
+
+// Load builds the configuration from the cluster file, the environment and the flags set on fs
+// The caller sets its remaining options and then calls Resolve
+func (f *NodeFlags) Load(fs *flag.FlagSet) (*Config, error) {
+	path := *f.ConfigPath
+	if path == "" {
+		path = os.Getenv(EnvClusterConfig)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "id":
+			cfg.NodeID = *f.NodeID
+		case "addr":
+			cfg.NodeAddr = *f.NodeAddr
+		case "api-port":
+			cfg.APIPort = *f.APIPort
+		case "raft-dir":
+			cfg.RaftDir = *f.RaftDir
+		case "bootstrap":
+			cfg.Bootstrap = *f.Bootstrap
+		case "v1-signature-cutover":
+			cfg.V1SignatureCutover = *f.V1SignatureCutover
+		case "legacy-command-cutover":
+			cfg.LegacyCommandCutover = *f.LegacyCommandCutover
+		case "lms-params-cutover":
+			cfg.LMSParamsCutover = *f.LMSParamsCutover
+		}
+	})
+	return cfg, nil
+}
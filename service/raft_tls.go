@@ -0,0 +1,78 @@
+package service
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/verifiable-state-chains/lms/tlsutil"
+)
+
+// tlsStreamLayer is a raft.StreamLayer over mutually authenticated TLS
+// Both directions present this node's certificate and require the peer's to chain to the cluster CA
+type tlsStreamLayer struct {
+	net.Listener
+	advertise    net.Addr
+	clientConfig *tls.Config
+}
+
+// newTLSStreamLayer listens on bindAddr for Raft peers and dials them with the node certificate
+func newTLSStreamLayer(bindAddr string, advertise net.Addr, files TLSFiles) (*tlsStreamLayer, error) {
+	serverConfig, err := tlsutil.ServerConfig(files.CAFile, files.CertFile, files.KeyFile, tls.RequireAndVerifyClientCert)
+	if err != nil {
+		return nil, err
+	}
+	clientConfig, err := tlsutil.ClientConfig(files.CAFile, files.CertFile, files.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := tls.Listen("tcp", bindAddr, serverConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", bindAddr, err)
+	}
+	return &tlsStreamLayer{
+		Listener:     listener,
+		advertise:    advertise,
+		clientConfig: clientConfig,
+	}, nil
+}
+
+// Dial opens a TLS connection to a Raft peer, verifying its certificate against the peer's address
+func (t *tlsStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", string(address), t.clientConfig)
+}
+
+// Addr returns the advertised address, which peers dial
+func (t *tlsStreamLayer) Addr() net.Addr {
+	if t.advertise != nil {
+		return t.advertise
+	}
+	return t.Listener.Addr()
+}
+
+// apiTLSConfig returns the HTTPS server configuration of the API
+func (c *Config) apiTLSConfig() (*tls.Config, error) {
+	clientAuth, err := tlsutil.ParseClientAuth(c.TLS.APIClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	return tlsutil.ServerConfig(c.TLS.CAFile, c.TLS.CertFile, c.TLS.KeyFile, clientAuth)
+}
+
+// NewHTTPClient returns a client for the cluster API: with TLS it trusts the cluster CA
+// and presents this node's certificate, so it passes API client certificate checks
+func NewHTTPClient(files TLSFiles, timeout time.Duration) (*http.Client, error) {
+	if !files.Enabled() {
+		return tlsutil.NewHTTPClient(nil, timeout), nil
+	}
+	config, err := tlsutil.ClientConfig(files.CAFile, files.CertFile, files.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tlsutil.NewHTTPClient(config, timeout), nil
+}
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/verifiable-state-chains/lms/tlsutil"
+)
+
+// testPKI is a CA with certificates for 127.0.0.1 written to a temporary directory
+type testPKI struct {
+	dir    string
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "lms-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	pki := &testPKI{dir: t.TempDir(), caCert: cert, caKey: key}
+	pki.writePEM(t, "ca.pem", "CERTIFICATE", der)
+	return pki
+}
+
+func (p *testPKI) writePEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(p.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// issue creates a certificate for 127.0.0.1 usable as both server and client, returning its TLS files
+func (p *testPKI) issue(t *testing.T, name string, serial int64) TLSFiles {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.caCert, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return TLSFiles{
+		CAFile:   filepath.Join(p.dir, "ca.pem"),
+		CertFile: p.writePEM(t, name+".pem", "CERTIFICATE", der),
+		KeyFile:  p.writePEM(t, name+"-key.pem", "EC PRIVATE KEY", keyDER),
+	}
+}
+
+func TestTLSStreamLayer_MutualAuthentication(t *testing.T) {
+	pki := newTestPKI(t)
+	node1 := pki.issue(t, "node1", 2)
+	node2 := pki.issue(t, "node2", 3)
+
+	server, err := newTLSStreamLayer("127.0.0.1:0", nil, node1)
+	if err != nil {
+		t.Fatalf("Failed to create stream layer: %v", err)
+	}
+	defer server.Close()
+
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// A peer with a node certificate gets through
+	client, err := newTLSStreamLayer("127.0.0.1:0", nil, node2)
+	if err != nil {
+		t.Fatalf("Failed to create stream layer: %v", err)
+	}
+	defer client.Close()
+
+	conn, err := client.Dial(raft.ServerAddress(server.Addr().String()), time.Second)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.Write([]byte("append-entries"))
+	echo := make([]byte, len("append-entries"))
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "append-entries" {
+		t.Fatalf("Echo over TLS failed: %q, %v", echo, err)
+	}
+	conn.Close()
+
+	// A client without a certificate is refused
+	caOnly, err := tlsutil.ClientConfig(node2.CAFile, "", "")
+	if err != nil {
+		t.Fatalf("ClientConfig failed: %v", err)
+	}
+	anonymous, err := tls.Dial("tcp", server.Addr().String(), caOnly)
+	if err == nil {
+		anonymous.SetDeadline(time.Now().Add(time.Second))
+		anonymous.Write([]byte("x"))
+		_, err = anonymous.Read(make([]byte, 1))
+		anonymous.Close()
+	}
+	if err == nil {
+		t.Error("Connection without a client certificate was accepted")
+	}
+}
+
+func TestAPITLS_RequireClientCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	files := pki.issue(t, "node1", 2)
+	files.APIClientAuth = tlsutil.ClientAuthRequire
+
+	cfg := DefaultConfig()
+	cfg.TLS = files
+	tlsConfig, err := cfg.apiTLSConfig()
+	if err != nil {
+		t.Fatalf("apiTLSConfig failed: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	// Cluster clients present the node certificate
+	client, err := NewHTTPClient(files, time.Second)
+	if err != nil {
+		t.Fatalf("NewHTTPClient failed: %v", err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request with a client certificate failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "node1" {
+		t.Errorf("Expected the server to see client node1, got %q", body)
+	}
+
+	// Without a client certificate the request fails
+	caOnly, _ := tlsutil.ClientConfig(files.CAFile, "", "")
+	if _, err := tlsutil.NewHTTPClient(caOnly, time.Second).Get(server.URL); err == nil {
+		t.Error("Request without a client certificate succeeded")
+	}
+}
+
+func TestResolve_TLSRequiresHTTPS(t *testing.T) {
+	pki := newTestPKI(t)
+
+	cfg := DefaultConfig()
+	cfg.TLS = pki.issue(t, "node1", 2)
+	if err := cfg.Resolve(); err == nil || !strings.Contains(err.Error(), "must use https") {
+		t.Errorf("Expected an https error for an http api_url with TLS, got %v", err)
+	}
+
+	cfg.ClusterNodes[0].APIURL = "https://127.0.0.1:8080"
+	cfg.TLS.APIClientAuth = "sometimes"
+	if err := cfg.Resolve(); err == nil || !strings.Contains(err.Error(), "api_client_auth") {
+		t.Errorf("Expected an api_client_auth error, got %v", err)
+	}
+
+	cfg.TLS.APIClientAuth = tlsutil.ClientAuthVerifyIfGiven
+	if err := cfg.Resolve(); err != nil {
+		t.Errorf("Resolve failed: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Read consistency levels for query endpoints (?consistency=)
+const (
+	// ReadStale answers from the local FSM of whichever node receives the request
+	ReadStale = "stale"
+	// ReadLeader forwards to the node that believes it is leader (a deposed leader may still answer)
+	ReadLeader = "leader"
+	// ReadLinearizable forwards to the leader, which confirms its leadership with a quorum
+	// and waits until its FSM has applied everything committed before the read (ReadIndex)
+	ReadLinearizable = "linearizable"
+)
+
+// ValidateReadConsistency checks that level names a read consistency level
+func ValidateReadConsistency(level string) error {
+	switch level {
+	case ReadStale, ReadLeader, ReadLinearizable:
+		return nil
+	default:
+		return fmt.Errorf("invalid consistency %q (expected %s, %s or %s)", level, ReadStale, ReadLeader, ReadLinearizable)
+	}
+}
+
+// parseReadConsistency returns the requested consistency level, or the configured default
+func (s *APIServer) parseReadConsistency(r *http.Request) (string, error) {
+	level := r.URL.Query().Get("consistency")
+	if level == "" {
+		level = s.config.DefaultReadConsistency
+	}
+	if level == "" {
+		return ReadLeader, nil
+	}
+	if err := ValidateReadConsistency(level); err != nil {
+		return "", err
+	}
+	return level, nil
+}
+
+// routeRead prepares a query for its consistency level and reports whether to serve it locally
+// It forwards to the leader or writes an error response itself when it returns false
+func (s *APIServer) routeRead(w http.ResponseWriter, r *http.Request, path string) bool {
+	level, err := s.parseReadConsistency(r)
+	if err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+
+	if level != ReadStale && !s.forwarder.IsLeader() {
+		// The query string (and so the consistency level) is forwarded unchanged
+		s.forwarder.ForwardRequest(w, r, path)
+		return false
+	}
+
+	if level == ReadLinearizable {
+		if err := s.linearizableRead(); err != nil {
+			s.writeJSONError(w, http.StatusServiceUnavailable, fmt.Sprintf("linearizable read failed: %v", err))
+			return false
+		}
+	}
+
+	w.Header().Set("X-Read-Consistency", level)
+	return true
+}
+
+// linearizableRead blocks until the local FSM reflects every write committed before the call
+func (s *APIServer) linearizableRead() error {
+	// A new leader's commit index is only current once it has committed an entry in its own term
+	if err := s.ensureTermBarrier(); err != nil {
+		return err
+	}
+
+	readIndex := s.raft.CommitIndex()
+	if err := s.raft.VerifyLeader().Error(); err != nil {
+		return fmt.Errorf("leadership not confirmed: %v", err)
+	}
+
+	deadline := time.Now().Add(s.config.RequestTimeout)
+	for s.raft.AppliedIndex() < readIndex {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for the FSM to apply index %d", readIndex)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// ensureTermBarrier commits a barrier once per leadership term
+func (s *APIServer) ensureTermBarrier() error {
+	term := s.raft.CurrentTerm()
+
+	s.readBarrierMu.Lock()
+	defer s.readBarrierMu.Unlock()
+
+	if s.readBarrierTerm == term {
+		return nil
+	}
+	if err := s.raft.Barrier(s.config.RequestTimeout).Error(); err != nil {
+		return fmt.Errorf("read barrier failed: %v", err)
+	}
+	s.readBarrierTerm = term
+	return nil
+}
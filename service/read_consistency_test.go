@@ -0,0 +1,114 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// newTestRaft starts an in-memory Raft node, bootstrapped as a single-node cluster if requested
+func newTestRaft(t *testing.T, fsm raft.FSM, bootstrap bool) *raft.Raft {
+	t.Helper()
+
+	config := raft.DefaultConfig()
+	config.LocalID = "node1"
+	config.LogOutput = io.Discard
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+
+	store := raft.NewInmemStore()
+	addr, transport := raft.NewInmemTransport("")
+	r, err := raft.NewRaft(config, fsm, store, store, raft.NewInmemSnapshotStore(), transport)
+	if err != nil {
+		t.Fatalf("Failed to create Raft node: %v", err)
+	}
+	t.Cleanup(func() { r.Shutdown().Error() })
+
+	if bootstrap {
+		configuration := raft.Configuration{Servers: []raft.Server{{ID: config.LocalID, Address: addr}}}
+		if err := r.BootstrapCluster(configuration).Error(); err != nil {
+			t.Fatalf("Failed to bootstrap: %v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for r.State() != raft.Leader {
+			if time.Now().After(deadline) {
+				t.Fatal("Node did not become leader")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return r
+}
+
+// newTestReadServer returns an API server with just what read routing needs
+func newTestReadServer(r *raft.Raft, cfg *Config) *APIServer {
+	return &APIServer{raft: r, forwarder: NewLeaderForwarder(r, cfg), config: cfg}
+}
+
+func TestRouteRead_Levels(t *testing.T) {
+	r := newTestRaft(t, NewSimpleFSM(), true)
+	s := newTestReadServer(r, DefaultConfig())
+
+	for _, level := range []string{"", ReadStale, ReadLeader, ReadLinearizable} {
+		req := httptest.NewRequest(http.MethodGet, "/keys?consistency="+level, nil)
+		w := httptest.NewRecorder()
+		if !s.routeRead(w, req, "/keys") {
+			t.Fatalf("consistency %q: read not served locally on the leader (status %d: %s)", level, w.Code, w.Body.String())
+		}
+		expected := level
+		if expected == "" {
+			expected = ReadLeader
+		}
+		if got := w.Header().Get("X-Read-Consistency"); got != expected {
+			t.Errorf("consistency %q: X-Read-Consistency = %q, expected %q", level, got, expected)
+		}
+	}
+
+	// A linearizable read observes every write committed before it
+	if err := r.Apply([]byte(`{}`), time.Second).Error(); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	commitIndex := r.CommitIndex()
+	if err := s.linearizableRead(); err != nil {
+		t.Fatalf("linearizableRead failed: %v", err)
+	}
+	if r.AppliedIndex() < commitIndex {
+		t.Errorf("Applied index %d behind commit index %d after a linearizable read", r.AppliedIndex(), commitIndex)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/keys?consistency=eventual", nil)
+	w := httptest.NewRecorder()
+	if s.routeRead(w, req, "/keys") {
+		t.Fatal("Invalid consistency level was accepted")
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid level, got %d", w.Code)
+	}
+}
+
+func TestRouteRead_FollowerServesStaleOnly(t *testing.T) {
+	r := newTestRaft(t, NewSimpleFSM(), false)
+	cfg := DefaultConfig()
+	cfg.RequestTimeout = 100 * time.Millisecond
+	s := newTestReadServer(r, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "/keys?consistency=stale", nil)
+	w := httptest.NewRecorder()
+	if !s.routeRead(w, req, "/keys") {
+		t.Fatalf("Stale read not served locally on a follower (status %d)", w.Code)
+	}
+
+	// Without a leader, leader and linearizable reads cannot be served
+	for _, level := range []string{ReadLeader, ReadLinearizable} {
+		req := httptest.NewRequest(http.MethodGet, "/keys?consistency="+level, nil)
+		w := httptest.NewRecorder()
+		if s.routeRead(w, req, "/keys") {
+			t.Errorf("consistency %q: read served locally on a follower", level)
+		}
+	}
+}
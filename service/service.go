@@ -1,8 +1,10 @@
 package service
 
 import (
+	"crypto/ecdsa"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -21,8 +23,43 @@ type Service struct {
 	fsm     FSMInterface
 }
 
+// durableFSM is an FSM whose state survives restarts up to a Raft index (a persistent FSM store)
+type durableFSM interface {
+	AppliedIndex() uint64
+}
+
+// cutoverFSM is an FSM that applies older log formats only up to configured Raft indices
+type cutoverFSM interface {
+	SetV1SignatureCutover(raftIndex uint64)
+	SetLegacyCommandCutover(raftIndex uint64)
+	SetLMSParamsCutover(raftIndex uint64)
+}
+
+// registryFSM is an FSM with an attestation key registry bootstrapped by the admin quorum
+type registryFSM interface {
+	SetRegistryBootstrapQuorum(adminKeys []*ecdsa.PublicKey, threshold int) error
+}
+
 // NewService creates and initializes a new service
 func NewService(cfg *Config, fsm FSMInterface) (*Service, error) {
+	// The cutovers decide how the log replays, so they are set before Raft applies anything
+	if cutover, ok := fsm.(cutoverFSM); ok {
+		cutover.SetV1SignatureCutover(cfg.V1SignatureCutover)
+		cutover.SetLegacyCommandCutover(cfg.LegacyCommandCutover)
+		cutover.SetLMSParamsCutover(cfg.LMSParamsCutover)
+	}
+
+	// The registry bootstrap must be signed by the configured admin quorum, so every node needs the same admin keys
+	if registry, ok := fsm.(registryFSM); ok && len(cfg.AdminKeys) > 0 {
+		threshold := cfg.AdminThreshold
+		if threshold < 1 {
+			threshold = 1
+		}
+		if err := registry.SetRegistryBootstrapQuorum(cfg.AdminKeys, threshold); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create Raft data directory
 	raftDir := filepath.Join(cfg.RaftDir, cfg.NodeID)
 	if err := os.MkdirAll(raftDir, 0755); err != nil {
@@ -55,6 +92,19 @@ func NewService(cfg *Config, fsm FSMInterface) (*Service, error) {
 	config.ElectionTimeout = 500 * time.Millisecond
 	config.LeaderLeaseTimeout = 500 * time.Millisecond
 
+	// A persistent FSM already holds the state of a snapshot at or below its applied index:
+	// skip the restore and let Raft replay only the log entries after the snapshot (the FSM skips those it has)
+	if durable, ok := fsm.(durableFSM); ok {
+		snapshots, err := snapshotStore.List()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshots: %v", err)
+		}
+		if len(snapshots) > 0 && snapshots[0].Index <= durable.AppliedIndex() {
+			log.Printf("FSM store is at Raft index %d; skipping restore of snapshot %d", durable.AppliedIndex(), snapshots[0].Index)
+			config.NoSnapshotRestoreOnStart = true
+		}
+	}
+
 	// Create transport for Raft communication
 	addr, err := net.ResolveTCPAddr("tcp", cfg.NodeAddr)
 	if err != nil {
@@ -64,19 +114,29 @@ func NewService(cfg *Config, fsm FSMInterface) (*Service, error) {
 	// Use the port from NodeAddr for the transport listener
 	transportAddr := fmt.Sprintf("0.0.0.0:%d", addr.Port)
 	
-	transport, err := raft.NewTCPTransport(
-		transportAddr,
-		addr,
-		3,
-		10*time.Second,
-		os.Stderr,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create transport: %v", err)
+	var transport *raft.NetworkTransport
+	if cfg.TLS.Enabled() {
+		// Peers authenticate each other with node certificates signed by the cluster CA
+		stream, err := newTLSStreamLayer(transportAddr, addr, cfg.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create TLS transport: %v", err)
+		}
+		transport = raft.NewNetworkTransport(stream, 3, 10*time.Second, os.Stderr)
+	} else {
+		transport, err = raft.NewTCPTransport(
+			transportAddr,
+			addr,
+			3,
+			10*time.Second,
+			os.Stderr,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create transport: %v", err)
+		}
 	}
 
 	// Create Raft node
-	r, err := raft.NewRaft(config, fsm, boltStore, boltStore, snapshotStore, transport)
+	r, err := raft.NewRaft(config, instrumentedFSM{fsm}, boltStore, boltStore, snapshotStore, transport)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Raft node: %v", err)
 	}
@@ -140,6 +200,13 @@ func (s *Service) Shutdown() error {
 	if err := future.Error(); err != nil {
 		return fmt.Errorf("failed to shutdown Raft: %v", err)
 	}
+
+	// Raft has stopped applying: a persistent FSM store can be closed
+	if closer, ok := s.fsm.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return fmt.Errorf("failed to close FSM store: %v", err)
+		}
+	}
 	
 	log.Println("Service shut down successfully")
 	return nil
@@ -153,22 +220,19 @@ func (s *Service) GetRaft() *raft.Raft {
 // RunServiceFromFlags creates and runs a service from command-line flags
 func RunServiceFromFlags(fsm FSMInterface) error {
 	// Parse flags
-	nodeID := flag.String("id", "node1", "Node ID (e.g., node1, node2, node3)")
-	nodeAddr := flag.String("addr", "159.69.23.29:7000", "Node address (IP:port)")
-	apiPort := flag.Int("api-port", 8080, "API server port")
+	nodeFlags := RegisterNodeFlags(flag.CommandLine)
 	raftPort := flag.Int("raft-port", 7000, "Raft transport port")
-	raftDir := flag.String("raft-dir", "./raft-data", "Raft data directory")
-	bootstrap := flag.Bool("bootstrap", false, "Bootstrap the cluster")
 	flag.Parse()
 
-	// Create config
-	cfg := DefaultConfig()
-	cfg.NodeID = *nodeID
-	cfg.NodeAddr = *nodeAddr
-	cfg.APIPort = *apiPort
+	// Create config: defaults, then cluster file, environment and explicit flags
+	cfg, err := nodeFlags.Load(flag.CommandLine)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
 	cfg.RaftPort = *raftPort
-	cfg.RaftDir = *raftDir
-	cfg.Bootstrap = *bootstrap
+	if err := cfg.Resolve(); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
 
 	// Create and start service
 	service, err := NewService(cfg, fsm)
@@ -176,7 +240,7 @@ func RunServiceFromFlags(fsm FSMInterface) error {
 		return fmt.Errorf("failed to create service: %v", err)
 	}
 
-	log.Printf("Starting service: node=%s, raft=%s, api=:%d", *nodeID, *nodeAddr, *apiPort)
+	log.Printf("Starting service: node=%s, raft=%s, api=:%d", cfg.NodeID, cfg.NodeAddr, cfg.APIPort)
 	
 	// Start service (blocks)
 	if err := service.Start(); err != nil {
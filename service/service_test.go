@@ -15,8 +15,8 @@ func TestDefaultConfig(t *testing.T) {
 		t.Errorf("Expected APIPort 8080, got %d", cfg.APIPort)
 	}
 	
-	if len(cfg.ClusterNodes) != 3 {
-		t.Errorf("Expected 3 cluster nodes, got %d", len(cfg.ClusterNodes))
+	if len(cfg.ClusterNodes) != 1 {
+		t.Errorf("Expected 1 cluster node, got %d", len(cfg.ClusterNodes))
 	}
 }
 
@@ -42,7 +42,7 @@ func TestGetAPIAddress(t *testing.T) {
 	cfg := DefaultConfig()
 	
 	addr := cfg.GetAPIAddress("node1")
-	expected := "159.69.23.29:8080"
+	expected := "127.0.0.1:8080"
 	if addr != expected {
 		t.Errorf("Expected API address '%s', got '%s'", expected, addr)
 	}
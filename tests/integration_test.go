@@ -2,6 +2,7 @@ package tests
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
@@ -50,11 +51,22 @@ func StartTestCluster(nodeCount int, genesisHash string) (*TestCluster, error) {
 		return nil, fmt.Errorf("failed to create temp directory: %v", err)
 	}
 
-	// Build cluster node addresses for bootstrap
-	clusterNodes := make([]string, nodeCount)
+	// Write the cluster config every node (and the bootstrap) uses
+	clusterNodes := make([]map[string]string, nodeCount)
 	for i := 0; i < nodeCount; i++ {
-		raftPort := 7000 + i
-		clusterNodes[i] = fmt.Sprintf("test-node-%d,127.0.0.1:%d", i+1, raftPort)
+		clusterNodes[i] = map[string]string{
+			"id":           fmt.Sprintf("test-node-%d", i+1),
+			"raft_address": fmt.Sprintf("127.0.0.1:%d", 7000+i),
+			"api_url":      fmt.Sprintf("http://127.0.0.1:%d", 8080+i),
+		}
+	}
+	configPath := filepath.Join(baseDir, "cluster.json")
+	configData, err := json.Marshal(map[string]interface{}{"nodes": clusterNodes})
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize cluster config: %v", err)
+	}
+	if err := os.WriteFile(configPath, configData, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write cluster config: %v", err)
 	}
 
 	// Start nodes
@@ -74,9 +86,8 @@ func StartTestCluster(nodeCount int, genesisHash string) (*TestCluster, error) {
 		}
 
 		cmd := exec.CommandContext(ctx, binaryPath,
+			"-config", configPath,
 			"-id", nodeID,
-			"-addr", fmt.Sprintf("127.0.0.1:%d", raftPort),
-			"-api-port", fmt.Sprintf("%d", apiPort),
 			"-raft-dir", raftDir,
 			"-genesis-hash", genesisHash,
 		)
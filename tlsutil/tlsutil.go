@@ -0,0 +1,95 @@
+// Package tlsutil builds the mutual TLS configurations shared by the Raft nodes, the HSM server and the explorer
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Client certificate policies for TLS servers
+const (
+	ClientAuthNone          = "none"            // No client certificate is requested
+	ClientAuthVerifyIfGiven = "verify_if_given" // A client certificate is optional but verified if presented
+	ClientAuthRequire       = "require"         // A client certificate signed by the CA is required
+)
+
+// ParseClientAuth maps a client certificate policy to its crypto/tls value ("" = none)
+func ParseClientAuth(policy string) (tls.ClientAuthType, error) {
+	switch policy {
+	case "", ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthVerifyIfGiven:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("invalid client auth %q (expected %s, %s or %s)", policy, ClientAuthNone, ClientAuthVerifyIfGiven, ClientAuthRequire)
+	}
+}
+
+// LoadCertPool loads the PEM CA certificates in caFile
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+	}
+	return pool, nil
+}
+
+// ServerConfig returns a TLS server configuration presenting certFile and verifying client certificates against caFile
+func ServerConfig(caFile, certFile, keyFile string, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	pool, err := LoadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   clientAuth,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientConfig returns a TLS client configuration trusting caFile
+// certFile and keyFile are the client certificate, both empty to connect without one
+func ClientConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// NewHTTPClient returns an HTTP client using config for https URLs (nil uses the system defaults)
+func NewHTTPClient(config *tls.Config, timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if config != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		client.Transport = transport
+	}
+	return client
+}
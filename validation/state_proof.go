@@ -0,0 +1,156 @@
+package validation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// stateLeafDomain must match the domain used by the cluster's state tree
+const stateLeafDomain = "verifiable-state-chains/lms/state-leaf/v1"
+
+// StateProof is a pubkey_hash state proof as served by /proof/state
+// It proves "pubkey_hash was at index N" (exists) or "pubkey_hash was never committed" (!exists)
+// against the state root signed in the tree head of size tree_size
+type StateProof struct {
+	PubkeyHash     string   `json:"pubkey_hash"`
+	Exists         bool     `json:"exists"`
+	Index          uint64   `json:"index"`
+	HeadHash       string   `json:"head_hash,omitempty"`
+	Siblings       []string `json:"siblings"`
+	OtherKey       string   `json:"other_key,omitempty"`
+	OtherValueHash string   `json:"other_value_hash,omitempty"`
+	StateRoot      string   `json:"state_root"`
+	TreeSize       uint64   `json:"tree_size"`
+}
+
+// VerifyStateProof checks a state proof against a trusted state root
+// stateRoot must come from a tree head whose signature the caller has verified; the proof's own
+// state_root is not trusted. This verifier is independent of the cluster implementation:
+//
+//	key   = SHA-256(pubkey_hash)
+//	value = SHA-256(length-prefixed(domain, pubkey_hash, index as 8-byte big-endian, head_hash))
+//	leaf  = SHA-256(0x00 || key || value), node = SHA-256(0x01 || left || right), empty = 32 zero bytes
+func VerifyStateProof(proof *StateProof, stateRoot string) error {
+	root, err := decodeStateHash(stateRoot)
+	if err != nil {
+		return fmt.Errorf("invalid state root: %v", err)
+	}
+	if len(proof.Siblings) > 256 {
+		return fmt.Errorf("proof has %d siblings, at most 256 allowed", len(proof.Siblings))
+	}
+	siblings := make([][32]byte, len(proof.Siblings))
+	for i, sibling := range proof.Siblings {
+		if siblings[i], err = decodeStateHash(sibling); err != nil {
+			return fmt.Errorf("invalid sibling %d: %v", i, err)
+		}
+	}
+
+	key := sha256.Sum256([]byte(proof.PubkeyHash))
+
+	// Hash of the terminal position: this key's leaf, another key's leaf, or empty
+	var current [32]byte
+	switch {
+	case proof.Exists:
+		value := stateValueHash(proof.PubkeyHash, proof.Index, proof.HeadHash)
+		current = stateLeafHash(key, value)
+	case proof.OtherKey != "":
+		otherKey, err := decodeStateHash(proof.OtherKey)
+		if err != nil {
+			return fmt.Errorf("invalid other_key: %v", err)
+		}
+		otherValue, err := decodeStateHash(proof.OtherValueHash)
+		if err != nil {
+			return fmt.Errorf("invalid other_value_hash: %v", err)
+		}
+		if otherKey == key {
+			return fmt.Errorf("other_key is the proven key")
+		}
+		// The other leaf can only sit on this key's path if both share the path prefix
+		for depth := range siblings {
+			if keyBit(otherKey, depth) != keyBit(key, depth) {
+				return fmt.Errorf("other_key diverges from the proven key at depth %d", depth)
+			}
+		}
+		current = stateLeafHash(otherKey, otherValue)
+	}
+
+	for depth := len(siblings) - 1; depth >= 0; depth-- {
+		if keyBit(key, depth) == 0 {
+			current = stateNodeHash(current, siblings[depth])
+		} else {
+			current = stateNodeHash(siblings[depth], current)
+		}
+	}
+
+	if !bytes.Equal(current[:], root[:]) {
+		return fmt.Errorf("state proof does not match the state root")
+	}
+	return nil
+}
+
+// VerifyKeyIndex checks that pubkeyHash was at index under a trusted state root
+func VerifyKeyIndex(proof *StateProof, stateRoot, pubkeyHash string, index uint64) error {
+	if proof.PubkeyHash != pubkeyHash {
+		return fmt.Errorf("proof is for pubkey_hash %s, not %s", proof.PubkeyHash, pubkeyHash)
+	}
+	if !proof.Exists {
+		return fmt.Errorf("pubkey_hash %s has no committed index", pubkeyHash)
+	}
+	if proof.Index != index {
+		return fmt.Errorf("pubkey_hash %s is at index %d, not %d", pubkeyHash, proof.Index, index)
+	}
+	return VerifyStateProof(proof, stateRoot)
+}
+
+// VerifyKeyNeverUsed checks that pubkeyHash has never been committed under a trusted state root
+func VerifyKeyNeverUsed(proof *StateProof, stateRoot, pubkeyHash string) error {
+	if proof.PubkeyHash != pubkeyHash {
+		return fmt.Errorf("proof is for pubkey_hash %s, not %s", proof.PubkeyHash, pubkeyHash)
+	}
+	if proof.Exists {
+		return fmt.Errorf("pubkey_hash %s has been committed (index %d)", pubkeyHash, proof.Index)
+	}
+	return VerifyStateProof(proof, stateRoot)
+}
+
+func stateValueHash(pubkeyHash string, index uint64, headHash string) [32]byte {
+	var payload []byte
+	for _, field := range [][]byte{
+		[]byte(stateLeafDomain),
+		[]byte(pubkeyHash),
+		binary.BigEndian.AppendUint64(nil, index),
+		[]byte(headHash),
+	} {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(field)))
+		payload = append(payload, field...)
+	}
+	return sha256.Sum256(payload)
+}
+
+func stateLeafHash(key, value [32]byte) [32]byte {
+	return sha256.Sum256(append(append([]byte{0x00}, key[:]...), value[:]...))
+}
+
+func stateNodeHash(left, right [32]byte) [32]byte {
+	return sha256.Sum256(append(append([]byte{0x01}, left[:]...), right[:]...))
+}
+
+func keyBit(key [32]byte, depth int) byte {
+	return (key[depth/8] >> (7 - depth%8)) & 1
+}
+
+func decodeStateHash(encoded string) ([32]byte, error) {
+	var hash [32]byte
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return hash, err
+	}
+	if len(decoded) != len(hash) {
+		return hash, fmt.Errorf("expected %d bytes, got %d", len(hash), len(decoded))
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
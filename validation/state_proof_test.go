@@ -0,0 +1,140 @@
+package validation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/verifiable-state-chains/lms/fsm"
+)
+
+// newStateTestFSM commits a create entry for each pubkey_hash and signs the first one up to index 2
+func newStateTestFSM(t *testing.T, pubkeyHashes []string) *fsm.KeyIndexFSM {
+	t.Helper()
+
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	f, _ := fsm.NewKeyIndexFSM("")
+	f.PinAttestationKey(&privKey.PublicKey)
+
+	raftIndex := uint64(0)
+	commit := func(pubkeyHash string, index uint64, previousHash, recordType string) *fsm.KeyIndexEntry {
+		entry := &fsm.KeyIndexEntry{
+			KeyID:        "key-" + pubkeyHash,
+			PubkeyHash:   pubkeyHash,
+			Index:        index,
+			PreviousHash: previousHash,
+			RecordType:   recordType,
+		}
+		if recordType == "create" {
+			entry.LMSParams = &fsm.LMSParams{Levels: 1, LmType: []int{5}, OtsType: []int{1}} // H5
+		}
+		if err := fsm.SignEntry(entry, privKey); err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		entry.Hash, _ = entry.ComputeHash()
+		data, _ := json.Marshal(entry)
+		raftIndex++
+		if result, ok := f.Apply(&raft.Log{Index: raftIndex, Type: raft.LogCommand, Data: data}).(string); !ok || result[:6] == "Error:" {
+			t.Fatalf("Apply failed: %v", result)
+		}
+		return entry
+	}
+
+	for _, pubkeyHash := range pubkeyHashes {
+		commit(pubkeyHash, 0, fsm.GenesisHash, "create")
+	}
+	head, _ := f.GetChainByPubkeyHash(pubkeyHashes[0])
+	next := commit(pubkeyHashes[0], 1, head[0].Hash, "sign")
+	commit(pubkeyHashes[0], 2, next.Hash, "sign")
+	return f
+}
+
+func TestVerifyStateProof_MembershipAndNonMembership(t *testing.T) {
+	pubkeyHashes := make([]string, 40)
+	for i := range pubkeyHashes {
+		pubkeyHashes[i] = fmt.Sprintf("pubkey-hash-%d", i)
+	}
+	f := newStateTestFSM(t, pubkeyHashes)
+	stateRoot := f.GetTreeHead().StateRoot
+
+	for i, pubkeyHash := range pubkeyHashes {
+		proof := getStateProof(t, f, pubkeyHash)
+		want := uint64(0)
+		if i == 0 {
+			want = 2
+		}
+		if err := VerifyKeyIndex(proof, stateRoot, pubkeyHash, want); err != nil {
+			t.Fatalf("Membership proof for %s failed: %v", pubkeyHash, err)
+		}
+	}
+
+	// Never-used keys: both empty positions and positions held by another leaf occur with 40 keys
+	sawOtherLeaf, sawEmpty := false, false
+	for i := 0; i < 64; i++ {
+		pubkeyHash := fmt.Sprintf("unused-%d", i)
+		proof := getStateProof(t, f, pubkeyHash)
+		if err := VerifyKeyNeverUsed(proof, stateRoot, pubkeyHash); err != nil {
+			t.Fatalf("Non-membership proof for %s failed: %v", pubkeyHash, err)
+		}
+		if proof.OtherKey != "" {
+			sawOtherLeaf = true
+		} else {
+			sawEmpty = true
+		}
+	}
+	if !sawOtherLeaf || !sawEmpty {
+		t.Fatalf("Expected both kinds of non-membership proofs (other leaf %v, empty %v)", sawOtherLeaf, sawEmpty)
+	}
+}
+
+func TestVerifyStateProof_RejectsForgedClaims(t *testing.T) {
+	f := newStateTestFSM(t, []string{"pk-a", "pk-b", "pk-c"})
+	stateRoot := f.GetTreeHead().StateRoot
+
+	// A stale or inflated index does not verify
+	proof := getStateProof(t, f, "pk-a")
+	if err := VerifyKeyIndex(proof, stateRoot, "pk-a", 1); err == nil {
+		t.Error("Expected claim of the wrong index to fail")
+	}
+	proof.Index = 1
+	if err := VerifyStateProof(proof, stateRoot); err == nil {
+		t.Error("Expected proof with a modified index to fail")
+	}
+
+	// A used key cannot be proven unused
+	proof = getStateProof(t, f, "pk-b")
+	proof.Exists = false
+	if err := VerifyKeyNeverUsed(proof, stateRoot, "pk-b"); err == nil {
+		t.Error("Expected non-membership claim for a used key to fail")
+	}
+
+	// A proof only verifies against the root it was produced for
+	proof = getStateProof(t, f, "pk-c")
+	otherRoot := newStateTestFSM(t, []string{"pk-a", "pk-b"}).GetTreeHead().StateRoot
+	if err := VerifyStateProof(proof, otherRoot); err == nil {
+		t.Error("Expected proof against another state root to fail")
+	}
+}
+
+func getStateProof(t *testing.T, f *fsm.KeyIndexFSM, pubkeyHash string) *StateProof {
+	t.Helper()
+
+	served, err := f.GetStateProof(pubkeyHash)
+	if err != nil {
+		t.Fatalf("GetStateProof failed: %v", err)
+	}
+	// Round trip through JSON, as a verifier receives it
+	data, _ := json.Marshal(served)
+	var proof StateProof
+	if err := json.Unmarshal(data, &proof); err != nil {
+		t.Fatalf("Failed to decode proof: %v", err)
+	}
+	return &proof
+}